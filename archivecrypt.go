@@ -0,0 +1,419 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+// Encrypted-at-rest archive
+//
+// With "archiveEncryption": {"recipients": ["age1..."]} originals are
+// encrypted to the listed age public keys as they are archived, so archive/
+// only holds ciphertext. Plain archive copies are named <name>.age; object
+// store blobs keep their content address (the plaintext SHA-256).
+//
+// Only the public key is needed to archive. Restore, undo and reprocessing
+// decrypt with the private key in identityFile, which should stay on the
+// machine running blendpdf rather than on the shared disk. Files are
+// recognised as encrypted by their age header, so encrypted and plain
+// archive copies can live side by side.
+
+const (
+	ENCRYPTED_SUFFIX = ".age"
+	ARCHIVE_KEY_FILE = "archive-key.txt"
+	ageHeaderPrefix  = "age-encryption.org/v1\n"
+	identityFileMode = 0600
+	identityDirMode  = 0700
+)
+
+// ArchiveEncryptionConfig holds the archive encryption keys
+type ArchiveEncryptionConfig struct {
+	Recipients   []string `json:"recipients,omitempty"`   // age public keys (age1...) to encrypt to
+	IdentityFile string   `json:"identityFile,omitempty"` // Private key file for decrypting (default in the user config folder)
+}
+
+// Check whether archive encryption is configured
+func (c ArchiveEncryptionConfig) enabled() bool {
+	return len(c.Recipients) > 0
+}
+
+// Check the configured recipients parse as age public keys
+func (c ArchiveEncryptionConfig) validate() error {
+	for _, recipient := range c.Recipients {
+		if _, err := age.ParseX25519Recipient(strings.TrimSpace(recipient)); err != nil {
+			return fmt.Errorf("invalid archive encryption recipient %q: %v", recipient, err)
+		}
+	}
+	return nil
+}
+
+// Check whether new archive copies are encrypted
+func archiveEncryptionEnabled() bool {
+	return CONFIG != nil && CONFIG.ArchiveEncryption.enabled()
+}
+
+// Parse the configured recipients
+func archiveRecipients() ([]age.Recipient, error) {
+	if !archiveEncryptionEnabled() {
+		return nil, fmt.Errorf("archive encryption is not configured")
+	}
+
+	var recipients []age.Recipient
+	for _, value := range CONFIG.ArchiveEncryption.Recipients {
+		recipient, err := age.ParseX25519Recipient(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive encryption recipient: %v", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// Get the path of the private key used to decrypt the archive
+func getIdentityFilePath() string {
+	if CONFIG != nil && CONFIG.ArchiveEncryption.IdentityFile != "" {
+		path := CONFIG.ArchiveEncryption.IdentityFile
+		if strings.HasPrefix(path, "~"+string(filepath.Separator)) || strings.HasPrefix(path, "~/") {
+			if home, err := os.UserHomeDir(); err == nil {
+				path = filepath.Join(home, path[2:])
+			}
+		}
+		return path
+	}
+
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		configDir = os.TempDir()
+	}
+	return filepath.Join(configDir, "blendpdf", ARCHIVE_KEY_FILE)
+}
+
+// Load the private keys used to decrypt the archive
+func archiveIdentities() ([]age.Identity, error) {
+	path := getIdentityFilePath()
+	file, err := os.Open(path) // #nosec G304 - configured key file
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("archive file is encrypted and no private key was found at %s (set archiveEncryption.identityFile)", path)
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive key file %s: %v", path, err)
+	}
+	return identities, nil
+}
+
+// Check whether a file starts with an age header
+func isEncryptedFile(path string) bool {
+	file, err := STORAGE.open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	header := make([]byte, len(ageHeaderPrefix))
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+	return string(header) == ageHeaderPrefix
+}
+
+// Encrypt src to dst for the configured recipients, streaming through an atomic write
+func encryptFile(src, dst string) error {
+	recipients, err := archiveRecipients()
+	if err != nil {
+		return err
+	}
+
+	in, err := STORAGE.open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	reader, writer := io.Pipe()
+	go func() {
+		encrypted, err := age.Encrypt(writer, recipients...)
+		if err == nil {
+			_, err = io.Copy(encrypted, in)
+		}
+		if err == nil {
+			err = encrypted.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	if err := ensureDestinationDirectory(dst); err != nil {
+		reader.CloseWithError(err)
+		return err
+	}
+	_, err = atomicWrite(dst, reader, nil)
+	reader.CloseWithError(err)
+	return err
+}
+
+// Choose the <name>.age path for an encrypted archive copy of dst
+// Ciphertext can't be compared, so every policy but fail falls back to a numbered name
+func resolveEncryptedArchivePath(dst string) (string, error) {
+	taken := func(candidate string) bool {
+		return fileExists(candidate) || fileExists(candidate+ENCRYPTED_SUFFIX) || archivedFileExists(candidate)
+	}
+	if !taken(dst) {
+		return dst + ENCRYPTED_SUFFIX, nil
+	}
+	if getConflictPolicy(filepath.Dir(dst)) == CONFLICT_FAIL {
+		return "", fmt.Errorf("destination already exists: %s", filepath.Base(dst))
+	}
+
+	base := strings.TrimSuffix(dst, filepath.Ext(dst))
+	ext := filepath.Ext(dst)
+	for counter := 1; counter <= 1000; counter++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, counter, ext)
+		if !taken(candidate) {
+			return candidate + ENCRYPTED_SUFFIX, nil
+		}
+	}
+	return "", fmt.Errorf("no free archive name for %s after 1000 attempts", filepath.Base(dst))
+}
+
+// Open an archived file as plaintext, decrypting it when needed
+// Archive paths are resolved through the object store index
+func openPlaintext(path string) (io.ReadCloser, error) {
+	readable, ok := resolveArchivedFile(path)
+	if !ok {
+		return nil, fmt.Errorf("%s not found", filepath.Base(path))
+	}
+
+	file, err := STORAGE.open(readable)
+	if err != nil {
+		return nil, err
+	}
+
+	buffered := bufio.NewReader(file)
+	header, _ := buffered.Peek(len(ageHeaderPrefix))
+	if !bytes.Equal(header, []byte(ageHeaderPrefix)) {
+		return readCloser{buffered, file}, nil
+	}
+
+	identities, err := archiveIdentities()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	decrypted, err := age.Decrypt(buffered, identities...)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to decrypt %s: %v", filepath.Base(path), err)
+	}
+	return readCloser{decrypted, file}, nil
+}
+
+// readCloser pairs a (decrypting) reader with the file underneath it
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Hash a file's plaintext, decrypting archive copies as they stream
+func plaintextDigest(path string) (string, error) {
+	reader, err := openPlaintext(path)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	return hashReader(reader)
+}
+
+// Copy a file's plaintext to dst, decrypting archive copies as they stream
+func copyPlaintext(path, dst string) error {
+	reader, err := openPlaintext(path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if err := ensureDestinationDirectory(dst); err != nil {
+		return err
+	}
+	_, err = atomicWrite(dst, reader, nil)
+	return err
+}
+
+// Key management
+
+// Generate a new archive key pair, writing the private key to path
+// Returns the public key to add to archiveEncryption.recipients
+func generateArchiveKey(path string) (string, error) {
+	if fileExists(path) {
+		return "", fmt.Errorf("key file already exists: %s", path)
+	}
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), identityDirMode); err != nil {
+		return "", err
+	}
+	content := fmt.Sprintf("# created: %s\n# public key: %s\n%s\n",
+		time.Now().Format(time.RFC3339), identity.Recipient(), identity)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, identityFileMode) // #nosec G304 - user chosen key path
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.WriteString(content); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		return "", err
+	}
+	return identity.Recipient().String(), nil
+}
+
+// Encrypt plain archive copies in place
+// Operations in the undo history are pointed at the encrypted copies, so undo decrypts them
+func encryptExistingArchive() (int, error) {
+	if !archiveEncryptionEnabled() {
+		return 0, fmt.Errorf("set archiveEncryption.recipients in blendpdf.json first")
+	}
+
+	encrypted := 0
+	var moved []encryptedArchiveFile
+	defer func() { relinkEncryptedHistory(moved) }()
+
+	files, err := listArchiveFiles()
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range files {
+		name := filepath.Base(item.path)
+		if isCompactZip(name) || strings.HasSuffix(name, ENCRYPTED_SUFFIX) || isEncryptedFile(item.path) {
+			continue
+		}
+		digest, err := calculateFileHash(item.path)
+		if err != nil {
+			return encrypted, err
+		}
+		if err := encryptFileInPlace(item.path, item.path+ENCRYPTED_SUFFIX); err != nil {
+			return encrypted, fmt.Errorf("failed to encrypt %s: %v", name, err)
+		}
+		moved = append(moved, encryptedArchiveFile{from: item.path, to: item.path + ENCRYPTED_SUFFIX, digest: digest})
+		encrypted++
+	}
+
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return encrypted, err
+	}
+	digests := map[string]string{} // Plaintext digest of each object encrypted here
+	for _, entry := range index.Entries {
+		objectPath := filepath.Join(ARCHIVE, entry.Object)
+		digest, done := digests[objectPath]
+		if !done {
+			if !fileExists(objectPath) || isEncryptedFile(objectPath) {
+				continue
+			}
+			if digest, err = calculateFileHash(objectPath); err != nil {
+				return encrypted, err
+			}
+			if err := encryptFileInPlace(objectPath, objectPath); err != nil {
+				return encrypted, fmt.Errorf("failed to encrypt %s: %v", entry.Name, err)
+			}
+			digests[objectPath] = digest
+			encrypted++
+		}
+		link := filepath.Join(ARCHIVE, entry.Name)
+		moved = append(moved, encryptedArchiveFile{from: link, to: link, digest: digest})
+	}
+	return encrypted, nil
+}
+
+// encryptedArchiveFile is an archive copy encrypted after operations recorded it
+type encryptedArchiveFile struct {
+	from   string // Path the history recorded
+	to     string // Path of the encrypted copy
+	digest string // Digest of the plain copy
+}
+
+// Point history entries at encrypted archive copies
+// Digests that matched the plain copy are moved to the encrypted one; others keep failing the undo check
+func relinkEncryptedHistory(moved []encryptedArchiveFile) {
+	if len(moved) == 0 {
+		return
+	}
+	changed := false
+	for _, entry := range HISTORY {
+		op := entry.Operation
+		for _, file := range moved {
+			for i, path := range op.ArchiveFiles {
+				if path != "" && samePath(path, file.from) {
+					op.ArchiveFiles[i] = file.to
+					changed = true
+				}
+			}
+			for path, digest := range entry.Digests {
+				if !samePath(path, file.from) {
+					continue
+				}
+				delete(entry.Digests, path)
+				entry.Digests[file.to] = digest
+				if digest == file.digest {
+					recordDigest(entry, file.to)
+				}
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := saveHistory(); err != nil {
+		printWarning(fmt.Sprintf("Failed to save operation history: %v", err))
+	}
+}
+
+// Replace a plain file with its encrypted form, keeping its modification time for retention
+func encryptFileInPlace(src, dst string) error {
+	info, err := STORAGE.stat(src)
+	if err != nil {
+		return err
+	}
+	if err := encryptFile(src, dst); err != nil {
+		return err
+	}
+	if err := os.Chtimes(dst, info.ModTime(), info.ModTime()); err != nil {
+		return err
+	}
+	if src != dst {
+		return STORAGE.remove(src)
+	}
+	return nil
+}
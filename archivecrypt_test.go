@@ -0,0 +1,286 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupEncryptionTest enables archive encryption with a fresh key pair
+func setupEncryptionTest(t *testing.T) string {
+	tempDir := useTestWorkspace(t)
+	keyFile := filepath.Join(tempDir, "keys", ARCHIVE_KEY_FILE)
+	recipient, err := generateArchiveKey(keyFile)
+	assert.NoError(t, err)
+
+	CONFIG.ArchiveEncryption = ArchiveEncryptionConfig{
+		Recipients:   []string{recipient},
+		IdentityFile: keyFile,
+	}
+	return tempDir
+}
+
+// readPlaintext reads an archived file through decryption
+func readPlaintext(t *testing.T, path string) string {
+	reader, err := openPlaintext(path)
+	assert.NoError(t, err)
+	if err != nil {
+		return ""
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func TestEncryptedArchiveCopy(t *testing.T) {
+	tempDir := setupEncryptionTest(t)
+	file := filepath.Join(tempDir, "scan.pdf")
+	_ = os.WriteFile(file, []byte("secret scan"), 0644)
+
+	var journal *operationJournal
+	archived, err := journal.archive(file, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(ARCHIVE, "scan.pdf.age"), archived)
+	assert.True(t, isEncryptedFile(archived))
+
+	content, _ := os.ReadFile(archived)
+	assert.NotContains(t, string(content), "secret scan", "the archive only holds ciphertext")
+	assert.Equal(t, "secret scan", readPlaintext(t, archived))
+
+	// The plaintext name stays taken by the encrypted copy
+	again, err := journal.archive(file, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(ARCHIVE, "scan_1.pdf.age"), again)
+}
+
+func TestEncryptedArchiveNeedsPrivateKey(t *testing.T) {
+	tempDir := setupEncryptionTest(t)
+	file := filepath.Join(tempDir, "scan.pdf")
+	_ = os.WriteFile(file, []byte("secret scan"), 0644)
+
+	var journal *operationJournal
+	archived, err := journal.archive(file, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+
+	CONFIG.ArchiveEncryption.IdentityFile = filepath.Join(tempDir, "elsewhere.txt")
+	_, err = openPlaintext(archived)
+	assert.ErrorContains(t, err, "no private key")
+
+	// A different key can't decrypt it either
+	otherKey := filepath.Join(tempDir, "other.txt")
+	_, err = generateArchiveKey(otherKey)
+	assert.NoError(t, err)
+	CONFIG.ArchiveEncryption.IdentityFile = otherKey
+	_, err = openPlaintext(archived)
+	assert.ErrorContains(t, err, "failed to decrypt")
+}
+
+func TestEncryptedArchiveJournalRollBack(t *testing.T) {
+	tempDir := setupEncryptionTest(t)
+	file := filepath.Join(tempDir, "scan.pdf")
+	_ = os.WriteFile(file, []byte("content"), 0644)
+
+	journal, err := beginJournal("single", file)
+	assert.NoError(t, err)
+	archived, err := journal.archive(file, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+	assert.FileExists(t, archived)
+
+	// Crash before commit
+	recoverIncompleteOperations()
+	assert.NoFileExists(t, archived, "uncommitted encrypted copy should be rolled back")
+	assert.FileExists(t, file)
+}
+
+func TestEncryptedMergeUndoRedo(t *testing.T) {
+	for _, store := range []string{ARCHIVE_STORE_FILES, ARCHIVE_STORE_OBJECTS} {
+		t.Run(store, func(t *testing.T) {
+			tempDir := setupEncryptionTest(t)
+			CONFIG.ArchiveStore = store
+			file1 := filepath.Join(tempDir, "front.pdf")
+			file2 := filepath.Join(tempDir, "back.pdf")
+			output := filepath.Join(tempDir, "output", "front-back.pdf")
+			_ = os.WriteFile(file1, []byte("front"), 0644)
+			_ = os.WriteFile(file2, []byte("back"), 0644)
+			_ = os.MkdirAll(filepath.Dir(output), 0755)
+			_ = os.WriteFile(output, []byte("merged"), 0644)
+
+			var journal *operationJournal
+			archiveFiles := archiveMergedOriginals(journal, planOriginalMoves(journal, true, file1, file2))
+			recordOperation(&LastOperation{
+				Type:          "merge",
+				OriginalFiles: []string{file1, file2},
+				ActualFiles:   []string{output},
+				ArchiveFiles:  archiveFiles,
+				ArchiveStore:  archiveStoreFor(archiveFiles),
+				Timestamp:     time.Now(),
+			})
+			readable, _ := resolveArchivedFile(archiveFiles[0])
+			assert.True(t, isEncryptedFile(readable))
+
+			assert.NoError(t, undoLatestOperation())
+			content, _ := os.ReadFile(file1)
+			assert.Equal(t, "front", string(content), "undo decrypts the original")
+			assert.False(t, archivedFileExists(archiveFiles[0]))
+
+			assert.NoError(t, redoLatestOperation())
+			assert.NoFileExists(t, file1)
+			readable, _ = resolveArchivedFile(archiveFiles[0])
+			assert.True(t, isEncryptedFile(readable), "redo encrypts again")
+
+			// The re-encrypted copy is accepted as unchanged
+			assert.NoError(t, undoLatestOperation())
+			assert.FileExists(t, file2)
+		})
+	}
+}
+
+func TestEncryptedObjectsDeduplicate(t *testing.T) {
+	tempDir := setupEncryptionTest(t)
+	CONFIG.ArchiveStore = ARCHIVE_STORE_OBJECTS
+	scan := filepath.Join(tempDir, "scan.pdf")
+	rescan := filepath.Join(tempDir, "rescan.pdf")
+	_ = os.WriteFile(scan, []byte("same bytes"), 0644)
+	_ = os.WriteFile(rescan, []byte("same bytes"), 0644)
+
+	var journal *operationJournal
+	first, err := journal.archive(scan, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+	_, err = journal.archive(rescan, filepath.Join(ARCHIVE, "rescan.pdf"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, countObjects(t), "identical plaintext is stored once")
+	assert.Equal(t, "same bytes", readPlaintext(t, first))
+}
+
+func TestEncryptionEncryptsExistingPlaintextObject(t *testing.T) {
+	tempDir := setupEncryptionTest(t)
+	encryption := CONFIG.ArchiveEncryption
+	CONFIG.ArchiveEncryption = ArchiveEncryptionConfig{}
+	CONFIG.ArchiveStore = ARCHIVE_STORE_OBJECTS
+	scan := filepath.Join(tempDir, "scan.pdf")
+	rescan := filepath.Join(tempDir, "rescan.pdf")
+	_ = os.WriteFile(scan, []byte("same bytes"), 0644)
+	_ = os.WriteFile(rescan, []byte("same bytes"), 0644)
+
+	var journal *operationJournal
+	first, err := journal.archive(scan, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+	entry := &HistoryEntry{Operation: &LastOperation{Type: "merge", ArchiveFiles: []string{first}}, Digests: map[string]string{}}
+	recordDigest(entry, first)
+
+	// Linking the same content with encryption on encrypts the shared object
+	CONFIG.ArchiveEncryption = encryption
+	second, err := journal.archive(rescan, filepath.Join(ARCHIVE, "rescan.pdf"))
+	assert.NoError(t, err)
+	readable, _ := resolveArchivedFile(second)
+	assert.True(t, isEncryptedFile(readable))
+	assert.Equal(t, 1, countObjects(t))
+	assert.Equal(t, "same bytes", readPlaintext(t, first))
+
+	// The earlier link's content is unchanged, so its undo check still passes
+	assert.NoError(t, verifyUndoSources(entry))
+}
+
+func TestRestoreEncryptedOriginal(t *testing.T) {
+	tempDir := setupEncryptionTest(t)
+	file := filepath.Join(tempDir, "scan.pdf")
+	_ = os.WriteFile(file, []byte("secret scan"), 0644)
+
+	var journal *operationJournal
+	_, err := journal.archive(file, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+	assert.NoError(t, os.Remove(file))
+
+	originals, err := listArchivedOriginals()
+	assert.NoError(t, err)
+	assert.Len(t, originals, 1)
+	assert.Equal(t, "scan.pdf", originals[0].Name)
+	assert.Equal(t, "scan.pdf.age", originals[0].Key)
+
+	restored, err := restoreArchivedOriginals([]string{"scan.pdf"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{file}, restored)
+	content, _ := os.ReadFile(file)
+	assert.Equal(t, "secret scan", string(content))
+}
+
+func TestEncryptExistingArchive(t *testing.T) {
+	setupEncryptionTest(t)
+	plain := writeArchivedFile(t, "old.pdf", 10, 48*time.Hour)
+
+	encrypted, err := encryptExistingArchive()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, encrypted)
+	assert.NoFileExists(t, plain)
+	assert.True(t, isEncryptedFile(plain+ENCRYPTED_SUFFIX))
+
+	info, _ := os.Stat(plain + ENCRYPTED_SUFFIX)
+	assert.WithinDuration(t, time.Now().Add(-48*time.Hour), info.ModTime(), time.Minute, "archive age is kept for retention")
+}
+
+func TestEncryptExistingArchiveKeepsUndo(t *testing.T) {
+	for _, store := range []string{ARCHIVE_STORE_FILES, ARCHIVE_STORE_OBJECTS} {
+		t.Run(store, func(t *testing.T) {
+			tempDir := setupEncryptionTest(t)
+			encryption := CONFIG.ArchiveEncryption
+			CONFIG.ArchiveEncryption = ArchiveEncryptionConfig{}
+			CONFIG.ArchiveStore = store
+			file1 := filepath.Join(tempDir, "front.pdf")
+			file2 := filepath.Join(tempDir, "back.pdf")
+			output := filepath.Join(tempDir, "output", "front-back.pdf")
+			_ = os.WriteFile(file1, []byte("front"), 0644)
+			_ = os.WriteFile(file2, []byte("back"), 0644)
+			_ = os.MkdirAll(filepath.Dir(output), 0755)
+			_ = os.WriteFile(output, []byte("merged"), 0644)
+
+			// Archived in plain before encryption was turned on
+			var journal *operationJournal
+			archiveFiles := archiveMergedOriginals(journal, planOriginalMoves(journal, true, file1, file2))
+			recordOperation(&LastOperation{
+				Type:          "merge",
+				OriginalFiles: []string{file1, file2},
+				ActualFiles:   []string{output},
+				ArchiveFiles:  archiveFiles,
+				ArchiveStore:  archiveStoreFor(archiveFiles),
+				Timestamp:     time.Now(),
+			})
+
+			CONFIG.ArchiveEncryption = encryption
+			encrypted, err := encryptExistingArchive()
+			assert.NoError(t, err)
+			assert.Equal(t, 2, encrypted)
+			for _, file := range HISTORY[0].Operation.ArchiveFiles {
+				readable, _ := resolveArchivedFile(file)
+				assert.True(t, isEncryptedFile(readable), "%s is encrypted", file)
+			}
+
+			// The new archive paths were saved with the history
+			loadHistory()
+			assert.NoError(t, undoLatestOperation())
+			content, _ := os.ReadFile(file1)
+			assert.Equal(t, "front", string(content), "undo decrypts the original")
+			content, _ = os.ReadFile(file2)
+			assert.Equal(t, "back", string(content))
+
+			assert.NoError(t, redoLatestOperation())
+			assert.NoFileExists(t, file1)
+			readable, _ := resolveArchivedFile(HISTORY[0].Operation.ArchiveFiles[0])
+			assert.True(t, isEncryptedFile(readable), "redo encrypts again")
+		})
+	}
+}
+
+func TestArchiveEncryptionConfigValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.ArchiveEncryption.Recipients = []string{"not-a-key"}
+	assert.Error(t, validateConfig(config))
+
+	config.ArchiveEncryption.Recipients = nil
+	assert.NoError(t, validateConfig(config))
+}
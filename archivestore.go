@@ -0,0 +1,388 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Content-addressed archive store
+//
+// With "archiveStore": "objects" originals are stored once per SHA-256 under
+// archive/objects/<aa>/<hash> and linked by name in archive/index.json. An
+// archived file keeps a path of the form archive/<name> everywhere else
+// (history, journal, retention) and is resolved through the index, so
+// re-archiving identical bytes costs nothing and undo works in either mode.
+//
+// The store never overwrites a name: a different file under an existing name
+// gets a suffix, or an error with the "fail" conflict policy.
+
+// Archive store layouts
+const (
+	ARCHIVE_STORE_FILES   = "files"
+	ARCHIVE_STORE_OBJECTS = "objects"
+
+	ARCHIVE_INDEX_FILE  = "index.json"
+	ARCHIVE_OBJECTS_DIR = "objects"
+)
+
+// ArchiveIndexEntry links an archived name to its stored object
+type ArchiveIndexEntry struct {
+	Name     string    `json:"name"`
+	Hash     string    `json:"sha256"`
+	Object   string    `json:"object"` // Path relative to the archive folder
+	Size     int64     `json:"size"`
+	Archived time.Time `json:"archived"`
+}
+
+// ArchiveIndex is the name-to-hash index of the object store
+type ArchiveIndex struct {
+	Entries []ArchiveIndexEntry `json:"entries"`
+}
+
+// Check whether new archive copies go to the object store
+func useObjectStore() bool {
+	return CONFIG != nil && CONFIG.ArchiveStore == ARCHIVE_STORE_OBJECTS
+}
+
+// Get the store to record for an operation's archive files ("" for plain files)
+func archiveStoreFor(archiveFiles []string) string {
+	for _, file := range archiveFiles {
+		if file != "" && useObjectStore() {
+			return ARCHIVE_STORE_OBJECTS
+		}
+	}
+	return ""
+}
+
+// Check an archive store setting
+func isValidArchiveStore(store string) bool {
+	return store == ARCHIVE_STORE_FILES || store == ARCHIVE_STORE_OBJECTS
+}
+
+// Get the path of the archive index
+func getArchiveIndexPath() string {
+	return filepath.Join(ARCHIVE, ARCHIVE_INDEX_FILE)
+}
+
+// Get an object's path relative to the archive folder
+func objectRelPath(hash string) string {
+	return filepath.Join(ARCHIVE_OBJECTS_DIR, hash[:2], hash)
+}
+
+// Load the archive index (empty if there is none yet)
+func loadArchiveIndex() (*ArchiveIndex, error) {
+	index := &ArchiveIndex{}
+
+	data, err := readStorageFile(getArchiveIndexPath())
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("invalid archive index: %v", err)
+	}
+	return index, nil
+}
+
+// Write the archive index atomically, sorted by name for browsing
+func (idx *ArchiveIndex) save() error {
+	sort.Slice(idx.Entries, func(i, j int) bool { return idx.Entries[i].Name < idx.Entries[j].Name })
+
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = atomicWrite(getArchiveIndexPath(), bytes.NewReader(data), nil)
+	return err
+}
+
+// Find an entry by name
+func (idx *ArchiveIndex) find(name string) *ArchiveIndexEntry {
+	for i := range idx.Entries {
+		if idx.Entries[i].Name == name {
+			return &idx.Entries[i]
+		}
+	}
+	return nil
+}
+
+// Remove an entry by name, returns its hash
+func (idx *ArchiveIndex) remove(name string) (string, bool) {
+	for i, entry := range idx.Entries {
+		if entry.Name == name {
+			idx.Entries = append(idx.Entries[:i], idx.Entries[i+1:]...)
+			return entry.Hash, true
+		}
+	}
+	return "", false
+}
+
+// Check whether any entry still links to an object
+func (idx *ArchiveIndex) references(hash string) bool {
+	for _, entry := range idx.Entries {
+		if entry.Hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the index name of an archive path (archive/<name>)
+func archiveEntryName(path string) (string, bool) {
+	if ARCHIVE == "" || path == "" || !samePath(filepath.Dir(path), ARCHIVE) {
+		return "", false
+	}
+	return filepath.Base(path), true
+}
+
+// Find the readable file behind an archive path: the file itself, or its object
+func resolveArchivedFile(path string) (string, bool) {
+	if fileExists(path) {
+		return path, true
+	}
+
+	name, ok := archiveEntryName(path)
+	if !ok {
+		return path, false
+	}
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return path, false
+	}
+	if entry := index.find(name); entry != nil {
+		return filepath.Join(ARCHIVE, entry.Object), true
+	}
+	return path, false
+}
+
+// Get the plaintext digest an archive link points at
+func archiveLinkDigest(path string) (string, bool) {
+	name, ok := archiveEntryName(path)
+	if !ok || fileExists(path) {
+		return "", false
+	}
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return "", false
+	}
+	entry := index.find(name)
+	if entry == nil || !fileExists(filepath.Join(ARCHIVE, entry.Object)) {
+		return "", false
+	}
+	return entry.Hash, true
+}
+
+// Check whether an archive path exists as a file or an index link
+func archivedFileExists(path string) bool {
+	_, ok := resolveArchivedFile(path)
+	return ok
+}
+
+// Choose the index name for src; preexisting means the name already links to identical content
+func resolveArchiveLink(index *ArchiveIndex, src, name string) (string, string, bool, error) {
+	digest, err := calculateFileHash(src)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	taken := func(candidate string) bool {
+		return index.find(candidate) != nil || fileExists(filepath.Join(ARCHIVE, candidate))
+	}
+
+	if entry := index.find(name); entry != nil && entry.Hash == digest {
+		return name, digest, true, nil
+	}
+	if !taken(name) {
+		return name, digest, false, nil
+	}
+	if getConflictPolicy(ARCHIVE) == CONFLICT_FAIL {
+		return "", "", false, fmt.Errorf("destination already exists: %s", name)
+	}
+
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	ext := filepath.Ext(name)
+	for counter := 1; counter <= 1000; counter++ {
+		candidate := fmt.Sprintf("%s_%d%s", base, counter, ext)
+		if entry := index.find(candidate); entry != nil && entry.Hash == digest {
+			return candidate, digest, true, nil
+		}
+		if !taken(candidate) {
+			return candidate, digest, false, nil
+		}
+	}
+	return "", "", false, fmt.Errorf("no free archive name for %s after 1000 attempts", name)
+}
+
+// Store src's bytes as an object (once) and link them under name
+func linkArchiveObject(src, name, digest string) error {
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return err
+	}
+
+	if entry := index.find(name); entry != nil {
+		if entry.Hash == digest {
+			return nil
+		}
+		return fmt.Errorf("archive name %s already links to other content", name)
+	}
+
+	info, err := STORAGE.stat(src)
+	if err != nil {
+		return err
+	}
+
+	object := objectRelPath(digest)
+	objectPath := filepath.Join(ARCHIVE, object)
+	// An encrypted object can't be hashed, but its path is its plaintext digest
+	encrypted := isEncryptedFile(objectPath)
+	switch {
+	case !encrypted && !targetMatchesDigest(objectPath, digest):
+		if err := ensureDestinationDirectory(objectPath); err != nil {
+			return err
+		}
+		if archiveEncryptionEnabled() {
+			err = encryptFile(src, objectPath)
+		} else {
+			err = performFileCopy(src, objectPath)
+		}
+		if err != nil {
+			return err
+		}
+	case !encrypted && archiveEncryptionEnabled():
+		// Archived before encryption was enabled; encrypt it so the new link isn't to plaintext
+		if err := encryptFileInPlace(objectPath, objectPath); err != nil {
+			return err
+		}
+		if VERBOSE {
+			printInfo(fmt.Sprintf("Identical content already archived, encrypted it and linking %s", name))
+		}
+	default:
+		if VERBOSE {
+			printInfo(fmt.Sprintf("Identical content already archived, linking %s", name))
+		}
+	}
+
+	index.Entries = append(index.Entries, ArchiveIndexEntry{
+		Name:     name,
+		Hash:     digest,
+		Object:   object,
+		Size:     info.Size(),
+		Archived: time.Now(),
+	})
+	return index.save()
+}
+
+// Remove an index link, deleting its object once nothing links to it
+func unlinkArchiveEntry(path string) error {
+	name, ok := archiveEntryName(path)
+	if !ok {
+		return fmt.Errorf("not an archive path: %s", path)
+	}
+
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return err
+	}
+	hash, found := index.remove(name)
+	if !found {
+		return nil
+	}
+	if err := index.save(); err != nil {
+		return err
+	}
+
+	if !index.references(hash) {
+		objectPath := filepath.Join(ARCHIVE, objectRelPath(hash))
+		if err := STORAGE.remove(objectPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		_ = STORAGE.remove(filepath.Dir(objectPath)) // Only succeeds when empty
+	}
+	return nil
+}
+
+// Put an archived original back at dst
+// Plain archive files are moved; encrypted copies are decrypted and removed;
+// object links are copied out and unlinked unless keepLink is set
+func restoreArchivedFile(path, dst string, keepLink bool) error {
+	if fileExists(path) && !isEncryptedFile(path) {
+		return moveFileWithRecovery(path, dst)
+	}
+
+	if !archivedFileExists(path) {
+		return fmt.Errorf("%s is not in the archive", filepath.Base(path))
+	}
+	if err := copyPlaintext(path, dst); err != nil {
+		return err
+	}
+	if fileExists(path) {
+		return STORAGE.remove(path)
+	}
+	if keepLink {
+		return nil
+	}
+	return unlinkArchiveEntry(path)
+}
+
+// Move a restored original back into the archive under its recorded path
+func rearchiveFile(src, path, store string) error {
+	if store != ARCHIVE_STORE_OBJECTS {
+		if strings.HasSuffix(path, ENCRYPTED_SUFFIX) {
+			if err := encryptFile(src, path); err != nil {
+				return err
+			}
+			return STORAGE.remove(src)
+		}
+		return performFileMove(src, path)
+	}
+
+	name, ok := archiveEntryName(path)
+	if !ok {
+		return fmt.Errorf("not an archive path: %s", path)
+	}
+	digest, err := calculateFileHash(src)
+	if err != nil {
+		return err
+	}
+	if err := linkArchiveObject(src, name, digest); err != nil {
+		return err
+	}
+	return STORAGE.remove(src)
+}
+
+// Check an archive path can take src again: free, or already linking identical content
+func archiveSlotAvailable(path, src string) bool {
+	if !archivedFileExists(path) {
+		return true
+	}
+	if fileExists(path) {
+		return false
+	}
+
+	linked, _ := archiveLinkDigest(path)
+	srcDigest, err := calculateFileHash(src)
+	return err == nil && linked == srcDigest
+}
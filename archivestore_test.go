@@ -0,0 +1,162 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countObjects counts the blobs under archive/objects
+func countObjects(t *testing.T) int {
+	count := 0
+	_ = filepath.Walk(filepath.Join(ARCHIVE, ARCHIVE_OBJECTS_DIR), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
+func TestObjectStoreDeduplicates(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.ArchiveStore = ARCHIVE_STORE_OBJECTS
+	scan := filepath.Join(tempDir, "scan.pdf")
+	copyOfScan := filepath.Join(tempDir, "rescan.pdf")
+	_ = os.WriteFile(scan, []byte("same bytes"), 0644)
+	_ = os.WriteFile(copyOfScan, []byte("same bytes"), 0644)
+
+	var journal *operationJournal
+	first, err := journal.archive(scan, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+	again, err := journal.archive(scan, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+	other, err := journal.archive(copyOfScan, filepath.Join(ARCHIVE, "rescan.pdf"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, filepath.Join(ARCHIVE, "scan.pdf"), first)
+	assert.Equal(t, first, again, "identical content under the same name is linked once")
+	assert.Equal(t, filepath.Join(ARCHIVE, "rescan.pdf"), other)
+	assert.Equal(t, 1, countObjects(t), "identical content is stored once")
+	assert.NoFileExists(t, first, "archived names live in the index, not as files")
+
+	index, err := loadArchiveIndex()
+	assert.NoError(t, err)
+	assert.Len(t, index.Entries, 2)
+
+	readable, ok := resolveArchivedFile(first)
+	assert.True(t, ok)
+	content, _ := os.ReadFile(readable)
+	assert.Equal(t, "same bytes", string(content))
+}
+
+func TestObjectStoreSuffixesDifferentContent(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.ArchiveStore = ARCHIVE_STORE_OBJECTS
+	file := filepath.Join(tempDir, "scan.pdf")
+
+	var journal *operationJournal
+	_ = os.WriteFile(file, []byte("first scan"), 0644)
+	first, err := journal.archive(file, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+
+	_ = os.WriteFile(file, []byte("second scan"), 0644)
+	second, err := journal.archive(file, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "scan.pdf", filepath.Base(first))
+	assert.Equal(t, "scan_1.pdf", filepath.Base(second))
+	assert.Equal(t, 2, countObjects(t))
+}
+
+func TestObjectStoreUnlinkRemovesUnreferencedObjects(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.ArchiveStore = ARCHIVE_STORE_OBJECTS
+	file := filepath.Join(tempDir, "scan.pdf")
+	_ = os.WriteFile(file, []byte("content"), 0644)
+
+	var journal *operationJournal
+	first, _ := journal.archive(file, filepath.Join(ARCHIVE, "a.pdf"))
+	second, _ := journal.archive(file, filepath.Join(ARCHIVE, "b.pdf"))
+
+	assert.NoError(t, unlinkArchiveEntry(first))
+	assert.Equal(t, 1, countObjects(t), "object still linked by b.pdf")
+	assert.False(t, archivedFileExists(first))
+
+	assert.NoError(t, unlinkArchiveEntry(second))
+	assert.Equal(t, 0, countObjects(t))
+}
+
+func TestObjectStoreJournalRollBack(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.ArchiveStore = ARCHIVE_STORE_OBJECTS
+	STATE_DIR = filepath.Join(tempDir, ".blendpdf")
+	file := filepath.Join(tempDir, "scan.pdf")
+	_ = os.WriteFile(file, []byte("content"), 0644)
+
+	journal, err := beginJournal("single", file)
+	assert.NoError(t, err)
+	archived, err := journal.archive(file, filepath.Join(ARCHIVE, "scan.pdf"))
+	assert.NoError(t, err)
+	assert.True(t, archivedFileExists(archived))
+
+	// Crash before commit
+	recoverIncompleteOperations()
+	assert.False(t, archivedFileExists(archived), "uncommitted archive link should be rolled back")
+	assert.Equal(t, 0, countObjects(t))
+	assert.FileExists(t, file)
+}
+
+func TestObjectStoreMergeUndoRedo(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.ArchiveStore = ARCHIVE_STORE_OBJECTS
+	file1 := filepath.Join(tempDir, "front.pdf")
+	file2 := filepath.Join(tempDir, "back.pdf")
+	output := filepath.Join(tempDir, "output", "front-back.pdf")
+	_ = os.WriteFile(file1, []byte("front"), 0644)
+	_ = os.WriteFile(file2, []byte("back"), 0644)
+	_ = os.MkdirAll(filepath.Dir(output), 0755)
+	_ = os.WriteFile(output, []byte("merged"), 0644)
+
+	var journal *operationJournal
+	archiveFiles := archiveMergedOriginals(journal, planOriginalMoves(journal, true, file1, file2))
+	assert.NoFileExists(t, file1)
+	assert.NoFileExists(t, file2)
+
+	recordOperation(&LastOperation{
+		Type:          "merge",
+		OriginalFiles: []string{file1, file2},
+		ActualFiles:   []string{output},
+		ArchiveFiles:  archiveFiles,
+		ArchiveStore:  archiveStoreFor(archiveFiles),
+		Timestamp:     time.Now(),
+	})
+	assert.Equal(t, ARCHIVE_STORE_OBJECTS, HISTORY[0].Operation.ArchiveStore)
+
+	assert.NoError(t, undoLatestOperation())
+	assert.FileExists(t, file1)
+	assert.FileExists(t, file2)
+	assert.NoFileExists(t, output)
+	assert.False(t, archivedFileExists(archiveFiles[0]))
+	assert.Equal(t, 0, countObjects(t))
+
+	assert.NoError(t, redoLatestOperation())
+	assert.NoFileExists(t, file1)
+	assert.NoFileExists(t, file2)
+	assert.FileExists(t, output)
+	assert.True(t, archivedFileExists(archiveFiles[0]))
+	assert.True(t, archivedFileExists(archiveFiles[1]))
+}
+
+func TestArchiveStoreConfigValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.ArchiveStore = ""
+	assert.NoError(t, validateConfig(config))
+	assert.Equal(t, ARCHIVE_STORE_FILES, config.ArchiveStore)
+
+	config.ArchiveStore = "cloud"
+	assert.Error(t, validateConfig(config))
+}
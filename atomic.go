@@ -0,0 +1,207 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Atomic write functions
+
+// Hidden temp files are named .blendpdf-<name>.<random>.tmp in the destination directory
+const (
+	TEMP_FILE_PREFIX = ".blendpdf-"
+	TEMP_FILE_SUFFIX = ".tmp"
+
+	// CreateTemp uses 0600; outputs keep the permissions os.Create used to give them
+	DEFAULT_FILE_MODE os.FileMode = 0644
+)
+
+// Copy src to dst via a hidden temp file, verifying the copy before renaming it into place
+// The temp file gets the destination's mode and group first, so a copy that can't be owned never replaces dst
+func atomicCopyFile(src, dst string) error {
+	sourceInfo, err := STORAGE.stat(src)
+	if err != nil {
+		return err
+	}
+	sourceFile, err := STORAGE.open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+
+	sourceHasher := sha256.New()
+	verify := func(tempPath string, size int64) error {
+		if size != sourceInfo.Size() {
+			return fmt.Errorf("size mismatch for %s: wrote %d of %d bytes", filepath.Base(dst), size, sourceInfo.Size())
+		}
+
+		// Compare the temp file against the digest taken while reading the source
+		tempHash, err := calculateFileHash(tempPath)
+		if err != nil {
+			return err
+		}
+		if tempHash != hex.EncodeToString(sourceHasher.Sum(nil)) {
+			return fmt.Errorf("digest mismatch for %s", filepath.Base(dst))
+		}
+		if err := applyFileOwnership(tempPath, dst); err != nil {
+			return fmt.Errorf("failed to set ownership of %s: %w", filepath.Base(dst), err)
+		}
+		return nil
+	}
+
+	_, err = atomicWrite(dst, io.TeeReader(sourceFile, sourceHasher), verify)
+	return err
+}
+
+// Write reader contents to dst via a synced temp file and rename, returns bytes written
+// The optional verify function inspects the synced temp file before the rename
+func atomicWrite(dst string, reader io.Reader, verify func(tempPath string, size int64) error) (int64, error) {
+	return STORAGE.createAtomic(dst, reader, verify)
+}
+
+// Write reader contents under a temp name beside dst, then place it without
+// replacing an existing file, for receivers writing into the watch folder
+// Returns the path used, which is numbered when dst was taken
+func atomicWriteNew(dst string, reader io.Reader, verify func(tempPath string, size int64) error) (string, error) {
+	staged := filepath.Join(filepath.Dir(dst), TEMP_FILE_PREFIX+filepath.Base(dst)+"."+strconv.FormatUint(rand.Uint64(), 36)+TEMP_FILE_SUFFIX) // #nosec G404 - unique name only
+	if _, err := atomicWrite(staged, reader, verify); err != nil {
+		return "", err
+	}
+	placed, err := placeWithoutReplacing(staged, dst)
+	if err != nil {
+		_ = STORAGE.remove(staged)
+	}
+	return placed, err
+}
+
+// Write a local file atomically, for localStorage
+func writeFileAtomic(dst string, reader io.Reader, verify func(tempPath string, size int64) error) (int64, error) {
+	destDir := filepath.Dir(dst)
+	if err := os.MkdirAll(destDir, 0750); err != nil {
+		return 0, fmt.Errorf("failed to create destination directory %s: %w", destDir, err)
+	}
+
+	tempFile, err := os.CreateTemp(destDir, TEMP_FILE_PREFIX+filepath.Base(dst)+".*"+TEMP_FILE_SUFFIX)
+	if err != nil {
+		return 0, err
+	}
+	tempPath := tempFile.Name()
+
+	if err := tempFile.Chmod(DEFAULT_FILE_MODE); err != nil && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to set permissions on %s: %v", filepath.Base(dst), err))
+	}
+
+	size, err := writeAndSync(tempFile, reader)
+	if err == nil {
+		err = verifyTempFileSize(tempPath, size)
+	}
+	if err == nil && verify != nil {
+		err = verify(tempPath, size)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return 0, err
+	}
+
+	if err := os.Rename(tempPath, dst); err != nil {
+		os.Remove(tempPath)
+		return 0, err
+	}
+
+	syncDirectory(destDir)
+	return size, nil
+}
+
+// Copy reader into file, fsync and close it
+func writeAndSync(file *os.File, reader io.Reader) (int64, error) {
+	size, err := io.Copy(file, reader)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return 0, fmt.Errorf("failed to sync %s: %w", filepath.Base(file.Name()), err)
+	}
+
+	return size, file.Close()
+}
+
+// Confirm the temp file on disk has the expected size
+func verifyTempFileSize(path string, expected int64) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != expected {
+		return fmt.Errorf("short write: %d of %d bytes", info.Size(), expected)
+	}
+	return nil
+}
+
+// Sync directory entry so the rename survives a crash (not supported on Windows)
+func syncDirectory(dir string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+
+	d, err := os.Open(dir) // #nosec G304 - internal path
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	_ = d.Sync()
+}
+
+// Check whether a filename is one of our hidden temp files
+func isTempFileName(name string) bool {
+	return strings.HasPrefix(name, TEMP_FILE_PREFIX) && strings.HasSuffix(name, TEMP_FILE_SUFFIX)
+}
+
+// Remove partially written temp files left behind by an interrupted run
+func cleanupPartialTempFiles(dirs ...string) int {
+	removed := 0
+	for _, dir := range dirs {
+		entries, err := STORAGE.list(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !isTempFileName(entry.Name()) {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+			if err := STORAGE.remove(path); err != nil {
+				printWarning(fmt.Sprintf("Failed to remove partial file %s: %v", entry.Name(), err))
+				continue
+			}
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAtomicCopyFile(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.pdf")
+	dst := filepath.Join(tempDir, "out", "doc.pdf")
+	_ = os.WriteFile(src, []byte("pdf content"), 0644)
+
+	err := atomicCopyFile(src, dst)
+	assert.NoError(t, err)
+
+	content, err := os.ReadFile(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, "pdf content", string(content))
+
+	// No temp files should remain in the destination
+	entries, _ := os.ReadDir(filepath.Dir(dst))
+	assert.Len(t, entries, 1)
+}
+
+func TestAtomicWriteVerifyFailureLeavesNoFile(t *testing.T) {
+	tempDir := t.TempDir()
+	dst := filepath.Join(tempDir, "doc.pdf")
+
+	_, err := atomicWrite(dst, strings.NewReader("content"), func(string, int64) error {
+		return errors.New("digest mismatch")
+	})
+	assert.Error(t, err)
+	assert.NoFileExists(t, dst)
+
+	entries, _ := os.ReadDir(tempDir)
+	assert.Len(t, entries, 0, "temp file should be removed after a failed verification")
+}
+
+func TestCleanupPartialTempFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	partial := filepath.Join(tempDir, ".blendpdf-doc.pdf.12345.tmp")
+	keep := filepath.Join(tempDir, "doc.pdf")
+	_ = os.WriteFile(partial, []byte("trunc"), 0644)
+	_ = os.WriteFile(keep, []byte("complete"), 0644)
+
+	removed := cleanupPartialTempFiles(tempDir, filepath.Join(tempDir, "missing"))
+	assert.Equal(t, 1, removed)
+	assert.NoFileExists(t, partial)
+	assert.FileExists(t, keep)
+}
+
+func TestIsTempFileName(t *testing.T) {
+	assert.True(t, isTempFileName(".blendpdf-doc.pdf.123.tmp"))
+	assert.False(t, isTempFileName("doc.pdf"))
+	assert.False(t, isTempFileName(".blendpdf-doc.pdf"))
+}
+
+// barrierReader holds its first read until every reader has started
+type barrierReader struct {
+	io.Reader
+	once    sync.Once
+	barrier *sync.WaitGroup
+}
+
+func (r *barrierReader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		r.barrier.Done()
+		r.barrier.Wait()
+	})
+	return r.Reader.Read(p)
+}
+
+func TestAtomicWriteNewNeverReplaces(t *testing.T) {
+	tempDir := t.TempDir()
+	dst := filepath.Join(tempDir, "scan.pdf")
+
+	// Every upload is in flight before any is placed
+	var wg, barrier sync.WaitGroup
+	barrier.Add(20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reader := &barrierReader{Reader: strings.NewReader(fmt.Sprintf("upload %d", i)), barrier: &barrier}
+			_, err := atomicWriteNew(dst, reader, nil)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	entries, _ := os.ReadDir(tempDir)
+	contents := map[string]bool{}
+	for _, entry := range entries {
+		assert.False(t, isTempFileName(entry.Name()), "staged upload left behind")
+		data, err := os.ReadFile(filepath.Join(tempDir, entry.Name()))
+		assert.NoError(t, err)
+		contents[string(data)] = true
+	}
+	assert.Len(t, contents, 20, "every upload kept")
+	assert.FileExists(t, filepath.Join(tempDir, "scan_19.pdf"))
+}
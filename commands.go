@@ -0,0 +1,418 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Command line subcommands
+//
+// Subcommands run once against a watch folder and exit, e.g.
+// "blendpdf history undo -dir /scans". They take the same lock as the
+// interactive mode so they never race a running instance.
+
+// command describes a subcommand
+type command struct {
+	usage       string
+	description string
+	run         func(args []string) error
+}
+
+// Registered subcommands, keyed by name, and their order in help output
+var (
+	commands     = map[string]command{}
+	commandOrder []string
+)
+
+// Register subcommands (done in init to avoid an initialization cycle with usage output)
+func init() {
+	registerCommand("history", command{
+		usage:       "history [list|undo|redo] [-dir folder] [ID]",
+		description: "Show operation history, or undo/redo an operation",
+		run:         runHistoryCommand,
+	})
+	registerCommand("archive", command{
+		usage:       "archive prune|keygen|encrypt [-dry-run] [-o keyfile] [-dir folder]",
+		description: "Apply archive retention rules, or manage archive encryption",
+		run:         runArchiveCommand,
+	})
+	registerCommand("search", command{
+		usage:       "search [-from date] [-to date] [-name glob] [-pages N|N-M] [-restore] [-dir folder] [text]",
+		description: "Find processed files by date, name, page count or text",
+		run:         runSearchCommand,
+	})
+	registerCommand("restore", command{
+		usage:       "restore [list|reprocess] [-back-order o] [-flip-edge e] [-dir folder] [name...]",
+		description: "Copy archived originals back, or merge an archived pair again",
+		run:         runRestoreCommand,
+	})
+	registerCommand("scan", command{
+		usage:       "scan [-dir folder]",
+		description: "Scan both sides on the network scanner and merge them",
+		run:         runScanCommand,
+	})
+	registerCommand("errors", command{
+		usage:       "errors [list|retry] [-dir folder] [file...]",
+		description: "Show why files failed, or move them back to the watch folder",
+		run:         runErrorsCommand,
+	})
+}
+
+// Add a subcommand to the registry
+func registerCommand(name string, cmd command) {
+	commands[name] = cmd
+	commandOrder = append(commandOrder, name)
+}
+
+// Check whether an argument names a subcommand
+func isCommand(name string) bool {
+	_, ok := commands[name]
+	return ok
+}
+
+// Run a subcommand and return the process exit code
+func runCommand(name string, args []string) int {
+	cmd := commands[name]
+	defer cleanupLock()
+
+	if err := cmd.run(args); err != nil {
+		if strings.Contains(err.Error(), "exit code 6") {
+			return 6
+		}
+		printError(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// Create a flag set with the flags every subcommand accepts
+func newCommandFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	dir := fs.String("dir", ".", "watch folder")
+	fs.BoolVar(&VERBOSE, "V", false, "verbose output")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: blendpdf %s\n", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs, dir
+}
+
+// Lock, configure and prepare a watch folder for a subcommand
+func openWatchFolder(dir string) error {
+	folder, err := resolveFolderPath(dir)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(folder); err != nil || !info.IsDir() {
+		return fmt.Errorf("watch folder does not exist: %s", folder)
+	}
+
+	if err := acquireLock(folder); err != nil {
+		return err
+	}
+
+	verbose := VERBOSE
+	CONFIG, err = loadConfig(folder)
+	if err != nil {
+		printWarning(fmt.Sprintf("Failed to load config: %v, using defaults", err))
+		CONFIG = getDefaultConfig()
+	}
+	VERBOSE = verbose || CONFIG.VerboseMode
+
+	return initDirectories(folder)
+}
+
+// Split a leading action word from subcommand arguments
+func splitAction(args []string, actions ...string) (string, []string) {
+	if len(args) > 0 {
+		for _, action := range actions {
+			if args[0] == action {
+				return action, args[1:]
+			}
+		}
+	}
+	return "", args
+}
+
+// history command
+
+// Show operation history or undo/redo an entry
+func runHistoryCommand(args []string) error {
+	action, args := splitAction(args, "list", "undo", "redo")
+	if action == "" {
+		action = "list"
+	}
+
+	fs, dir := newCommandFlags("history")
+	limit := fs.Int("n", 20, "number of entries to list (0 for all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := openWatchFolder(*dir); err != nil {
+		return err
+	}
+
+	id := fs.Arg(0)
+	switch action {
+	case "undo":
+		if id == "" {
+			return undoLatestOperation()
+		}
+		return undoOperationByID(id)
+	case "redo":
+		if id == "" {
+			return redoLatestOperation()
+		}
+		return redoOperationByID(id)
+	default:
+		displayHistory(*limit)
+		return nil
+	}
+}
+
+// archive command
+
+// Apply archive retention rules
+func runArchiveCommand(args []string) error {
+	action, args := splitAction(args, "prune", "keygen", "encrypt")
+	if action == "" {
+		return fmt.Errorf("usage: blendpdf %s", commands["archive"].usage)
+	}
+
+	fs, dir := newCommandFlags("archive")
+	dryRun := fs.Bool("dry-run", false, "show what would be pruned without changing anything")
+	keyFile := fs.String("o", "", "keygen: private key file (default: archiveEncryption.identityFile)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if action == "keygen" && *keyFile != "" {
+		return runArchiveKeygen(*keyFile)
+	}
+	if err := openWatchFolder(*dir); err != nil {
+		return err
+	}
+
+	switch action {
+	case "keygen":
+		return runArchiveKeygen(getIdentityFilePath())
+	case "encrypt":
+		encrypted, err := encryptExistingArchive()
+		printSuccess(fmt.Sprintf("Encrypted %d archive file(s)", encrypted))
+		return err
+	}
+	return pruneArchive(*dryRun)
+}
+
+// Create an archive key pair and show the public key to configure
+func runArchiveKeygen(path string) error {
+	recipient, err := generateArchiveKey(path)
+	if err != nil {
+		return err
+	}
+	printSuccess(fmt.Sprintf("Private key written to %s - keep it off the shared disk and back it up", path))
+	fmt.Printf("Add the public key to blendpdf.json:\n  \"archiveEncryption\": {\"recipients\": [\"%s\"]}\n", recipient)
+	return nil
+}
+
+// errors command
+
+// Show error folder reports or retry failed files
+func runErrorsCommand(args []string) error {
+	action, args := splitAction(args, "list", "retry")
+
+	fs, dir := newCommandFlags("errors")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := openWatchFolder(*dir); err != nil {
+		return err
+	}
+
+	if action != "retry" {
+		displayErrorFiles()
+		return nil
+	}
+
+	retried, err := retryErrorFiles(fs.Args())
+	printSuccess(fmt.Sprintf("Moved %d file(s) back to %s", retried, FOLDER))
+	return err
+}
+
+// search command
+
+// Search the operation index, optionally restoring the archived originals of a match
+func runSearchCommand(args []string) error {
+	fs, dir := newCommandFlags("search")
+	from := fs.String("from", "", "only operations on or after this date (YYYY-MM-DD)")
+	to := fs.String("to", "", "only operations on or before this date (YYYY-MM-DD)")
+	name := fs.String("name", "", "source or output name glob, e.g. 'bank*'")
+	text := fs.String("text", "", "text the output must contain")
+	pages := fs.String("pages", "", "page count: N, N-M, N- or -M")
+	id := fs.String("id", "", "only the operation with this history ID")
+	restore := fs.Bool("restore", false, "copy the archived originals of the match back to the watch folder")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	query, err := buildSearchQuery(*from, *to, *name, *text, *pages, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	if err := openWatchFolder(*dir); err != nil {
+		return err
+	}
+	if err := backfillSearchIndex(); err != nil {
+		return err
+	}
+
+	results, err := searchIndex(query)
+	if err != nil {
+		return err
+	}
+	if *id != "" {
+		var filtered []*SearchRecord
+		for _, record := range results {
+			if record.ID == *id {
+				filtered = append(filtered, record)
+			}
+		}
+		results = filtered
+	}
+
+	displaySearchResults(results, query)
+	if !*restore {
+		return nil
+	}
+
+	if len(results) != 1 {
+		return fmt.Errorf("%d operations match; narrow the search (e.g. with -id) to restore one", len(results))
+	}
+	restored, err := restoreIndexedOriginals(results[0])
+	for _, file := range restored {
+		printSuccess(fmt.Sprintf("Restored %s", file))
+	}
+	return err
+}
+
+// Build a search query from command line values
+func buildSearchQuery(from, to, name, text, pages string, words []string) (SearchQuery, error) {
+	query := SearchQuery{Name: name, Text: text}
+	if query.Text == "" {
+		query.Text = strings.Join(words, " ")
+	}
+
+	var err error
+	if from != "" {
+		if query.From, err = parseSearchDate(from); err != nil {
+			return query, err
+		}
+	}
+	if to != "" {
+		if query.To, err = parseSearchDate(to); err != nil {
+			return query, err
+		}
+		query.To = query.To.AddDate(0, 0, 1) // Include the whole day
+	}
+	if pages != "" {
+		if query.MinPages, query.MaxPages, err = parsePageRange(pages); err != nil {
+			return query, err
+		}
+	}
+	return query, nil
+}
+
+// restore command
+
+// List the archive, copy originals back to the watch folder or reprocess a pair
+func runRestoreCommand(args []string) error {
+	action, args := splitAction(args, "list", "reprocess")
+
+	fs, dir := newCommandFlags("restore")
+	backOrder := fs.String("back-order", BACK_ORDER_REVERSED, "reprocess: back pages "+BACK_ORDER_REVERSED+" or "+BACK_ORDER_SCANNED)
+	flipEdge := fs.String("flip-edge", FLIP_LONG_EDGE, "reprocess: stack flipped on the "+FLIP_LONG_EDGE+" or "+FLIP_SHORT_EDGE+" edge")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := openWatchFolder(*dir); err != nil {
+		return err
+	}
+
+	switch {
+	case action == "reprocess":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("reprocess needs a front and a back file")
+		}
+		outputs, err := reprocessArchivedPair(fs.Arg(0), fs.Arg(1), MergeOptions{BackOrder: *backOrder, FlipEdge: *flipEdge})
+		for _, output := range outputs {
+			if output != "" {
+				printSuccess(fmt.Sprintf("Reprocessed into %s", output))
+			}
+		}
+		return err
+	case action == "list" || fs.NArg() == 0:
+		originals, err := listArchivedOriginals()
+		if err != nil {
+			return err
+		}
+		displayArchivedOriginals(originals)
+		return nil
+	default:
+		restored, err := restoreArchivedOriginals(fs.Args())
+		for _, file := range restored {
+			printSuccess(fmt.Sprintf("Restored %s", file))
+		}
+		return err
+	}
+}
+
+// scan command
+
+// Scan front and back on the configured eSCL scanner and merge them
+func runScanCommand(args []string) error {
+	fs, dir := newCommandFlags("scan")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := openWatchFolder(*dir); err != nil {
+		return err
+	}
+
+	output, err := scanAndMerge(promptFlipOnStdin)
+	if err != nil {
+		return err
+	}
+	printSuccess(fmt.Sprintf("Scanned and merged into %s", output))
+	return nil
+}
+
+// Show subcommands in help output
+func showCommands() {
+	fmt.Printf("Commands:\n")
+	for _, name := range commandOrder {
+		cmd := commands[name]
+		fmt.Printf("  %-45s %s\n", cmd.usage, cmd.description)
+	}
+	fmt.Println()
+}
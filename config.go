@@ -16,25 +16,68 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
 )
 
 // Configuration structure
 type Config struct {
-	ArchiveMode   bool     `json:"archiveMode"`
-	OutputFolders []string `json:"outputFolders"`
-	VerboseMode   bool     `json:"verboseMode"`
-	DebugMode     bool     `json:"debugMode"`
+	ArchiveMode    bool                         `json:"archiveMode"`
+	OutputFolders  []string                     `json:"outputFolders"`
+	VerboseMode    bool                         `json:"verboseMode"`
+	DebugMode      bool                         `json:"debugMode"`
+	ConflictPolicy string                       `json:"conflictPolicy"`
+	Destinations   map[string]DestinationConfig `json:"destinations,omitempty"`
+	HistoryLimit   int                          `json:"historyLimit"`
+	Retention      RetentionConfig              `json:"retention"`
+	ArchiveStore   string                       `json:"archiveStore"`
+
+	ArchiveEncryption ArchiveEncryptionConfig `json:"archiveEncryption"`
+	Routing           RoutingConfig           `json:"routing"`
+	MinFreeMB         int                     `json:"minFreeMB"` // Free space every destination keeps after a copy
+	Retry             RetryConfig             `json:"retry"`
+	Inbox             InboxConfig             `json:"inbox"`
+	FTP               FTPReceiverConfig       `json:"ftp"`
+	SMTP              SMTPReceiverConfig      `json:"smtp"`
+	Scanner           ScannerConfig           `json:"scanner"`
+	Hooks             HooksConfig             `json:"hooks"`
+	Webhooks          WebhooksConfig          `json:"webhooks"`
+}
+
+// Per-destination settings, keyed by output folder, "archive" or "error"
+type DestinationConfig struct {
+	ConflictPolicy string `json:"conflictPolicy,omitempty"`
+	FileMode       string `json:"fileMode,omitempty"` // Octal mode of copied files, e.g. "0640"
+	DirMode        string `json:"dirMode,omitempty"`  // Octal mode of the folder itself
+	Group          string `json:"group,omitempty"`    // Group name or ID owning the folder and its files
+
+	// Remote destinations (s3://bucket/prefix)
+	Endpoint string `json:"endpoint,omitempty"` // e.g. https://minio.local:9000
+	Region   string `json:"region,omitempty"`
+	Profile  string `json:"profile,omitempty"` // Profile in the AWS credentials file
+
+	// WebDAV destinations (webdav://host/path, https://host/path)
+	Username string `json:"username,omitempty"` // Also the SFTP user when the URL has none
+	Password string `json:"password,omitempty"` // An app password rather than the account password
+	Token    string `json:"token,omitempty"`    // Bearer token, used instead of username and password
+
+	// SFTP destinations (sftp://user@host/path)
+	KeyFile    string `json:"keyFile,omitempty"`    // Private key; defaults to the SSH agent and ~/.ssh keys
+	KnownHosts string `json:"knownHosts,omitempty"` // Defaults to ~/.ssh/known_hosts
 }
 
 // Default configuration
 func getDefaultConfig() *Config {
 	return &Config{
-		ArchiveMode:   true,
-		OutputFolders: []string{"output"},
-		VerboseMode:   false,
-		DebugMode:     false,
+		ArchiveMode:    true,
+		OutputFolders:  []string{"output"},
+		VerboseMode:    false,
+		DebugMode:      false,
+		ConflictPolicy: CONFLICT_SUFFIX,
+		HistoryLimit:   DEFAULT_HISTORY_LIMIT,
+		ArchiveStore:   ARCHIVE_STORE_FILES,
+		MinFreeMB:      DEFAULT_MIN_FREE_MB,
 	}
 }
 
@@ -85,6 +128,112 @@ func validateConfig(config *Config) error {
 	if len(config.OutputFolders) == 0 {
 		config.OutputFolders = []string{"output"}
 	}
+	for _, folder := range config.OutputFolders {
+		if err := validateDestinationFolder(folder); err != nil {
+			return err
+		}
+	}
+
+	if config.HistoryLimit <= 0 {
+		config.HistoryLimit = DEFAULT_HISTORY_LIMIT
+	}
+
+	if config.ConflictPolicy == "" {
+		config.ConflictPolicy = CONFLICT_SUFFIX
+	}
+	if !isValidConflictPolicy(config.ConflictPolicy) {
+		return fmt.Errorf("unknown conflict policy: %s", config.ConflictPolicy)
+	}
+
+	if config.ArchiveStore == "" {
+		config.ArchiveStore = ARCHIVE_STORE_FILES
+	}
+	if !isValidArchiveStore(config.ArchiveStore) {
+		return fmt.Errorf("unknown archive store: %s", config.ArchiveStore)
+	}
+
+	if err := config.ArchiveEncryption.validate(); err != nil {
+		return err
+	}
+
+	if err := config.Routing.validate(); err != nil {
+		return err
+	}
+
+	if config.MinFreeMB < 0 {
+		return fmt.Errorf("minFreeMB must not be negative")
+	}
+
+	if err := config.Retry.validate(); err != nil {
+		return err
+	}
+
+	if err := config.Inbox.validate(); err != nil {
+		return err
+	}
+
+	if err := config.FTP.validate(); err != nil {
+		return err
+	}
+
+	if err := config.SMTP.validate(); err != nil {
+		return err
+	}
+
+	if err := config.Scanner.validate(); err != nil {
+		return err
+	}
+
+	if err := config.Hooks.validate(); err != nil {
+		return err
+	}
+
+	if err := config.Webhooks.validate(); err != nil {
+		return err
+	}
+
+	if config.Retention.KeepDays < 0 || config.Retention.KeepGB < 0 || config.Retention.CompactAfterDays < 0 {
+		return fmt.Errorf("retention rules must not be negative")
+	}
+
+	for name, dest := range config.Destinations {
+		if dest.ConflictPolicy != "" && !isValidConflictPolicy(dest.ConflictPolicy) {
+			return fmt.Errorf("unknown conflict policy for destination %s: %s", name, dest.ConflictPolicy)
+		}
+		if err := dest.validateOwnership(); err != nil {
+			return fmt.Errorf("destination %s: %v", name, err)
+		}
+	}
 
 	return nil
 }
+
+// Find per-destination settings for a directory
+func findDestinationConfig(dir string) (DestinationConfig, bool) {
+	if CONFIG == nil || len(CONFIG.Destinations) == 0 {
+		return DestinationConfig{}, false
+	}
+
+	cleanDir := filepath.Clean(dir)
+	for name, dest := range CONFIG.Destinations {
+		switch {
+		case name == "archive" && ARCHIVE != "" && cleanDir == filepath.Clean(ARCHIVE):
+			return dest, true
+		case name == "error" && ERROR_DIR != "" && cleanDir == filepath.Clean(ERROR_DIR):
+			return dest, true
+		case samePath(name, cleanDir):
+			return dest, true
+		}
+	}
+	return DestinationConfig{}, false
+}
+
+// Compare two paths after resolving them to absolute form
+func samePath(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
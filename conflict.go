@@ -0,0 +1,161 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Destination conflict resolution functions
+
+// conflictResolution describes where a copy should be written
+type conflictResolution struct {
+	path    string
+	outcome string
+	skip    bool // Destination already holds identical content
+}
+
+// Check whether a conflict policy name is known
+func isValidConflictPolicy(policy string) bool {
+	switch policy {
+	case CONFLICT_SUFFIX, CONFLICT_TIMESTAMP, CONFLICT_OVERWRITE, CONFLICT_SKIP_IDENTICAL, CONFLICT_FAIL:
+		return true
+	}
+	return false
+}
+
+// Get the conflict policy for a destination directory
+func getConflictPolicy(dir string) string {
+	if dest, ok := findDestinationConfig(dir); ok && dest.ConflictPolicy != "" {
+		return dest.ConflictPolicy
+	}
+	if CONFIG != nil && CONFIG.ConflictPolicy != "" {
+		return CONFIG.ConflictPolicy
+	}
+	return CONFLICT_SUFFIX
+}
+
+// Resolve a destination conflict according to the given policy
+func resolveConflict(src, dst, policy string) (conflictResolution, error) {
+	if !destinationExists(dst) {
+		return conflictResolution{path: dst, outcome: OUTCOME_CREATED}, nil
+	}
+
+	switch policy {
+	case CONFLICT_OVERWRITE:
+		return conflictResolution{path: dst, outcome: OUTCOME_OVERWRITTEN}, nil
+	case CONFLICT_FAIL:
+		return conflictResolution{}, fmt.Errorf("%w: %s", errDestinationExists, filepath.Base(dst))
+	case CONFLICT_TIMESTAMP:
+		newDst, err := generateTimestampFileName(dst, time.Now())
+		if err != nil {
+			return conflictResolution{}, err
+		}
+		return conflictResolution{path: newDst, outcome: OUTCOME_TIMESTAMPED}, nil
+	case CONFLICT_SKIP_IDENTICAL:
+		if existing, ok := findIdenticalFile(src, dst); ok {
+			if VERBOSE {
+				printInfo(fmt.Sprintf("Identical file already exists, skipping: %s", filepath.Base(existing)))
+			}
+			return conflictResolution{path: existing, outcome: OUTCOME_SKIPPED, skip: true}, nil
+		}
+	}
+
+	newDst, err := generateUniqueFileName(dst)
+	if err != nil {
+		return conflictResolution{}, err
+	}
+	return conflictResolution{path: newDst, outcome: OUTCOME_SUFFIXED}, nil
+}
+
+// Generate timestamped filename if destination exists
+func generateTimestampFileName(dst string, now time.Time) (string, error) {
+	dstDir, name := splitDestination(dst)
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	ext := filepath.Ext(name)
+	stamp := now.Format("20060102-150405")
+
+	newDst := joinDestination(dstDir, fmt.Sprintf("%s_%s%s", base, stamp, ext))
+	if !destinationExists(newDst) {
+		return newDst, nil
+	}
+
+	// Several copies within the same second fall back to a counter
+	return generateUniqueFileName(newDst)
+}
+
+// Find an existing copy of src at dst or one of its suffixed variants
+func findIdenticalFile(src, dst string) (string, bool) {
+	srcInfo, err := STORAGE.stat(src)
+	if err != nil {
+		return "", false
+	}
+
+	srcHash, err := calculateFileHash(src)
+	if err != nil {
+		return "", false
+	}
+
+	// Remote objects carry the digest they were uploaded with
+	if isRemotePath(dst) {
+		for _, candidate := range remoteConflictCandidates(dst) {
+			if digest, err := remoteDigest(candidate); err == nil && digest == srcHash {
+				return candidate, true
+			}
+		}
+		return "", false
+	}
+
+	for _, candidate := range conflictCandidates(dst) {
+		info, err := STORAGE.stat(candidate)
+		if err != nil || !info.Mode().IsRegular() || info.Size() != srcInfo.Size() {
+			continue
+		}
+
+		if hash, err := calculateFileHash(candidate); err == nil && hash == srcHash {
+			return candidate, true
+		}
+	}
+
+	return "", false
+}
+
+// List dst and any files previously created from it by conflict resolution
+func conflictCandidates(dst string) []string {
+	candidates := []string{dst}
+
+	entries, err := STORAGE.list(filepath.Dir(dst))
+	if err != nil {
+		return candidates
+	}
+
+	ext := filepath.Ext(dst)
+	prefix := strings.TrimSuffix(filepath.Base(dst), ext) + "_"
+
+	var matches []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, prefix) && strings.HasSuffix(name, ext) {
+			matches = append(matches, filepath.Join(filepath.Dir(dst), name))
+		}
+	}
+
+	sort.Strings(matches)
+	return append(candidates, matches...)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveConflictNoExistingFile(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.pdf")
+	dst := filepath.Join(tempDir, "out", "doc.pdf")
+	_ = os.WriteFile(src, []byte("content"), 0644)
+
+	for _, policy := range []string{CONFLICT_SUFFIX, CONFLICT_TIMESTAMP, CONFLICT_OVERWRITE, CONFLICT_SKIP_IDENTICAL, CONFLICT_FAIL} {
+		resolution, err := resolveConflict(src, dst, policy)
+		assert.NoError(t, err, policy)
+		assert.Equal(t, dst, resolution.path, policy)
+		assert.Equal(t, OUTCOME_CREATED, resolution.outcome, policy)
+		assert.False(t, resolution.skip, policy)
+	}
+}
+
+func TestResolveConflictPolicies(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.pdf")
+	dst := filepath.Join(tempDir, "doc.pdf")
+	_ = os.WriteFile(src, []byte("new content"), 0644)
+	_ = os.WriteFile(dst, []byte("old content"), 0644)
+
+	resolution, err := resolveConflict(src, dst, CONFLICT_SUFFIX)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(tempDir, "doc_1.pdf"), resolution.path)
+	assert.Equal(t, OUTCOME_SUFFIXED, resolution.outcome)
+
+	resolution, err = resolveConflict(src, dst, CONFLICT_TIMESTAMP)
+	assert.NoError(t, err)
+	assert.Regexp(t, `doc_\d{8}-\d{6}\.pdf$`, resolution.path)
+	assert.Equal(t, OUTCOME_TIMESTAMPED, resolution.outcome)
+
+	resolution, err = resolveConflict(src, dst, CONFLICT_OVERWRITE)
+	assert.NoError(t, err)
+	assert.Equal(t, dst, resolution.path)
+	assert.Equal(t, OUTCOME_OVERWRITTEN, resolution.outcome)
+
+	_, err = resolveConflict(src, dst, CONFLICT_FAIL)
+	assert.Error(t, err)
+
+	// Different content falls back to a suffix
+	resolution, err = resolveConflict(src, dst, CONFLICT_SKIP_IDENTICAL)
+	assert.NoError(t, err)
+	assert.Equal(t, OUTCOME_SUFFIXED, resolution.outcome)
+	assert.False(t, resolution.skip)
+}
+
+func TestResolveConflictSkipIdentical(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.pdf")
+	dst := filepath.Join(tempDir, "doc.pdf")
+	_ = os.WriteFile(src, []byte("same content"), 0644)
+	_ = os.WriteFile(dst, []byte("other content"), 0644)
+	_ = os.WriteFile(filepath.Join(tempDir, "doc_1.pdf"), []byte("same content"), 0644)
+
+	resolution, err := resolveConflict(src, dst, CONFLICT_SKIP_IDENTICAL)
+	assert.NoError(t, err)
+	assert.True(t, resolution.skip)
+	assert.Equal(t, OUTCOME_SKIPPED, resolution.outcome)
+	assert.Equal(t, filepath.Join(tempDir, "doc_1.pdf"), resolution.path)
+}
+
+func TestGenerateTimestampFileNameCollision(t *testing.T) {
+	tempDir := t.TempDir()
+	now := time.Date(2025, 3, 14, 9, 26, 53, 0, time.UTC)
+	dst := filepath.Join(tempDir, "doc.pdf")
+	_ = os.WriteFile(filepath.Join(tempDir, "doc_20250314-092653.pdf"), []byte("x"), 0644)
+
+	newDst, err := generateTimestampFileName(dst, now)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(tempDir, "doc_20250314-092653_1.pdf"), newDst)
+}
+
+func TestCopyFileWithPolicyUsesDestinationConfig(t *testing.T) {
+	tempDir := t.TempDir()
+	outDir := filepath.Join(tempDir, "out")
+	_ = os.MkdirAll(outDir, 0755)
+
+	originalConfig := CONFIG
+	defer func() { CONFIG = originalConfig }()
+
+	CONFIG = getDefaultConfig()
+	CONFIG.Destinations = map[string]DestinationConfig{
+		outDir: {ConflictPolicy: CONFLICT_FAIL},
+	}
+
+	src := filepath.Join(tempDir, "src.pdf")
+	_ = os.WriteFile(src, []byte("content"), 0644)
+
+	actual, outcome, err := copyFileWithPolicy(src, filepath.Join(outDir, "doc.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, OUTCOME_CREATED, outcome)
+	assert.FileExists(t, actual)
+
+	_, _, err = copyFileWithPolicy(src, filepath.Join(outDir, "doc.pdf"))
+	assert.Error(t, err, "fail policy should refuse an existing destination")
+}
+
+func TestValidateConfigRejectsUnknownPolicy(t *testing.T) {
+	config := getDefaultConfig()
+	config.ConflictPolicy = "bogus"
+	assert.Error(t, validateConfig(config))
+
+	config = getDefaultConfig()
+	config.ConflictPolicy = ""
+	assert.NoError(t, validateConfig(config))
+	assert.Equal(t, CONFLICT_SUFFIX, config.ConflictPolicy)
+}
@@ -54,6 +54,7 @@ var (
 	ARCHIVE   = ""
 	OUTPUT    = ""
 	ERROR_DIR = ""
+	STATE_DIR = "" // Hidden folder for journal and other persisted state
 	LOCKFILE  = ""
 )
 
@@ -64,14 +65,36 @@ var (
 	START_TIME  = time.Now()
 )
 
+// Destination conflict policies
+const (
+	CONFLICT_SUFFIX         = "suffix"         // Append _1, _2, ... to the filename
+	CONFLICT_TIMESTAMP      = "timestamp"      // Append _YYYYMMDD-HHMMSS to the filename
+	CONFLICT_OVERWRITE      = "overwrite"      // Replace the existing file
+	CONFLICT_SKIP_IDENTICAL = "skip-identical" // Skip when an identical copy exists, otherwise suffix
+	CONFLICT_FAIL           = "fail"           // Refuse to write
+)
+
+// Conflict policy outcomes recorded per destination copy
+const (
+	OUTCOME_CREATED     = "created"
+	OUTCOME_SUFFIXED    = "suffixed"
+	OUTCOME_TIMESTAMPED = "timestamped"
+	OUTCOME_OVERWRITTEN = "overwritten"
+	OUTCOME_SKIPPED     = "skipped-identical"
+)
+
 // Operation tracking for undo functionality
 type LastOperation struct {
-	Type          string   // "single" or "merge"
-	OriginalFiles []string // Original file paths in main/
-	ActualFiles   []string // Actual filenames used (with conflict resolution)
-	OutputFolders []string // Output folders used
-	ArchiveFiles  []string // Files in archive/ (for merge operations)
-	Timestamp     time.Time
+	Type             string    `json:"type"`                       // "single" or "merge"
+	OriginalFiles    []string  `json:"originalFiles"`              // Original file paths in main/
+	ActualFiles      []string  `json:"actualFiles"`                // Actual filenames used (with conflict resolution)
+	ConflictOutcomes []string  `json:"conflictOutcomes,omitempty"` // Conflict policy outcome for each entry in ActualFiles
+	OutputFolders    []string  `json:"outputFolders"`              // Destination folder of each entry in ActualFiles
+	ArchiveFiles     []string  `json:"archiveFiles,omitempty"`     // Files in archive/ (for merge operations)
+	Repaired         []string  `json:"repaired,omitempty"`         // Originals processed from a repaired copy
+	ArchiveStore     string    `json:"archiveStore,omitempty"`     // "objects" when ArchiveFiles are object store links
+	Route            string    `json:"route,omitempty"`            // Routing rule that picked the outputs
+	Timestamp        time.Time `json:"timestamp"`
 }
 
 var LAST_OPERATION *LastOperation
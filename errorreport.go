@@ -0,0 +1,345 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Error folder reports
+//
+// Every file moved to the error folder gets a JSON sidecar next to it
+// (scan.pdf -> scan.pdf.json) recording why it failed, so the cause can
+// be fixed and the file retried without digging through logs.
+
+// Failure stages recorded in error reports
+const (
+	STAGE_VALIDATION = "validation"
+	STAGE_MERGE      = "merge"
+	STAGE_OUTPUT     = "output"
+	STAGE_PROCESSING = "processing"
+
+	ERROR_REPORT_SUFFIX = ".json"
+)
+
+// ErrorReport describes why a file was moved to the error folder
+type ErrorReport struct {
+	File               string    `json:"file"`
+	Stage              string    `json:"stage"`
+	Error              string    `json:"error"`
+	ValidationMessages []string  `json:"validationMessages,omitempty"`
+	Partner            string    `json:"partner,omitempty"`
+	Destinations       []string  `json:"destinations,omitempty"` // Output copies that failed; retrying copies the file to these
+	Timestamp          time.Time `json:"timestamp"`
+}
+
+// ErrorFile is a file waiting in the error folder and its report (nil if none)
+type ErrorFile struct {
+	Path   string
+	Report *ErrorReport
+}
+
+// stageError tags an error with the processing stage it came from
+type stageError struct {
+	stage string
+	err   error
+}
+
+func (e *stageError) Error() string { return e.err.Error() }
+func (e *stageError) Unwrap() error { return e.err }
+
+// Tag an error with a failure stage
+func withStage(stage string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &stageError{stage: stage, err: err}
+}
+
+// Get the failure stage of an error, defaulting to general processing
+func errorStage(err error) string {
+	var se *stageError
+	if errors.As(err, &se) {
+		return se.stage
+	}
+	return STAGE_PROCESSING
+}
+
+// Get the sidecar report path for a file in the error folder
+func getErrorReportPath(file string) string {
+	return file + ERROR_REPORT_SUFFIX
+}
+
+// Collect pdfcpu validation messages for a file
+func collectValidationMessages(file string) []string {
+	err := validateFileSafely(file)
+	if err == nil {
+		return nil
+	}
+
+	var messages []string
+	for _, line := range strings.Split(err.Error(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			messages = append(messages, line)
+		}
+	}
+	return messages
+}
+
+// Move a failed file to the error folder and write its report
+// partner is the other file of a merge, or "" for single files
+func moveToErrorFolder(file, partner string, cause error) error {
+	if file == "" || !fileExists(file) {
+		return fmt.Errorf("file not found: %s", filepath.Base(file))
+	}
+
+	report := newErrorReport(file, partner, cause)
+
+	dest, err := moveFileResolved(file, filepath.Join(ERROR_DIR, filepath.Base(file)))
+	if err != nil {
+		return err
+	}
+
+	if err := writeErrorReport(dest, report); err != nil {
+		printWarning(fmt.Sprintf("Failed to write error report for %s: %v", filepath.Base(dest), err))
+	}
+	return nil
+}
+
+// Build a report for a file that is about to be moved to the error folder
+func newErrorReport(file, partner string, cause error) *ErrorReport {
+	report := &ErrorReport{
+		File:      filepath.Base(file),
+		Stage:     errorStage(cause),
+		Timestamp: time.Now(),
+	}
+	if cause != nil {
+		report.Error = cause.Error()
+	}
+	if partner != "" {
+		report.Partner = filepath.Base(partner)
+	}
+	if report.Stage == STAGE_VALIDATION {
+		report.ValidationMessages = collectValidationMessages(file)
+	}
+	return report
+}
+
+// Write a report next to a file in the error folder
+func writeErrorReport(file string, report *ErrorReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = atomicWrite(getErrorReportPath(file), bytes.NewReader(data), nil)
+	return err
+}
+
+// Load the report for a file in the error folder (nil if it has none)
+func loadErrorReport(file string) (*ErrorReport, error) {
+	data, err := readStorageFile(getErrorReportPath(file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var report ErrorReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, fmt.Errorf("invalid error report: %v", err)
+	}
+	return &report, nil
+}
+
+// Move files in a merge pair to the error folder, each naming the other as partner
+func moveFilesToErrorFolder(cause error, files ...string) bool {
+	allMoved := true
+	for i, file := range files {
+		if file == "" {
+			continue
+		}
+
+		partner := ""
+		if len(files) == 2 {
+			partner = files[1-i]
+		}
+
+		if err := moveToErrorFolder(file, partner, cause); err != nil {
+			printError(fmt.Sprintf("Failed to move invalid file %s: %v", filepath.Base(file), err))
+			allMoved = false
+		}
+	}
+	return allMoved
+}
+
+// Retry from error
+
+// List files in the error folder with their reports, oldest name first
+func listErrorFiles() ([]ErrorFile, error) {
+	files, err := listStorageFiles(ERROR_DIR, ".pdf")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ErrorFile
+	for _, file := range files {
+		report, err := loadErrorReport(file)
+		if err != nil && VERBOSE {
+			printWarning(fmt.Sprintf("%s: %v", filepath.Base(file), err))
+		}
+		result = append(result, ErrorFile{Path: file, Report: report})
+	}
+	return result, nil
+}
+
+// Move files from the error folder back to the watch folder
+// names are base names in the error folder; none means every file
+func retryErrorFiles(names []string) (int, error) {
+	if len(names) == 0 {
+		files, err := listErrorFiles()
+		if err != nil {
+			return 0, err
+		}
+		for _, file := range files {
+			names = append(names, filepath.Base(file.Path))
+		}
+	}
+
+	retried := 0
+	var failures []string
+	for _, name := range names {
+		if err := retryErrorFile(filepath.Join(ERROR_DIR, filepath.Base(name))); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", filepath.Base(name), err))
+			continue
+		}
+		retried++
+	}
+
+	if len(failures) > 0 {
+		return retried, fmt.Errorf("failed to retry %s", strings.Join(failures, "; "))
+	}
+	return retried, nil
+}
+
+// Move one file back to the watch folder under its original name
+func retryErrorFile(file string) error {
+	if !fileExists(file) {
+		return fmt.Errorf("not in error folder")
+	}
+
+	report, _ := loadErrorReport(file)
+	if report != nil && len(report.Destinations) > 0 {
+		return retryOutputCopies(file, report)
+	}
+
+	name := filepath.Base(file)
+	if report != nil && report.File != "" {
+		// The report is only a hint, so it never names a path outside the watch folder
+		name = filepath.Base(report.File)
+		if name == "." || name == ".." || name == string(filepath.Separator) {
+			return fmt.Errorf("invalid file name in error report: %q", report.File)
+		}
+	}
+
+	dest, err := moveFileResolved(file, filepath.Join(FOLDER, name))
+	if err != nil {
+		return err
+	}
+
+	if err := STORAGE.remove(getErrorReportPath(file)); err != nil && !os.IsNotExist(err) && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to remove error report: %v", err))
+	}
+
+	logOperation("RETRY_FROM_ERROR", filepath.Base(file), filepath.Base(dest), "SUCCESS")
+	if VERBOSE {
+		printInfo(fmt.Sprintf("Moved %s back to %s", filepath.Base(file), filepath.Base(FOLDER)))
+	}
+	return nil
+}
+
+// Copy a result back to the output destinations it failed to reach
+// Destinations that fail again stay in the report for the next retry
+func retryOutputCopies(file string, report *ErrorReport) error {
+	var remaining, failures []string
+	for _, target := range report.Destinations {
+		if !isRouteDestination(target) {
+			return fmt.Errorf("error report names %s, which is not an output destination", target)
+		}
+	}
+	for _, target := range report.Destinations {
+		actual, _, err := copyFileWithPolicy(file, target)
+		if err != nil {
+			remaining = append(remaining, target)
+			failures = append(failures, fmt.Sprintf("%s: %v", destinationDir(target), err))
+			continue
+		}
+		logOperation("RETRY_COPY_FROM_ERROR", filepath.Base(file), actual, "SUCCESS")
+	}
+
+	if len(remaining) > 0 {
+		report.Destinations = remaining
+		if err := writeErrorReport(file, report); err != nil && VERBOSE {
+			printWarning(fmt.Sprintf("Failed to update error report: %v", err))
+		}
+		return fmt.Errorf("output copy failed: %s", strings.Join(failures, "; "))
+	}
+
+	if err := STORAGE.remove(file); err != nil {
+		return err
+	}
+	if err := STORAGE.remove(getErrorReportPath(file)); err != nil && !os.IsNotExist(err) && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to remove error report: %v", err))
+	}
+	if VERBOSE {
+		printInfo(fmt.Sprintf("Copied %s to %d output destination(s)", filepath.Base(file), len(report.Destinations)))
+	}
+	return nil
+}
+
+// Show files in the error folder and why they failed
+func displayErrorFiles() {
+	files, err := listErrorFiles()
+	if err != nil {
+		printError(fmt.Sprintf("Error listing error folder: %v", err))
+		return
+	}
+	if len(files) == 0 {
+		printInfo("Error folder is empty")
+		return
+	}
+
+	for _, file := range files {
+		fmt.Printf("%s%s%s\n", YELLOW, filepath.Base(file.Path), NC)
+		if file.Report == nil {
+			fmt.Printf("  no report\n")
+			continue
+		}
+		fmt.Printf("  %s failed at %s: %s\n", formatHistoryTime(file.Report.Timestamp), file.Report.Stage, file.Report.Error)
+		if file.Report.Partner != "" {
+			fmt.Printf("  partner: %s\n", file.Report.Partner)
+		}
+		for _, message := range file.Report.ValidationMessages {
+			fmt.Printf("  - %s\n", message)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorStage(t *testing.T) {
+	err := withStage(STAGE_MERGE, errors.New("boom"))
+	assert.Equal(t, STAGE_MERGE, errorStage(err))
+	assert.Equal(t, "boom", err.Error())
+
+	wrapped := fmt.Errorf("outer: %w", err)
+	assert.Equal(t, STAGE_MERGE, errorStage(wrapped))
+
+	assert.Equal(t, STAGE_PROCESSING, errorStage(errors.New("plain")))
+	assert.Nil(t, withStage(STAGE_MERGE, nil))
+}
+
+func TestMoveToErrorFolderWritesReport(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	file1 := filepath.Join(tempDir, "front.pdf")
+	file2 := filepath.Join(tempDir, "back.pdf")
+	_ = os.WriteFile(file1, []byte("front"), 0644)
+	_ = os.WriteFile(file2, []byte("back"), 0644)
+
+	assert.True(t, moveFilesToErrorFolder(withStage(STAGE_MERGE, errors.New("page count mismatch")), file1, file2))
+
+	report, err := loadErrorReport(filepath.Join(ERROR_DIR, "front.pdf"))
+	assert.NoError(t, err)
+	assert.NotNil(t, report)
+	assert.Equal(t, "front.pdf", report.File)
+	assert.Equal(t, STAGE_MERGE, report.Stage)
+	assert.Equal(t, "page count mismatch", report.Error)
+	assert.Equal(t, "back.pdf", report.Partner)
+	assert.False(t, report.Timestamp.IsZero())
+
+	report, _ = loadErrorReport(filepath.Join(ERROR_DIR, "back.pdf"))
+	assert.Equal(t, "front.pdf", report.Partner)
+}
+
+func TestMoveToErrorFolderRecordsValidationMessages(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	file := filepath.Join(tempDir, "broken.pdf")
+	_ = os.WriteFile(file, []byte("not a pdf"), 0644)
+
+	assert.NoError(t, moveToErrorFolder(file, "", withStage(STAGE_VALIDATION, errors.New("invalid PDF structure"))))
+
+	report, _ := loadErrorReport(filepath.Join(ERROR_DIR, "broken.pdf"))
+	assert.NotNil(t, report)
+	assert.Equal(t, STAGE_VALIDATION, report.Stage)
+	assert.NotEmpty(t, report.ValidationMessages)
+}
+
+func TestRetryErrorFilesRestoresOriginalName(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	file := filepath.Join(tempDir, "scan.pdf")
+	_ = os.WriteFile(file, []byte("first"), 0644)
+	_ = os.WriteFile(filepath.Join(ERROR_DIR, "scan.pdf"), []byte("older failure"), 0644)
+
+	// Conflict in the error folder gives the file a suffixed name
+	assert.NoError(t, moveToErrorFolder(file, "", errors.New("failed")))
+	suffixed := filepath.Join(ERROR_DIR, "scan_1.pdf")
+	assert.FileExists(t, suffixed)
+	assert.FileExists(t, getErrorReportPath(suffixed))
+
+	retried, err := retryErrorFiles([]string{"scan_1.pdf"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, retried)
+	assert.FileExists(t, file, "file should return under its original name")
+	assert.NoFileExists(t, suffixed)
+	assert.NoFileExists(t, getErrorReportPath(suffixed), "report should be removed on retry")
+	assert.FileExists(t, filepath.Join(ERROR_DIR, "scan.pdf"), "unselected files stay in the error folder")
+}
+
+func TestRetryAllErrorFiles(t *testing.T) {
+	useTestWorkspace(t)
+	for _, name := range []string{"a.pdf", "b.pdf"} {
+		_ = os.WriteFile(filepath.Join(ERROR_DIR, name), []byte(name), 0644)
+	}
+
+	retried, err := retryErrorFiles(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, retried)
+
+	files, _ := listErrorFiles()
+	assert.Len(t, files, 0)
+}
+
+func TestRetryMissingErrorFile(t *testing.T) {
+	useTestWorkspace(t)
+
+	retried, err := retryErrorFiles([]string{"missing.pdf"})
+	assert.Error(t, err)
+	assert.Equal(t, 0, retried)
+}
+
+func TestRetryErrorFileIgnoresPathsInReport(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	file := filepath.Join(ERROR_DIR, "scan.pdf")
+	_ = os.WriteFile(file, []byte("scan"), 0644)
+
+	assert.NoError(t, writeErrorReport(file, &ErrorReport{File: "../../escaped.pdf"}))
+	retried, err := retryErrorFiles(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, retried)
+	assert.FileExists(t, filepath.Join(tempDir, "escaped.pdf"))
+
+	_ = os.WriteFile(file, []byte("scan"), 0644)
+	assert.NoError(t, writeErrorReport(file, &ErrorReport{File: ".."}))
+	_, err = retryErrorFiles(nil)
+	assert.ErrorContains(t, err, "invalid file name")
+	assert.FileExists(t, file)
+
+	// Output copies only go back to configured destinations
+	assert.NoError(t, writeErrorReport(file, &ErrorReport{File: "scan.pdf", Destinations: []string{filepath.Join(tempDir, "elsewhere", "scan.pdf")}}))
+	_, err = retryErrorFiles(nil)
+	assert.ErrorContains(t, err, "not an output destination")
+	assert.NoFileExists(t, filepath.Join(tempDir, "elsewhere", "scan.pdf"))
+}
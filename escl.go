@@ -0,0 +1,453 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// eSCL scanner client
+//
+// Network scanners that support AirScan (eSCL) can be driven directly: the
+// front stack is scanned, the user flips it, the back stack is scanned and
+// the two documents go straight into the usual merge. Scans are requested as
+// PDF, or as JPEG pages converted here when the scanner offers no PDF.
+
+const (
+	DEFAULT_SCANNER_RESOLUTION = 300
+	ESCL_DEFAULT_PATH          = "/eSCL"
+	ESCL_TIMEOUT               = 60 * time.Second // Per request
+	ESCL_JOB_TIMEOUT           = 5 * time.Minute  // For all pages of one stack
+	ESCL_RETRY_INTERVAL        = time.Second      // Wait while the next page is not ready
+	ESCL_MAX_DOCUMENT_MB       = 200
+
+	SCAN_SOURCE_FEEDER = "Feeder"
+	SCAN_SOURCE_PLATEN = "Platen"
+)
+
+// Colour modes eSCL scanners accept
+var scannerColorModes = []string{"RGB24", "Grayscale8", "BlackAndWhite1"}
+
+// Network scanner settings
+type ScannerConfig struct {
+	URL        string `json:"url"`        // eSCL address, e.g. http://192.168.1.40/eSCL
+	Source     string `json:"source"`     // "Feeder" (default) or "Platen"
+	Resolution int    `json:"resolution"` // Dots per inch (default 300)
+	ColorMode  string `json:"colorMode"`  // "RGB24" (default), "Grayscale8" or "BlackAndWhite1"
+}
+
+// Validate network scanner settings
+func (s ScannerConfig) validate() error {
+	if s.URL == "" {
+		return nil
+	}
+	if _, err := s.root(); err != nil {
+		return err
+	}
+	if s.Source != "" && s.Source != SCAN_SOURCE_FEEDER && s.Source != SCAN_SOURCE_PLATEN {
+		return fmt.Errorf("invalid scanner source %q (use %s or %s)", s.Source, SCAN_SOURCE_FEEDER, SCAN_SOURCE_PLATEN)
+	}
+	if s.Resolution < 0 {
+		return fmt.Errorf("scanner resolution must not be negative")
+	}
+	if s.ColorMode != "" && !slices.Contains(scannerColorModes, s.ColorMode) {
+		return fmt.Errorf("invalid scanner colorMode %q (use %s)", s.ColorMode, strings.Join(scannerColorModes, ", "))
+	}
+	return nil
+}
+
+// Get the eSCL root URL, defaulting the path to /eSCL
+func (s ScannerConfig) root() (*url.URL, error) {
+	root, err := url.Parse(s.URL)
+	if err != nil || (root.Scheme != "http" && root.Scheme != "https") || root.Host == "" {
+		return nil, fmt.Errorf("invalid scanner url %q: use http://host/eSCL", s.URL)
+	}
+	root.Path = strings.TrimSuffix(root.Path, "/")
+	if root.Path == "" {
+		root.Path = ESCL_DEFAULT_PATH
+	}
+	return root, nil
+}
+
+// Check whether a network scanner is configured
+func scannerEnabled() bool {
+	return CONFIG != nil && CONFIG.Scanner.URL != ""
+}
+
+// Reported when the feeder has no paper in it
+var errFeederEmpty = errors.New("the document feeder is empty")
+
+// esclClient talks to one scanner
+type esclClient struct {
+	config ScannerConfig
+	root   *url.URL
+	client *http.Client
+}
+
+func newESCLClient(config ScannerConfig) (*esclClient, error) {
+	root, err := config.root()
+	if err != nil {
+		return nil, err
+	}
+	if config.Source == "" {
+		config.Source = SCAN_SOURCE_FEEDER
+	}
+	if config.Resolution == 0 {
+		config.Resolution = DEFAULT_SCANNER_RESOLUTION
+	}
+	if config.ColorMode == "" {
+		config.ColorMode = scannerColorModes[0]
+	}
+	return &esclClient{config: config, root: root, client: &http.Client{Timeout: ESCL_TIMEOUT}}, nil
+}
+
+// esclInputCaps lists what one input source can produce
+type esclInputCaps struct {
+	Formats    []string `xml:"SettingProfiles>SettingProfile>DocumentFormats>DocumentFormat"`
+	FormatsExt []string `xml:"SettingProfiles>SettingProfile>DocumentFormats>DocumentFormatExt"`
+}
+
+// esclCapabilities is the part of ScannerCapabilities used here
+type esclCapabilities struct {
+	MakeAndModel string         `xml:"MakeAndModel"`
+	Platen       *esclInputCaps `xml:"Platen>PlatenInputCaps"`
+	Feeder       *esclInputCaps `xml:"Adf>AdfSimplexInputCaps"`
+}
+
+// esclStatus is the part of ScannerStatus used here
+type esclStatus struct {
+	State    string `xml:"State"`
+	AdfState string `xml:"AdfState"`
+}
+
+// Resolve a path or URL against the eSCL root
+func (c *esclClient) resolve(path string) string {
+	if strings.Contains(path, "://") || strings.HasPrefix(path, "/") {
+		reference, err := url.Parse(path)
+		if err == nil {
+			return c.root.ResolveReference(reference).String()
+		}
+	}
+	return c.root.String() + "/" + path
+}
+
+// Send a request, returning the response for the caller to close
+func (c *esclClient) do(method, target string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "text/xml")
+	}
+	return c.client.Do(request)
+}
+
+// Fetch and decode an XML resource
+func (c *esclClient) getXML(path string, value any) error {
+	response, err := c.do(http.MethodGet, c.resolve(path), nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, response.Status)
+	}
+	return xml.NewDecoder(response.Body).Decode(value)
+}
+
+// Discover what the scanner can do
+func (c *esclClient) capabilities() (*esclCapabilities, error) {
+	var caps esclCapabilities
+	if err := c.getXML("ScannerCapabilities", &caps); err != nil {
+		return nil, fmt.Errorf("scanner not reachable at %s: %v", c.root, err)
+	}
+	return &caps, nil
+}
+
+// Choose the document format for the configured source
+func (c *esclClient) documentFormat(caps *esclCapabilities) (string, error) {
+	input := caps.Feeder
+	if c.config.Source == SCAN_SOURCE_PLATEN {
+		input = caps.Platen
+	}
+	if input == nil {
+		return "", fmt.Errorf("scanner has no %s", strings.ToLower(c.config.Source))
+	}
+	formats := slices.Concat(input.FormatsExt, input.Formats)
+	for _, format := range []string{"application/pdf", "image/jpeg"} {
+		if slices.Contains(formats, format) {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("scanner offers neither PDF nor JPEG output")
+}
+
+// Check the scanner is idle and, for the feeder, loaded
+func (c *esclClient) ready() error {
+	var status esclStatus
+	if err := c.getXML("ScannerStatus", &status); err != nil {
+		return err
+	}
+	if status.State != "" && status.State != "Idle" {
+		return fmt.Errorf("scanner is not ready (%s)", status.State)
+	}
+	if c.config.Source == SCAN_SOURCE_FEEDER && status.AdfState == "ScannerAdfEmpty" {
+		return errFeederEmpty
+	}
+	return nil
+}
+
+// Build the ScanSettings request body
+func (c *esclClient) scanSettings(format string) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScanSettings xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">
+  <pwg:Version>2.63</pwg:Version>
+  <scan:Intent>Document</scan:Intent>
+  <pwg:InputSource>%s</pwg:InputSource>
+  <scan:ColorMode>%s</scan:ColorMode>
+  <scan:XResolution>%d</scan:XResolution>
+  <scan:YResolution>%d</scan:YResolution>
+  <pwg:DocumentFormat>%s</pwg:DocumentFormat>
+  <scan:DocumentFormatExt>%s</scan:DocumentFormatExt>
+</scan:ScanSettings>
+`, c.config.Source, c.config.ColorMode, c.config.Resolution, c.config.Resolution, format, format))
+}
+
+// Scan one stack and return it as a single PDF
+func (c *esclClient) scan(format string) ([]byte, error) {
+	if err := c.ready(); err != nil {
+		return nil, err
+	}
+
+	response, err := c.do(http.MethodPost, c.resolve("ScanJobs"), c.scanSettings(format))
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("scanner refused the job: %s", response.Status)
+	}
+	location := response.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("scanner did not return a job location")
+	}
+	job := c.resolve(location)
+
+	documents, err := c.fetchDocuments(job)
+	if err != nil {
+		// Cancel the job so the scanner is free for the next attempt
+		if response, err := c.do(http.MethodDelete, job, nil); err == nil {
+			response.Body.Close()
+		}
+		return nil, err
+	}
+	return combineScannedDocuments(documents, format)
+}
+
+// Fetch every document of a job until the scanner reports there are no more
+func (c *esclClient) fetchDocuments(job string) ([][]byte, error) {
+	var documents [][]byte
+	deadline := time.Now().Add(ESCL_JOB_TIMEOUT)
+	for {
+		response, err := c.do(http.MethodGet, strings.TrimSuffix(job, "/")+"/NextDocument", nil)
+		if err != nil {
+			return nil, err
+		}
+		switch response.StatusCode {
+		case http.StatusOK:
+			// Read one byte past the limit so an oversized page fails instead of being cut short
+			limit := int64(ESCL_MAX_DOCUMENT_MB * 1024 * 1024)
+			data, err := io.ReadAll(io.LimitReader(response.Body, limit+1))
+			response.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read scanned page: %v", err)
+			}
+			if int64(len(data)) > limit {
+				return nil, fmt.Errorf("scanned page is larger than %d MB", ESCL_MAX_DOCUMENT_MB)
+			}
+			documents = append(documents, data)
+		case http.StatusNotFound:
+			response.Body.Close()
+			if len(documents) == 0 {
+				return nil, fmt.Errorf("scanner returned no pages")
+			}
+			return documents, nil
+		case http.StatusServiceUnavailable:
+			response.Body.Close()
+			if time.Now().After(deadline) {
+				return nil, fmt.Errorf("timed out waiting for the scanner")
+			}
+			time.Sleep(ESCL_RETRY_INTERVAL)
+		default:
+			response.Body.Close()
+			return nil, fmt.Errorf("scanner failed: %s", response.Status)
+		}
+	}
+}
+
+// Turn the documents of one job into a single PDF
+func combineScannedDocuments(documents [][]byte, format string) ([]byte, error) {
+	if format == "image/jpeg" {
+		for i, page := range documents {
+			converted, err := convertImageToPDF(bytes.NewReader(page))
+			if err != nil {
+				return nil, fmt.Errorf("failed to convert scanned page %d: %v", i+1, err)
+			}
+			documents[i] = converted
+		}
+	}
+	if len(documents) == 1 {
+		return documents[0], nil
+	}
+
+	readers := make([]io.ReadSeeker, len(documents))
+	for i, document := range documents {
+		readers[i] = bytes.NewReader(document)
+	}
+	var merged bytes.Buffer
+	if err := api.MergeRaw(readers, &merged, false, model.NewDefaultConfiguration()); err != nil {
+		return nil, fmt.Errorf("failed to combine scanned pages: %v", err)
+	}
+	return merged.Bytes(), nil
+}
+
+// Save a scanned stack in the watch folder
+// The FTP and SMTP receivers write there too, so an existing file is never replaced
+func saveScan(data []byte, stamp, side string) (string, error) {
+	dst, err := atomicWriteNew(filepath.Join(FOLDER, "scan-"+stamp+"-"+side+".pdf"), bytes.NewReader(data), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s scan: %v", side, err)
+	}
+	return dst, nil
+}
+
+// Scan the front stack, ask for it to be flipped, scan the back and merge the two
+// flip shows a prompt and returns false to cancel; returns the merged file name
+func scanAndMerge(flip func(prompt string) bool) (string, error) {
+	if !scannerEnabled() {
+		return "", fmt.Errorf("no scanner configured; set scanner.url in the config")
+	}
+	startTime := time.Now()
+	stamp := startTime.Format("20060102-150405")
+
+	client, err := newESCLClient(CONFIG.Scanner)
+	if err != nil {
+		return "", err
+	}
+	caps, err := client.capabilities()
+	if err != nil {
+		return "", err
+	}
+	format, err := client.documentFormat(caps)
+	if err != nil {
+		return "", err
+	}
+
+	printInfo(fmt.Sprintf("Scanning front pages on %s...", scannerName(caps, client)))
+	front, err := client.scan(format)
+	if err != nil {
+		return "", fmt.Errorf("front scan failed: %v", err)
+	}
+	logOperation("SCAN", "front", scannerName(caps, client), "COMPLETED")
+
+	// Keep the front pages if the back is never scanned
+	keepFront := func(reason error) error {
+		kept, err := saveScan(front, stamp, "front")
+		if err != nil {
+			return fmt.Errorf("%v; the front pages could not be kept: %v", reason, err)
+		}
+		return fmt.Errorf("%v; front pages kept as %s", reason, filepath.Base(kept))
+	}
+
+	prompt := "Flip the stack and press Enter to scan the back pages"
+	var back []byte
+	for {
+		if !flip(prompt) {
+			return "", keepFront(errors.New("scan cancelled"))
+		}
+		printInfo("Scanning back pages...")
+		back, err = client.scan(format)
+		if errors.Is(err, errFeederEmpty) {
+			prompt = "The feeder is empty. Load the flipped stack and press Enter"
+			continue
+		}
+		if err != nil {
+			return "", keepFront(fmt.Errorf("back scan failed: %v", err))
+		}
+		break
+	}
+	logOperation("SCAN", "back", scannerName(caps, client), "COMPLETED")
+
+	file1, err := saveScan(front, stamp, "front")
+	if err != nil {
+		return "", err
+	}
+	file2, err := saveScan(back, stamp, "back")
+	if err != nil {
+		return "", err
+	}
+
+	output, err := processMerge(file1, file2, startTime)
+	if err != nil {
+		handleMergeError(file1, file2, err, startTime)
+		return "", err
+	}
+	return output, nil
+}
+
+// Name the scanner for messages
+func scannerName(caps *esclCapabilities, client *esclClient) string {
+	if caps.MakeAndModel != "" {
+		return caps.MakeAndModel
+	}
+	return client.root.Host
+}
+
+// Ask on standard input whether to carry on, returns false to cancel
+func promptFlipOnStdin(prompt string) bool {
+	fmt.Printf("%s (C to cancel): ", prompt)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return err == nil && !strings.EqualFold(strings.TrimSpace(answer), "c")
+}
+
+// Scan and merge from the interactive menu
+func processScanOperation() {
+	output, err := scanAndMerge(promptFlipOnStdin)
+	if err != nil {
+		printWarning(err.Error())
+		return
+	}
+	printSuccess(fmt.Sprintf("Scanned and merged into %s", output))
+}
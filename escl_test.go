@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeESCL stands in for a network scanner's eSCL endpoints
+type fakeESCL struct {
+	mu       sync.Mutex
+	state    string     // Scanner state reported by ScannerStatus
+	formats  []string   // Document formats offered by the feeder
+	stacks   [][][]byte // Documents in the feeder, one stack per job
+	jobs     map[string][][]byte
+	notReady int      // NextDocument answers 503 this many times first
+	settings []string // ScanSettings received
+	deleted  []string // Jobs cancelled
+}
+
+func newFakeESCL(t *testing.T) (*fakeESCL, *httptest.Server) {
+	fake := &fakeESCL{state: "Idle", formats: []string{"application/pdf", "image/jpeg"}, jobs: map[string][][]byte{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /eSCL/ScannerCapabilities", fake.capabilities)
+	mux.HandleFunc("GET /eSCL/ScannerStatus", fake.status)
+	mux.HandleFunc("POST /eSCL/ScanJobs", fake.createJob)
+	mux.HandleFunc("GET /eSCL/ScanJobs/{id}/NextDocument", fake.nextDocument)
+	mux.HandleFunc("DELETE /eSCL/ScanJobs/{id}", fake.deleteJob)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+// load puts a stack of documents in the feeder
+func (f *fakeESCL) load(documents ...[]byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stacks = append(f.stacks, documents)
+}
+
+func (f *fakeESCL) capabilities(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var formats strings.Builder
+	for _, format := range f.formats {
+		fmt.Fprintf(&formats, "<pwg:DocumentFormat>%s</pwg:DocumentFormat><scan:DocumentFormatExt>%s</scan:DocumentFormatExt>", format, format)
+	}
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerCapabilities xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">
+  <pwg:Version>2.63</pwg:Version>
+  <pwg:MakeAndModel>Test MFP 100</pwg:MakeAndModel>
+  <scan:Adf><scan:AdfSimplexInputCaps><scan:SettingProfiles><scan:SettingProfile>
+    <scan:DocumentFormats>%s</scan:DocumentFormats>
+  </scan:SettingProfile></scan:SettingProfiles></scan:AdfSimplexInputCaps></scan:Adf>
+</scan:ScannerCapabilities>`, formats.String())
+}
+
+func (f *fakeESCL) status(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	adf := "ScannerAdfLoaded"
+	if len(f.stacks) == 0 {
+		adf = "ScannerAdfEmpty"
+	}
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScannerStatus xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">
+  <pwg:State>%s</pwg:State><scan:AdfState>%s</scan:AdfState>
+</scan:ScannerStatus>`, f.state, adf)
+}
+
+func (f *fakeESCL) createJob(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.settings = append(f.settings, string(body))
+	if len(f.stacks) == 0 {
+		http.Error(w, "feeder empty", http.StatusConflict)
+		return
+	}
+	id := fmt.Sprintf("job-%d", len(f.settings))
+	f.jobs[id], f.stacks = f.stacks[0], f.stacks[1:]
+	w.Header().Set("Location", "/eSCL/ScanJobs/"+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (f *fakeESCL) nextDocument(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.notReady > 0 {
+		f.notReady--
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	documents := f.jobs[r.PathValue("id")]
+	if len(documents) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	f.jobs[r.PathValue("id")] = documents[1:]
+	w.Write(documents[0])
+}
+
+func (f *fakeESCL) deleteJob(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, r.PathValue("id"))
+}
+
+// setupScanTest points the config at a fake scanner
+func setupScanTest(t *testing.T) (string, *fakeESCL) {
+	tempDir := useTestWorkspace(t)
+	fake, server := newFakeESCL(t)
+	CONFIG.Scanner = ScannerConfig{URL: server.URL}
+	assert.NoError(t, CONFIG.Scanner.validate())
+	return tempDir, fake
+}
+
+// buildTestJPEG encodes one scanned page
+func buildTestJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 30, 40)), nil))
+	return buf.Bytes()
+}
+
+func TestScanAndMergeInterleavesBothStacks(t *testing.T) {
+	tempDir, fake := setupScanTest(t)
+	fake.load(buildTextPDF("page 1", "page 3", "page 5"))
+	fake.notReady = 1
+
+	// The first flip forgets to load the back pages
+	var prompts []string
+	output, err := scanAndMerge(func(prompt string) bool {
+		prompts = append(prompts, prompt)
+		if len(prompts) == 2 {
+			fake.load(buildTextPDF("page 6", "page 4", "page 2"))
+		}
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Len(t, prompts, 2)
+	assert.Contains(t, prompts[1], "feeder is empty")
+	assert.Len(t, fake.settings, 2)
+	assert.Contains(t, fake.settings[0], "<pwg:InputSource>Feeder</pwg:InputSource>")
+	assert.Contains(t, fake.settings[0], "<scan:XResolution>300</scan:XResolution>")
+	assert.Contains(t, fake.settings[0], "<pwg:DocumentFormat>application/pdf</pwg:DocumentFormat>")
+
+	merged := filepath.Join(tempDir, "output", output)
+	text, err := extractPDFText(merged)
+	assert.NoError(t, err)
+	previous := -1
+	for i := 1; i <= 6; i++ {
+		position := strings.Index(text, fmt.Sprintf("page %d", i))
+		assert.Greater(t, position, previous, "page %d in order", i)
+		previous = position
+	}
+
+	// Both stacks went through the normal merge and left the watch folder
+	entry := latestHistoryEntry(HISTORY_DONE)
+	if assert.NotNil(t, entry) {
+		assert.Equal(t, "merge", entry.Operation.Type)
+		assert.Len(t, entry.Operation.OriginalFiles, 2)
+	}
+	files, _ := findPDFFiles()
+	assert.Empty(t, files)
+}
+
+func TestScanAndMergeReturnsRoutedName(t *testing.T) {
+	tempDir, fake := setupScanTest(t)
+	CONFIG.Routing = RoutingConfig{Default: []RouteDestination{{Folder: filepath.Join(tempDir, "output"), Name: "scanned-{name}"}}}
+	assert.NoError(t, CONFIG.Routing.validate())
+	fake.load(buildTextPDF("page 1"))
+
+	output, err := scanAndMerge(func(prompt string) bool {
+		fake.load(buildTextPDF("page 2"))
+		return true
+	})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(output, "scanned-scan-"), "got %s", output)
+	assert.FileExists(t, filepath.Join(tempDir, "output", output))
+}
+
+func TestScanAndMergeConvertsJPEGPages(t *testing.T) {
+	tempDir, fake := setupScanTest(t)
+	fake.formats = []string{"image/jpeg"}
+	fake.load(buildTestJPEG(t), buildTestJPEG(t))
+
+	output, err := scanAndMerge(func(prompt string) bool {
+		fake.load(buildTestJPEG(t), buildTestJPEG(t))
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, fake.settings[0], "<pwg:DocumentFormat>image/jpeg</pwg:DocumentFormat>")
+
+	pages, err := getPageCount(filepath.Join(tempDir, "output", output))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, pages)
+}
+
+func TestScanCancelledKeepsFrontPages(t *testing.T) {
+	tempDir, fake := setupScanTest(t)
+	fake.load(buildTextPDF("page 1", "page 3"))
+
+	_, err := scanAndMerge(func(prompt string) bool { return false })
+	assert.ErrorContains(t, err, "scan cancelled; front pages kept as scan-")
+
+	files, _ := findPDFFiles()
+	if assert.Len(t, files, 1) {
+		assert.True(t, strings.HasSuffix(files[0], "-front.pdf"))
+	}
+	entries, _ := os.ReadDir(filepath.Join(tempDir, "output"))
+	assert.Empty(t, entries)
+}
+
+func TestScanRefusedWhenScannerUnavailable(t *testing.T) {
+	_, fake := setupScanTest(t)
+	fake.state = "Processing"
+	fake.load(buildTextPDF("page 1"))
+	_, err := scanAndMerge(func(prompt string) bool { return true })
+	assert.ErrorContains(t, err, "not ready (Processing)")
+	assert.Empty(t, fake.settings)
+
+	// A scanner that sends nothing has its job cancelled
+	fake.state = "Idle"
+	fake.stacks = [][][]byte{{}}
+	_, err = scanAndMerge(func(prompt string) bool { return true })
+	assert.ErrorContains(t, err, "no pages")
+	assert.Equal(t, []string{"job-1"}, fake.deleted)
+
+	CONFIG.Scanner.URL = ""
+	_, err = scanAndMerge(func(prompt string) bool { return true })
+	assert.ErrorContains(t, err, "no scanner configured")
+}
+
+func TestScannerConfigValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.Scanner = ScannerConfig{URL: "http://192.168.1.40", Source: SCAN_SOURCE_PLATEN, Resolution: 600, ColorMode: "Grayscale8"}
+	assert.NoError(t, validateConfig(config))
+	root, _ := config.Scanner.root()
+	assert.Equal(t, "http://192.168.1.40/eSCL", root.String())
+
+	for _, scanner := range []ScannerConfig{
+		{URL: "ftp://192.168.1.40/eSCL"},
+		{URL: "http://192.168.1.40/eSCL", Source: "Duplex"},
+		{URL: "http://192.168.1.40/eSCL", Resolution: -1},
+		{URL: "http://192.168.1.40/eSCL", ColorMode: "CMYK"},
+	} {
+		config.Scanner = scanner
+		assert.Error(t, validateConfig(config))
+	}
+}
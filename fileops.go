@@ -15,7 +15,10 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -27,16 +30,31 @@ import (
 
 // Setup application directories
 func setupDirectories(folder string) error {
+	if err := initDirectories(folder); err != nil {
+		return err
+	}
+
+	displayDirectoryPaths()
+	return nil
+}
+
+// Set directory paths, create them and recover state from a previous run
+func initDirectories(folder string) error {
 	FOLDER = folder
 	ARCHIVE = filepath.Join(folder, "archive")
 	OUTPUT = filepath.Join(folder, "output")
 	ERROR_DIR = filepath.Join(folder, "error")
+	STATE_DIR = filepath.Join(folder, ".blendpdf")
 
 	if err := createRequiredDirectories(); err != nil {
 		return err
 	}
 
-	displayDirectoryPaths()
+	removePartialWrites()
+	loadHistory()
+	recoverIncompleteOperations() // Records the history of operations it completes
+	loadRetryQueue()
+	loadWebhookState()
 	return nil
 }
 
@@ -52,15 +70,34 @@ func createRequiredDirectories() error {
 		// Create multi-output folders at startup
 		dirs = append(dirs, CONFIG.OutputFolders...)
 	}
+	if routingEnabled() {
+		dirs = append(dirs, routeFolders()...)
+	}
 
 	for _, dir := range dirs {
-		if err := os.MkdirAll(dir, 0750); err != nil {
+		if isRemotePath(dir) {
+			continue
+		}
+		if err := STORAGE.mkdirAll(dir); err != nil {
 			return fmt.Errorf("failed to create directory %s: %v", dir, err)
 		}
 	}
 	return nil
 }
 
+// Remove temp files left by copies interrupted in a previous run
+func removePartialWrites() {
+	dirs := []string{FOLDER, ARCHIVE, OUTPUT, ERROR_DIR, getJournalDir(), getRepairDir()}
+	if CONFIG != nil {
+		dirs = append(dirs, CONFIG.OutputFolders...)
+		dirs = append(dirs, routeFolders()...)
+	}
+
+	if removed := cleanupPartialTempFiles(dirs...); removed > 0 {
+		printInfo(fmt.Sprintf("Removed %d partially written file(s) from a previous run", removed))
+	}
+}
+
 // Display directory paths
 func displayDirectoryPaths() {
 	fmt.Printf("Watching folder: %s%s%s\n", BLUE, FOLDER, NC)
@@ -72,8 +109,7 @@ func displayDirectoryPaths() {
 
 // Find PDF files in the main directory
 func findPDFFiles() ([]string, error) {
-	pattern := filepath.Join(FOLDER, "*.pdf")
-	files, err := filepath.Glob(pattern)
+	files, err := listPDFFiles(FOLDER)
 	if err != nil {
 		return nil, err
 	}
@@ -82,6 +118,25 @@ func findPDFFiles() ([]string, error) {
 	return files, nil
 }
 
+// List the *.pdf files in a directory
+func listPDFFiles(dir string) ([]string, error) {
+	entries, err := STORAGE.list(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // Matches filepath.Glob on a missing folder
+		}
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if matched, _ := filepath.Match("*.pdf", entry.Name()); matched {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
 // File counting and display functions
 
 // Get file counts for all directories
@@ -91,7 +146,7 @@ func getFileCounts() (int, int, int, int) {
 
 // Count PDF files in a specific directory
 func countPDFFiles(dir string) int {
-	files, err := filepath.Glob(filepath.Join(dir, "*.pdf"))
+	files, err := listPDFFiles(dir)
 	if err != nil {
 		return 0
 	}
@@ -152,7 +207,7 @@ func displayFiles(files []string, maxDisplay int) int {
 
 // Get human readable file size
 func getHumanReadableSize(filepath string) string {
-	info, err := os.Stat(filepath)
+	info, err := STORAGE.stat(filepath)
 	if err != nil {
 		return "unknown"
 	}
@@ -180,6 +235,26 @@ func formatFileSize(size int64) string {
 	}
 }
 
+// Calculate SHA-256 digest of a file as a hex string
+func calculateFileHash(path string) (string, error) {
+	file, err := STORAGE.open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	return hashReader(file)
+}
+
+// Calculate SHA-256 digest of a stream as a hex string
+func hashReader(reader io.Reader) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, reader); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
 // File movement and processing functions
 
 // Move processed files to destination directory with enhanced error handling
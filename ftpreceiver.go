@@ -0,0 +1,402 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Built-in FTP receiver
+//
+// Office MFPs that can only "scan to FTP" can upload straight into the watch
+// folder. The receiver speaks just enough FTP for that: one configured user,
+// passive mode only, and a root that is the watch folder itself. Uploads are
+// written under a hidden temp name and renamed into place once complete, so
+// the menu and auto-processing never see a partial file.
+
+const (
+	DEFAULT_FTP_LISTEN = ":2121"
+	FTP_DATA_TIMEOUT   = 30 * time.Second
+	FTP_IDLE_TIMEOUT   = 5 * time.Minute
+)
+
+// FTP receiver settings
+type FTPReceiverConfig struct {
+	Enabled      bool   `json:"enabled"`
+	Listen       string `json:"listen"` // Address to listen on (default ":2121")
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	PassivePorts string `json:"passivePorts"` // Port range for data connections, e.g. "50000-50100"
+	PublicHost   string `json:"publicHost"`   // Address sent in passive replies when behind NAT
+}
+
+// Validate FTP receiver settings
+func (f FTPReceiverConfig) validate() error {
+	if !f.Enabled {
+		return nil
+	}
+	if f.Username == "" || f.Password == "" {
+		return fmt.Errorf("ftp receiver needs a username and password")
+	}
+	if _, _, err := f.passivePortRange(); err != nil {
+		return err
+	}
+	if f.PublicHost != "" && net.ParseIP(f.PublicHost).To4() == nil {
+		return fmt.Errorf("ftp publicHost must be an IPv4 address: %s", f.PublicHost)
+	}
+	return nil
+}
+
+// Parse the passive port range, 0-0 meaning any free port
+func (f FTPReceiverConfig) passivePortRange() (int, int, error) {
+	if f.PassivePorts == "" {
+		return 0, 0, nil
+	}
+	low, high, ok := strings.Cut(f.PassivePorts, "-")
+	first, err1 := strconv.Atoi(strings.TrimSpace(low))
+	last, err2 := strconv.Atoi(strings.TrimSpace(high))
+	if !ok || err1 != nil || err2 != nil || first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid ftp passivePorts %q: use a range such as 50000-50100", f.PassivePorts)
+	}
+	return first, last, nil
+}
+
+// ftpReceiver accepts uploads into a folder
+type ftpReceiver struct {
+	*tcpReceiver
+	config FTPReceiverConfig
+	folder string
+}
+
+// The running receiver, stopped by cleanup
+var FTP_RECEIVER *ftpReceiver
+
+// Start listening for uploads into folder
+func startFTPReceiver(config FTPReceiverConfig, folder string) (*ftpReceiver, error) {
+	address := config.Listen
+	if address == "" {
+		address = DEFAULT_FTP_LISTEN
+	}
+
+	receiver := &ftpReceiver{config: config, folder: folder}
+	server, err := listenReceiver("FTP", address, func(conn net.Conn) {
+		newFTPSession(receiver, conn).run()
+	})
+	if err != nil {
+		return nil, err
+	}
+	receiver.tcpReceiver = server
+	return receiver, nil
+}
+
+// ftpSession is one control connection
+type ftpSession struct {
+	receiver *ftpReceiver
+	conn     net.Conn
+	text     *textproto.Conn
+	user     string
+	loggedIn bool
+	passive  net.Listener
+}
+
+func newFTPSession(receiver *ftpReceiver, conn net.Conn) *ftpSession {
+	return &ftpSession{receiver: receiver, conn: conn, text: textproto.NewConn(conn)}
+}
+
+func (s *ftpSession) reply(code int, message string) {
+	_ = s.text.PrintfLine("%d %s", code, message)
+}
+
+// Read and answer commands until QUIT or disconnect
+func (s *ftpSession) run() {
+	defer s.closePassive()
+	s.reply(220, "BlendPDF FTP receiver ready")
+
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(FTP_IDLE_TIMEOUT))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, argument, _ := strings.Cut(line, " ")
+		command = strings.ToUpper(command)
+
+		if !s.loggedIn && !ftpAllowedBeforeLogin[command] {
+			s.reply(530, "Please log in with USER and PASS")
+			continue
+		}
+		if !s.handle(command, argument) {
+			return
+		}
+	}
+}
+
+// Commands answered before logging in
+var ftpAllowedBeforeLogin = map[string]bool{"USER": true, "PASS": true, "QUIT": true, "FEAT": true, "SYST": true, "NOOP": true, "OPTS": true}
+
+// Answer one command, returns false to close the session
+func (s *ftpSession) handle(command, argument string) bool {
+	switch command {
+	case "USER":
+		s.user, s.loggedIn = argument, false
+		s.reply(331, "Password required")
+	case "PASS":
+		s.login(argument)
+	case "QUIT":
+		s.reply(221, "Goodbye")
+		return false
+	case "SYST":
+		s.reply(215, "UNIX Type: L8")
+	case "FEAT":
+		_ = s.text.PrintfLine("211-Features:\r\n PASV\r\n EPSV\r\n SIZE\r\n UTF8\r\n211 End")
+	case "OPTS":
+		s.reply(200, "OK")
+	case "NOOP":
+		s.reply(200, "OK")
+	case "PWD", "XPWD":
+		s.reply(257, `"/" is the current directory`)
+	case "CWD", "XCWD", "CDUP":
+		// Everything is stored in the watch folder; only its root can be entered
+		if command == "CDUP" || ftpCleanPath(argument) == "/" {
+			s.reply(250, "Directory changed")
+		} else {
+			s.reply(550, "No such directory")
+		}
+	case "TYPE", "MODE", "STRU":
+		s.reply(200, "OK")
+	case "PASV":
+		s.enterPassive(false)
+	case "EPSV":
+		s.enterPassive(true)
+	case "PORT", "EPRT":
+		s.reply(502, "Active mode is not supported; use passive mode")
+	case "STOR":
+		s.store(argument)
+	case "SIZE":
+		s.size(argument)
+	case "LIST", "NLST":
+		s.list(command == "NLST")
+	default:
+		s.reply(502, "Command not implemented")
+	}
+	return true
+}
+
+// Check the password for the user given with USER
+func (s *ftpSession) login(password string) {
+	config := s.receiver.config
+	if !credentialsMatch(s.user, password, config.Username, config.Password) {
+		time.Sleep(RECEIVER_LOGIN_FAIL_DELAY)
+		logOperation("FTP", s.user, s.conn.RemoteAddr().String(), "login refused")
+		s.reply(530, "Login incorrect")
+		return
+	}
+	s.loggedIn = true
+	s.reply(230, "Logged in")
+}
+
+// Open a passive data listener and tell the client where it is
+func (s *ftpSession) enterPassive(extended bool) {
+	s.closePassive()
+
+	local := s.conn.LocalAddr().(*net.TCPAddr)
+	listener, err := s.listenPassive(local.IP)
+	if err != nil {
+		s.reply(425, "Cannot open data connection")
+		return
+	}
+	s.passive = listener
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if extended {
+		s.reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+	ip := local.IP.To4()
+	if public := s.receiver.config.PublicHost; public != "" {
+		ip = net.ParseIP(public).To4()
+	}
+	if ip == nil {
+		s.closePassive()
+		s.reply(425, "Use EPSV for IPv6 connections")
+		return
+	}
+	s.reply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff))
+}
+
+// Listen on the control connection's address within the passive port range
+func (s *ftpSession) listenPassive(ip net.IP) (net.Listener, error) {
+	first, last, _ := s.receiver.config.passivePortRange()
+	for port := first; port <= last; port++ {
+		listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no free passive port")
+}
+
+func (s *ftpSession) closePassive() {
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+}
+
+// Accept the data connection for a transfer, only from the client's own address
+func (s *ftpSession) acceptData() (net.Conn, error) {
+	if s.passive == nil {
+		return nil, errors.New("no passive connection")
+	}
+	defer s.closePassive()
+
+	listener := s.passive.(*net.TCPListener)
+	_ = listener.SetDeadline(time.Now().Add(FTP_DATA_TIMEOUT))
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	client := s.conn.RemoteAddr().(*net.TCPAddr).IP
+	if !conn.RemoteAddr().(*net.TCPAddr).IP.Equal(client) {
+		conn.Close()
+		return nil, errors.New("data connection from another address")
+	}
+	_ = conn.SetDeadline(time.Now().Add(FTP_IDLE_TIMEOUT))
+	return conn, nil
+}
+
+// Clean a client path against the root
+func ftpCleanPath(name string) string {
+	return path.Clean("/" + strings.TrimSpace(name))
+}
+
+// Get the watch folder file name for an upload, or an error to send back
+func ftpUploadName(argument string) (string, error) {
+	clean := ftpCleanPath(argument)
+	if path.Dir(clean) != "/" {
+		return "", errors.New("uploads must go to the top folder")
+	}
+	name := path.Base(clean)
+	if name == "/" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `\:*?"<>|`) {
+		return "", errors.New("invalid file name")
+	}
+	if !strings.EqualFold(filepath.Ext(name), ".pdf") {
+		return "", errors.New("only PDF files are accepted")
+	}
+	return name, nil
+}
+
+// Receive a file into the watch folder
+func (s *ftpSession) store(argument string) {
+	name, err := ftpUploadName(argument)
+	if err != nil {
+		s.closePassive()
+		s.reply(553, err.Error())
+		return
+	}
+
+	data, err := s.acceptData()
+	if err != nil {
+		s.reply(425, "Cannot open data connection")
+		return
+	}
+	s.reply(150, "Ready to receive "+name)
+
+	// The upload is hidden under a temp name until it is complete, then
+	// placed without replacing a file another upload put there meanwhile
+	dst, err := atomicWriteNew(filepath.Join(s.receiver.folder, name), data, func(tempPath string, size int64) error {
+		if size == 0 {
+			return errors.New("empty upload")
+		}
+		return nil
+	})
+	data.Close()
+
+	if err != nil {
+		logOperation("FTP", name, s.conn.RemoteAddr().String(), fmt.Sprintf("upload failed: %v", err))
+		s.reply(451, "Upload failed")
+		return
+	}
+	logOperation("FTP", filepath.Base(dst), s.conn.RemoteAddr().String(), "received")
+	s.reply(226, "Transfer complete")
+}
+
+// Report the size of a file in the watch folder
+func (s *ftpSession) size(argument string) {
+	clean := ftpCleanPath(argument)
+	info, err := STORAGE.stat(filepath.Join(s.receiver.folder, path.Base(clean)))
+	if path.Dir(clean) != "/" || err != nil || info.IsDir() {
+		s.reply(550, "No such file")
+		return
+	}
+	s.reply(213, strconv.FormatInt(info.Size(), 10))
+}
+
+// List the PDFs in the watch folder; some scanners list before uploading
+func (s *ftpSession) list(namesOnly bool) {
+	data, err := s.acceptData()
+	if err != nil {
+		s.reply(425, "Cannot open data connection")
+		return
+	}
+	s.reply(150, "Listing")
+
+	files, _ := listPDFFiles(s.receiver.folder)
+	for _, file := range files {
+		name := filepath.Base(file)
+		if namesOnly {
+			fmt.Fprintf(data, "%s\r\n", name)
+			continue
+		}
+		var size int64
+		modified := time.Now()
+		if info, err := STORAGE.stat(file); err == nil {
+			size, modified = info.Size(), info.ModTime()
+		}
+		fmt.Fprintf(data, "-rw-r--r-- 1 ftp ftp %d %s %s\r\n", size, modified.Format("Jan _2 15:04"), name)
+	}
+	data.Close()
+	s.reply(226, "Listing complete")
+}
+
+// Start the FTP receiver if it is enabled
+func startFTPReceiverAtStartup() error {
+	if CONFIG == nil || !CONFIG.FTP.Enabled {
+		return nil
+	}
+	receiver, err := startFTPReceiver(CONFIG.FTP, FOLDER)
+	if err != nil {
+		return err
+	}
+	FTP_RECEIVER = receiver
+	printInfo(fmt.Sprintf("FTP receiver listening on %s", receiver.addr()))
+	return nil
+}
+
+// Stop the FTP receiver if it is running
+func stopFTPReceiver() {
+	if FTP_RECEIVER != nil {
+		FTP_RECEIVER.stop()
+		FTP_RECEIVER = nil
+	}
+}
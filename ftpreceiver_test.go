@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ftpTestClient drives the receiver over a plain control connection
+type ftpTestClient struct {
+	t    *testing.T
+	text *textproto.Conn
+}
+
+func dialFTP(t *testing.T, address string) *ftpTestClient {
+	text, err := textproto.Dial("tcp", address)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { text.Close() })
+	client := &ftpTestClient{t: t, text: text}
+	client.expect(220)
+	return client
+}
+
+// Send a command and return the reply message, checking its code
+func (c *ftpTestClient) cmd(code int, format string, args ...any) string {
+	assert.NoError(c.t, c.text.PrintfLine(format, args...))
+	return c.expect(code)
+}
+
+func (c *ftpTestClient) expect(code int) string {
+	_, message, err := c.text.ReadResponse(code)
+	assert.NoError(c.t, err)
+	return message
+}
+
+// Open a data connection with EPSV
+func (c *ftpTestClient) data(address string) net.Conn {
+	message := c.cmd(229, "EPSV")
+	port := strings.TrimSuffix(message[strings.Index(message, "|||")+3:], "|)")
+	host, _, _ := net.SplitHostPort(address)
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, port))
+	if !assert.NoError(c.t, err) {
+		c.t.FailNow()
+	}
+	return conn
+}
+
+// setupFTPTest starts a receiver on the test's watch folder
+func setupFTPTest(t *testing.T) (string, string) {
+	tempDir := useTestWorkspace(t)
+	config := FTPReceiverConfig{Enabled: true, Listen: "127.0.0.1:0", Username: "scanner", Password: "secret"}
+	assert.NoError(t, config.validate())
+
+	receiver, err := startFTPReceiver(config, tempDir)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(receiver.stop)
+	return tempDir, receiver.addr()
+}
+
+func TestFTPReceiverUploadsAppearWhenComplete(t *testing.T) {
+	tempDir, address := setupFTPTest(t)
+	client := dialFTP(t, address)
+	client.cmd(331, "USER scanner")
+	client.cmd(230, "PASS secret")
+	client.cmd(200, "TYPE I")
+	client.cmd(250, "CWD /")
+
+	data := client.data(address)
+	client.cmd(150, "STOR scan.pdf")
+	_, err := data.Write([]byte("%PDF-1.4 first half"))
+	assert.NoError(t, err)
+
+	// Nothing is visible until the transfer completes
+	files, _ := findPDFFiles()
+	assert.Empty(t, files)
+
+	_, _ = data.Write([]byte(" second half"))
+	data.Close()
+	client.expect(226)
+
+	content, err := os.ReadFile(filepath.Join(tempDir, "scan.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, "%PDF-1.4 first half second half", string(content))
+	assert.Equal(t, "31", client.cmd(213, "SIZE scan.pdf"))
+
+	// A second upload of the same name keeps both
+	data = client.data(address)
+	client.cmd(150, "STOR /scan.pdf")
+	fmt.Fprint(data, "%PDF-1.4 again")
+	data.Close()
+	client.expect(226)
+	assert.FileExists(t, filepath.Join(tempDir, "scan_1.pdf"))
+
+	data = client.data(address)
+	client.cmd(150, "NLST")
+	listing, _ := io.ReadAll(data)
+	data.Close()
+	client.expect(226)
+	assert.Equal(t, "scan.pdf\r\nscan_1.pdf\r\n", string(listing))
+
+	client.cmd(221, "QUIT")
+}
+
+func TestFTPReceiverRefusesBadRequests(t *testing.T) {
+	tempDir, address := setupFTPTest(t)
+	client := dialFTP(t, address)
+	client.cmd(530, "STOR scan.pdf")
+	client.cmd(331, "USER scanner")
+	client.cmd(530, "PASS wrong")
+	client.cmd(530, "PWD")
+
+	client.cmd(331, "USER scanner")
+	client.cmd(230, "PASS secret")
+	client.cmd(553, "STOR notes.txt")
+	client.cmd(553, "STOR sub/scan.pdf")
+	client.cmd(553, "STOR .hidden.pdf")
+	client.cmd(550, "CWD /elsewhere")
+	client.cmd(502, "PORT 127,0,0,1,4,1")
+
+	// Paths can't climb out of the watch folder
+	data := client.data(address)
+	client.cmd(150, "STOR ../../escape.pdf")
+	fmt.Fprint(data, "%PDF-1.4")
+	data.Close()
+	client.expect(226)
+	assert.FileExists(t, filepath.Join(tempDir, "escape.pdf"))
+	assert.NoFileExists(t, filepath.Join(filepath.Dir(filepath.Dir(tempDir)), "escape.pdf"))
+
+	// Empty uploads are discarded
+	data = client.data(address)
+	client.cmd(150, "STOR empty.pdf")
+	data.Close()
+	client.expect(451)
+	assert.NoFileExists(t, filepath.Join(tempDir, "empty.pdf"))
+}
+
+func TestFTPReceiverValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.FTP = FTPReceiverConfig{Enabled: true, Username: "scanner", Password: "secret", PassivePorts: "50000-50100"}
+	assert.NoError(t, validateConfig(config))
+
+	for _, ftp := range []FTPReceiverConfig{
+		{Enabled: true, Username: "scanner"},
+		{Enabled: true, Username: "scanner", Password: "secret", PassivePorts: "50100-50000"},
+		{Enabled: true, Username: "scanner", Password: "secret", PublicHost: "scanner.local"},
+	} {
+		config.FTP = ftp
+		assert.Error(t, validateConfig(config))
+	}
+}
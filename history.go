@@ -0,0 +1,652 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Persistent operation history with multi-level undo and redo
+//
+// Undo parks outputs in a per-entry stash under the state folder instead of
+// deleting them, so redo can put back exactly what was produced. Digests
+// recorded with each entry let undo and redo refuse to touch files that have
+// changed since.
+
+// History entry states
+const (
+	HISTORY_DONE   = "done"
+	HISTORY_UNDONE = "undone"
+
+	DEFAULT_HISTORY_LIMIT = 50
+)
+
+// HistoryEntry records a completed operation and its undo state
+type HistoryEntry struct {
+	ID            string            `json:"id"`
+	State         string            `json:"state"`
+	Operation     *LastOperation    `json:"operation"`
+	Digests       map[string]string `json:"digests"`                 // SHA-256 of files the entry may restore or remove
+	RestoredFiles []string          `json:"restoredFiles,omitempty"` // Where undo put the originals
+	StashFiles    []string          `json:"stashFiles,omitempty"`    // Where undo parked outputs (aligned with ActualFiles)
+	HookError     string            `json:"hookError,omitempty"`     // Hook failure that marked the operation failed
+}
+
+// Operation history, oldest first
+var HISTORY []*HistoryEntry
+
+// Get the history file path
+func getHistoryPath() string {
+	if STATE_DIR == "" {
+		return ""
+	}
+	return filepath.Join(STATE_DIR, "history.json")
+}
+
+// Get the stash directory for an entry's undone outputs
+func getStashDir(id string) string {
+	base := STATE_DIR
+	if base == "" {
+		base = filepath.Join(os.TempDir(), "blendpdf")
+	}
+	return filepath.Join(base, "history", id)
+}
+
+// Load history from disk, replacing any in-memory history
+func loadHistory() {
+	HISTORY = nil
+
+	path := getHistoryPath()
+	if path == "" {
+		return
+	}
+
+	data, err := readStorageFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &HISTORY)
+	}
+	if err != nil {
+		printWarning(fmt.Sprintf("Failed to load operation history: %v", err))
+		HISTORY = nil
+	}
+}
+
+// Save history to disk
+func saveHistory() error {
+	path := getHistoryPath()
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(HISTORY, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = atomicWrite(path, bytes.NewReader(data), nil)
+	return err
+}
+
+// Record a completed operation for undo
+func recordOperation(op *LastOperation) *HistoryEntry {
+	LAST_OPERATION = op
+
+	entry := &HistoryEntry{
+		ID:        fmt.Sprintf("%s-%s", op.Timestamp.Format("20060102-150405.000"), op.Type),
+		State:     HISTORY_DONE,
+		Operation: op,
+		Digests:   make(map[string]string),
+	}
+	for _, file := range append(append([]string{}, op.ActualFiles...), op.ArchiveFiles...) {
+		recordDigest(entry, file)
+	}
+
+	// A new operation discards anything that could have been redone
+	var kept []*HistoryEntry
+	for _, existing := range HISTORY {
+		if existing.State == HISTORY_UNDONE {
+			discardHistoryEntry(existing)
+			removeIndexedOperation(existing.ID)
+			continue
+		}
+		kept = append(kept, existing)
+	}
+	HISTORY = append(kept, entry)
+
+	limit := DEFAULT_HISTORY_LIMIT
+	if CONFIG != nil && CONFIG.HistoryLimit > 0 {
+		limit = CONFIG.HistoryLimit
+	}
+	for len(HISTORY) > limit {
+		discardHistoryEntry(HISTORY[0])
+		HISTORY = HISTORY[1:]
+	}
+
+	if err := saveHistory(); err != nil {
+		printWarning(fmt.Sprintf("Failed to save operation history: %v", err))
+	}
+	indexOperation(entry)
+	return entry
+}
+
+// Remove an entry's stash from disk
+func discardHistoryEntry(entry *HistoryEntry) {
+	if err := removeStorageTree(getStashDir(entry.ID)); err != nil && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to remove undo stash for %s: %v", entry.ID, err))
+	}
+}
+
+// Record the current digest of a file in an entry
+func recordDigest(entry *HistoryEntry, file string) {
+	if file == "" {
+		return
+	}
+	if isRemotePath(file) {
+		if digest, err := remoteDigest(file); err == nil {
+			entry.Digests[file] = digest
+		}
+		return
+	}
+	readable, _ := resolveArchivedFile(file)
+	if digest, err := calculateFileHash(readable); err == nil {
+		entry.Digests[file] = digest
+	}
+}
+
+// Find a history entry by ID
+func findHistoryEntry(id string) *HistoryEntry {
+	for _, entry := range HISTORY {
+		if entry.ID == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Find the newest entry in a given state
+func latestHistoryEntry(state string) *HistoryEntry {
+	for i := len(HISTORY) - 1; i >= 0; i-- {
+		if HISTORY[i].State == state {
+			return HISTORY[i]
+		}
+	}
+	return nil
+}
+
+// Describe an entry for listings
+func describeHistoryEntry(entry *HistoryEntry) string {
+	op := entry.Operation
+	inputs := describeInputs(op.OriginalFiles)
+
+	var outputs []string
+	for _, file := range op.ActualFiles {
+		if file != "" {
+			outputs = append(outputs, filepath.Base(file))
+		}
+	}
+	if len(op.Repaired) > 0 {
+		inputs += " (repaired)"
+	}
+	if entry.HookError != "" {
+		inputs += " (hook failed)"
+	}
+	if len(outputs) == 0 {
+		return inputs
+	}
+	if op.Route != "" {
+		return fmt.Sprintf("%s → %s (route %s)", inputs, outputs[0], op.Route)
+	}
+	return fmt.Sprintf("%s → %s", inputs, outputs[0])
+}
+
+// Check that a file still has the digest recorded in the entry
+func checkUnchanged(entry *HistoryEntry, file string) error {
+	expected, ok := entry.Digests[file]
+	if !ok {
+		return nil
+	}
+	if isRemotePath(file) {
+		actual, err := remoteDigest(file)
+		if err != nil {
+			return fmt.Errorf("cannot check %s: %v", file, err)
+		}
+		if actual != expected {
+			return fmt.Errorf("%s has changed since the operation", file)
+		}
+		return nil
+	}
+	readable, ok := resolveArchivedFile(file)
+	if !ok {
+		return fmt.Errorf("%s no longer exists", file)
+	}
+	actual, err := calculateFileHash(readable)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", file, err)
+	}
+	if actual != expected && isEncryptedFile(readable) {
+		// A shared archive object may have been encrypted in place since
+		if actual, err = plaintextDigest(file); err != nil {
+			return fmt.Errorf("cannot check %s: %v", file, err)
+		}
+	}
+	if actual != expected {
+		return fmt.Errorf("%s has changed since the operation", file)
+	}
+	return nil
+}
+
+// Undo
+
+// Undo a specific history entry
+func undoHistoryEntry(entry *HistoryEntry) error {
+	startTime := time.Now()
+	if entry.State != HISTORY_DONE {
+		return fmt.Errorf("operation %s has already been undone", entry.ID)
+	}
+
+	op := entry.Operation
+	if err := verifyUndoSources(entry); err != nil {
+		return fmt.Errorf("undo refused: %v", err)
+	}
+
+	var restored []string
+	var err error
+	switch op.Type {
+	case "single":
+		restored, err = restoreSingleOriginal(entry)
+	case "merge":
+		restored, err = restoreMergeOriginals(entry)
+	case "reprocess":
+		// The originals never left the archive; only the new outputs are removed
+	default:
+		return fmt.Errorf("unknown operation type for undo: %s", op.Type)
+	}
+	if err != nil {
+		return err
+	}
+
+	stashFiles, err := stashOutputs(entry)
+	if err != nil {
+		return err
+	}
+
+	cancelOutputRetries(entry.ID)
+	entry.State = HISTORY_UNDONE
+	entry.RestoredFiles = restored
+	entry.StashFiles = stashFiles
+	for _, file := range restored {
+		recordDigest(entry, file)
+	}
+
+	if LAST_OPERATION == op {
+		LAST_OPERATION = nil
+	}
+	markIndexedOperation(entry.ID, true)
+	if err := saveHistory(); err != nil {
+		return err
+	}
+	return notifyUndo(entry, startTime)
+}
+
+// Verify every file undo would restore or remove is unchanged
+func verifyUndoSources(entry *HistoryEntry) error {
+	op := entry.Operation
+	for i, file := range op.ActualFiles {
+		if file == "" || isPreexistingOutput(op, i) || !destinationExists(file) {
+			continue
+		}
+		if err := checkUnchanged(entry, file); err != nil {
+			return err
+		}
+	}
+
+	// Merges and repaired files restore their originals from the archive copies
+	if op.Type == "merge" || len(op.Repaired) > 0 {
+		for _, file := range op.ArchiveFiles {
+			if file == "" {
+				continue
+			}
+			if err := checkUnchanged(entry, file); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Copy the original of a single file operation back from its first output (or archive copy if repaired)
+func restoreSingleOriginal(entry *HistoryEntry) ([]string, error) {
+	op := entry.Operation
+
+	// Outputs of a repaired file hold the repaired bytes; prefer the untouched archive copy
+	sources := op.ActualFiles
+	if len(op.Repaired) > 0 {
+		sources = append(append([]string{}, op.ArchiveFiles...), op.ActualFiles...)
+	}
+
+	for _, file := range sources {
+		remote := isRemotePath(file)
+		if file == "" || remote && !destinationExists(file) || !remote && !archivedFileExists(file) {
+			continue
+		}
+
+		dst, err := resolveDestinationConflicts(op.OriginalFiles[0])
+		if err != nil {
+			return nil, err
+		}
+		if err := ensureDestinationDirectory(dst); err != nil {
+			return nil, err
+		}
+		if err := validateFilePaths(file, dst); err != nil {
+			return nil, err
+		}
+		copyBack := copyPlaintext
+		if remote {
+			copyBack = downloadRemote
+		}
+		if err := copyBack(file, dst); err != nil {
+			return nil, fmt.Errorf("failed to restore file: %v", err)
+		}
+
+		printSuccess(fmt.Sprintf("Restored %s to main directory", filepath.Base(dst)))
+		return []string{dst}, nil
+	}
+	return nil, fmt.Errorf("no output file found to restore from")
+}
+
+// Move merged originals back from the archive
+// Object store links shared with other operations are copied out and kept
+func restoreMergeOriginals(entry *HistoryEntry) ([]string, error) {
+	op := entry.Operation
+	restored := make([]string, len(op.ArchiveFiles))
+	for i, archiveFile := range op.ArchiveFiles {
+		if archiveFile == "" || i >= len(op.OriginalFiles) {
+			continue
+		}
+
+		dst, err := resolveDestinationConflicts(op.OriginalFiles[i])
+		if err != nil {
+			return restored, err
+		}
+		if err := restoreArchivedFile(archiveFile, dst, archiveFileShared(entry, archiveFile)); err != nil {
+			// A half-undone merge can't be redone, so put back what was already restored
+			unrestoreMergeOriginals(entry, restored)
+			return nil, fmt.Errorf("failed to restore %s: %v", filepath.Base(op.OriginalFiles[i]), err)
+		}
+		restored[i] = dst
+	}
+
+	printSuccess("Restored original files to main directory and removed merged outputs")
+	return restored, nil
+}
+
+// Return restored originals to the archive after a failed undo
+func unrestoreMergeOriginals(entry *HistoryEntry, restored []string) {
+	op := entry.Operation
+	for i, file := range restored {
+		if file == "" {
+			continue
+		}
+		var err error
+		if archivedFileExists(op.ArchiveFiles[i]) {
+			// A shared link was kept, so the restored file is only a copy
+			err = STORAGE.remove(file)
+		} else {
+			err = rearchiveFile(file, op.ArchiveFiles[i], op.ArchiveStore)
+		}
+		if err != nil {
+			printWarning(fmt.Sprintf("Failed to return %s to the archive: %v", filepath.Base(file), err))
+		}
+	}
+}
+
+// Park outputs in the entry's stash so they can be redone
+func stashOutputs(entry *HistoryEntry) ([]string, error) {
+	op := entry.Operation
+	stashDir := getStashDir(entry.ID)
+	stashFiles := make([]string, len(op.ActualFiles))
+
+	for i, file := range op.ActualFiles {
+		if file == "" || isPreexistingOutput(op, i) || !destinationExists(file) {
+			continue
+		}
+
+		stashFile := filepath.Join(stashDir, fmt.Sprintf("%d-%s", i, filepath.Base(file)))
+		if err := ensureDestinationDirectory(stashFile); err != nil {
+			return stashFiles, err
+		}
+		if err := performFileMove(file, stashFile); err != nil {
+			printWarning(fmt.Sprintf("Failed to remove %s: %v", file, err))
+			continue
+		}
+		stashFiles[i] = stashFile
+	}
+	return stashFiles, nil
+}
+
+// Redo
+
+// Redo a previously undone history entry
+func redoHistoryEntry(entry *HistoryEntry) error {
+	if entry.State != HISTORY_UNDONE {
+		return fmt.Errorf("operation %s has not been undone", entry.ID)
+	}
+
+	op := entry.Operation
+	if err := verifyRedoSources(entry); err != nil {
+		return fmt.Errorf("redo refused: %v", err)
+	}
+
+	// Put the outputs back where they were
+	for i, stashFile := range entry.StashFiles {
+		if stashFile == "" {
+			continue
+		}
+		if err := performFileMove(stashFile, op.ActualFiles[i]); err != nil {
+			return fmt.Errorf("failed to restore output %s: %v", op.ActualFiles[i], err)
+		}
+	}
+
+	// Take the originals out of the watch folder again
+	for i, restored := range entry.RestoredFiles {
+		if restored == "" {
+			continue
+		}
+		if op.Type == "merge" && i < len(op.ArchiveFiles) && op.ArchiveFiles[i] != "" {
+			if err := rearchiveFile(restored, op.ArchiveFiles[i], op.ArchiveStore); err != nil {
+				return fmt.Errorf("failed to archive %s: %v", filepath.Base(restored), err)
+			}
+			continue
+		}
+		if err := STORAGE.remove(restored); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", filepath.Base(restored), err)
+		}
+	}
+
+	for _, file := range entry.RestoredFiles {
+		delete(entry.Digests, file)
+	}
+	if op.Type == "merge" {
+		// Re-encrypted archive copies have new ciphertext
+		for _, file := range op.ArchiveFiles {
+			recordDigest(entry, file)
+		}
+	}
+	discardHistoryEntry(entry)
+	entry.State = HISTORY_DONE
+	entry.RestoredFiles = nil
+	entry.StashFiles = nil
+	LAST_OPERATION = op
+	markIndexedOperation(entry.ID, false)
+
+	printSuccess(fmt.Sprintf("Redid %s of %s", op.Type, describeInputs(op.OriginalFiles)))
+	return saveHistory()
+}
+
+// Verify restored originals are unchanged and output paths are free
+func verifyRedoSources(entry *HistoryEntry) error {
+	for _, file := range entry.RestoredFiles {
+		if file == "" {
+			continue
+		}
+		if err := checkUnchanged(entry, file); err != nil {
+			return err
+		}
+	}
+
+	op := entry.Operation
+	for i, stashFile := range entry.StashFiles {
+		if stashFile == "" {
+			continue
+		}
+		if !fileExists(stashFile) {
+			return fmt.Errorf("undone output %s is missing from the stash", filepath.Base(op.ActualFiles[i]))
+		}
+		if destinationExists(op.ActualFiles[i]) {
+			return fmt.Errorf("%s already exists", op.ActualFiles[i])
+		}
+	}
+
+	if op.Type == "merge" {
+		for i, archiveFile := range op.ArchiveFiles {
+			if archiveFile == "" || i >= len(entry.RestoredFiles) || entry.RestoredFiles[i] == "" {
+				continue
+			}
+			if !archiveSlotAvailable(archiveFile, entry.RestoredFiles[i]) {
+				return fmt.Errorf("%s already exists", archiveFile)
+			}
+		}
+	}
+	return nil
+}
+
+// Interactive entry points
+
+// Undo the most recent operation
+func undoLatestOperation() error {
+	entry := latestHistoryEntry(HISTORY_DONE)
+	if entry == nil {
+		return fmt.Errorf("no operation to undo")
+	}
+	return undoHistoryEntry(entry)
+}
+
+// Redo the most recently undone operation
+func redoLatestOperation() error {
+	entry := latestHistoryEntry(HISTORY_UNDONE)
+	if entry == nil {
+		return fmt.Errorf("no operation to redo")
+	}
+	return redoHistoryEntry(entry)
+}
+
+// Undo a specific operation by ID
+func undoOperationByID(id string) error {
+	entry := findHistoryEntry(id)
+	if entry == nil {
+		return fmt.Errorf("no operation with ID %s", id)
+	}
+	return undoHistoryEntry(entry)
+}
+
+// Redo a specific operation by ID
+func redoOperationByID(id string) error {
+	entry := findHistoryEntry(id)
+	if entry == nil {
+		return fmt.Errorf("no operation with ID %s", id)
+	}
+	return redoHistoryEntry(entry)
+}
+
+// Print operation history, newest first
+func displayHistory(limit int) {
+	if len(HISTORY) == 0 {
+		fmt.Println("No operations recorded")
+		return
+	}
+
+	fmt.Printf("%-28s %-7s %-6s %s\n", "ID", "STATE", "TYPE", "FILES")
+	shown := 0
+	for i := len(HISTORY) - 1; i >= 0 && (limit <= 0 || shown < limit); i-- {
+		entry := HISTORY[i]
+		state := entry.State
+		if state == HISTORY_UNDONE {
+			state = YELLOW + fmt.Sprintf("%-7s", state) + NC
+		} else {
+			state = fmt.Sprintf("%-7s", state)
+		}
+		fmt.Printf("%-28s %s %-6s %s\n", entry.ID, state, entry.Operation.Type, describeHistoryEntry(entry))
+		shown++
+	}
+}
+
+// Format an entry timestamp relative to now
+func formatHistoryTime(t time.Time) string {
+	if time.Since(t) < 24*time.Hour {
+		return t.Format("15:04:05")
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+// Collect every file the history still refers to (clean absolute paths)
+// Housekeeping such as archive pruning must leave these alone so undo and redo keep working
+func historyReferencedFiles() map[string]bool {
+	referenced := map[string]bool{}
+	add := func(files ...string) {
+		for _, file := range files {
+			if file == "" {
+				continue
+			}
+			if abs, err := filepath.Abs(file); err == nil {
+				referenced[abs] = true
+			}
+		}
+	}
+
+	for _, entry := range HISTORY {
+		op := entry.Operation
+		add(op.OriginalFiles...)
+		add(op.ActualFiles...)
+		add(op.ArchiveFiles...)
+		add(entry.RestoredFiles...)
+		add(entry.StashFiles...)
+		for file := range entry.Digests {
+			add(file)
+		}
+	}
+	return referenced
+}
+
+// Check whether another completed operation still relies on an archived file
+func archiveFileShared(entry *HistoryEntry, file string) bool {
+	for _, other := range HISTORY {
+		if other == entry || other.State != HISTORY_DONE {
+			continue
+		}
+		for _, archiveFile := range other.Operation.ArchiveFiles {
+			if archiveFile != "" && samePath(archiveFile, file) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordSingleTestOperation simulates a completed single file move
+func recordSingleTestOperation(t *testing.T, tempDir, name string, at time.Time) (string, []string) {
+	original := filepath.Join(tempDir, name)
+	outputs := []string{
+		filepath.Join(tempDir, "out1", name),
+		filepath.Join(tempDir, "out2", name),
+	}
+	for _, output := range outputs {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(output), 0755))
+		assert.NoError(t, os.WriteFile(output, []byte("content of "+name), 0644))
+	}
+
+	recordOperation(&LastOperation{
+		Type:          "single",
+		OriginalFiles: []string{original},
+		ActualFiles:   outputs,
+		Timestamp:     at,
+	})
+	return original, outputs
+}
+
+func TestHistoryUndoRedoSingle(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	original, outputs := recordSingleTestOperation(t, tempDir, "scan.pdf", time.Now())
+
+	assert.NoError(t, undoLatestOperation())
+	assert.FileExists(t, original)
+	for _, output := range outputs {
+		assert.NoFileExists(t, output)
+	}
+	assert.Equal(t, HISTORY_UNDONE, HISTORY[0].State)
+
+	assert.NoError(t, redoLatestOperation())
+	assert.NoFileExists(t, original)
+	for _, output := range outputs {
+		assert.FileExists(t, output)
+	}
+	assert.Equal(t, HISTORY_DONE, HISTORY[0].State)
+}
+
+func TestHistoryMultiLevelUndo(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	first, _ := recordSingleTestOperation(t, tempDir, "first.pdf", time.Now().Add(-time.Minute))
+	second, _ := recordSingleTestOperation(t, tempDir, "second.pdf", time.Now())
+
+	assert.NoError(t, undoLatestOperation())
+	assert.FileExists(t, second)
+	assert.NoError(t, undoLatestOperation())
+	assert.FileExists(t, first)
+	assert.Error(t, undoLatestOperation(), "nothing left to undo")
+}
+
+func TestHistoryUndoRefusedWhenChanged(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	original, outputs := recordSingleTestOperation(t, tempDir, "scan.pdf", time.Now())
+
+	assert.NoError(t, os.WriteFile(outputs[0], []byte("edited"), 0644))
+
+	err := undoLatestOperation()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "changed")
+	assert.NoFileExists(t, original)
+	assert.Equal(t, HISTORY_DONE, HISTORY[0].State)
+}
+
+func TestHistoryUndoSpecificEntry(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	first, _ := recordSingleTestOperation(t, tempDir, "first.pdf", time.Now().Add(-time.Minute))
+	second, _ := recordSingleTestOperation(t, tempDir, "second.pdf", time.Now())
+
+	assert.NoError(t, undoOperationByID(HISTORY[0].ID))
+	assert.FileExists(t, first)
+	assert.NoFileExists(t, second)
+	assert.Equal(t, HISTORY_DONE, HISTORY[1].State)
+}
+
+func TestHistoryPersistsAcrossLoads(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	recordSingleTestOperation(t, tempDir, "scan.pdf", time.Now())
+
+	HISTORY = nil
+	loadHistory()
+	assert.Len(t, HISTORY, 1)
+	assert.Equal(t, "single", HISTORY[0].Operation.Type)
+}
+
+func TestHistoryLimit(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.HistoryLimit = 2
+
+	base := time.Now()
+	for i, name := range []string{"a.pdf", "b.pdf", "c.pdf"} {
+		recordSingleTestOperation(t, tempDir, name, base.Add(time.Duration(i)*time.Second))
+	}
+	assert.Len(t, HISTORY, 2)
+	assert.Equal(t, "b.pdf", filepath.Base(HISTORY[0].Operation.OriginalFiles[0]))
+}
+
+func TestNewOperationDiscardsRedo(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	recordSingleTestOperation(t, tempDir, "first.pdf", time.Now().Add(-time.Minute))
+	assert.NoError(t, undoLatestOperation())
+
+	recordSingleTestOperation(t, tempDir, "second.pdf", time.Now())
+	assert.Len(t, HISTORY, 1)
+	assert.Error(t, redoLatestOperation())
+}
+
+func TestMergeUndoAbortsWhenOriginalCannotBeRestored(t *testing.T) {
+	tempDir := setupEncryptionTest(t)
+	outputs := []string{filepath.Join(tempDir, "output", "merged.pdf")}
+	assert.NoError(t, os.MkdirAll(filepath.Dir(outputs[0]), 0755))
+	assert.NoError(t, os.WriteFile(outputs[0], []byte("merged"), 0644))
+
+	// The first original was archived before encryption was turned on
+	plain := filepath.Join(ARCHIVE, "front.pdf")
+	assert.NoError(t, os.MkdirAll(ARCHIVE, 0755))
+	assert.NoError(t, os.WriteFile(plain, []byte("front"), 0644))
+	back := filepath.Join(tempDir, "back.pdf")
+	assert.NoError(t, os.WriteFile(back, []byte("back"), 0644))
+	encrypted := filepath.Join(ARCHIVE, "back.pdf"+ENCRYPTED_SUFFIX)
+	assert.NoError(t, encryptFile(back, encrypted))
+	assert.NoError(t, os.Remove(back))
+
+	front := filepath.Join(tempDir, "front.pdf")
+	recordOperation(&LastOperation{
+		Type:          "merge",
+		OriginalFiles: []string{front, back},
+		ArchiveFiles:  []string{plain, encrypted},
+		ActualFiles:   outputs,
+		Timestamp:     time.Now(),
+	})
+
+	// Without the private key the second original can't be restored
+	CONFIG.ArchiveEncryption.IdentityFile = filepath.Join(tempDir, "missing.txt")
+	assert.Error(t, undoLatestOperation())
+
+	assert.Equal(t, HISTORY_DONE, HISTORY[0].State)
+	assert.NoFileExists(t, front)
+	assert.NoFileExists(t, back)
+	assert.FileExists(t, plain)
+	assert.FileExists(t, encrypted)
+	assert.FileExists(t, outputs[0])
+}
+
+func TestRepairedUndoAbortsWhenArchiveCopyChanged(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	original := filepath.Join(tempDir, "scan.pdf")
+	output := filepath.Join(tempDir, "output", "scan.pdf")
+	archived := filepath.Join(tempDir, "archive", "scan.pdf")
+	for _, file := range []string{output, archived} {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+	}
+	assert.NoError(t, os.WriteFile(output, []byte("repaired scan"), 0644))
+	assert.NoError(t, os.WriteFile(archived, []byte("broken scan"), 0644))
+
+	recordOperation(&LastOperation{
+		Type:          "single",
+		OriginalFiles: []string{original},
+		ActualFiles:   []string{output},
+		ArchiveFiles:  []string{archived},
+		Repaired:      []string{"scan.pdf"},
+		Timestamp:     time.Now(),
+	})
+
+	// Undo restores a repaired file from its archive copy, so that copy is checked too
+	assert.NoError(t, os.WriteFile(archived, []byte("something else"), 0644))
+	assert.ErrorContains(t, undoLatestOperation(), "has changed since the operation")
+	assert.Equal(t, HISTORY_DONE, HISTORY[0].State)
+	assert.NoFileExists(t, original)
+	assert.FileExists(t, output)
+}
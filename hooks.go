@@ -0,0 +1,329 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Operation hooks
+//
+// A hook is a shell command run after an operation succeeds, fails or is
+// undone, so scans can be handed on to OCR, a document management system or
+// a notification. The command gets the operation as JSON on stdin and as
+// BLENDPDF_* environment variables. A successful operation whose hook fails
+// can be reported as failed; its outputs stay where they are.
+
+// Operation events
+const (
+	EVENT_SUCCESS = "success"
+	EVENT_ERROR   = "error"
+	EVENT_UNDO    = "undo"
+
+	DEFAULT_HOOK_TIMEOUT_SECONDS = 60
+	HOOK_OUTPUT_LIMIT            = 4096 // Bytes of hook output kept for the log
+	HOOK_WAIT_DELAY              = time.Second
+)
+
+// Hook settings
+type HooksConfig struct {
+	OnSuccess      string `json:"onSuccess"`      // Command run after an operation completes
+	OnError        string `json:"onError"`        // Command run after an operation fails
+	OnUndo         string `json:"onUndo"`         // Command run after an operation is undone
+	TimeoutSeconds int    `json:"timeoutSeconds"` // How long a hook may run (default 60)
+	FailOperation  bool   `json:"failOperation"`  // Report the operation as failed when onSuccess or onUndo fails
+}
+
+// Validate hook settings
+func (h HooksConfig) validate() error {
+	if h.TimeoutSeconds < 0 {
+		return fmt.Errorf("hooks timeoutSeconds must not be negative")
+	}
+	return nil
+}
+
+// Get the command configured for an event
+func (h HooksConfig) command(event string) string {
+	switch event {
+	case EVENT_SUCCESS:
+		return h.OnSuccess
+	case EVENT_ERROR:
+		return h.OnError
+	case EVENT_UNDO:
+		return h.OnUndo
+	}
+	return ""
+}
+
+// Get how long a hook may run
+func (h HooksConfig) timeout() time.Duration {
+	if h.TimeoutSeconds > 0 {
+		return time.Duration(h.TimeoutSeconds) * time.Second
+	}
+	return DEFAULT_HOOK_TIMEOUT_SECONDS * time.Second
+}
+
+// OperationEvent describes an operation to hooks and webhooks
+type OperationEvent struct {
+	Event      string      `json:"event"`        // "success", "error" or "undo"
+	ID         string      `json:"id,omitempty"` // History entry ID
+	Type       string      `json:"type"`         // "single", "merge" or "reprocess"
+	Inputs     []EventFile `json:"inputs"`
+	Outputs    []EventFile `json:"outputs"`
+	Route      string      `json:"route,omitempty"`
+	DurationMs int64       `json:"durationMs"`
+	Error      string      `json:"error,omitempty"`
+	Timestamp  time.Time   `json:"timestamp"`
+}
+
+// EventFile is one input or output of an operation
+type EventFile struct {
+	Path  string `json:"path"`
+	Pages int    `json:"pages,omitempty"` // 0 when the file could not be read
+}
+
+// hookError reports a hook that failed an otherwise completed operation
+type hookError struct {
+	event string
+	err   error
+}
+
+func (e *hookError) Error() string {
+	return fmt.Sprintf("%s hook failed: %v", hookName(e.event), e.err)
+}
+
+func (e *hookError) Unwrap() error { return e.err }
+
+// Check whether an error is a failed hook rather than a failed operation
+func isHookError(err error) bool {
+	var he *hookError
+	return errors.As(err, &he)
+}
+
+// Get the config name of an event's hook
+func hookName(event string) string {
+	return "on" + strings.ToUpper(event[:1]) + event[1:]
+}
+
+// Check whether anything listens for an event
+// Page counts are only worth reading when something will receive them
+func eventWanted(event string) bool {
+	return CONFIG != nil && (CONFIG.Hooks.command(event) != "" || webhookWanted(event))
+}
+
+// Describe files for an event, reading page counts from readable copies where given
+func eventFiles(paths []string, readable ...string) []EventFile {
+	files := []EventFile{}
+	for i, path := range paths {
+		if path == "" {
+			continue
+		}
+		source := path
+		if i < len(readable) && readable[i] != "" {
+			source = readable[i]
+		}
+		file := EventFile{Path: path}
+		if !isRemotePath(source) {
+			if pages, err := getPageCount(source); err == nil {
+				file.Pages = pages
+			}
+		}
+		files = append(files, file)
+	}
+	return files
+}
+
+// Build the event for a history entry
+func newOperationEvent(event string, entry *HistoryEntry, inputs []EventFile, startTime time.Time) *OperationEvent {
+	op := entry.Operation
+	return &OperationEvent{
+		Event:      event,
+		ID:         entry.ID,
+		Type:       op.Type,
+		Inputs:     inputs,
+		Outputs:    eventFiles(op.ActualFiles),
+		Route:      op.Route,
+		DurationMs: time.Since(startTime).Milliseconds(),
+		Timestamp:  time.Now(),
+	}
+}
+
+// Notify hooks and webhooks of a completed operation
+// Returns a hookError when the hook fails and failOperation is set
+func notifySuccess(entry *HistoryEntry, inputs []EventFile, startTime time.Time) error {
+	if !eventWanted(EVENT_SUCCESS) {
+		return nil
+	}
+	event := newOperationEvent(EVENT_SUCCESS, entry, inputs, startTime)
+	return dispatchOperationEvent(entry, event)
+}
+
+// Notify hooks and webhooks of an undone operation
+func notifyUndo(entry *HistoryEntry, startTime time.Time) error {
+	if !eventWanted(EVENT_UNDO) {
+		return nil
+	}
+	op := entry.Operation
+	event := newOperationEvent(EVENT_UNDO, entry, eventFiles(entry.RestoredFiles), startTime)
+	event.Outputs = eventFiles(op.ActualFiles, entry.StashFiles...)
+	return dispatchOperationEvent(entry, event)
+}
+
+// Notify hooks and webhooks of a failed operation on files still in the watch folder
+func notifyFailure(opType string, cause error, startTime time.Time, files ...string) {
+	if !eventWanted(EVENT_ERROR) {
+		return
+	}
+	event := &OperationEvent{
+		Event:      EVENT_ERROR,
+		Type:       opType,
+		Inputs:     eventFiles(files),
+		Outputs:    []EventFile{},
+		DurationMs: time.Since(startTime).Milliseconds(),
+		Error:      cause.Error(),
+		Timestamp:  time.Now(),
+	}
+	_ = runEventHook(event)
+	sendWebhooks(event)
+}
+
+// Pass an operation's event to its hook and webhooks
+// A failed hook marks the entry failed when it is allowed to, and webhooks then hear of the failure instead
+func dispatchOperationEvent(entry *HistoryEntry, event *OperationEvent) error {
+	err := runEventHook(event)
+	if err == nil {
+		sendWebhooks(event)
+		return nil
+	}
+	if !CONFIG.Hooks.FailOperation {
+		printWarning(fmt.Sprintf("%s hook failed: %v", hookName(event.Event), err))
+		sendWebhooks(event)
+		return nil
+	}
+
+	failed := &hookError{event: event.Event, err: err}
+	entry.HookError = failed.Error()
+	if err := saveHistory(); err != nil {
+		printWarning(fmt.Sprintf("Failed to save operation history: %v", err))
+	}
+
+	// The operation now counts as failed, so the error hook hears about it too
+	errorEvent := *event
+	errorEvent.Event = EVENT_ERROR
+	errorEvent.Error = failed.Error()
+	_ = runEventHook(&errorEvent)
+	sendWebhooks(&errorEvent)
+	return failed
+}
+
+// Run the hook for an event, if one is configured, and log what it printed
+func runEventHook(event *OperationEvent) error {
+	command := CONFIG.Hooks.command(event.Event)
+	if command == "" {
+		return nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CONFIG.Hooks.timeout())
+	defer cancel()
+
+	cmd := hookCommand(ctx, command)
+	cmd.Dir = FOLDER
+	cmd.Env = append(os.Environ(), hookEnvironment(event)...)
+	cmd.Stdin = bytes.NewReader(payload)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.WaitDelay = HOOK_WAIT_DELAY // Don't wait on children still holding the output open
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", CONFIG.Hooks.timeout())
+	}
+
+	name := hookName(event.Event)
+	if text := hookOutput(output.Bytes()); text != "" {
+		logOperation("HOOK_OUTPUT", name, "", text)
+	}
+	if err != nil {
+		logOperation("HOOK", name, event.ID, "FAILED: "+err.Error())
+		return err
+	}
+	logOperation("HOOK", name, event.ID, "COMPLETED")
+	return nil
+}
+
+// Build the shell command that runs a hook
+func hookCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command) // #nosec G204 - command comes from the user's config
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command) // #nosec G204 - command comes from the user's config
+}
+
+// Describe an event as environment variables
+// Lists are separated like PATH so file names with spaces survive
+func hookEnvironment(event *OperationEvent) []string {
+	paths := func(files []EventFile) string {
+		var list []string
+		for _, file := range files {
+			list = append(list, file.Path)
+		}
+		return strings.Join(list, string(filepath.ListSeparator))
+	}
+	pages := func(files []EventFile) string {
+		var list []string
+		for _, file := range files {
+			list = append(list, strconv.Itoa(file.Pages))
+		}
+		return strings.Join(list, ",")
+	}
+
+	return []string{
+		"BLENDPDF_EVENT=" + event.Event,
+		"BLENDPDF_OPERATION_ID=" + event.ID,
+		"BLENDPDF_TYPE=" + event.Type,
+		"BLENDPDF_INPUTS=" + paths(event.Inputs),
+		"BLENDPDF_INPUT_PAGES=" + pages(event.Inputs),
+		"BLENDPDF_OUTPUTS=" + paths(event.Outputs),
+		"BLENDPDF_OUTPUT_PAGES=" + pages(event.Outputs),
+		"BLENDPDF_ROUTE=" + event.Route,
+		"BLENDPDF_DURATION_MS=" + strconv.FormatInt(event.DurationMs, 10),
+		"BLENDPDF_ERROR=" + event.Error,
+		"BLENDPDF_WATCH_FOLDER=" + FOLDER,
+	}
+}
+
+// Flatten captured hook output onto one log line, keeping the end if it is long
+func hookOutput(output []byte) string {
+	if len(output) > HOOK_OUTPUT_LIMIT {
+		output = output[len(output)-HOOK_OUTPUT_LIMIT:]
+	}
+	return strings.Join(strings.Fields(string(output)), " ")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupHooksTest prepares a watch folder with a front and back scan
+func setupHooksTest(t *testing.T) (string, string, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hook scripts use sh")
+	}
+	tempDir := useTestWorkspace(t)
+	front := filepath.Join(tempDir, "front.pdf")
+	back := filepath.Join(tempDir, "back.pdf")
+	assert.NoError(t, os.WriteFile(front, buildTextPDF("page 1", "page 3"), 0644))
+	assert.NoError(t, os.WriteFile(back, buildTextPDF("page 4", "page 2"), 0644))
+	return tempDir, front, back
+}
+
+// recordingHook writes the event it receives and its environment to files named after the event
+func recordingHook(dir string) string {
+	return `cat > "` + dir + `/$BLENDPDF_EVENT.json"; env | grep ^BLENDPDF_ > "` + dir + `/$BLENDPDF_EVENT.env"`
+}
+
+// readHookEvent reads an event written by recordingHook
+func readHookEvent(t *testing.T, dir, event string) (*OperationEvent, string) {
+	data, err := os.ReadFile(filepath.Join(dir, event+".json"))
+	if !assert.NoError(t, err, "%s hook did not run", event) {
+		t.FailNow()
+	}
+	var received OperationEvent
+	assert.NoError(t, json.Unmarshal(data, &received))
+	env, _ := os.ReadFile(filepath.Join(dir, event+".env"))
+	return &received, string(env)
+}
+
+func TestSuccessHookReceivesOperation(t *testing.T) {
+	tempDir, front, back := setupHooksTest(t)
+	hookDir := t.TempDir()
+	CONFIG.Hooks = HooksConfig{OnSuccess: recordingHook(hookDir)}
+
+	assert.NoError(t, validateAndProcessMerge(front, back, time.Now()))
+
+	event, env := readHookEvent(t, hookDir, EVENT_SUCCESS)
+	entry := latestHistoryEntry(HISTORY_DONE)
+	assert.Equal(t, entry.ID, event.ID)
+	assert.Equal(t, "merge", event.Type)
+	assert.Equal(t, []EventFile{{Path: front, Pages: 2}, {Path: back, Pages: 2}}, event.Inputs)
+	assert.Equal(t, []EventFile{{Path: filepath.Join(tempDir, "output", "front-back.pdf"), Pages: 4}}, event.Outputs)
+	assert.GreaterOrEqual(t, event.DurationMs, int64(0))
+
+	assert.Contains(t, env, "BLENDPDF_EVENT=success\n")
+	assert.Contains(t, env, "BLENDPDF_TYPE=merge\n")
+	assert.Contains(t, env, "BLENDPDF_INPUT_PAGES=2,2\n")
+	assert.Contains(t, env, "BLENDPDF_OUTPUT_PAGES=4\n")
+	assert.Contains(t, env, "BLENDPDF_INPUTS="+front+string(filepath.ListSeparator)+back+"\n")
+	assert.Empty(t, entry.HookError)
+}
+
+func TestFailingHookMarksOperationFailed(t *testing.T) {
+	_, front, back := setupHooksTest(t)
+	hookDir := t.TempDir()
+	hooks := HooksConfig{OnSuccess: "echo importing; exit 3", OnError: recordingHook(hookDir)}
+	CONFIG.Hooks = hooks
+
+	// Without failOperation the failure is only a warning
+	assert.NoError(t, validateAndProcessMerge(front, back, time.Now()))
+	assert.Empty(t, latestHistoryEntry(HISTORY_DONE).HookError)
+	assert.NoFileExists(t, filepath.Join(hookDir, "error.json"))
+
+	tempDir, front, back := setupHooksTest(t)
+	hooks.FailOperation = true
+	CONFIG.Hooks = hooks
+	err := validateAndProcessMerge(front, back, time.Now())
+	assert.True(t, isHookError(err))
+	assert.ErrorContains(t, err, "onSuccess hook failed: exit status 3")
+
+	// The operation stays in place and can be undone, but is recorded as failed
+	entry := latestHistoryEntry(HISTORY_DONE)
+	assert.Equal(t, err.Error(), entry.HookError)
+	assert.Contains(t, describeHistoryEntry(entry), "(hook failed)")
+	assert.FileExists(t, filepath.Join(tempDir, "output", "front-back.pdf"))
+
+	event, _ := readHookEvent(t, hookDir, EVENT_ERROR)
+	assert.Equal(t, entry.ID, event.ID)
+	assert.Equal(t, err.Error(), event.Error)
+	assert.Len(t, event.Outputs, 1)
+}
+
+func TestHookTimesOut(t *testing.T) {
+	_, front, back := setupHooksTest(t)
+	CONFIG.Hooks = HooksConfig{OnSuccess: "sleep 10", TimeoutSeconds: 1, FailOperation: true}
+
+	start := time.Now()
+	err := validateAndProcessMerge(front, back, start)
+	assert.ErrorContains(t, err, "timed out after 1s")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestErrorHookReceivesFailure(t *testing.T) {
+	tempDir, front, back := setupHooksTest(t)
+	hookDir := t.TempDir()
+	CONFIG.Hooks = HooksConfig{OnError: recordingHook(hookDir)}
+	assert.NoError(t, os.WriteFile(back, []byte("not a pdf"), 0644))
+
+	start := time.Now()
+	err := validateAndProcessMerge(front, back, start)
+	assert.Error(t, err)
+	handleMergeError(front, back, err, start)
+
+	event, env := readHookEvent(t, hookDir, EVENT_ERROR)
+	assert.Equal(t, "merge", event.Type)
+	assert.Empty(t, event.ID)
+	assert.Contains(t, event.Error, "second PDF 'back.pdf' is invalid")
+	assert.Equal(t, []EventFile{{Path: front, Pages: 2}, {Path: back}}, event.Inputs)
+	assert.Contains(t, env, "BLENDPDF_INPUT_PAGES=2,0\n")
+	assert.FileExists(t, filepath.Join(tempDir, "error", "back.pdf"))
+}
+
+func TestUndoHookReceivesRestoredFiles(t *testing.T) {
+	_, front, back := setupHooksTest(t)
+	hookDir := t.TempDir()
+	assert.NoError(t, validateAndProcessMerge(front, back, time.Now()))
+
+	CONFIG.Hooks = HooksConfig{OnUndo: recordingHook(hookDir)}
+	assert.NoError(t, undoLatestOperation())
+
+	event, _ := readHookEvent(t, hookDir, EVENT_UNDO)
+	assert.Equal(t, "merge", event.Type)
+	assert.Equal(t, []EventFile{{Path: front, Pages: 2}, {Path: back, Pages: 2}}, event.Inputs)
+	if assert.Len(t, event.Outputs, 1) {
+		assert.Equal(t, 4, event.Outputs[0].Pages)
+	}
+
+	// A failing undo hook reports the undo as failed
+	assert.NoError(t, redoLatestOperation())
+	CONFIG.Hooks = HooksConfig{OnUndo: "exit 1", FailOperation: true}
+	err := undoLatestOperation()
+	assert.ErrorContains(t, err, "onUndo hook failed")
+	assert.Equal(t, HISTORY_UNDONE, HISTORY[len(HISTORY)-1].State)
+}
+
+func TestHooksConfigValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.Hooks = HooksConfig{OnSuccess: "/opt/ocr/run.sh", TimeoutSeconds: 300}
+	assert.NoError(t, validateConfig(config))
+	assert.Equal(t, 300*time.Second, config.Hooks.timeout())
+
+	config.Hooks.TimeoutSeconds = 0
+	assert.Equal(t, DEFAULT_HOOK_TIMEOUT_SECONDS*time.Second, config.Hooks.timeout())
+
+	config.Hooks.TimeoutSeconds = -1
+	assert.Error(t, validateConfig(config))
+
+	assert.Equal(t, "importing done", hookOutput([]byte("importing\n  done\n")))
+	assert.Len(t, hookOutput([]byte(strings.Repeat("x", HOOK_OUTPUT_LIMIT*2))), HOOK_OUTPUT_LIMIT)
+}
@@ -0,0 +1,296 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Remote inbox
+//
+// Scanners that upload to cloud storage can feed BlendPDF through a remote
+// inbox: an S3, WebDAV or SFTP folder polled for new PDFs. Each one is claimed
+// by moving it under processing/ in the same folder, which only one instance
+// can do, then downloaded into the local watch folder and removed. Claims are
+// recorded in the state folder before they are made and until the download
+// finishes, so an interrupted fetch is completed on the next poll.
+
+const (
+	DEFAULT_INBOX_POLL_SECONDS = 30
+	INBOX_PROCESSING_FOLDER    = "processing"
+)
+
+// Remote inbox settings
+type InboxConfig struct {
+	URL         string `json:"url"`         // Remote folder polled for scans, e.g. s3://bucket/incoming
+	PollSeconds int    `json:"pollSeconds"` // Seconds between polls (default 30)
+}
+
+// Validate remote inbox settings
+func (i InboxConfig) validate() error {
+	if i.PollSeconds < 0 {
+		return fmt.Errorf("inbox pollSeconds must not be negative")
+	}
+	if i.URL == "" {
+		return nil
+	}
+	if !strings.Contains(i.URL, "://") {
+		return fmt.Errorf("inbox %s must be a remote URL; the watch folder is already local", i.URL)
+	}
+	return validateDestinationFolder(i.URL)
+}
+
+// Poll state for the status line
+var inboxState struct {
+	nextPoll  time.Time
+	lastPoll  time.Time
+	fetched   int
+	lastError string
+}
+
+// Check whether a remote inbox is configured
+func inboxEnabled() bool {
+	return CONFIG != nil && CONFIG.Inbox.URL != ""
+}
+
+// Get the seconds between polls with the default filled in
+func inboxPollInterval() time.Duration {
+	seconds := DEFAULT_INBOX_POLL_SECONDS
+	if CONFIG != nil && CONFIG.Inbox.PollSeconds > 0 {
+		seconds = CONFIG.Inbox.PollSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Get the path of the claims being fetched
+func getInboxClaimsPath() string {
+	if STATE_DIR == "" {
+		return ""
+	}
+	return filepath.Join(STATE_DIR, "inbox.json")
+}
+
+// Load the claims left by an interrupted fetch
+func loadInboxClaims() []string {
+	path := getInboxClaimsPath()
+	if path == "" {
+		return nil
+	}
+	data, err := readStorageFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	var claims []string
+	if err == nil {
+		err = json.Unmarshal(data, &claims)
+	}
+	if err != nil {
+		printWarning(fmt.Sprintf("Failed to load inbox claims: %v", err))
+		return nil
+	}
+	return claims
+}
+
+// Save the claims being fetched, removing the file when there are none
+func saveInboxClaims(claims []string) error {
+	path := getInboxClaimsPath()
+	if path == "" {
+		return nil
+	}
+	if len(claims) == 0 {
+		if err := STORAGE.remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = atomicWrite(path, bytes.NewReader(data), nil)
+	return err
+}
+
+// Poll the remote inbox if it is due, returns whether any files arrived
+func pollRemoteInbox(now time.Time) bool {
+	if !inboxEnabled() || now.Before(inboxState.nextPoll) {
+		return false
+	}
+	inboxState.nextPoll = now.Add(inboxPollInterval())
+	inboxState.lastPoll = now
+
+	fetched, err := fetchRemoteInbox()
+	inboxState.fetched += fetched
+	inboxState.lastError = ""
+	if err != nil {
+		inboxState.lastError = err.Error()
+		if VERBOSE {
+			printWarning(fmt.Sprintf("Inbox poll failed: %v", err))
+		}
+	}
+	if fetched > 0 {
+		logOperation("INBOX", CONFIG.Inbox.URL, "", fmt.Sprintf("fetched %d file(s)", fetched))
+	}
+	return fetched > 0
+}
+
+// Claim and download every new PDF in the remote inbox, returns how many arrived
+func fetchRemoteInbox() (int, error) {
+	fetched := 0
+
+	// Finish fetches interrupted by a previous run first
+	claims := loadInboxClaims()
+	for len(claims) > 0 {
+		arrived, err := fetchClaim(claims[0])
+		if err != nil {
+			return fetched, err
+		}
+		if arrived {
+			fetched++
+		}
+		claims = claims[1:]
+		if err := saveInboxClaims(claims); err != nil {
+			return fetched, err
+		}
+	}
+
+	names, err := listInbox()
+	if err != nil {
+		return fetched, err
+	}
+	for _, name := range names {
+		claimed := joinDestination(CONFIG.Inbox.URL, INBOX_PROCESSING_FOLDER+"/"+name)
+
+		// Record the claim before making it, so a crash right after claiming can't orphan the file
+		if err := saveInboxClaims([]string{claimed}); err != nil {
+			return fetched, err
+		}
+		err := claimInboxFile(joinDestination(CONFIG.Inbox.URL, name), claimed)
+		if errors.Is(err, errRemoteClaimed) {
+			// Another instance got there first
+			if err := saveInboxClaims(nil); err != nil {
+				return fetched, err
+			}
+			continue
+		}
+		if err != nil {
+			return fetched, err
+		}
+
+		if _, err := fetchClaim(claimed); err != nil {
+			return fetched, err
+		}
+		fetched++
+		if err := saveInboxClaims(nil); err != nil {
+			return fetched, err
+		}
+	}
+	return fetched, nil
+}
+
+// List the PDFs waiting directly in the remote inbox
+func listInbox() ([]string, error) {
+	store, key, err := openRemote(CONFIG.Inbox.URL)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(key, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	keys, err := store.list(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if strings.Contains(name, "/") || isTempFileName(name) || !strings.EqualFold(filepath.Ext(name), ".pdf") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Move an inbox file under processing/, failing with errRemoteClaimed if another instance has it
+func claimInboxFile(src, dst string) error {
+	store, srcKey, err := openRemote(src)
+	if err != nil {
+		return err
+	}
+	_, dstKey, err := openRemote(dst)
+	if err != nil {
+		return err
+	}
+	return store.claim(srcKey, dstKey)
+}
+
+// Download a claimed file into the watch folder and remove it, returns whether it arrived
+func fetchClaim(claimed string) (bool, error) {
+	if !destinationExists(claimed) {
+		return false, nil // Already fetched before the claim record was cleared
+	}
+
+	// The FTP and SMTP receivers write into the watch folder too, so never replace what is there
+	_, name := splitDestination(claimed)
+	local, err := downloadRemoteNew(claimed, filepath.Join(FOLDER, name))
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch %s: %v", name, err)
+	}
+	if err := removeDestination(claimed); err != nil {
+		// The file is here; a second copy would only arrive if another instance reclaimed it
+		printWarning(fmt.Sprintf("Fetched %s but could not remove it from the inbox: %v", name, err))
+	}
+	if VERBOSE {
+		printInfo(fmt.Sprintf("Fetched %s from the inbox", filepath.Base(local)))
+	}
+	return true, nil
+}
+
+// Describe the remote inbox for the status line, "" when there is none
+func describeRemoteInbox() string {
+	if !inboxEnabled() {
+		return ""
+	}
+	if inboxState.lastPoll.IsZero() {
+		return fmt.Sprintf("%s, not polled yet", CONFIG.Inbox.URL)
+	}
+	if inboxState.lastError != "" {
+		return fmt.Sprintf("FAIL - %s at %s: %s", CONFIG.Inbox.URL, inboxState.lastPoll.Format("15:04:05"), inboxState.lastError)
+	}
+	return fmt.Sprintf("%s, %d fetched, checked %s", CONFIG.Inbox.URL, inboxState.fetched, inboxState.lastPoll.Format("15:04:05"))
+}
+
+// Fetch waiting scans before the menu starts
+func pollInboxAtStartup() {
+	if !inboxEnabled() {
+		return
+	}
+	if pollRemoteInbox(time.Now()) {
+		printInfo(fmt.Sprintf("Fetched %d file(s) from %s", inboxState.fetched, CONFIG.Inbox.URL))
+	}
+	if inboxState.lastError != "" {
+		printWarning(fmt.Sprintf("Inbox %s: %s", CONFIG.Inbox.URL, inboxState.lastError))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteInboxFetchesNewScans(t *testing.T) {
+	tempDir, fake := setupS3Test(t)
+	CONFIG.Inbox = InboxConfig{URL: "s3://docs/incoming"}
+	fake.put("incoming/a.pdf", []byte("scan a"))
+	fake.put("incoming/notes.txt", []byte("not a scan"))
+	fake.put("incoming/processing/other.pdf", []byte("claimed elsewhere"))
+	assert.NoError(t, os.WriteFile(filepath.Join(tempDir, "a.pdf"), []byte("local"), 0644))
+
+	now := time.Now()
+	assert.True(t, pollRemoteInbox(now))
+	fetched, err := os.ReadFile(filepath.Join(tempDir, "a_1.pdf"))
+	assert.NoError(t, err, "a local file of the same name is kept")
+	assert.Equal(t, "scan a", string(fetched))
+
+	assert.Nil(t, fake.object("incoming/a.pdf"))
+	assert.Nil(t, fake.object("incoming/processing/a.pdf"), "released after the fetch")
+	assert.NotNil(t, fake.object("incoming/notes.txt"))
+	assert.NotNil(t, fake.object("incoming/processing/other.pdf"))
+	assert.NoFileExists(t, getInboxClaimsPath())
+	assert.Contains(t, describeRemoteInbox(), "1 fetched")
+
+	// Polls wait for the interval
+	fake.put("incoming/b.pdf", []byte("scan b"))
+	assert.False(t, pollRemoteInbox(now.Add(time.Second)))
+	assert.True(t, pollRemoteInbox(now.Add(inboxPollInterval())))
+	assert.FileExists(t, filepath.Join(tempDir, "b.pdf"))
+}
+
+func TestRemoteInboxClaimsAreExclusive(t *testing.T) {
+	_, fake := setupS3Test(t)
+	fake.put("incoming/a.pdf", []byte("scan a"))
+	fake.put("incoming/processing/a.pdf", []byte("taken"))
+	err := claimInboxFile("s3://docs/incoming/a.pdf", "s3://docs/incoming/processing/a.pdf")
+	assert.ErrorIs(t, err, errRemoteClaimed)
+	assert.NotNil(t, fake.object("incoming/a.pdf"), "left for the instance holding the claim")
+
+	_, root, _ := setupWebDAVTest(t)
+	assert.NoError(t, performFileCopy(writeRoutedPDF(t, t.TempDir(), "a.pdf", "Page"), root+"/incoming/a.pdf"))
+	assert.NoError(t, claimInboxFile(root+"/incoming/a.pdf", root+"/incoming/processing/a.pdf"))
+	err = claimInboxFile(root+"/incoming/a.pdf", root+"/incoming/processing/a.pdf")
+	assert.ErrorIs(t, err, errRemoteClaimed)
+
+	tempDir, remote := setupSFTPTest(t)
+	assert.NoError(t, performFileCopy(writeRoutedPDF(t, tempDir, "a.pdf", "Page"), remote+"/incoming/a.pdf"))
+	assert.NoError(t, performFileCopy(writeRoutedPDF(t, tempDir, "b.pdf", "Page"), remote+"/incoming/processing/b.pdf"))
+	assert.NoError(t, claimInboxFile(remote+"/incoming/a.pdf", remote+"/incoming/processing/a.pdf"))
+	assert.ErrorIs(t, claimInboxFile(remote+"/incoming/a.pdf", remote+"/incoming/processing/a.pdf"), errRemoteClaimed)
+	assert.NoError(t, performFileCopy(writeRoutedPDF(t, tempDir, "b.pdf", "Page"), remote+"/incoming/b.pdf"))
+	assert.ErrorIs(t, claimInboxFile(remote+"/incoming/b.pdf", remote+"/incoming/processing/b.pdf"), errRemoteClaimed)
+}
+
+func TestRemoteInboxResumesInterruptedFetch(t *testing.T) {
+	tempDir, fake := setupS3Test(t)
+	CONFIG.Inbox = InboxConfig{URL: "s3://docs/incoming"}
+	fake.put("incoming/processing/a.pdf", []byte("scan a"))
+	assert.NoError(t, saveInboxClaims([]string{"s3://docs/incoming/processing/a.pdf", "s3://docs/incoming/processing/gone.pdf"}))
+
+	assert.True(t, pollRemoteInbox(time.Now()))
+	assert.FileExists(t, filepath.Join(tempDir, "a.pdf"))
+	assert.NoFileExists(t, filepath.Join(tempDir, "gone.pdf"))
+	assert.Nil(t, fake.object("incoming/processing/a.pdf"))
+	assert.NoFileExists(t, getInboxClaimsPath())
+}
+
+// arrivingStorage places a file in the watch folder while a write there is in progress, like a receiver would
+type arrivingStorage struct {
+	storage
+	arrival string
+}
+
+func (a *arrivingStorage) createAtomic(dst string, reader io.Reader, verify func(tempPath string, size int64) error) (int64, error) {
+	if a.arrival != "" && filepath.Dir(dst) == filepath.Dir(a.arrival) {
+		_ = os.WriteFile(a.arrival, []byte("received meanwhile"), 0644)
+		a.arrival = ""
+	}
+	return a.storage.createAtomic(dst, reader, verify)
+}
+
+func TestRemoteInboxKeepsFileReceivedDuringFetch(t *testing.T) {
+	tempDir, fake := setupS3Test(t)
+	CONFIG.Inbox = InboxConfig{URL: "s3://docs/incoming"}
+	fake.put("incoming/a.pdf", []byte("scan a"))
+
+	STORAGE = &arrivingStorage{storage: STORAGE, arrival: filepath.Join(tempDir, "a.pdf")}
+
+	assert.True(t, pollRemoteInbox(time.Now()))
+	received, _ := os.ReadFile(filepath.Join(tempDir, "a.pdf"))
+	assert.Equal(t, "received meanwhile", string(received), "a file placed during the fetch is not replaced")
+	fetched, _ := os.ReadFile(filepath.Join(tempDir, "a_1.pdf"))
+	assert.Equal(t, "scan a", string(fetched))
+}
+
+func TestRemoteInboxRecordsClaimBeforeClaiming(t *testing.T) {
+	_, fake := setupS3Test(t)
+	CONFIG.Inbox = InboxConfig{URL: "s3://docs/incoming"}
+	fake.put("incoming/a.pdf", []byte("scan a"))
+
+	// The claim record can't be written, so nothing may be claimed
+	STORAGE = &flakyStorage{storage: STORAGE, folder: STATE_DIR, blocked: true}
+
+	assert.False(t, pollRemoteInbox(time.Now()))
+	assert.NotNil(t, fake.object("incoming/a.pdf"), "the scan stays in the inbox for the next poll")
+	assert.Nil(t, fake.object("incoming/processing/a.pdf"))
+}
+
+func TestRemoteInboxValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.Inbox = InboxConfig{URL: "s3://docs/incoming", PollSeconds: 60}
+	assert.NoError(t, validateConfig(config))
+
+	for _, inbox := range []InboxConfig{{URL: "/srv/scans"}, {URL: "ftp://host/scans"}, {URL: "s3://docs", PollSeconds: -1}} {
+		config.Inbox = inbox
+		assert.Error(t, validateConfig(config), inbox.URL)
+	}
+}
@@ -0,0 +1,573 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Write-ahead operation journal
+//
+// Every step of an operation is recorded before it runs and marked done after.
+// Once all output copies exist and the archive and remove steps are planned the
+// operation is committed; on startup an uncommitted journal is rolled back and
+// a committed one is rolled forward and recorded in the history.
+
+// Journal step actions
+const (
+	STEP_TEMP    = "temp"    // Temporary merge result
+	STEP_COPY    = "copy"    // Copy to output or archive folder
+	STEP_REMOVE  = "remove"  // Remove an original from the watch folder
+	STEP_ARCHIVE = "archive" // Link an original into the archive object store
+	STEP_ENCRYPT = "encrypt" // Write an encrypted archive copy
+)
+
+// JournalStep records one step of an operation
+type JournalStep struct {
+	Action      string `json:"action"`
+	Source      string `json:"source,omitempty"`
+	Target      string `json:"target,omitempty"`
+	Digest      string `json:"digest,omitempty"`      // SHA-256 of source at planning time
+	Preexisting bool   `json:"preexisting,omitempty"` // Target already held identical content
+	Existed     bool   `json:"existed,omitempty"`     // Target existed before the step, so it is never removed
+	Done        bool   `json:"done"`
+}
+
+// JournalEntry records an in-flight operation
+type JournalEntry struct {
+	ID        string        `json:"id"`
+	Type      string        `json:"type"`
+	Inputs    []string      `json:"inputs"`
+	Started   time.Time     `json:"started"`
+	Committed bool          `json:"committed"`
+	Steps     []JournalStep `json:"steps"`
+
+	Operation *LastOperation `json:"operation,omitempty"` // History entry, recorded if recovery completes the operation
+}
+
+// operationJournal persists a JournalEntry; a nil journal records nothing
+type operationJournal struct {
+	entry JournalEntry
+	path  string
+}
+
+// Get the journal directory inside the state folder
+func getJournalDir() string {
+	if STATE_DIR == "" {
+		return ""
+	}
+	return filepath.Join(STATE_DIR, "journal")
+}
+
+// Start journaling a new operation
+func beginJournal(opType string, inputs ...string) (*operationJournal, error) {
+	journalDir := getJournalDir()
+	if journalDir == "" {
+		return nil, nil
+	}
+
+	if err := STORAGE.mkdirAll(journalDir); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %v", err)
+	}
+
+	now := time.Now()
+	id := fmt.Sprintf("%s-%s", now.Format("20060102-150405.000000000"), opType)
+	j := &operationJournal{
+		entry: JournalEntry{ID: id, Type: opType, Inputs: inputs, Started: now},
+		path:  filepath.Join(journalDir, id+".json"),
+	}
+
+	if err := j.save(); err != nil {
+		return nil, fmt.Errorf("failed to write journal: %v", err)
+	}
+	return j, nil
+}
+
+// Record a step before it runs, returns its index
+func (j *operationJournal) plan(action, source, target string, preexisting bool) int {
+	return j.planStep(JournalStep{Action: action, Source: source, Target: target, Preexisting: preexisting}).index
+}
+
+// Record a step before it runs, keeping it so it can be run later
+func (j *operationJournal) planStep(step JournalStep) plannedStep {
+	if j == nil {
+		return plannedStep{index: -1, step: step}
+	}
+
+	if step.Digest == "" && (step.Action == STEP_COPY || step.Action == STEP_ARCHIVE || step.Action == STEP_ENCRYPT) {
+		if digest, err := calculateFileHash(step.Source); err == nil {
+			step.Digest = digest
+		}
+	}
+
+	j.entry.Steps = append(j.entry.Steps, step)
+	j.persist()
+	return plannedStep{index: len(j.entry.Steps) - 1, step: step}
+}
+
+// Record that a planned step's target existed before it ran
+// Rollback must leave it alone even when it now holds the new content
+func (j *operationJournal) markExisted(index int) {
+	if j == nil || index < 0 || index >= len(j.entry.Steps) {
+		return
+	}
+	j.entry.Steps[index].Existed = true
+	j.persist()
+}
+
+// Mark a planned step as completed
+func (j *operationJournal) done(index int) {
+	if j == nil || index < 0 || index >= len(j.entry.Steps) {
+		return
+	}
+	j.entry.Steps[index].Done = true
+	j.persist()
+}
+
+// Mark the point after which the operation is rolled forward rather than back
+// Every remaining step must already be planned, and op is the history entry to record
+func (j *operationJournal) commit(op *LastOperation) {
+	if j == nil {
+		return
+	}
+	j.entry.Committed = true
+	j.entry.Operation = op
+	j.persist()
+}
+
+// Roll back an operation that failed before committing and drop its journal
+func (j *operationJournal) abort() {
+	if j == nil {
+		return
+	}
+	for _, problem := range rollBack(&j.entry) {
+		printWarning(problem)
+	}
+	j.finish()
+}
+
+// Remove the journal once every step has completed
+func (j *operationJournal) finish() {
+	if j == nil {
+		return
+	}
+	if err := STORAGE.remove(j.path); err != nil && !os.IsNotExist(err) && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to remove journal %s: %v", filepath.Base(j.path), err))
+	}
+}
+
+// Write the journal atomically
+func (j *operationJournal) save() error {
+	data, err := json.MarshalIndent(j.entry, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = atomicWrite(j.path, bytes.NewReader(data), nil)
+	return err
+}
+
+// Write the journal, warning on failure
+func (j *operationJournal) persist() {
+	if err := j.save(); err != nil {
+		printWarning(fmt.Sprintf("Failed to update journal: %v", err))
+	}
+}
+
+// Journaled step helpers
+
+// plannedStep is a step recorded in the journal, kept so it can run later
+type plannedStep struct {
+	index int
+	step  JournalStep
+}
+
+// Run a planned step and mark it done
+func (j *operationJournal) run(p plannedStep) error {
+	step := p.step
+	var err error
+	switch step.Action {
+	case STEP_COPY:
+		if !step.Preexisting {
+			err = performFileCopy(step.Source, step.Target)
+		}
+	case STEP_ARCHIVE:
+		if !step.Preexisting {
+			err = linkArchiveObject(step.Source, filepath.Base(step.Target), step.Digest)
+		}
+	case STEP_ENCRYPT:
+		err = encryptFile(step.Source, step.Target)
+	case STEP_REMOVE:
+		if err = STORAGE.remove(step.Source); os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	j.done(p.index)
+	return nil
+}
+
+// Plan a copy using the destination conflict policy, recording the resolved target
+func (j *operationJournal) planCopy(src, dst string) (plannedStep, string, error) {
+	if err := validateFilePaths(src, dst); err != nil {
+		return plannedStep{}, "", err
+	}
+
+	resolution, err := resolveConflict(src, dst, getConflictPolicy(destinationDir(dst)))
+	if err != nil {
+		return plannedStep{}, "", err
+	}
+
+	p := j.planStep(JournalStep{Action: STEP_COPY, Source: src, Target: resolution.path, Preexisting: resolution.skip})
+	if !resolution.skip && destinationExists(resolution.path) {
+		j.markExisted(p.index)
+	}
+	return p, resolution.outcome, nil
+}
+
+// Copy using the destination conflict policy, recording the resolved target
+func (j *operationJournal) copyWithPolicy(src, dst string) (string, string, error) {
+	p, outcome, err := j.planCopy(src, dst)
+	if err != nil {
+		return "", "", err
+	}
+	if err := j.run(p); err != nil {
+		return "", "", err
+	}
+	return p.step.Target, outcome, nil
+}
+
+// Plan archiving an original, using the object store when it is enabled
+// The planned step's target is the archive path the original is recorded under
+func (j *operationJournal) planArchive(src, dst string) (plannedStep, error) {
+	if !useObjectStore() {
+		if archiveEncryptionEnabled() {
+			return j.planEncrypt(src, dst)
+		}
+		p, _, err := j.planCopy(src, dst)
+		return p, err
+	}
+
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return plannedStep{}, err
+	}
+	name, digest, preexisting, err := resolveArchiveLink(index, src, filepath.Base(dst))
+	if err != nil {
+		return plannedStep{}, err
+	}
+
+	path := filepath.Join(ARCHIVE, name)
+	return j.planStep(JournalStep{Action: STEP_ARCHIVE, Source: src, Target: path, Digest: digest, Preexisting: preexisting}), nil
+}
+
+// Archive an original, using the object store when it is enabled
+// Returns the archive path the original is recorded under
+func (j *operationJournal) archive(src, dst string) (string, error) {
+	p, err := j.planArchive(src, dst)
+	if err != nil {
+		return "", err
+	}
+	if err := j.run(p); err != nil {
+		return "", err
+	}
+	return p.step.Target, nil
+}
+
+// Plan an encrypted archive copy of src as <dst>.age
+func (j *operationJournal) planEncrypt(src, dst string) (plannedStep, error) {
+	if err := validateFilePaths(src, dst); err != nil {
+		return plannedStep{}, err
+	}
+
+	path, err := resolveEncryptedArchivePath(dst)
+	if err != nil {
+		return plannedStep{}, err
+	}
+	return j.planStep(JournalStep{Action: STEP_ENCRYPT, Source: src, Target: path}), nil
+}
+
+// Plan removing an original file from the watch folder
+func (j *operationJournal) planRemove(file string) plannedStep {
+	return j.planStep(JournalStep{Action: STEP_REMOVE, Source: file})
+}
+
+// Remove an original file from the watch folder
+func (j *operationJournal) remove(file string) error {
+	return j.run(j.planRemove(file))
+}
+
+// Remove a temporary merge result
+func (j *operationJournal) removeTemp(file string) {
+	if err := STORAGE.remove(file); err != nil && !os.IsNotExist(err) && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to remove temp file %s: %v", filepath.Base(file), err))
+	}
+	if j == nil {
+		return
+	}
+	for i, step := range j.entry.Steps {
+		if step.Action == STEP_TEMP && step.Target == file {
+			j.done(i)
+		}
+	}
+}
+
+// Startup recovery
+
+// Recover operations interrupted by a crash, returns the number recovered
+func recoverIncompleteOperations() int {
+	journalDir := getJournalDir()
+	if journalDir == "" {
+		return 0
+	}
+
+	files, err := listStorageFiles(journalDir, ".json")
+	if err != nil || len(files) == 0 {
+		return 0
+	}
+
+	recovered := 0
+	for _, file := range files {
+		entry, err := loadJournalEntry(file)
+		if err != nil {
+			printWarning(fmt.Sprintf("Unreadable journal %s: %v", filepath.Base(file), err))
+			continue
+		}
+
+		var problems []string
+		if entry.Committed {
+			problems = rollForward(entry)
+			recordRecoveredOperation(entry)
+			printInfo(fmt.Sprintf("Completed interrupted %s of %s", entry.Type, describeInputs(entry.Inputs)))
+		} else {
+			problems = rollBack(entry)
+			printInfo(fmt.Sprintf("Rolled back interrupted %s of %s", entry.Type, describeInputs(entry.Inputs)))
+		}
+
+		for _, problem := range problems {
+			printWarning(problem)
+		}
+
+		// Keep journals that could not be fully recovered for inspection, but don't retry them
+		if len(problems) == 0 {
+			_ = STORAGE.remove(file)
+		} else if err := STORAGE.rename(file, file+".failed"); err == nil {
+			printWarning(fmt.Sprintf("Recovery incomplete, journal kept as %s.failed", filepath.Base(file)))
+		}
+		recovered++
+	}
+	return recovered
+}
+
+// Load a journal entry from disk
+func loadJournalEntry(path string) (*JournalEntry, error) {
+	data, err := readStorageFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry JournalEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+// Finish the remaining steps of a committed operation, marking each one completed
+// An original whose archive copy cannot be completed is kept in the watch folder
+func rollForward(entry *JournalEntry) []string {
+	var problems []string
+	kept := map[string]bool{}
+	fail := func(step *JournalStep, problem string) {
+		problems = append(problems, problem)
+		kept[step.Source] = true
+	}
+
+	for i := range entry.Steps {
+		step := &entry.Steps[i]
+		if step.Done {
+			continue
+		}
+
+		switch step.Action {
+		case STEP_COPY:
+			if step.Preexisting || targetMatchesDigest(step.Target, step.Digest) {
+				step.Done = true
+				continue
+			}
+			if !fileExists(step.Source) {
+				fail(step, fmt.Sprintf("Cannot complete copy to %s: %s is missing", step.Target, filepath.Base(step.Source)))
+				continue
+			}
+			if err := performFileCopy(step.Source, step.Target); err != nil {
+				fail(step, fmt.Sprintf("Cannot complete copy to %s: %v", step.Target, err))
+				continue
+			}
+			if VERBOSE {
+				printInfo(fmt.Sprintf("Recovered copy %s", step.Target))
+			}
+		case STEP_ARCHIVE:
+			if step.Preexisting || archiveLinkMatches(step.Target, step.Digest) {
+				step.Done = true
+				continue
+			}
+			if !fileExists(step.Source) {
+				fail(step, fmt.Sprintf("Cannot complete archive of %s: original is missing", filepath.Base(step.Source)))
+				continue
+			}
+			if err := linkArchiveObject(step.Source, filepath.Base(step.Target), step.Digest); err != nil {
+				fail(step, fmt.Sprintf("Cannot complete archive of %s: %v", filepath.Base(step.Source), err))
+				continue
+			}
+		case STEP_ENCRYPT:
+			if fileExists(step.Target) {
+				step.Done = true
+				continue
+			}
+			if !fileExists(step.Source) {
+				fail(step, fmt.Sprintf("Cannot complete archive of %s: original is missing", filepath.Base(step.Source)))
+				continue
+			}
+			if err := encryptFile(step.Source, step.Target); err != nil {
+				fail(step, fmt.Sprintf("Cannot complete archive of %s: %v", filepath.Base(step.Source), err))
+				continue
+			}
+		case STEP_REMOVE:
+			if kept[step.Source] {
+				problems = append(problems, fmt.Sprintf("Kept %s in the watch folder", filepath.Base(step.Source)))
+				continue
+			}
+			if err := STORAGE.remove(step.Source); err != nil && !os.IsNotExist(err) {
+				problems = append(problems, fmt.Sprintf("Cannot remove %s: %v", filepath.Base(step.Source), err))
+				continue
+			}
+		case STEP_TEMP:
+			_ = STORAGE.remove(step.Target)
+		}
+		step.Done = true
+	}
+
+	return problems
+}
+
+// Record the history entry of an operation recovery completed, so it can be undone
+func recordRecoveredOperation(entry *JournalEntry) {
+	op := entry.Operation
+	if op == nil {
+		return
+	}
+
+	// Originals whose archive copy was not completed are still in the watch folder
+	for i, file := range op.ArchiveFiles {
+		if file != "" && !archiveStepDone(entry, file) {
+			op.ArchiveFiles[i] = ""
+		}
+	}
+	op.ArchiveStore = archiveStoreFor(op.ArchiveFiles)
+	op.Timestamp = time.Now()
+	recordOperation(op)
+}
+
+// Check whether the step archiving to path has completed
+func archiveStepDone(entry *JournalEntry, path string) bool {
+	for _, step := range entry.Steps {
+		if step.Target == path && step.Action != STEP_REMOVE && step.Action != STEP_TEMP {
+			return step.Done
+		}
+	}
+	return false
+}
+
+// Undo the completed steps of an uncommitted operation, newest first
+func rollBack(entry *JournalEntry) []string {
+	var problems []string
+
+	for i := len(entry.Steps) - 1; i >= 0; i-- {
+		step := entry.Steps[i]
+
+		switch step.Action {
+		case STEP_COPY:
+			// Remove only copies we wrote, including ones renamed before being marked done
+			if step.Preexisting || step.Existed || !targetMatchesDigest(step.Target, step.Digest) {
+				continue
+			}
+			if err := removeDestination(step.Target); err != nil {
+				problems = append(problems, fmt.Sprintf("Cannot remove partial output %s: %v", step.Target, err))
+			} else if VERBOSE {
+				printInfo(fmt.Sprintf("Removed partial output %s", step.Target))
+			}
+		case STEP_ARCHIVE:
+			if step.Preexisting || !archiveLinkMatches(step.Target, step.Digest) {
+				continue
+			}
+			if err := unlinkArchiveEntry(step.Target); err != nil {
+				problems = append(problems, fmt.Sprintf("Cannot remove partial archive link %s: %v", filepath.Base(step.Target), err))
+			}
+		case STEP_ENCRYPT:
+			// The name was free when planned and is written atomically, so anything there is ours
+			if err := STORAGE.remove(step.Target); err != nil && !os.IsNotExist(err) {
+				problems = append(problems, fmt.Sprintf("Cannot remove partial archive copy %s: %v", filepath.Base(step.Target), err))
+			}
+		case STEP_REMOVE:
+			if step.Done {
+				problems = append(problems, fmt.Sprintf("%s was removed before the operation committed", filepath.Base(step.Source)))
+			}
+		case STEP_TEMP:
+			_ = STORAGE.remove(step.Target)
+		}
+	}
+
+	return problems
+}
+
+// Check a target exists with the expected digest
+func targetMatchesDigest(target, digest string) bool {
+	if target == "" || digest == "" {
+		return false
+	}
+	if isRemotePath(target) {
+		remote, err := remoteDigest(target)
+		return err == nil && remote == digest
+	}
+	if !fileExists(target) {
+		return false
+	}
+	hash, err := calculateFileHash(target)
+	return err == nil && hash == digest
+}
+
+// Check an archive link exists with the expected digest
+// Objects are content-addressed, so the index hash stands for the (possibly encrypted) object
+func archiveLinkMatches(path, digest string) bool {
+	hash, ok := archiveLinkDigest(path)
+	return ok && digest != "" && hash == digest
+}
+
+// Format input file names for reporting
+func describeInputs(inputs []string) string {
+	names := make([]string, len(inputs))
+	for i, input := range inputs {
+		names[i] = filepath.Base(input)
+	}
+	return strings.Join(names, " + ")
+}
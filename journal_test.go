@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalRollBackUncommitted(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	original := filepath.Join(tempDir, "scan.pdf")
+	_ = os.WriteFile(original, []byte("scan content"), 0644)
+
+	journal, err := beginJournal("single", original)
+	assert.NoError(t, err)
+
+	output, _, err := journal.copyWithPolicy(original, filepath.Join(tempDir, "output", "scan.pdf"))
+	assert.NoError(t, err)
+	assert.FileExists(t, output)
+
+	// Simulate a crash: journal left on disk, never committed
+	recovered := recoverIncompleteOperations()
+	assert.Equal(t, 1, recovered)
+	assert.NoFileExists(t, output, "uncommitted output copy should be removed")
+	assert.FileExists(t, original, "original should be untouched")
+
+	files, _ := filepath.Glob(filepath.Join(getJournalDir(), "*"))
+	assert.Len(t, files, 0, "journal should be removed after recovery")
+}
+
+func TestJournalRollForwardCommitted(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	original := filepath.Join(tempDir, "scan.pdf")
+	_ = os.WriteFile(original, []byte("scan content"), 0644)
+
+	journal, err := beginJournal("single", original)
+	assert.NoError(t, err)
+
+	_, _, err = journal.copyWithPolicy(original, filepath.Join(tempDir, "output", "scan.pdf"))
+	assert.NoError(t, err)
+	journal.commit(nil)
+
+	// Plan the archive copy and removal but crash before running them
+	archiveTarget := filepath.Join(tempDir, "archive", "scan.pdf")
+	journal.plan(STEP_COPY, original, archiveTarget, false)
+	journal.plan(STEP_REMOVE, original, "", false)
+
+	recoverIncompleteOperations()
+	assert.FileExists(t, archiveTarget, "archive copy should be completed")
+	assert.NoFileExists(t, original, "original should be removed")
+}
+
+func TestJournalRollBackKeepsPreexisting(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	original := filepath.Join(tempDir, "scan.pdf")
+	existing := filepath.Join(tempDir, "output", "scan.pdf")
+	_ = os.WriteFile(original, []byte("scan content"), 0644)
+	_ = os.MkdirAll(filepath.Dir(existing), 0755)
+	_ = os.WriteFile(existing, []byte("scan content"), 0644)
+
+	journal, err := beginJournal("single", original)
+	assert.NoError(t, err)
+	journal.plan(STEP_COPY, original, existing, true)
+
+	recoverIncompleteOperations()
+	assert.FileExists(t, existing, "pre-existing identical output should not be removed")
+}
+
+func TestJournalRollBackKeepsOverwrittenTarget(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	original := filepath.Join(tempDir, "scan.pdf")
+	existing := filepath.Join(tempDir, "output", "scan.pdf")
+	_ = os.WriteFile(original, []byte("scan content"), 0644)
+	_ = os.MkdirAll(filepath.Dir(existing), 0755)
+	_ = os.WriteFile(existing, []byte("scan content"), 0644)
+	CONFIG.ConflictPolicy = CONFLICT_OVERWRITE
+
+	journal, err := beginJournal("single", original)
+	assert.NoError(t, err)
+	output, _, err := journal.copyWithPolicy(original, existing)
+	assert.NoError(t, err)
+	assert.Equal(t, existing, output)
+
+	// The overwritten file matches the copy, but it was there before the operation
+	recoverIncompleteOperations()
+	assert.FileExists(t, existing, "a file that existed before the operation should not be removed")
+}
+
+func TestNilJournalIsNoop(t *testing.T) {
+	tempDir := t.TempDir()
+	src := filepath.Join(tempDir, "src.pdf")
+	_ = os.WriteFile(src, []byte("content"), 0644)
+
+	var journal *operationJournal
+	assert.NotPanics(t, func() {
+		_, _, err := journal.copyWithPolicy(src, filepath.Join(tempDir, "out", "src.pdf"))
+		assert.NoError(t, err)
+		journal.commit(nil)
+		assert.NoError(t, journal.remove(src))
+		journal.finish()
+	})
+	assert.NoFileExists(t, src)
+}
+
+// setupPlannedMerge commits a merge of a.pdf and b.pdf whose originals are planned but not yet moved
+func setupPlannedMerge(t *testing.T) (string, []originalMove) {
+	tempDir := useTestWorkspace(t)
+
+	file1 := filepath.Join(tempDir, "a.pdf")
+	file2 := filepath.Join(tempDir, "b.pdf")
+	_ = os.WriteFile(file1, []byte("first scan"), 0644)
+	_ = os.WriteFile(file2, []byte("second scan"), 0644)
+
+	journal, err := beginJournal("merge", file1, file2)
+	assert.NoError(t, err)
+	output, _, err := journal.copyWithPolicy(file1, filepath.Join(tempDir, "output", "a-b.pdf"))
+	assert.NoError(t, err)
+
+	moves := planOriginalMoves(journal, true, file1, file2)
+	journal.commit(&LastOperation{
+		Type:          "merge",
+		OriginalFiles: []string{file1, file2},
+		ActualFiles:   []string{output},
+		OutputFolders: []string{filepath.Dir(output)},
+		ArchiveFiles:  plannedArchiveFiles(moves),
+	})
+	return tempDir, moves
+}
+
+func TestJournalRollForwardPlannedMoves(t *testing.T) {
+	tempDir, moves := setupPlannedMerge(t)
+
+	// Crash after committing, before the originals were moved
+	recoverIncompleteOperations()
+	assert.FileExists(t, filepath.Join(ARCHIVE, "a.pdf"))
+	assert.FileExists(t, filepath.Join(ARCHIVE, "b.pdf"))
+	assert.NoFileExists(t, filepath.Join(tempDir, "a.pdf"), "original should be removed")
+	assert.NoFileExists(t, filepath.Join(tempDir, "b.pdf"), "original should be removed")
+
+	if assert.Len(t, HISTORY, 1, "recovered operation should be recorded for undo") {
+		assert.Equal(t, plannedArchiveFiles(moves), HISTORY[0].Operation.ArchiveFiles)
+	}
+}
+
+func TestJournalRollForwardKeepsUnarchivedOriginal(t *testing.T) {
+	tempDir, _ := setupPlannedMerge(t)
+
+	// The archive folder can no longer take copies
+	_ = os.RemoveAll(ARCHIVE)
+	_ = os.WriteFile(ARCHIVE, []byte("not a folder"), 0644)
+
+	recoverIncompleteOperations()
+	assert.FileExists(t, filepath.Join(tempDir, "a.pdf"), "original without an archive copy should stay")
+	assert.FileExists(t, filepath.Join(tempDir, "b.pdf"), "original without an archive copy should stay")
+
+	if assert.Len(t, HISTORY, 1) {
+		assert.Equal(t, []string{"", ""}, HISTORY[0].Operation.ArchiveFiles)
+	}
+}
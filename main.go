@@ -32,6 +32,11 @@ func main() {
 	initializeApplication()
 	setupSignalHandling()
 
+	// Subcommands run once and exit instead of starting the interactive UI
+	if len(os.Args) > 1 && isCommand(os.Args[1]) {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	if err := setupLockFile(); err != nil {
 		handleLockFileError(err)
 	}
@@ -44,6 +49,20 @@ func main() {
 	if err := setupApplicationDirectories(folder); err != nil {
 		handleStartupError(err)
 	}
+	if err := checkDestinationOwnership(); err != nil {
+		handleStartupError(err)
+	}
+	applyRetentionAtStartup()
+	warnDestinationHealthAtStartup()
+	processRetriesAtStartup()
+	processWebhooksAtStartup()
+	pollInboxAtStartup()
+	if err := startFTPReceiverAtStartup(); err != nil {
+		handleStartupError(err)
+	}
+	if err := startSMTPReceiverAtStartup(); err != nil {
+		handleStartupError(err)
+	}
 
 	// Try to run TUI, fallback to original interface if needed
 	if err := runTUI(); err != nil {
@@ -69,8 +88,16 @@ func runTUI() error {
 	)
 
 	// Add undo and archive toggle functions
-	bridge.SetUndoFunction(func() error { processUndoOperation(); return nil })
+	bridge.SetUndoFunction(processUndoOperation)
+	bridge.SetHistoryFunctions(listHistoryItems, undoOperationByID, processRedoOperation)
+	bridge.SetErrorFunctions(listErrorItems, retryErrorFiles)
+	bridge.SetArchiveFunctions(listArchiveEntries, restoreArchiveEntries, reprocessArchiveEntries)
 	bridge.SetArchiveToggleFunction(toggleArchiveMode)
+	bridge.SetRouteFunction(latestOperationRoute)
+	bridge.SetHealthFunction(destinationHealthSummary)
+	bridge.SetRetryFunctions(processDueDeliveries, describePendingDeliveries)
+	bridge.SetInboxFunctions(func() bool { return pollRemoteInbox(time.Now()) }, describeRemoteInbox)
+	bridge.SetScanFunction(scanAndMerge)
 
 	// Detect terminal capabilities and choose appropriate UI
 	if ui.ShouldUseFallbackUI() {
@@ -90,6 +117,91 @@ func runTUI() error {
 	return menu.Run()
 }
 
+// Convert operation history for the UI history screen
+func listHistoryItems() ([]ui.HistoryItem, error) {
+	var items []ui.HistoryItem
+	for i := len(HISTORY) - 1; i >= 0; i-- {
+		entry := HISTORY[i]
+		items = append(items, ui.HistoryItem{
+			ID:          entry.ID,
+			Time:        formatHistoryTime(entry.Operation.Timestamp),
+			Type:        entry.Operation.Type,
+			Description: describeHistoryEntry(entry),
+			Undone:      entry.State == HISTORY_UNDONE,
+		})
+	}
+	return items, nil
+}
+
+// Latest recorded operation and the route it took, for the recent-operations line
+func latestOperationRoute() (string, string) {
+	if len(HISTORY) == 0 {
+		return "", ""
+	}
+	entry := HISTORY[len(HISTORY)-1]
+	return entry.ID, describeRoute(entry.Operation)
+}
+
+// Convert error folder contents for the UI retry screen
+func listErrorItems() ([]ui.ErrorItem, error) {
+	files, err := listErrorFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []ui.ErrorItem
+	for _, file := range files {
+		item := ui.ErrorItem{Name: filepath.Base(file.Path)}
+		if file.Report != nil {
+			item.Time = formatHistoryTime(file.Report.Timestamp)
+			item.Stage = file.Report.Stage
+			item.Error = file.Report.Error
+			item.Partner = file.Report.Partner
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Convert archived originals for the UI browse screen
+func listArchiveEntries() ([]ui.ArchiveItem, error) {
+	originals, err := listArchivedOriginals()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []ui.ArchiveItem
+	for _, original := range originals {
+		items = append(items, ui.ArchiveItem{
+			Key:  original.Key,
+			Name: original.Name,
+			Time: formatHistoryTime(original.Archived),
+			Size: formatFileSize(original.Size),
+		})
+	}
+	return items, nil
+}
+
+// Copy archived originals back to the watch folder for the UI browse screen
+func restoreArchiveEntries(keys []string) (int, error) {
+	restored, err := restoreArchivedOriginals(keys)
+	return len(restored), err
+}
+
+// Reprocess an archived pair for the UI browse screen, returns the first output name
+func reprocessArchiveEntries(front, back, backOrder, flipEdge string) (string, error) {
+	outputs, err := reprocessArchivedPair(front, back, MergeOptions{BackOrder: backOrder, FlipEdge: flipEdge})
+	if err != nil {
+		return "", err
+	}
+	for _, output := range outputs {
+		if output != "" {
+			return filepath.Base(output), nil
+		}
+	}
+	return "", nil
+}
+
 // Initialize application components
 func initializeApplication() {
 	if DEBUG {
@@ -160,10 +272,36 @@ func processUserMenu() {
 	executeUserChoice(choice)
 }
 
+// Retry queued output copies and webhooks that are due
+// Returns whether either queue changed
+func processDueDeliveries() bool {
+	retried := processDueRetries(time.Now())
+	return processDueWebhooks(time.Now()) || retried
+}
+
+// Summarise queued output copies and webhooks, "" when nothing is waiting
+func describePendingDeliveries() string {
+	var pending []string
+	for _, queue := range []string{describeRetryQueue(), describeWebhookQueue()} {
+		if queue != "" {
+			pending = append(pending, queue)
+		}
+	}
+	return strings.Join(pending, "; ")
+}
+
 // Display current application status
 func displayApplicationStatus() {
 	fmt.Println()
+	processDueDeliveries()
+	pollRemoteInbox(time.Now())
 	displayFileCounts()
+	if pending := describePendingDeliveries(); pending != "" {
+		fmt.Printf("Retry: %s\n", pending)
+	}
+	if inbox := describeRemoteInbox(); inbox != "" {
+		fmt.Printf("Inbox: %s\n", inbox)
+	}
 	showFilePreview()
 	displayMenuOptions()
 }
@@ -208,8 +346,18 @@ func executeUserChoice(choice string) {
 		processSingleFileOperation()
 	case "M":
 		processMergeOperation()
+	case "C":
+		processScanOperation()
 	case "U":
 		processUndoOperation()
+	case "Y":
+		processRedoOperation()
+	case "L":
+		displayHistory(10)
+	case "E":
+		processRetryOperation()
+	case "B":
+		processBrowseOperation()
 	case "A":
 		toggleArchiveMode()
 	case "H":
@@ -221,7 +369,7 @@ func executeUserChoice(choice string) {
 	case "Q":
 		exitApplication()
 	default:
-		printWarning("Invalid choice. Please enter S, M, U, A, H, V, D, or Q.")
+		printWarning("Invalid choice. Please enter S, M, C, U, Y, L, E, B, A, H, V, D, or Q.")
 	}
 }
 
@@ -236,92 +384,58 @@ func processMergeOperation() {
 }
 
 // Process undo operation
-func processUndoOperation() {
-	if LAST_OPERATION == nil {
-		printWarning("No operation to undo")
-		return
-	}
-
+func processUndoOperation() error {
 	startTime := time.Now()
 
-	switch LAST_OPERATION.Type {
-	case "single":
-		undoSingleFileOperation()
-	case "merge":
-		undoMergeOperation()
-	default:
-		printError("Unknown operation type for undo")
-		return
+	if err := undoLatestOperation(); err != nil {
+		printWarning(err.Error())
+		return err
 	}
 
-	// Clear undo history after successful undo
-	LAST_OPERATION = nil
-
 	duration := time.Since(startTime)
 	printSuccess(fmt.Sprintf("Undo completed in %v", duration))
+	return nil
 }
 
-// Undo single file operation
-func undoSingleFileOperation() {
-	op := LAST_OPERATION
-
-	// Find first successful output file to restore from
-	var sourceFile string
-	for _, actualFile := range op.ActualFiles {
-		if actualFile != "" && fileExists(actualFile) {
-			sourceFile = actualFile
-			break
-		}
+// Process redo operation
+func processRedoOperation() error {
+	if err := redoLatestOperation(); err != nil {
+		printWarning(err.Error())
+		return err
 	}
+	return nil
+}
 
-	if sourceFile == "" {
-		printError("No output file found to restore from")
-		return
-	}
+// Process retry from error operation (moves every failed file back to the watch folder)
+func processRetryOperation() error {
+	displayErrorFiles()
 
-	// Restore original file to main directory
-	originalPath := op.OriginalFiles[0]
-	if err := moveFileWithRecovery(sourceFile, originalPath); err != nil {
-		printError(fmt.Sprintf("Failed to restore file: %v", err))
-		return
+	retried, err := retryErrorFiles(nil)
+	if retried > 0 {
+		printSuccess(fmt.Sprintf("Moved %d file(s) back from the error folder", retried))
 	}
-
-	// Remove from other output folders
-	for _, actualFile := range op.ActualFiles {
-		if actualFile != "" && actualFile != sourceFile && fileExists(actualFile) {
-			if err := os.Remove(actualFile); err != nil && VERBOSE {
-				printWarning(fmt.Sprintf("Failed to remove %s: %v", actualFile, err))
-			}
-		}
+	if err != nil {
+		printWarning(err.Error())
 	}
-
-	printSuccess(fmt.Sprintf("Restored %s to main directory", filepath.Base(originalPath)))
+	return err
 }
 
-// Undo merge operation
-func undoMergeOperation() {
-	op := LAST_OPERATION
-
-	// Restore original files from archive
-	for i, archiveFile := range op.ArchiveFiles {
-		if archiveFile != "" && fileExists(archiveFile) {
-			originalPath := op.OriginalFiles[i]
-			if err := moveFileWithRecovery(archiveFile, originalPath); err != nil {
-				printWarning(fmt.Sprintf("Failed to restore %s: %v", filepath.Base(originalPath), err))
-			}
-		}
+// Process browse archive operation (lists archived originals; restore with the restore command)
+func processBrowseOperation() {
+	originals, err := listArchivedOriginals()
+	if err != nil {
+		printWarning(err.Error())
+		return
 	}
-
-	// Remove merged files from all output folders
-	for _, actualFile := range op.ActualFiles {
-		if actualFile != "" && fileExists(actualFile) {
-			if err := os.Remove(actualFile); err != nil && VERBOSE {
-				printWarning(fmt.Sprintf("Failed to remove merged file %s: %v", actualFile, err))
-			}
-		}
+	displayArchivedOriginals(originals)
+	if len(originals) > 0 {
+		printInfo("Use 'blendpdf restore <name>' or 'blendpdf restore reprocess <front> <back>'")
 	}
+}
 
-	printSuccess("Restored original files to main directory and removed merged outputs")
+// Check whether an output copy was skipped because an identical file already existed
+func isPreexistingOutput(op *LastOperation, index int) bool {
+	return index >= 0 && index < len(op.ConflictOutcomes) && op.ConflictOutcomes[index] == OUTCOME_SKIPPED
 }
 
 // Show application help
@@ -329,37 +443,86 @@ func showApplicationHelp() {
 	showHelp()
 }
 
-// Copy file to all configured output folders, returns actual filenames used
-func copyToAllOutputFolders(srcFile, filename string) ([]string, error) {
-	// Get output folders from config or use default
-	outputFolders := []string{"output"}
-	if CONFIG != nil && len(CONFIG.OutputFolders) > 0 {
-		outputFolders = CONFIG.OutputFolders
+// outputCopies records where a result was copied
+type outputCopies struct {
+	route    string         // Routing rule that matched ("" when routing is not configured)
+	files    []string       // Actual filenames used, "" for failed copies
+	outcomes []string       // Conflict policy outcome for each copy
+	folders  []string       // Destination folder of each copy
+	retries  []*PendingCopy // Failed copies queued for retry
+}
+
+// Name a result after its first output copy, delivered or queued, for messages
+func (c *outputCopies) name() string {
+	for _, file := range c.files {
+		if file != "" {
+			_, name := splitDestination(file)
+			return name
+		}
+	}
+	if len(c.retries) > 0 {
+		_, name := splitDestination(c.retries[0].Target)
+		return name
+	}
+	return ""
+}
+
+// Copy a result to the destinations its route picked (every output folder without routing)
+func copyToOutputs(journal *operationJournal, choice *routeChoice, srcFile, filename string) (*outputCopies, error) {
+	copies := &outputCopies{folders: choice.folders}
+	if routingEnabled() {
+		copies.route = choice.route
+		if VERBOSE {
+			printInfo(fmt.Sprintf("Route %s: %d destination(s)", choice.route, len(choice.targets)))
+		}
 	}
 
 	var errors []string
-	var actualFiles []string
+	var failedTargets []string
+	var transient []failedCopy
 	successCount := 0
 
-	for _, folder := range outputFolders {
-		destFile := filepath.Join(folder, filename)
-		actualFile, err := copyFileWithConflictResolution(srcFile, destFile)
+	for i, destFile := range choice.targets {
+		actualFile, outcome, err := journal.copyWithPolicy(srcFile, destFile)
 		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s: %v", folder, err))
-			actualFiles = append(actualFiles, "") // Empty for failed copies
+			copies.files = append(copies.files, "") // Empty for failed copies
+			copies.outcomes = append(copies.outcomes, "failed")
+			if isTransientCopyError(err) {
+				transient = append(transient, failedCopy{index: i, target: destFile, folder: choice.folders[i], err: err})
+			} else {
+				errors = append(errors, fmt.Sprintf("%s: %v", choice.folders[i], err))
+				failedTargets = append(failedTargets, destFile)
+			}
 		} else {
-			actualFiles = append(actualFiles, actualFile)
+			copies.files = append(copies.files, actualFile)
+			copies.outcomes = append(copies.outcomes, outcome)
 			successCount++
 		}
 	}
 
-	// If any destination failed, copy to error folder
-	if len(errors) > 0 {
-		errorFile := filepath.Join(ERROR_DIR, filename)
-		if _, err := copyFileWithConflictResolution(srcFile, errorFile); err != nil && VERBOSE {
-			printWarning(fmt.Sprintf("Failed to copy to error folder: %v", err))
+	// Queue transient failures for retry, keeping the result until they succeed
+	if len(transient) > 0 {
+		pending, err := queueOutputRetries(srcFile, filename, transient)
+		if err != nil {
+			for _, f := range transient {
+				errors = append(errors, fmt.Sprintf("%s: %v", f.folder, f.err))
+				failedTargets = append(failedTargets, f.target)
+			}
+			if VERBOSE {
+				printWarning(err.Error())
+			}
+		} else {
+			copies.retries = pending
+			for _, p := range pending {
+				copies.outcomes[p.Index] = OUTCOME_QUEUED
+				printWarning(fmt.Sprintf("Copy to %s failed, will retry: %s", filepath.Base(p.Folder), p.LastError))
+			}
+			successCount += len(pending)
 		}
+	}
 
+	// If any destination failed for good, copy to error folder
+	if len(errors) > 0 {
 		if VERBOSE {
 			for _, errMsg := range errors {
 				printWarning(fmt.Sprintf("Output destination failed: %s", errMsg))
@@ -367,12 +530,27 @@ func copyToAllOutputFolders(srcFile, filename string) ([]string, error) {
 		}
 
 		// If no destinations succeeded, return error
+		// The originals go to the error folder instead, so only they are retried
 		if successCount == 0 {
-			return actualFiles, fmt.Errorf("all output destinations failed: %v", errors)
+			return copies, fmt.Errorf("all output destinations failed: %v", errors)
+		}
+
+		errorFile := filepath.Join(ERROR_DIR, filename)
+		if actualError, err := copyFileWithConflictResolution(srcFile, errorFile); err != nil {
+			if VERBOSE {
+				printWarning(fmt.Sprintf("Failed to copy to error folder: %v", err))
+			}
+		} else {
+			report := newErrorReport(srcFile, "", withStage(STAGE_OUTPUT, fmt.Errorf("output destinations failed: %s", strings.Join(errors, "; "))))
+			report.File = filename
+			report.Destinations = failedTargets
+			if err := writeErrorReport(actualError, report); err != nil && VERBOSE {
+				printWarning(fmt.Sprintf("Failed to write error report: %v", err))
+			}
 		}
 	}
 
-	return actualFiles, nil
+	return copies, nil
 }
 
 // Toggle archive mode
@@ -432,9 +610,11 @@ func exitApplication() {
 // Show comprehensive help information
 func showHelp() {
 	fmt.Printf("BlendPDF v%s - A tool for merging PDF files\n\n", VERSION)
-	fmt.Printf("Usage: %s [options] [folder]\n\n", filepath.Base(os.Args[0]))
+	fmt.Printf("Usage: %s [options] [folder]\n", filepath.Base(os.Args[0]))
+	fmt.Printf("       %s <command> [options]\n\n", filepath.Base(os.Args[0]))
 
 	showCommandLineOptions()
+	showCommands()
 	showUsageExamples()
 	showInteractiveOptions()
 }
@@ -461,6 +641,11 @@ func showUsageExamples() {
 	fmt.Printf("  %s -D                # Run in debug mode\n", baseName)
 	fmt.Printf("  %s /path/to/pdfs     # Watch specific folder\n", baseName)
 	fmt.Printf("  %s -V /path/to/pdfs  # Verbose mode with specific folder\n", baseName)
+	fmt.Printf("  %s history undo      # Undo the most recent operation\n", baseName)
+	fmt.Printf("  %s errors retry      # Move failed files back to the watch folder\n", baseName)
+	fmt.Printf("  %s search bank       # Find processed files containing \"bank\"\n", baseName)
+	fmt.Printf("  %s restore scan.pdf  # Copy an archived original back to the watch folder\n", baseName)
+	fmt.Printf("  %s archive keygen    # Create a key pair for encrypting the archive\n", baseName)
 	fmt.Printf("  %s                   # Watch current directory\n\n", baseName)
 }
 
@@ -469,6 +654,12 @@ func showInteractiveOptions() {
 	fmt.Printf("Interactive options:\n")
 	fmt.Printf("  S - Move a single PDF file to the output directory\n")
 	fmt.Printf("  M - Merge two PDF files (first file + reversed second file)\n")
+	fmt.Printf("  C - Scan front and back on the network scanner and merge them\n")
+	fmt.Printf("  U - Undo the most recent operation\n")
+	fmt.Printf("  Y - Redo the most recently undone operation\n")
+	fmt.Printf("  L - List operation history\n")
+	fmt.Printf("  E - Retry files from the error folder\n")
+	fmt.Printf("  B - Browse the archive to restore or reprocess originals\n")
 	fmt.Printf("  H - Show this help information\n")
 	fmt.Printf("  V - Toggle verbose mode\n")
 	fmt.Printf("  D - Toggle debug mode\n")
@@ -496,15 +687,17 @@ func processSingleFileWithValidation() {
 	logDebugOperation("Processing single file", filename)
 
 	if err := validateAndProcessSingleFile(file, filename, startTime); err != nil {
-		handleSingleFileError(file, filename, err)
+		handleSingleFileError(file, filename, err, startTime)
 	}
 }
 
 // Validate and process single file
 func validateAndProcessSingleFile(file, filename string, startTime time.Time) error {
-	if err := validatePDFFile(file); err != nil {
-		return fmt.Errorf("validation failed: %v", err)
+	source, repaired, err := validateOrRepairPDF(file)
+	if err != nil {
+		return withStage(STAGE_VALIDATION, fmt.Errorf("validation failed: %v", err))
 	}
+	defer removeRepairedCopy(source, repaired)
 
 	if VERBOSE {
 		filesize := getHumanReadableSize(file)
@@ -512,11 +705,19 @@ func validateAndProcessSingleFile(file, filename string, startTime time.Time) er
 	}
 
 	fileSize := getFileSize(file)
+	var inputs []EventFile
+	if eventWanted(EVENT_SUCCESS) {
+		inputs = eventFiles([]string{file}, source)
+	}
 
-	// Get output folders for tracking
-	outputFolders := []string{"output"}
-	if CONFIG != nil && len(CONFIG.OutputFolders) > 0 {
-		outputFolders = CONFIG.OutputFolders
+	choice, err := preflightOperation(source, filename, file)
+	if err != nil {
+		return err
+	}
+
+	journal, err := beginJournal("single", file)
+	if err != nil {
+		return err
 	}
 
 	var archiveFiles []string
@@ -525,32 +726,48 @@ func validateAndProcessSingleFile(file, filename string, startTime time.Time) er
 	if CONFIG != nil && CONFIG.ArchiveMode {
 		// Copy to archive first
 		archiveFile := filepath.Join(ARCHIVE, filename)
-		actualArchive, err := copyFileWithConflictResolution(file, archiveFile)
+		actualArchive, err := journal.archive(file, archiveFile)
 		if err != nil {
-			return fmt.Errorf("archive copy failed: %v", err)
+			journal.abort()
+			return withStage(STAGE_OUTPUT, fmt.Errorf("archive copy failed: %v", err))
 		}
 		archiveFiles = append(archiveFiles, actualArchive)
 	}
 
-	// Copy to all output folders
-	actualFiles, err := copyToAllOutputFolders(file, filename)
+	// Copy to the routed output folders (the original stays in the archive, outputs get the repaired copy)
+	copies, err := copyToOutputs(journal, choice, source, filename)
 	if err != nil {
-		return fmt.Errorf("output copy failed: %v", err)
+		journal.abort()
+		return withStage(STAGE_OUTPUT, fmt.Errorf("output copy failed: %v", err))
+	}
+
+	// Plan the removal before committing, so recovery finishes it after a crash
+	op := &LastOperation{
+		Type:             "single",
+		OriginalFiles:    []string{file},
+		ActualFiles:      copies.files,
+		ConflictOutcomes: copies.outcomes,
+		OutputFolders:    copies.folders,
+		Route:            copies.route,
+		ArchiveFiles:     archiveFiles,
+		Repaired:         repairedNames(file, repaired),
+		ArchiveStore:     archiveStoreFor(archiveFiles),
 	}
+	removal := journal.planRemove(file)
+	journal.commit(op)
 
 	// Remove original file
-	if err := os.Remove(file); err != nil {
+	if err := journal.run(removal); err != nil {
 		return fmt.Errorf("failed to remove original file: %v", err)
 	}
+	journal.finish()
 
 	// Track operation for undo
-	LAST_OPERATION = &LastOperation{
-		Type:          "single",
-		OriginalFiles: []string{file},
-		ActualFiles:   actualFiles,
-		OutputFolders: outputFolders,
-		ArchiveFiles:  archiveFiles,
-		Timestamp:     time.Now(),
+	op.Timestamp = time.Now()
+	entry := recordOperation(op)
+	linkOutputRetries(copies.retries, entry)
+	if err := notifySuccess(entry, inputs, startTime); err != nil {
+		return err
 	}
 
 	recordSuccessfulOperation(startTime, filename, fileSize)
@@ -558,11 +775,23 @@ func validateAndProcessSingleFile(file, filename string, startTime time.Time) er
 }
 
 // Handle single file processing errors
-func handleSingleFileError(file, filename string, err error) {
+func handleSingleFileError(file, filename string, err error, startTime time.Time) {
 	printError(fmt.Sprintf("'%s' processing failed: %v", filename, err))
 
-	destFile := filepath.Join(ERROR_DIR, filename)
-	if moveErr := moveFileWithRecovery(file, destFile); moveErr != nil {
+	if isHookError(err) {
+		printWarning("The file was processed; its outputs were kept")
+		logOperation("SINGLE_FILE_MOVE", filename, "", "FAILED")
+		return
+	}
+	notifyFailure("single", err, startTime, file)
+
+	if isPreflightError(err) {
+		printWarning("Nothing was moved; the file stays in the watch folder")
+		logOperation("SINGLE_FILE_REFUSED", filename, "", "FAILED")
+		return
+	}
+
+	if moveErr := moveToErrorFolder(file, "", err); moveErr != nil {
 		printError(fmt.Sprintf("Failed to move invalid file to error directory: %v", moveErr))
 	} else {
 		ERROR_COUNT++
@@ -600,100 +829,208 @@ func processMergeFilesWithValidation() {
 	logDebugOperation("Processing merge", fmt.Sprintf("%s + %s", filepath.Base(file1), filepath.Base(file2)))
 
 	if err := validateAndProcessMerge(file1, file2, startTime); err != nil {
-		handleMergeError(file1, file2, err)
+		handleMergeError(file1, file2, err, startTime)
 	}
 }
 
 // Validate and process merge operation
 func validateAndProcessMerge(file1, file2 string, startTime time.Time) error {
-	if err := validateBothPDFs(file1, file2); err != nil {
-		return err
+	_, err := processMerge(file1, file2, startTime)
+	return err
+}
+
+// Merge two files, returns the name the result was delivered under
+func processMerge(file1, file2 string, startTime time.Time) (string, error) {
+	source1, source2, repaired, err := validateBothPDFs(file1, file2)
+	if err != nil {
+		return "", withStage(STAGE_VALIDATION, err)
 	}
+	defer removeRepairedCopy(source1, repaired[0])
+	defer removeRepairedCopy(source2, repaired[1])
 
 	displayMergeInfo(file1, file2)
 	totalSize := getFileSize(file1) + getFileSize(file2)
+	var inputs []EventFile
+	if eventWanted(EVENT_SUCCESS) {
+		inputs = eventFiles([]string{file1, file2}, source1, source2)
+	}
 
-	// Get output folders for tracking
-	outputFolders := []string{"output"}
-	if CONFIG != nil && len(CONFIG.OutputFolders) > 0 {
-		outputFolders = CONFIG.OutputFolders
+	journal, err := beginJournal("merge", file1, file2)
+	if err != nil {
+		return "", err
 	}
 
 	// Create temporary output file
 	name1 := strings.TrimSuffix(filepath.Base(file1), filepath.Ext(file1))
 	name2 := strings.TrimSuffix(filepath.Base(file2), filepath.Ext(file2))
 	tempOutputFile := filepath.Join(os.TempDir(), name1+"-"+name2+".pdf")
+	journal.plan(STEP_TEMP, "", tempOutputFile, false)
 
-	// Process and merge to temporary file
-	processAndMergeToTemp(tempOutputFile, file1, file2, 0)
+	// Process and merge to temporary file (repaired copies stand in for broken originals)
+	if err := processAndMergeToTemp(tempOutputFile, source1, source2, 0); err != nil {
+		journal.abort()
+		return "", err
+	}
 
-	// Copy to all output folders
+	// Check the destinations before anything leaves the watch folder
 	filename := name1 + "-" + name2 + ".pdf"
-	actualFiles, err := copyToAllOutputFolders(tempOutputFile, filename)
+	choice, err := preflightOperation(tempOutputFile, filename, file1, file2)
 	if err != nil {
-		os.Remove(tempOutputFile)
-		return fmt.Errorf("failed to copy to output folders: %v", err)
+		journal.abort()
+		return "", err
 	}
 
+	// Copy to the routed output folders
+	copies, err := copyToOutputs(journal, choice, tempOutputFile, filename)
+	if err != nil {
+		journal.abort()
+		return "", withStage(STAGE_OUTPUT, fmt.Errorf("failed to copy to output folders: %v", err))
+	}
+
+	// Plan archiving and removing the originals before committing, so recovery finishes them after a crash
+	archiving := CONFIG != nil && CONFIG.ArchiveMode
+	moves := planOriginalMoves(journal, archiving, file1, file2)
+	op := &LastOperation{
+		Type:             "merge",
+		OriginalFiles:    []string{file1, file2},
+		ActualFiles:      copies.files,
+		ConflictOutcomes: copies.outcomes,
+		OutputFolders:    copies.folders,
+		Route:            copies.route,
+		ArchiveFiles:     plannedArchiveFiles(moves),
+		Repaired:         append(repairedNames(file1, repaired[0]), repairedNames(file2, repaired[1])...),
+	}
+	op.ArchiveStore = archiveStoreFor(op.ArchiveFiles)
+	journal.commit(op)
+
 	// Clean up temporary file
-	os.Remove(tempOutputFile)
+	journal.removeTemp(tempOutputFile)
 
 	// Move source files to archive (respect archive mode setting)
 	var archiveFiles []string
-	if CONFIG != nil && CONFIG.ArchiveMode {
-		archiveFile1 := filepath.Join(ARCHIVE, filepath.Base(file1))
-		archiveFile2 := filepath.Join(ARCHIVE, filepath.Base(file2))
-		actualArchive1, err1 := copyFileWithConflictResolution(file1, archiveFile1)
-		actualArchive2, err2 := copyFileWithConflictResolution(file2, archiveFile2)
-
-		moveProcessedFiles(ARCHIVE, "Files merged and moved.", file1, file2)
-
-		// Track archive files for undo (only if archive copies succeeded)
-		if err1 == nil {
-			archiveFiles = append(archiveFiles, actualArchive1)
-		}
-		if err2 == nil {
-			archiveFiles = append(archiveFiles, actualArchive2)
-		}
+	if archiving {
+		archiveFiles = archiveMergedOriginals(journal, moves)
 	} else {
 		// No archiving - just remove original files
-		if err := os.Remove(file1); err != nil && VERBOSE {
-			printWarning(fmt.Sprintf("Failed to remove %s: %v", file1, err))
-		}
-		if err := os.Remove(file2); err != nil && VERBOSE {
-			printWarning(fmt.Sprintf("Failed to remove %s: %v", file2, err))
+		for _, move := range moves {
+			if err := journal.run(move.removal); err != nil && VERBOSE {
+				printWarning(fmt.Sprintf("Failed to remove %s: %v", move.file, err))
+			}
 		}
 		if VERBOSE {
 			printSuccess("Files merged and removed.")
 		}
 	}
-	LAST_OPERATION = &LastOperation{
-		Type:          "merge",
-		OriginalFiles: []string{file1, file2},
-		ActualFiles:   actualFiles,
-		OutputFolders: outputFolders,
-		ArchiveFiles:  archiveFiles,
-		Timestamp:     time.Now(),
+	journal.finish()
+
+	op.ArchiveFiles = archiveFiles
+	op.ArchiveStore = archiveStoreFor(archiveFiles)
+	op.Timestamp = time.Now()
+	entry := recordOperation(op)
+	linkOutputRetries(copies.retries, entry)
+	if err := notifySuccess(entry, inputs, startTime); err != nil {
+		return "", err
 	}
 
 	duration := time.Since(startTime)
 	logOperation("MERGE", filepath.Base(file1), filepath.Base(file2), "COMPLETED")
 	logPerformance("MERGE", duration, totalSize)
 
-	return nil
+	return copies.name(), nil
+}
+
+// originalMove is the planned archiving and removal of one merged original
+type originalMove struct {
+	file       string
+	archive    plannedStep
+	archiveErr error // Archiving could not be planned, so the original stays put
+	removal    plannedStep
+}
+
+// Plan archiving (when enabled) and removing merged originals
+// An original whose archive copy cannot be planned gets no removal step
+func planOriginalMoves(journal *operationJournal, archiving bool, files ...string) []originalMove {
+	moves := make([]originalMove, len(files))
+	for i, file := range files {
+		moves[i].file = file
+		if archiving {
+			moves[i].archive, moves[i].archiveErr = journal.planArchive(file, filepath.Join(ARCHIVE, filepath.Base(file)))
+			if moves[i].archiveErr != nil {
+				continue
+			}
+		}
+		moves[i].removal = journal.planRemove(file)
+	}
+	return moves
 }
 
-// Validate both PDFs for merge
-func validateBothPDFs(file1, file2 string) error {
-	if err := validatePDFFile(file1); err != nil {
-		return fmt.Errorf("first PDF '%s' is invalid: %v", filepath.Base(file1), err)
+// List the archive paths of planned moves ("" where archiving could not be planned)
+func plannedArchiveFiles(moves []originalMove) []string {
+	archiveFiles := make([]string, len(moves))
+	for i, move := range moves {
+		if move.archiveErr == nil {
+			archiveFiles[i] = move.archive.step.Target
+		}
 	}
+	return archiveFiles
+}
+
+// Copy merged originals to the archive and remove them from the watch folder
+// Returns archive paths aligned with the originals ("" where archiving failed)
+func archiveMergedOriginals(journal *operationJournal, moves []originalMove) []string {
+	archiveFiles := make([]string, len(moves))
+	allMoved := true
+
+	for i, move := range moves {
+		err := move.archiveErr
+		if err == nil {
+			err = journal.run(move.archive)
+		}
+		if err != nil {
+			// Keep the original in the watch folder rather than lose it
+			printError(fmt.Sprintf("Failed to move %s: %v", filepath.Base(move.file), err))
+			allMoved = false
+			continue
+		}
+		archiveFiles[i] = move.archive.step.Target
 
-	if err := validatePDFFile(file2); err != nil {
-		return fmt.Errorf("second PDF '%s' is invalid: %v", filepath.Base(file2), err)
+		if err := journal.run(move.removal); err != nil {
+			printWarning(fmt.Sprintf("Original file not deleted: %v", err))
+		} else if VERBOSE {
+			printInfo(fmt.Sprintf("Moved %s to %s", filepath.Base(move.file), filepath.Base(ARCHIVE)))
+		}
 	}
 
-	return nil
+	updateCountersBasedOnResults(allMoved, ARCHIVE, "Files merged and moved.")
+	return archiveFiles
+}
+
+// Validate both PDFs for merge, repairing them if needed
+// Returns the files to merge and which of them are repaired copies
+func validateBothPDFs(file1, file2 string) (string, string, [2]bool, error) {
+	var repaired [2]bool
+
+	source1, repaired1, err := validateOrRepairPDF(file1)
+	if err != nil {
+		return "", "", repaired, fmt.Errorf("first PDF '%s' is invalid: %v", filepath.Base(file1), err)
+	}
+
+	source2, repaired2, err := validateOrRepairPDF(file2)
+	if err != nil {
+		removeRepairedCopy(source1, repaired1)
+		return "", "", repaired, fmt.Errorf("second PDF '%s' is invalid: %v", filepath.Base(file2), err)
+	}
+
+	repaired[0], repaired[1] = repaired1, repaired2
+	return source1, source2, repaired, nil
+}
+
+// List an original in operation details if it was processed from a repaired copy
+func repairedNames(file string, repaired bool) []string {
+	if !repaired {
+		return nil
+	}
+	return []string{filepath.Base(file)}
 }
 
 // Display merge information
@@ -714,31 +1051,35 @@ func displayMergeInfo(file1, file2 string) {
 }
 
 // Handle merge processing errors
-func handleMergeError(file1, file2 string, err error) {
+func handleMergeError(file1, file2 string, err error, startTime time.Time) {
 	printError(fmt.Sprintf("Merge processing failed: %v", err))
-	moveInvalidFiles(file1, file2)
+
+	if isHookError(err) {
+		printWarning("The files were merged; the outputs were kept")
+		logOperation("MERGE", filepath.Base(file1), filepath.Base(file2), "FAILED")
+		return
+	}
+	notifyFailure("merge", err, startTime, file1, file2)
+
+	if isPreflightError(err) {
+		printWarning("Nothing was moved; the files stay in the watch folder")
+		logOperation("MERGE_REFUSED", filepath.Base(file1), filepath.Base(file2), "FAILED")
+		return
+	}
+	moveInvalidFiles(err, file1, file2)
 	logOperation("MERGE_INVALID", filepath.Base(file1), filepath.Base(file2), "FAILED")
 }
 
-// Move invalid files to error directory
-func moveInvalidFiles(files ...string) {
-	for _, file := range files {
-		if file == "" {
-			continue
-		}
-		filename := filepath.Base(file)
-		destFile := filepath.Join(ERROR_DIR, filename)
-		if err := moveFileWithRecovery(file, destFile); err != nil {
-			printError(fmt.Sprintf("Failed to move invalid file %s: %v", filename, err))
-		}
-	}
+// Move invalid files to error directory with a report of the cause
+func moveInvalidFiles(cause error, files ...string) {
+	moveFilesToErrorFolder(cause, files...)
 	ERROR_COUNT++
 	printError("Invalid PDF files moved to error folder")
 }
 
 // Get file size safely
 func getFileSize(filepath string) int64 {
-	if info, err := os.Stat(filepath); err == nil {
+	if info, err := STORAGE.stat(filepath); err == nil {
 		return info.Size()
 	}
 	return 0
@@ -754,6 +1095,8 @@ func logDebugOperation(operation, details string) {
 // Cleanup resources and show statistics
 func cleanup() {
 	// Statistics now handled by enhanced menu UI
+	stopFTPReceiver()
+	stopSMTPReceiver()
 	cleanupLock()
 }
 
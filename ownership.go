@@ -0,0 +1,235 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Per-destination ownership
+//
+// A destination can set the mode of the files copied into it (fileMode), the
+// mode of the folder itself (dirMode) and the group owning both (group).
+// Settings are applied after every copy and whenever the folder is used, and
+// checked at startup so a destination the process can't manage stops the
+// program before any file moves.
+
+// ownershipSettings are a destination's parsed ownership settings
+type ownershipSettings struct {
+	fileMode    os.FileMode
+	dirMode     os.FileMode
+	gid         int
+	hasFileMode bool
+	hasDirMode  bool
+	hasGroup    bool
+}
+
+// Check whether a destination sets any ownership
+func (d DestinationConfig) hasOwnership() bool {
+	return d.FileMode != "" || d.DirMode != "" || d.Group != ""
+}
+
+// Validate the ownership settings that don't depend on this machine
+func (d DestinationConfig) validateOwnership() error {
+	for _, mode := range []string{d.FileMode, d.DirMode} {
+		if mode == "" {
+			continue
+		}
+		if _, err := parsePermissions(mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse a destination's ownership settings, looking up its group
+func (d DestinationConfig) ownership() (ownershipSettings, error) {
+	var settings ownershipSettings
+	var err error
+	if d.FileMode != "" {
+		if settings.fileMode, err = parsePermissions(d.FileMode); err != nil {
+			return settings, err
+		}
+		settings.hasFileMode = true
+	}
+	if d.DirMode != "" {
+		if settings.dirMode, err = parsePermissions(d.DirMode); err != nil {
+			return settings, err
+		}
+		settings.hasDirMode = true
+	}
+	if d.Group != "" {
+		if settings.gid, err = lookupGroupID(d.Group); err != nil {
+			return settings, err
+		}
+		settings.hasGroup = true
+	}
+	return settings, nil
+}
+
+// Parse octal permissions such as "0640"
+func parsePermissions(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("invalid permissions %q: expected octal such as 0640", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// Resolve a group name or numeric group ID
+func lookupGroupID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	found, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, fmt.Errorf("unknown group %q", group)
+	}
+	return strconv.Atoi(found.Gid)
+}
+
+// Get the ownership settings for a destination folder
+func destinationOwnership(dir string) (ownershipSettings, bool) {
+	dest, ok := findDestinationConfig(dir)
+	if !ok || !dest.hasOwnership() {
+		return ownershipSettings{}, false
+	}
+	settings, err := dest.ownership()
+	if err != nil {
+		// Reported by the startup check; copies keep default ownership
+		return ownershipSettings{}, false
+	}
+	return settings, true
+}
+
+// Apply the file settings of dst's destination to path, the temp file that becomes dst
+func applyFileOwnership(path, dst string) error {
+	settings, ok := destinationOwnership(filepath.Dir(dst))
+	if !ok {
+		return nil
+	}
+	return applyOwnership(path, settings.fileMode, settings.hasFileMode, settings.gid, settings.hasGroup)
+}
+
+// Apply the folder settings of a destination
+func applyDirOwnership(dir string) error {
+	settings, ok := destinationOwnership(dir)
+	if !ok {
+		return nil
+	}
+	return applyOwnership(dir, settings.dirMode, settings.hasDirMode, settings.gid, settings.hasGroup)
+}
+
+// Set a path's mode and group where they differ from the wanted ones
+func applyOwnership(path string, mode os.FileMode, hasMode bool, gid int, hasGroup bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if hasGroup {
+		if current, ok := fileGroupID(info); !ok || current != gid {
+			if err := os.Chown(path, -1, gid); err != nil {
+				return unwrapPathError(err)
+			}
+		}
+	}
+	// Chmod after chown, which may clear setgid bits
+	if hasMode && info.Mode().Perm() != mode {
+		if err := os.Chmod(path, mode); err != nil {
+			return unwrapPathError(err)
+		}
+	}
+	return nil
+}
+
+// Get the folder a destination settings key refers to
+func destinationFolder(name string) string {
+	switch name {
+	case "archive":
+		return ARCHIVE
+	case "error":
+		return ERROR_DIR
+	}
+	return name
+}
+
+// Confirm the process may apply every destination's ownership settings
+func checkDestinationOwnership() error {
+	if CONFIG == nil {
+		return nil
+	}
+
+	var names []string
+	for name, dest := range CONFIG.Destinations {
+		if dest.hasOwnership() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var problems []string
+	for _, name := range names {
+		if err := checkOwnershipAllowed(destinationFolder(name), CONFIG.Destinations[name]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("destination ownership settings can't be applied: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Check one destination's settings against what this process may do
+func checkOwnershipAllowed(folder string, dest DestinationConfig) error {
+	settings, err := dest.ownership()
+	if err != nil {
+		return err
+	}
+	if settings.hasGroup {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("group ownership is not supported on Windows")
+		}
+		if !canUseGroup(settings.gid) {
+			return fmt.Errorf("this user is not a member of group %s", dest.Group)
+		}
+	}
+
+	// A folder that isn't there yet gets its settings when it is first used
+	if info, err := os.Stat(folder); err != nil || !info.IsDir() {
+		return nil
+	}
+	if err := applyOwnership(folder, settings.dirMode, settings.hasDirMode, settings.gid, settings.hasGroup); err != nil {
+		return fmt.Errorf("can't set folder ownership: %v", err)
+	}
+
+	probe, err := os.CreateTemp(folder, TEMP_FILE_PREFIX+"ownership.*"+TEMP_FILE_SUFFIX)
+	if err != nil {
+		return unwrapPathError(err)
+	}
+	name := probe.Name()
+	probe.Close()
+	defer os.Remove(name)
+	if err := applyOwnership(name, settings.fileMode, settings.hasFileMode, settings.gid, settings.hasGroup); err != nil {
+		return fmt.Errorf("can't set file ownership: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePermissions(t *testing.T) {
+	mode, err := parsePermissions("0640")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), mode)
+
+	for _, bad := range []string{"rw-r-----", "0999", "17777", ""} {
+		_, err := parsePermissions(bad)
+		assert.Error(t, err, bad)
+	}
+
+	config := getDefaultConfig()
+	config.Destinations = map[string]DestinationConfig{"out": {FileMode: "0640", DirMode: "2750", Group: "office"}}
+	assert.Error(t, validateConfig(config), "setgid is outside the permission bits")
+	config.Destinations["out"] = DestinationConfig{FileMode: "0640", DirMode: "0750", Group: "office"}
+	assert.NoError(t, validateConfig(config))
+}
+
+func TestCopyAppliesDestinationOwnership(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX modes and groups")
+	}
+	tempDir := useTestWorkspace(t)
+	shared := filepath.Join(tempDir, "shared")
+	CONFIG.Destinations = map[string]DestinationConfig{
+		shared: {FileMode: "0640", DirMode: "0710", Group: strconv.Itoa(os.Getegid())},
+	}
+	src := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	assert.NoError(t, performFileCopy(src, filepath.Join(shared, "scan.pdf")))
+	info, err := os.Stat(filepath.Join(shared, "scan.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o640), info.Mode().Perm())
+	gid, ok := fileGroupID(info)
+	assert.True(t, ok)
+	assert.Equal(t, os.Getegid(), gid)
+
+	info, err = os.Stat(shared)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o710), info.Mode().Perm())
+
+	// Folders without settings keep the defaults
+	assert.NoError(t, performFileCopy(src, filepath.Join(tempDir, "plain", "scan.pdf")))
+	info, err = os.Stat(filepath.Join(tempDir, "plain", "scan.pdf"))
+	assert.NoError(t, err)
+	assert.Equal(t, DEFAULT_FILE_MODE, info.Mode().Perm())
+}
+
+// verifyRecorder notes the mode a temp file has when it is verified, before the rename
+type verifyRecorder struct {
+	storage
+	modes []os.FileMode
+}
+
+func (r *verifyRecorder) createAtomic(path string, reader io.Reader, verify func(tempPath string, size int64) error) (int64, error) {
+	return r.storage.createAtomic(path, reader, func(tempPath string, size int64) error {
+		err := verify(tempPath, size)
+		if info, statErr := os.Stat(tempPath); statErr == nil {
+			r.modes = append(r.modes, info.Mode().Perm())
+		}
+		return err
+	})
+}
+
+func TestOwnershipIsAppliedBeforeRename(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX modes and groups")
+	}
+	tempDir := useTestWorkspace(t)
+	recorder := &verifyRecorder{storage: STORAGE}
+	STORAGE = recorder
+
+	shared := filepath.Join(tempDir, "shared")
+	CONFIG.Destinations = map[string]DestinationConfig{shared: {FileMode: "0640"}}
+	src := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	assert.NoError(t, performFileCopy(src, filepath.Join(shared, "scan.pdf")))
+	assert.Equal(t, []os.FileMode{0o640}, recorder.modes)
+}
+
+func TestCheckDestinationOwnership(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("POSIX modes and groups")
+	}
+	tempDir := useTestWorkspace(t)
+	CONFIG.Destinations = map[string]DestinationConfig{
+		"archive": {FileMode: "0600", Group: strconv.Itoa(os.Getegid())},
+	}
+	assert.NoError(t, checkDestinationOwnership())
+	entries, err := os.ReadDir(ARCHIVE)
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "the probe file is removed")
+
+	CONFIG.Destinations["error"] = DestinationConfig{Group: "no-such-group-blendpdf"}
+	err = checkDestinationOwnership()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `error: unknown group "no-such-group-blendpdf"`)
+
+	if !canUseGroup(0) {
+		delete(CONFIG.Destinations, "error")
+		CONFIG.Destinations[filepath.Join(tempDir, "output")] = DestinationConfig{Group: "0"}
+		assert.ErrorContains(t, checkDestinationOwnership(), "not a member of group 0")
+	}
+}
@@ -17,11 +17,13 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
 	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
 	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
 )
 
@@ -39,15 +41,13 @@ func validatePDF(file string) bool {
 
 // Check if file exists
 func fileExists(file string) bool {
-	_, err := os.Stat(file)
+	_, err := STORAGE.stat(file)
 	return !os.IsNotExist(err)
 }
 
 // Validate PDF structure using pdfcpu API
 func validatePDFStructure(file string) bool {
-	conf := createValidationConfig()
-
-	if err := api.ValidateFile(file, conf); err != nil {
+	if err := validateFileSafely(file); err != nil {
 		printError(fmt.Sprintf("'%s' is not a valid PDF file: %v", file, err))
 		return false
 	}
@@ -55,6 +55,20 @@ func validatePDFStructure(file string) bool {
 	return true
 }
 
+// Run relaxed pdfcpu validation, turning parser panics on badly broken files into errors
+func validateFileSafely(file string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("pdfcpu: unreadable file structure: %v", r)
+		}
+	}()
+	data, err := readStorageFile(file)
+	if err != nil {
+		return err
+	}
+	return api.Validate(bytes.NewReader(data), createValidationConfig())
+}
+
 // Create validation configuration
 func createValidationConfig() *model.Configuration {
 	conf := model.NewDefaultConfiguration()
@@ -66,7 +80,11 @@ func createValidationConfig() *model.Configuration {
 
 // Get page count using pdfcpu API
 func getPageCount(file string) (int, error) {
-	pageCount, err := api.PageCountFile(file)
+	data, err := readStorageFile(file)
+	if err != nil {
+		return -1, fmt.Errorf("could not determine page count for '%s': %v", file, err)
+	}
+	pageCount, err := api.PageCount(bytes.NewReader(data), model.NewDefaultConfiguration())
 	if err != nil {
 		return -1, fmt.Errorf("could not determine page count for '%s': %v", file, err)
 	}
@@ -152,7 +170,7 @@ func displayReversalInfo(pageCount int) {
 // Clean up temporary files
 func cleanupTempFiles(tempFiles []string) {
 	for _, tempFile := range tempFiles {
-		if err := os.Remove(tempFile); err != nil && VERBOSE {
+		if err := STORAGE.remove(tempFile); err != nil && VERBOSE {
 			printWarning(fmt.Sprintf("Failed to remove temp file %s: %v", tempFile, err))
 		}
 	}
@@ -175,9 +193,21 @@ func performDirectMerge(file1, file2, outputFile string) error {
 		printInfo("Single-page second file detected - merging directly without reversal")
 	}
 
-	conf := model.NewDefaultConfiguration()
-	inputFiles := []string{file1, file2}
-	return api.MergeCreateFile(inputFiles, outputFile, false, conf)
+	var readers []io.ReadSeeker
+	for _, file := range []string{file1, file2} {
+		data, err := readStorageFile(file)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, bytes.NewReader(data))
+	}
+
+	var merged bytes.Buffer
+	if err := api.MergeRaw(readers, &merged, false, model.NewDefaultConfiguration()); err != nil {
+		return err
+	}
+	_, err := atomicWrite(outputFile, &merged, nil)
+	return err
 }
 
 // Perform reversed merge for multi-page second file using in-memory processing
@@ -196,7 +226,7 @@ func createReversedFileName(file string) string {
 
 // Remove reversed file with error handling
 func removeReversedFile(reversedFile string) {
-	if err := os.Remove(reversedFile); err != nil && VERBOSE {
+	if err := STORAGE.remove(reversedFile); err != nil && VERBOSE {
 		printWarning(fmt.Sprintf("Failed to clean up temporary file %s: %v", reversedFile, err))
 	}
 }
@@ -206,41 +236,25 @@ func createInterleavedMerge(file1, file2, outputFile string, pageCount int) erro
 	conf := model.NewDefaultConfiguration()
 
 	// Load both PDFs into memory
-	bytes1, err := os.ReadFile(file1)
+	bytes1, err := readStorageFile(file1)
 	if err != nil {
 		return fmt.Errorf("failed to read file1 into memory: %v", err)
 	}
 
-	bytes2, err := os.ReadFile(file2)
+	bytes2, err := readStorageFile(file2)
 	if err != nil {
 		return fmt.Errorf("failed to read file2 into memory: %v", err)
 	}
 
-	// Create reverse page selection for second document (3,2,1 for 3-page doc)
-	reversePages := ""
-	for i := pageCount; i >= 1; i-- {
-		if reversePages != "" {
-			reversePages += ","
-		}
-		reversePages += fmt.Sprintf("%d", i)
-	}
-
-	// Reverse second document in memory using stream-based Trim
-	reader2 := bytes.NewReader(bytes2)
-	var reversedBuffer bytes.Buffer
-	reverseSelection, err := api.ParsePageSelection(reversePages)
-	if err != nil {
-		return fmt.Errorf("failed to parse reverse page selection: %v", err)
-	}
-
-	err = api.Trim(reader2, &reversedBuffer, reverseSelection, conf)
+	// Reverse second document in memory
+	reversed, err := reversePDFPages(bytes2, conf)
 	if err != nil {
 		return fmt.Errorf("failed to reverse document in memory: %v", err)
 	}
 
 	// Zip merge for perfect interleaving using stream-based MergeCreateZip
 	reader1 := bytes.NewReader(bytes1)
-	reversedReader := bytes.NewReader(reversedBuffer.Bytes())
+	reversedReader := bytes.NewReader(reversed)
 	var finalBuffer bytes.Buffer
 
 	err = api.MergeCreateZip(reader1, reversedReader, &finalBuffer, conf)
@@ -249,7 +263,7 @@ func createInterleavedMerge(file1, file2, outputFile string, pageCount int) erro
 	}
 
 	// Write final result to output file
-	err = os.WriteFile(outputFile, finalBuffer.Bytes(), 0644)
+	_, err = atomicWrite(outputFile, &finalBuffer, nil)
 	if err != nil {
 		return fmt.Errorf("failed to write output file: %v", err)
 	}
@@ -257,21 +271,147 @@ func createInterleavedMerge(file1, file2, outputFile string, pageCount int) erro
 	return nil
 }
 
+// Merge options for reprocessing a pair with different scan settings
+const (
+	BACK_ORDER_REVERSED = "reversed"   // Back pages were scanned last page first (the default)
+	BACK_ORDER_SCANNED  = "as-scanned" // Back pages are already in page order
+
+	FLIP_LONG_EDGE  = "long"  // Stack turned over its long edge (the default)
+	FLIP_SHORT_EDGE = "short" // Stack turned over its short edge, back pages are upside down
+)
+
+// MergeOptions describes how the back file of a pair was scanned
+type MergeOptions struct {
+	BackOrder string
+	FlipEdge  string
+}
+
+// Get the options the normal merge uses
+func defaultMergeOptions() MergeOptions {
+	return MergeOptions{BackOrder: BACK_ORDER_REVERSED, FlipEdge: FLIP_LONG_EDGE}
+}
+
+// Check merge options, filling in defaults for empty values
+func (o *MergeOptions) validate() error {
+	if o.BackOrder == "" {
+		o.BackOrder = BACK_ORDER_REVERSED
+	}
+	if o.FlipEdge == "" {
+		o.FlipEdge = FLIP_LONG_EDGE
+	}
+	if o.BackOrder != BACK_ORDER_REVERSED && o.BackOrder != BACK_ORDER_SCANNED {
+		return fmt.Errorf("invalid back order: %s (must be %s or %s)", o.BackOrder, BACK_ORDER_REVERSED, BACK_ORDER_SCANNED)
+	}
+	if o.FlipEdge != FLIP_LONG_EDGE && o.FlipEdge != FLIP_SHORT_EDGE {
+		return fmt.Errorf("invalid flip edge: %s (must be %s or %s)", o.FlipEdge, FLIP_LONG_EDGE, FLIP_SHORT_EDGE)
+	}
+	return nil
+}
+
+// Describe merge options for messages
+func (o MergeOptions) String() string {
+	return fmt.Sprintf("back order %s, %s-edge flip", o.BackOrder, o.FlipEdge)
+}
+
+// Merge a front and back file with explicit options
+func mergeWithOptions(file1, file2, outputFile string, opts MergeOptions) error {
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	pages1, pages2, err := validatePDFsForMerge(file1, file2)
+	if err != nil {
+		return withStage(STAGE_VALIDATION, err)
+	}
+	if opts == defaultMergeOptions() {
+		if err := smartMerge(file1, file2, outputFile, pages1, pages2); err != nil {
+			return withStage(STAGE_MERGE, fmt.Errorf("failed to merge PDFs: %v", err))
+		}
+		return nil
+	}
+
+	conf := model.NewDefaultConfiguration()
+	back, err := readStorageFile(file2)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", filepath.Base(file2), err)
+	}
+
+	if opts.BackOrder == BACK_ORDER_REVERSED && pages2 > 1 {
+		if back, err = reversePDFPages(back, conf); err != nil {
+			return withStage(STAGE_MERGE, fmt.Errorf("failed to reverse back pages: %v", err))
+		}
+	}
+
+	if opts.FlipEdge == FLIP_SHORT_EDGE {
+		var rotated bytes.Buffer
+		if err := api.Rotate(bytes.NewReader(back), &rotated, 180, nil, conf); err != nil {
+			return withStage(STAGE_MERGE, fmt.Errorf("failed to rotate back pages: %v", err))
+		}
+		back = rotated.Bytes()
+	}
+
+	front, err := readStorageFile(file1)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", filepath.Base(file1), err)
+	}
+
+	var merged bytes.Buffer
+	if err := api.MergeCreateZip(bytes.NewReader(front), bytes.NewReader(back), &merged, conf); err != nil {
+		return withStage(STAGE_MERGE, fmt.Errorf("failed to create interleaved merge: %v", err))
+	}
+	_, err = atomicWrite(outputFile, &merged, nil)
+	return err
+}
+
+// Reverse the page order of a PDF held in memory
+// (api.Trim sorts its page selection, so it cannot be used to reorder pages)
+func reversePDFPages(data []byte, conf *model.Configuration) ([]byte, error) {
+	ctx, err := api.ReadValidateAndOptimize(bytes.NewReader(data), conf)
+	if err != nil {
+		return nil, err
+	}
+
+	pageNrs := make([]int, 0, ctx.PageCount)
+	for i := ctx.PageCount; i >= 1; i-- {
+		pageNrs = append(pageNrs, i)
+	}
+	reversed, err := pdfcpu.ExtractPages(ctx, pageNrs, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := api.WriteContext(reversed, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Convert a scanned image (TIFF, PNG or JPEG) to a PDF with one page per frame, each sized to its image
+func convertImageToPDF(image io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := api.ImportImages(nil, &buf, []io.Reader{image}, pdfcpu.DefaultImportConfig(), model.NewDefaultConfiguration()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // Main processing function
 
 // Process and merge files with smart page reversal
 // Process and merge to temporary file (for multi-output support)
-func processAndMergeToTemp(outputFile, file1, file2 string, pages int) {
+// Failures are returned tagged with their stage; the caller moves the sources to the error folder
+func processAndMergeToTemp(outputFile, file1, file2 string, pages int) error {
 	pages1, pages2, err := validatePDFsForMerge(file1, file2)
 	if err != nil {
-		handleMergeValidationError(file1, file2, err)
-		return
+		return withStage(STAGE_VALIDATION, err)
 	}
 
 	if err := smartMerge(file1, file2, outputFile, pages1, pages2); err != nil {
-		handleMergeExecutionError(file1, file2, err)
+		return withStage(STAGE_MERGE, fmt.Errorf("failed to merge PDFs: %v", err))
 	}
 	// Note: Don't move source files here - that's handled by the caller
+	return nil
 }
 
 // Process and merge PDFs with file movement
@@ -292,13 +432,19 @@ func processAndMerge(outputFile, file1, file2 string, pages int) {
 // Handle merge validation errors
 func handleMergeValidationError(file1, file2 string, err error) {
 	printError(err.Error())
-	moveProcessedFiles(ERROR_DIR, "PDF validation failed. Moving files to error folder...", file1, file2)
+	moveFailedMergeFiles("PDF validation failed. Moving files to error folder...", withStage(STAGE_VALIDATION, err), file1, file2)
 }
 
 // Handle merge execution errors
 func handleMergeExecutionError(file1, file2 string, err error) {
 	printError(fmt.Sprintf("Failed to merge PDFs: %v", err))
-	moveProcessedFiles(ERROR_DIR, "Merge failed. Moving files to error folder...", file1, file2)
+	moveFailedMergeFiles("Merge failed. Moving files to error folder...", withStage(STAGE_MERGE, err), file1, file2)
+}
+
+// Move both merge sources to the error folder with reports
+func moveFailedMergeFiles(message string, cause error, file1, file2 string) {
+	allMoved := moveFilesToErrorFolder(cause, file1, file2)
+	updateCountersBasedOnResults(allMoved, ERROR_DIR, message)
 }
 
 // Handle successful merge
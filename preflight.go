@@ -0,0 +1,302 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pre-flight destination checks
+//
+// Before an operation moves anything, every folder it will write to (the
+// routed outputs, the archive and the error folder) is checked for write
+// permission and for enough free space to take its copies plus a margin.
+// An operation that fails a check is refused and its files stay in the
+// watch folder, so outputs are never left partially distributed.
+
+const (
+	DEFAULT_MIN_FREE_MB    = 100
+	DESTINATION_HEALTH_TTL = 60 * time.Second // How long the header reuses a health check
+)
+
+// destinationHealth is the result of checking one destination folder
+type destinationHealth struct {
+	Folder  string
+	Free    uint64 // Bytes available, when FreeOK
+	FreeOK  bool
+	Problem string // "" when the folder can take the copies
+}
+
+// preflightError lists the destinations that failed their checks
+type preflightError struct {
+	problems []string
+}
+
+func (e *preflightError) Error() string {
+	return "destination check failed: " + strings.Join(e.problems, "; ")
+}
+
+// Check whether an error is a refused pre-flight check
+func isPreflightError(err error) bool {
+	var pf *preflightError
+	return errors.As(err, &pf)
+}
+
+// Get the free space margin every destination must keep
+func minFreeBytes() uint64 {
+	mb := DEFAULT_MIN_FREE_MB
+	if CONFIG != nil && CONFIG.MinFreeMB > 0 {
+		mb = CONFIG.MinFreeMB
+	}
+	return uint64(mb) * 1024 * 1024 // #nosec G115 - validated non-negative
+}
+
+// Check an operation's destinations before anything is written
+// result is the file copied to the outputs; originals go to the archive, or the error folder on failure
+func preflightOperation(result, filename string, originals ...string) (*routeChoice, error) {
+	choice, err := chooseRoute(result, filename, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	resultSize := getFileSize(result)
+	var originalsSize int64
+	for _, original := range originals {
+		originalsSize += getFileSize(original)
+	}
+
+	needs := map[string]int64{}
+	var order []string
+	need := func(folder string, size int64) {
+		if folder == "" {
+			return
+		}
+		key := folder
+		if !isRemotePath(folder) {
+			key = filepath.Clean(folder)
+		}
+		if _, ok := needs[key]; !ok {
+			order = append(order, key)
+		}
+		needs[key] += size
+	}
+	for _, folder := range choice.folders {
+		need(folder, resultSize)
+	}
+	if CONFIG != nil && CONFIG.ArchiveMode && len(originals) > 0 {
+		need(ARCHIVE, originalsSize)
+	}
+	need(ERROR_DIR, originalsSize)
+
+	var problems []string
+	for _, folder := range order {
+		if health := checkDestination(folder, needs[folder]); health.Problem != "" {
+			problems = append(problems, health.Problem)
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &preflightError{problems: problems}
+	}
+	return choice, nil
+}
+
+// Check a folder is writable and has room for need bytes plus the margin
+func checkDestination(folder string, need int64) destinationHealth {
+	health := destinationHealth{Folder: folder}
+	name := filepath.Base(folder)
+
+	// Remote destinations have no free space to check; make sure they answer
+	if isRemotePath(folder) {
+		if err := checkRemoteDestination(folder); err != nil {
+			health.Problem = fmt.Sprintf("%s is not reachable: %v", folder, err)
+		}
+		return health
+	}
+
+	// A missing folder is created on first copy; check where it would be created
+	existing := existingAncestor(folder)
+	if existing == "" {
+		health.Problem = fmt.Sprintf("%s: no such folder", name)
+		return health
+	}
+
+	if err := probeWritable(existing); err != nil {
+		health.Problem = fmt.Sprintf("%s is not writable: %v", name, err)
+		return health
+	}
+
+	free, err := STORAGE.freeSpace(existing)
+	if err != nil {
+		// Some network filesystems can't report space; the write probe still passed
+		return health
+	}
+	health.Free, health.FreeOK = free, true
+
+	required := uint64(need) + minFreeBytes() // #nosec G115 - sizes are never negative
+	if free < required {
+		health.Problem = fmt.Sprintf("%s has %s free, needs %s (%s plus %s margin)",
+			name, formatFileSize(int64(free)), formatFileSize(int64(required)), formatFileSize(need), formatFileSize(int64(minFreeBytes()))) // #nosec G115
+	}
+	return health
+}
+
+// Find the folder itself or its closest existing parent
+func existingAncestor(folder string) string {
+	dir := folder
+	for {
+		if info, err := STORAGE.stat(dir); err == nil {
+			if info.IsDir() {
+				return dir
+			}
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Create and remove a probe file to prove the folder accepts writes
+func probeWritable(dir string) error {
+	// Unique per call: the background health check probes beside foreground preflights
+	probe := filepath.Join(dir, fmt.Sprintf("%spreflight.%d.%s%s", TEMP_FILE_PREFIX, os.Getpid(), strconv.FormatUint(rand.Uint64(), 36), TEMP_FILE_SUFFIX)) // #nosec G404 - unique name only
+	if _, err := STORAGE.createAtomic(probe, strings.NewReader(""), nil); err != nil {
+		return unwrapPathError(err)
+	}
+	return STORAGE.remove(probe)
+}
+
+// Reduce a path error to its cause for short messages
+func unwrapPathError(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
+
+// Destination health
+
+// Check every configured destination, for the UI header
+func checkDestinationHealth() []destinationHealth {
+	return checkDestinationFolders(healthFolders())
+}
+
+// List the folders the health check covers, each once
+func healthFolders() []string {
+	var folders []string
+	seen := map[string]bool{}
+	for _, folder := range append(routeFolders(), ARCHIVE, ERROR_DIR) {
+		if folder == "" || seen[filepath.Clean(folder)] {
+			continue
+		}
+		seen[filepath.Clean(folder)] = true
+		folders = append(folders, folder)
+	}
+	return folders
+}
+
+// Check a list of destination folders
+func checkDestinationFolders(folders []string) []destinationHealth {
+	health := make([]destinationHealth, len(folders))
+	for i, folder := range folders {
+		health[i] = checkDestination(folder, 0)
+	}
+	return health
+}
+
+// Summarise destination health in one line
+func describeDestinationHealth(health []destinationHealth) (string, bool) {
+	var problems []string
+	var lowest uint64
+	lowestKnown := false
+	for _, h := range health {
+		if h.Problem != "" {
+			problems = append(problems, h.Problem)
+		}
+		if h.FreeOK && (!lowestKnown || h.Free < lowest) {
+			lowest, lowestKnown = h.Free, true
+		}
+	}
+
+	if len(problems) > 0 {
+		return strings.Join(problems, "; "), false
+	}
+	summary := fmt.Sprintf("OK - %d destination(s) writable", len(health))
+	if lowestKnown {
+		summary += fmt.Sprintf(", lowest free %s", formatFileSize(int64(lowest))) // #nosec G115
+	}
+	return summary, true
+}
+
+// healthCache keeps the last destination health summary for the UI header
+// A check can stall on an unreachable share, so refreshes run in the background
+type healthCache struct {
+	mu         sync.Mutex
+	summary    string
+	ok         bool
+	checked    time.Time
+	refreshing bool
+}
+
+var DESTINATION_HEALTH = &healthCache{}
+
+// Get the cached summary, starting a background refresh once it is older than the TTL
+// The summary is "" until the first check has finished
+func (c *healthCache) get(now time.Time) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.refreshing && now.Sub(c.checked) >= DESTINATION_HEALTH_TTL {
+		c.refreshing = true
+		folders := healthFolders()
+		go func() {
+			summary, ok := describeDestinationHealth(checkDestinationFolders(folders))
+			c.store(summary, ok, time.Now())
+		}()
+	}
+	return c.summary, c.ok
+}
+
+// Record a finished health check
+func (c *healthCache) store(summary string, ok bool, checked time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.summary, c.ok, c.checked, c.refreshing = summary, ok, checked, false
+}
+
+// Get the destination health summary for the UI header without waiting on the check
+func destinationHealthSummary() (string, bool) {
+	return DESTINATION_HEALTH.get(time.Now())
+}
+
+// Warn at startup about destinations that would refuse operations
+// The result seeds the header's health cache
+func warnDestinationHealthAtStartup() {
+	summary, ok := describeDestinationHealth(checkDestinationHealth())
+	DESTINATION_HEALTH.store(summary, ok, time.Now())
+	if !ok {
+		printWarning("Destination check: " + summary)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreflightPassesWithRoom(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.MinFreeMB = 1
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	choice, err := preflightOperation(file, "scan.pdf", file)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tempDir, "output", "scan.pdf")}, choice.targets)
+	assert.NoDirExists(t, filepath.Join(tempDir, "output"), "checks must not create folders")
+}
+
+func TestPreflightRefusesLowSpace(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.MinFreeMB = 1 << 40 // More than any disk
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	_, err := preflightOperation(file, "scan.pdf", file)
+	assert.True(t, isPreflightError(err))
+	assert.Contains(t, err.Error(), "output has")
+
+	// A refused operation leaves the file in the watch folder
+	processSingleFileOperation()
+	assert.FileExists(t, file)
+	assert.NoFileExists(t, filepath.Join(tempDir, "output", "scan.pdf"))
+	assert.NoFileExists(t, filepath.Join(tempDir, "error", "scan.pdf"))
+}
+
+func TestPreflightRefusesReadOnlyFolder(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	tempDir := useTestWorkspace(t)
+	CONFIG.MinFreeMB = 1
+	locked := filepath.Join(tempDir, "locked")
+	assert.NoError(t, os.Mkdir(locked, 0555))
+	t.Cleanup(func() { _ = os.Chmod(locked, 0755) })
+	CONFIG.OutputFolders = []string{filepath.Join(locked, "out")}
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	_, err := preflightOperation(file, "scan.pdf")
+	assert.True(t, isPreflightError(err))
+	assert.Contains(t, err.Error(), "not writable")
+}
+
+func TestDescribeDestinationHealth(t *testing.T) {
+	useTestWorkspace(t)
+	CONFIG.MinFreeMB = 1
+
+	summary, ok := describeDestinationHealth(checkDestinationHealth())
+	assert.True(t, ok)
+	assert.Contains(t, summary, "OK - 3 destination(s) writable, lowest free")
+
+	summary, ok = describeDestinationHealth([]destinationHealth{
+		{Folder: "a", Free: 10, FreeOK: true},
+		{Folder: "b", Problem: "b is not writable: permission denied"},
+	})
+	assert.False(t, ok)
+	assert.Equal(t, "b is not writable: permission denied", summary)
+}
+
+func TestDestinationHealthIsCached(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.MinFreeMB = 1
+	cache := &healthCache{}
+
+	// The first call starts the check without waiting for it
+	start := time.Now()
+	summary, _ := cache.get(start)
+	assert.Empty(t, summary)
+	assert.Eventually(t, func() bool {
+		summary, _ := cache.get(start)
+		return summary != ""
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// A broken destination only shows once the cached result expires
+	blocker := filepath.Join(tempDir, "blocker")
+	assert.NoError(t, os.WriteFile(blocker, nil, 0644))
+	CONFIG.OutputFolders = []string{filepath.Join(blocker, "out")}
+	_, ok := cache.get(start.Add(DESTINATION_HEALTH_TTL / 2))
+	assert.True(t, ok)
+	assert.Eventually(t, func() bool {
+		_, ok := cache.get(time.Now().Add(DESTINATION_HEALTH_TTL))
+		return !ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Let a refresh started by the last call finish before the folders go
+	assert.Eventually(t, func() bool {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return !cache.refreshing
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMinFreeMBValidation(t *testing.T) {
+	config := getDefaultConfig()
+	assert.Equal(t, DEFAULT_MIN_FREE_MB, config.MinFreeMB)
+	config.MinFreeMB = -1
+	assert.Error(t, validateConfig(config))
+}
@@ -0,0 +1,103 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Built-in receivers
+//
+// The FTP and SMTP receivers share a listener that serves each connection in
+// its own goroutine and closes them all when stopped. Receivers run alongside
+// the menu, so they only write finished files into the watch folder and log
+// through logOperation.
+
+// Pause before answering a failed login, to slow password guessing
+const RECEIVER_LOGIN_FAIL_DELAY = time.Second
+
+// tcpReceiver accepts connections and hands each to a session
+type tcpReceiver struct {
+	listener net.Listener
+	session  func(conn net.Conn)
+	wg       sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]bool
+}
+
+// Listen on address and serve each connection with session
+func listenReceiver(kind, address string, session func(conn net.Conn)) (*tcpReceiver, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %s receiver on %s: %v", kind, address, err)
+	}
+
+	receiver := &tcpReceiver{listener: listener, session: session, conns: map[net.Conn]bool{}}
+	receiver.wg.Add(1)
+	go receiver.serve()
+	return receiver, nil
+}
+
+// Accept connections until stopped
+func (r *tcpReceiver) serve() {
+	defer r.wg.Done()
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.conns[conn] = true
+		r.mu.Unlock()
+
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			r.session(conn)
+			r.mu.Lock()
+			delete(r.conns, conn)
+			r.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+// Stop listening and close open sessions
+func (r *tcpReceiver) stop() {
+	r.listener.Close()
+	r.mu.Lock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+// Get the address the receiver listens on
+func (r *tcpReceiver) addr() string {
+	return r.listener.Addr().String()
+}
+
+// Compare credentials without leaking how much of them matched
+func credentialsMatch(user, password, wantUser, wantPassword string) bool {
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(wantPassword)) == 1
+	return userOK && passwordOK
+}
@@ -0,0 +1,339 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Remote destinations
+//
+// An output folder can be a URL such as s3://bucket/prefix instead of a local
+// path. Targets under it are URLs too; the copy, conflict, journal and undo
+// code hands them to the store for their scheme instead of the filesystem.
+
+// remoteStore reaches the objects of one remote destination
+type remoteStore interface {
+	stat(key string) (remoteObject, error) // errRemoteNotFound when missing
+	list(prefix string) ([]string, error)  // Keys starting with prefix
+	upload(src, key, digest string) error  // Write src to key, recording its SHA-256 where the store can
+	open(key string) (io.ReadCloser, error)
+	remove(key string) error
+	check(folder string) error   // Confirm a destination folder can be reached
+	claim(src, dst string) error // Move src to dst unless dst exists or src is gone (errRemoteClaimed)
+}
+
+// remoteObject describes a stored object
+type remoteObject struct {
+	size   int64
+	digest string // SHA-256 recorded at upload, "" when unknown
+}
+
+var (
+	errRemoteNotFound = errors.New("object not found")
+	errRemoteClaimed  = errors.New("already claimed")
+)
+
+// remoteStatusError is a request the server answered with an error status
+type remoteStatusError struct {
+	request string // Method and key, e.g. "PUT /scans/a.pdf"
+	status  int
+}
+
+func (e *remoteStatusError) Error() string {
+	return fmt.Sprintf("%s: %d %s", e.request, e.status, http.StatusText(e.status))
+}
+
+// Check whether a remote store failed on the server side, so a later attempt may succeed
+func isRemoteServerError(err error) bool {
+	var se *remoteStatusError
+	if errors.As(err, &se) {
+		return se.status >= 500
+	}
+	return isS3ServerError(err)
+}
+
+// Openers for each supported URL scheme
+var remoteSchemes = map[string]func(u *url.URL, dest DestinationConfig) (remoteStore, error){
+	"s3":     openS3Store,
+	"webdav": openWebDAVStore, // Over HTTPS
+	"https":  openWebDAVStore,
+	"sftp":   openSFTPStore,
+}
+
+// Open stores, keyed by scheme, user, host and the destination settings they use
+// The background health check opens stores too, so the map is locked
+var (
+	remoteStores   = map[string]remoteStore{}
+	remoteStoresMu sync.Mutex
+)
+
+// Check whether a folder or target is a remote URL
+func isRemotePath(path string) bool {
+	scheme, _, ok := strings.Cut(path, "://")
+	return ok && remoteSchemes[scheme] != nil
+}
+
+// Validate an output folder, which may be a remote URL
+func validateDestinationFolder(folder string) error {
+	scheme, _, ok := strings.Cut(folder, "://")
+	if !ok {
+		return nil
+	}
+	if remoteSchemes[scheme] == nil {
+		return fmt.Errorf("unsupported destination %s: only %s URLs are supported", folder, supportedRemoteSchemes())
+	}
+
+	u, err := url.Parse(folder)
+	if err != nil {
+		return fmt.Errorf("invalid destination URL %s: %v", folder, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("destination URL %s has no bucket or host", folder)
+	}
+	return nil
+}
+
+// List the supported URL schemes for messages
+func supportedRemoteSchemes() string {
+	var schemes []string
+	for scheme := range remoteSchemes {
+		schemes = append(schemes, scheme+"://")
+	}
+	sort.Strings(schemes)
+	return strings.Join(schemes, ", ")
+}
+
+// Join a file name onto a local folder or remote URL
+func joinDestination(folder, name string) string {
+	if isRemotePath(folder) {
+		return strings.TrimSuffix(folder, "/") + "/" + name
+	}
+	return filepath.Join(folder, name)
+}
+
+// Split a local path or remote URL into its folder and file name
+func splitDestination(path string) (string, string) {
+	if isRemotePath(path) {
+		i := strings.LastIndex(path, "/")
+		return path[:i], path[i+1:]
+	}
+	return filepath.Dir(path), filepath.Base(path)
+}
+
+// Get the folder holding a local path or remote URL
+func destinationDir(path string) string {
+	dir, _ := splitDestination(path)
+	return dir
+}
+
+// Find the store and object key for a remote URL
+func openRemote(path string) (remoteStore, string, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, "", err
+	}
+	// Destinations on one server can have different settings, so each gets its own store
+	name, dest := remoteDestinationConfig(u)
+	id := (&url.URL{Scheme: u.Scheme, User: u.User, Host: u.Host}).String() + " " + name
+	remoteStoresMu.Lock()
+	defer remoteStoresMu.Unlock()
+	store, ok := remoteStores[id]
+	if !ok {
+		if store, err = remoteSchemes[u.Scheme](u, dest); err != nil {
+			return nil, "", err
+		}
+		remoteStores[id] = store
+	}
+	return store, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+// Find the per-destination settings for a remote URL, preferring the longest matching destination
+// Destinations named without a user match URLs for any user
+func remoteDestinationConfig(u *url.URL) (string, DestinationConfig) {
+	if CONFIG == nil {
+		return "", DestinationConfig{}
+	}
+	full := u.String()
+	anyUser := (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+
+	best := ""
+	for name := range CONFIG.Destinations {
+		prefix, err := url.Parse(strings.TrimSuffix(name, "/"))
+		if err != nil || !isRemotePath(name) {
+			continue
+		}
+		target := full
+		if prefix.User == nil {
+			target = anyUser
+		}
+		if target != prefix.String() && !strings.HasPrefix(target, prefix.String()+"/") {
+			continue
+		}
+		if len(name) > len(best) || (len(name) == len(best) && name < best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return "", DestinationConfig{}
+	}
+	return best, CONFIG.Destinations[best]
+}
+
+// Check whether a local file or remote object exists
+func destinationExists(path string) bool {
+	if !isRemotePath(path) {
+		return fileExists(path)
+	}
+	store, key, err := openRemote(path)
+	if err != nil {
+		return false
+	}
+	_, err = store.stat(key)
+	return err == nil
+}
+
+// Get the SHA-256 of a remote object as recorded when it was uploaded
+func remoteDigest(path string) (string, error) {
+	store, key, err := openRemote(path)
+	if err != nil {
+		return "", err
+	}
+	object, err := store.stat(key)
+	if err != nil {
+		return "", err
+	}
+	if object.digest != "" {
+		return object.digest, nil
+	}
+
+	// Stores without checksums are hashed by reading the object back
+	body, err := store.open(key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Upload a local file to a remote URL
+func uploadRemote(src, dst string) error {
+	store, key, err := openRemote(dst)
+	if err != nil {
+		return err
+	}
+	digest, err := calculateFileHash(src)
+	if err != nil {
+		return err
+	}
+	return store.upload(src, key, digest)
+}
+
+// Download a remote object to a local file, checking any recorded digest
+func downloadRemote(src, dst string) error {
+	_, err := downloadRemoteWith(src, dst, func(dst string, reader io.Reader, verify func(tempPath string, size int64) error) (string, error) {
+		_, err := atomicWrite(dst, reader, verify)
+		return dst, err
+	})
+	return err
+}
+
+// Download a remote object into a folder other writers share, without replacing a file there
+// Returns the path used, which is numbered when dst was taken
+func downloadRemoteNew(src, dst string) (string, error) {
+	return downloadRemoteWith(src, dst, atomicWriteNew)
+}
+
+// Download a remote object with the given atomic writer, checking any recorded digest
+func downloadRemoteWith(src, dst string, write func(dst string, reader io.Reader, verify func(tempPath string, size int64) error) (string, error)) (string, error) {
+	store, key, err := openRemote(src)
+	if err != nil {
+		return "", err
+	}
+	object, err := store.stat(key)
+	if err != nil {
+		return "", err
+	}
+	body, err := store.open(key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hasher := sha256.New()
+	return write(dst, io.TeeReader(body, hasher), func(tempPath string, size int64) error {
+		if object.digest != "" && hex.EncodeToString(hasher.Sum(nil)) != object.digest {
+			return fmt.Errorf("digest mismatch downloading %s", src)
+		}
+		return nil
+	})
+}
+
+// Remove a local file or remote object
+func removeDestination(path string) error {
+	if !isRemotePath(path) {
+		return STORAGE.remove(path)
+	}
+	store, key, err := openRemote(path)
+	if err != nil {
+		return err
+	}
+	return store.remove(key)
+}
+
+// List a remote target and the copies conflict resolution made of it
+func remoteConflictCandidates(dst string) []string {
+	candidates := []string{dst}
+	store, key, err := openRemote(dst)
+	if err != nil {
+		return candidates
+	}
+
+	dir, _ := splitDestination(dst)
+	ext := filepath.Ext(key)
+	keys, err := store.list(strings.TrimSuffix(key, ext) + "_")
+	if err != nil {
+		return candidates
+	}
+	for _, found := range keys {
+		if strings.HasSuffix(found, ext) {
+			candidates = append(candidates, joinDestination(dir, found[strings.LastIndex(found, "/")+1:]))
+		}
+	}
+	return candidates
+}
+
+// Check a remote destination can be reached
+func checkRemoteDestination(folder string) error {
+	store, key, err := openRemote(folder)
+	if err != nil {
+		return err
+	}
+	return store.check(key)
+}
@@ -0,0 +1,223 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// PDF repair
+//
+// Many scanners write PDFs whose objects are fine but whose cross-reference
+// table, trailer or startxref offset is wrong. Before such a file is sent to
+// the error folder we rebuild the xref by scanning for "N G obj" headers,
+// append a fresh xref section and trailer, and validate the result. The
+// original file is never modified; the repaired copy is a scratch file used
+// as the source for outputs and merges.
+//
+// Objects stored inside object streams cannot be found by scanning, so files
+// whose catalog lives in an object stream are not repairable this way.
+
+var (
+	objectHeaderPattern = regexp.MustCompile(`(?:^|[\r\n\s])(\d+)\s+(\d+)\s+obj\b`)
+	catalogPattern      = regexp.MustCompile(`/Type\s*/Catalog\b`)
+	infoRefPattern      = regexp.MustCompile(`/Info\s+(\d+)\s+(\d+)\s+R`)
+	idPattern           = regexp.MustCompile(`/ID\s*\[[^\]]*\]`)
+)
+
+// pdfObjectRef locates an indirect object in a PDF file
+type pdfObjectRef struct {
+	generation int
+	offset     int
+}
+
+// Validate a PDF, falling back to a repaired copy if its structure is broken
+// Returns the file to process (the original or the repaired copy) and whether it was repaired
+func validateOrRepairPDF(file string) (string, bool, error) {
+	if err := checkFileExists(file); err != nil {
+		return "", false, err
+	}
+	if err := checkFileProperties(file); err != nil {
+		return "", false, err
+	}
+
+	validationErr := validateFileSafely(file)
+	if validationErr == nil {
+		return file, false, nil
+	}
+
+	repaired, err := repairPDFFile(file)
+	if err != nil {
+		printError(fmt.Sprintf("'%s' is not a valid PDF file: %v", file, validationErr))
+		logDebugOperation("Repair failed", fmt.Sprintf("%s: %v", filepath.Base(file), err))
+		return "", false, fmt.Errorf("invalid PDF structure")
+	}
+
+	printInfo(fmt.Sprintf("Repaired cross-reference table of %s", filepath.Base(file)))
+	logOperation("PDF_REPAIR", filepath.Base(file), "", "SUCCESS")
+	return repaired, true, nil
+}
+
+// Get the folder holding repaired scratch copies
+func getRepairDir() string {
+	if STATE_DIR == "" {
+		return filepath.Join(os.TempDir(), "blendpdf", "repair")
+	}
+	return filepath.Join(STATE_DIR, "repair")
+}
+
+// Write a repaired copy of a PDF and check it validates
+func repairPDFFile(file string) (string, error) {
+	data, err := readStorageFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	repaired, err := repairPDF(data)
+	if err != nil {
+		return "", err
+	}
+
+	tempPath := filepath.Join(getRepairDir(), TEMP_FILE_PREFIX+filepath.Base(file)+"."+strconv.FormatInt(time.Now().UnixNano(), 36)+TEMP_FILE_SUFFIX)
+	if _, err := atomicWrite(tempPath, bytes.NewReader(repaired), nil); err != nil {
+		return "", err
+	}
+	if err := validateFileSafely(tempPath); err != nil {
+		_ = STORAGE.remove(tempPath)
+		return "", fmt.Errorf("repaired file is still invalid: %v", err)
+	}
+	return tempPath, nil
+}
+
+// Remove a repaired scratch copy (no-op for originals)
+func removeRepairedCopy(file string, repaired bool) {
+	if !repaired {
+		return
+	}
+	if err := STORAGE.remove(file); err != nil && !os.IsNotExist(err) && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to remove repaired copy: %v", err))
+	}
+}
+
+// Rebuild the cross-reference table and trailer of a PDF
+func repairPDF(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bytes.TrimLeft(data, "\x00\t\r\n "), []byte("%PDF-")) {
+		return nil, fmt.Errorf("missing PDF header")
+	}
+
+	objects := scanPDFObjects(data)
+	if len(objects) == 0 {
+		return nil, fmt.Errorf("no objects found")
+	}
+
+	root, ok := findCatalogObject(data, objects)
+	if !ok {
+		return nil, fmt.Errorf("no document catalog found")
+	}
+
+	maxNumber := 0
+	for number := range objects {
+		if number > maxNumber {
+			maxNumber = number
+		}
+	}
+
+	var out bytes.Buffer
+	out.Write(data)
+	if !bytes.HasSuffix(data, []byte("\n")) {
+		out.WriteByte('\n')
+	}
+
+	xrefOffset := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n", maxNumber+1)
+	out.WriteString("0000000000 65535 f\r\n")
+	for number := 1; number <= maxNumber; number++ {
+		if ref, ok := objects[number]; ok {
+			fmt.Fprintf(&out, "%010d %05d n\r\n", ref.offset, ref.generation)
+		} else {
+			out.WriteString("0000000000 00000 f\r\n")
+		}
+	}
+
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root %d %d R", maxNumber+1, root, objects[root].generation)
+	if info, ok := findInfoReference(data, objects); ok {
+		fmt.Fprintf(&out, " /Info %d %d R", info, objects[info].generation)
+	}
+	if id := idPattern.FindAll(data, -1); len(id) > 0 {
+		out.WriteString(" ")
+		out.Write(id[len(id)-1])
+	}
+	fmt.Fprintf(&out, " >>\nstartxref\n%d\n%%%%EOF\n", xrefOffset)
+
+	return out.Bytes(), nil
+}
+
+// Find every "N G obj" header; later definitions win, as with incremental updates
+func scanPDFObjects(data []byte) map[int]pdfObjectRef {
+	objects := map[int]pdfObjectRef{}
+	for _, match := range objectHeaderPattern.FindAllSubmatchIndex(data, -1) {
+		number, err := strconv.Atoi(string(data[match[2]:match[3]]))
+		if err != nil || number == 0 {
+			continue
+		}
+		generation, err := strconv.Atoi(string(data[match[4]:match[5]]))
+		if err != nil {
+			continue
+		}
+		objects[number] = pdfObjectRef{generation: generation, offset: match[2]}
+	}
+	return objects
+}
+
+// Get the body of an object, up to its endobj keyword
+func pdfObjectBody(data []byte, ref pdfObjectRef) []byte {
+	body := data[ref.offset:]
+	if end := bytes.Index(body, []byte("endobj")); end >= 0 {
+		body = body[:end]
+	}
+	return body
+}
+
+// Find the document catalog, preferring the last definition in the file
+func findCatalogObject(data []byte, objects map[int]pdfObjectRef) (int, bool) {
+	root, rootOffset := 0, -1
+	for number, ref := range objects {
+		if ref.offset > rootOffset && catalogPattern.Match(pdfObjectBody(data, ref)) {
+			root, rootOffset = number, ref.offset
+		}
+	}
+	return root, rootOffset >= 0
+}
+
+// Find the document information dictionary named by an existing trailer
+func findInfoReference(data []byte, objects map[int]pdfObjectRef) (int, bool) {
+	matches := infoRefPattern.FindAllSubmatch(data, -1)
+	for i := len(matches) - 1; i >= 0; i-- {
+		number, err := strconv.Atoi(string(matches[i][1]))
+		if err != nil {
+			continue
+		}
+		if _, ok := objects[number]; ok {
+			return number, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// buildTestPDF writes a minimal blank PDF with the given number of pages
+// damage is "" for a valid file, "offsets" for a wrong xref table or "truncate" for no xref at all
+func buildTestPDF(pages int, damage string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+
+	kids := ""
+	for i := 0; i < pages; i++ {
+		kids += fmt.Sprintf("%d 0 R ", 3+i)
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, pages),
+	}
+	for i := 0; i < pages; i++ {
+		objects = append(objects, "<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] >>")
+	}
+
+	var offsets []int
+	for i, object := range objects {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	if damage == "truncate" {
+		return b.Bytes()
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f\r\n", len(objects)+1)
+	for _, offset := range offsets {
+		if damage == "offsets" {
+			offset += 7
+		}
+		fmt.Fprintf(&b, "%010d 00000 n\r\n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return b.Bytes()
+}
+
+func TestValidateOrRepairLeavesValidFiles(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	file := filepath.Join(tempDir, "good.pdf")
+	_ = os.WriteFile(file, buildTestPDF(2, ""), 0644)
+
+	source, repaired, err := validateOrRepairPDF(file)
+	assert.NoError(t, err)
+	assert.False(t, repaired)
+	assert.Equal(t, file, source)
+}
+
+func TestValidateOrRepairFixesBrokenXref(t *testing.T) {
+	for _, damage := range []string{"offsets", "truncate"} {
+		t.Run(damage, func(t *testing.T) {
+			tempDir := useTestWorkspace(t)
+			file := filepath.Join(tempDir, "scan.pdf")
+			original := buildTestPDF(2, damage)
+			_ = os.WriteFile(file, original, 0644)
+
+			assert.Error(t, validateFileSafely(file), "damaged file should not validate")
+
+			source, repaired, err := validateOrRepairPDF(file)
+			assert.NoError(t, err)
+			assert.True(t, repaired)
+			assert.NotEqual(t, file, source)
+			assert.NoError(t, validateFileSafely(source))
+
+			pages, err := getPageCount(source)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, pages)
+
+			content, _ := os.ReadFile(file)
+			assert.Equal(t, original, content, "original should be kept unchanged")
+
+			removeRepairedCopy(source, repaired)
+			assert.NoFileExists(t, source)
+		})
+	}
+}
+
+func TestValidateOrRepairRejectsGarbage(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	file := filepath.Join(tempDir, "garbage.pdf")
+	_ = os.WriteFile(file, []byte("this is not a pdf"), 0644)
+
+	_, repaired, err := validateOrRepairPDF(file)
+	assert.Error(t, err)
+	assert.False(t, repaired)
+
+	leftovers, _ := filepath.Glob(filepath.Join(getRepairDir(), "*"))
+	assert.Empty(t, leftovers, "failed repairs should not leave scratch files")
+}
+
+func TestRepairPDFNeedsCatalog(t *testing.T) {
+	_, err := repairPDF([]byte("%PDF-1.4\n1 0 obj\n<< /Type /Page >>\nendobj\n"))
+	assert.Error(t, err)
+}
+
+func TestMergeWithRepairedCopies(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	file1 := filepath.Join(tempDir, "front.pdf")
+	file2 := filepath.Join(tempDir, "back.pdf")
+	_ = os.WriteFile(file1, buildTestPDF(2, ""), 0644)
+	_ = os.WriteFile(file2, buildTestPDF(2, "offsets"), 0644)
+
+	source1, source2, repaired, err := validateBothPDFs(file1, file2)
+	assert.NoError(t, err)
+	assert.Equal(t, [2]bool{false, true}, repaired)
+	defer removeRepairedCopy(source2, repaired[1])
+
+	output := filepath.Join(tempDir, "merged.pdf")
+	assert.NoError(t, processAndMergeToTemp(output, source1, source2, 0))
+
+	pages, err := getPageCount(output)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, pages)
+}
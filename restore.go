@@ -0,0 +1,312 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archive browsing, restore and reprocessing
+//
+// Archived originals can be copied back into the watch folder, or a front and
+// back pair can be merged again with different settings into a new output.
+// Neither touches the archive or existing outputs, so history undo/redo of
+// the original operation keeps working. Originals compacted into dated zips
+// by retention are listed and restored from inside the zip.
+
+// ArchivedOriginal is an original that can be restored from the archive
+type ArchivedOriginal struct {
+	Name     string    // File name
+	Key      string    // Unique name: the archive file name, or "<zip>/<name>" for compacted files
+	Path     string    // Archive path (the zip for compacted files)
+	Member   string    // Name inside the zip, "" for loose and linked files
+	Size     int64     // Size in bytes
+	Archived time.Time // When it was archived
+}
+
+// List every PDF original in the archive, newest first
+func listArchivedOriginals() ([]ArchivedOriginal, error) {
+	items, err := listArchiveItems()
+	if err != nil {
+		return nil, err
+	}
+
+	var originals []ArchivedOriginal
+	for _, item := range items {
+		name := filepath.Base(item.path)
+		if isCompactZip(name) {
+			members, err := listCompactedOriginals(item.path)
+			if err != nil {
+				printWarning(fmt.Sprintf("Failed to read %s: %v", name, err))
+				continue
+			}
+			originals = append(originals, members...)
+			continue
+		}
+		key := name
+		name = strings.TrimSuffix(name, ENCRYPTED_SUFFIX)
+		if !strings.EqualFold(filepath.Ext(name), ".pdf") {
+			continue
+		}
+
+		size := item.size
+		if item.linked {
+			// Retention counts shared objects once; browsing shows every link's size
+			if readable, ok := resolveArchivedFile(item.path); ok {
+				if info, err := STORAGE.stat(readable); err == nil {
+					size = info.Size()
+				}
+			}
+		}
+		originals = append(originals, ArchivedOriginal{
+			Name:     name,
+			Key:      key,
+			Path:     item.path,
+			Size:     size,
+			Archived: item.modTime,
+		})
+	}
+
+	sort.SliceStable(originals, func(i, j int) bool { return originals[i].Archived.After(originals[j].Archived) })
+	return originals, nil
+}
+
+// Check whether an archive file name is a retention compaction zip
+func isCompactZip(name string) bool {
+	return strings.HasPrefix(name, COMPACT_PREFIX) && strings.EqualFold(filepath.Ext(name), ".zip")
+}
+
+// List the originals stored in a compaction zip
+func listCompactedOriginals(zipPath string) ([]ArchivedOriginal, error) {
+	zr, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var originals []ArchivedOriginal
+	for _, file := range zr.File {
+		if file.Name == COMPACT_MANIFEST || !strings.EqualFold(filepath.Ext(file.Name), ".pdf") {
+			continue
+		}
+		originals = append(originals, ArchivedOriginal{
+			Name:     file.Name,
+			Key:      filepath.Base(zipPath) + "/" + file.Name,
+			Path:     zipPath,
+			Member:   file.Name,
+			Size:     int64(file.UncompressedSize64),
+			Archived: file.Modified,
+		})
+	}
+	return originals, nil
+}
+
+// Find archived originals by key, or by file name when that is unambiguous
+func findArchivedOriginals(names []string) ([]ArchivedOriginal, error) {
+	originals, err := listArchivedOriginals()
+	if err != nil {
+		return nil, err
+	}
+
+	var found []ArchivedOriginal
+	for _, name := range names {
+		var matches []ArchivedOriginal
+		for _, original := range originals {
+			if original.Key == name {
+				matches = []ArchivedOriginal{original}
+				break
+			}
+			if original.Name == name {
+				matches = append(matches, original)
+			}
+		}
+
+		switch len(matches) {
+		case 0:
+			return nil, fmt.Errorf("%s is not in the archive", name)
+		case 1:
+			found = append(found, matches[0])
+		default:
+			return nil, fmt.Errorf("%s is in the archive %d times; use one of: %s", name, len(matches), describeOriginalKeys(matches))
+		}
+	}
+	return found, nil
+}
+
+// List the keys of archived originals for messages
+func describeOriginalKeys(originals []ArchivedOriginal) string {
+	var keys []string
+	for _, original := range originals {
+		keys = append(keys, original.Key)
+	}
+	return strings.Join(keys, ", ")
+}
+
+// Write an archived original's bytes to dst
+func extractArchivedOriginal(original ArchivedOriginal, dst string) error {
+	if original.Member == "" {
+		if !archivedFileExists(original.Path) {
+			return fmt.Errorf("%s is no longer in the archive", original.Key)
+		}
+		return copyPlaintext(original.Path, dst)
+	}
+
+	zr, err := zip.OpenReader(original.Path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, file := range zr.File {
+		if file.Name != original.Member {
+			continue
+		}
+		reader, err := file.Open()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		_, err = atomicWrite(dst, io.LimitReader(reader, int64(file.UncompressedSize64)), nil)
+		return err
+	}
+	return fmt.Errorf("%s is no longer in %s", original.Member, filepath.Base(original.Path))
+}
+
+// Copy archived originals back into the watch folder, returns the restored paths
+func restoreArchivedOriginals(names []string) ([]string, error) {
+	originals, err := findArchivedOriginals(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var restored []string
+	for _, original := range originals {
+		dst := filepath.Join(FOLDER, original.Name)
+		if fileExists(dst) {
+			unique, err := generateUniqueFileName(dst)
+			if err != nil {
+				return restored, err
+			}
+			dst = unique
+		}
+		if err := extractArchivedOriginal(original, dst); err != nil {
+			return restored, fmt.Errorf("failed to restore %s: %v", original.Key, err)
+		}
+		restored = append(restored, dst)
+		logOperation("RESTORE", original.Key, filepath.Base(dst), "SUCCESS")
+	}
+	return restored, nil
+}
+
+// Reprocessing
+
+// Merge an archived front and back pair again with different options
+// The result gets its own name in every output folder and is recorded in the history
+func reprocessArchivedPair(front, back string, opts MergeOptions) ([]string, error) {
+	startTime := time.Now()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	originals, err := findArchivedOriginals([]string{front, back})
+	if err != nil {
+		return nil, err
+	}
+
+	scratch, err := os.MkdirTemp("", "blendpdf-reprocess-")
+	if err != nil {
+		return nil, err
+	}
+	defer removeStorageTree(scratch)
+
+	// Work on copies so nothing in the archive is touched
+	var sources []string
+	for i, original := range originals {
+		source := filepath.Join(scratch, fmt.Sprintf("%d-%s", i+1, original.Name))
+		if err := extractArchivedOriginal(original, source); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", original.Key, err)
+		}
+		sources = append(sources, source)
+	}
+
+	merged := filepath.Join(scratch, "merged.pdf")
+	if err := mergeWithOptions(sources[0], sources[1], merged, opts); err != nil {
+		return nil, err
+	}
+
+	name1 := strings.TrimSuffix(originals[0].Name, filepath.Ext(originals[0].Name))
+	name2 := strings.TrimSuffix(originals[1].Name, filepath.Ext(originals[1].Name))
+	filename := name1 + "-" + name2 + "-reprocessed.pdf"
+
+	choice, err := preflightOperation(merged, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	inputs := []string{originals[0].Key, originals[1].Key}
+	journal, err := beginJournal("reprocess", inputs...)
+	if err != nil {
+		return nil, err
+	}
+	copies, err := copyToOutputs(journal, choice, merged, filename)
+	if err != nil {
+		journal.abort()
+		return nil, err
+	}
+	op := &LastOperation{
+		Type:             "reprocess",
+		OriginalFiles:    []string{filepath.Join(ARCHIVE, originals[0].Key), filepath.Join(ARCHIVE, originals[1].Key)},
+		ActualFiles:      copies.files,
+		ConflictOutcomes: copies.outcomes,
+		OutputFolders:    copies.folders,
+		Route:            copies.route,
+	}
+	journal.commit(op)
+	journal.finish()
+
+	op.Timestamp = time.Now()
+	entry := recordOperation(op)
+	linkOutputRetries(copies.retries, entry)
+	var eventInputs []EventFile
+	if eventWanted(EVENT_SUCCESS) {
+		eventInputs = eventFiles(entry.Operation.OriginalFiles, sources...)
+	}
+	if err := notifySuccess(entry, eventInputs, startTime); err != nil {
+		return copies.files, err
+	}
+
+	logOperation("REPROCESS", originals[0].Key, originals[1].Key, "SUCCESS")
+	return copies.files, nil
+}
+
+// Print the archived originals with their keys
+func displayArchivedOriginals(originals []ArchivedOriginal) {
+	if len(originals) == 0 {
+		fmt.Println("Archive is empty")
+		return
+	}
+
+	fmt.Printf("%-17s %9s  %s\n", "ARCHIVED", "SIZE", "NAME")
+	for _, original := range originals {
+		fmt.Printf("%-17s %9s  %s\n", original.Archived.Format("2006-01-02 15:04"), formatFileSize(original.Size), original.Key)
+	}
+}
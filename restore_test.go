@@ -0,0 +1,137 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListArchivedOriginals(t *testing.T) {
+	useTestWorkspace(t)
+	writeArchivedFile(t, "loose.pdf", 10, time.Hour)
+	writeArchivedFile(t, "notes.txt", 10, time.Hour)
+	writeArchivedFile(t, "old.pdf", 10, 20*24*time.Hour)
+
+	plan, err := planArchivePrune(RetentionConfig{CompactAfterDays: 10}, time.Now())
+	assert.NoError(t, err)
+	_, err = applyPrunePlan(plan)
+	assert.NoError(t, err)
+
+	originals, err := listArchivedOriginals()
+	assert.NoError(t, err)
+	var keys []string
+	for _, original := range originals {
+		keys = append(keys, original.Key)
+	}
+	zipName := COMPACT_PREFIX + time.Now().Add(-20*24*time.Hour).Format("2006-01-02") + ".zip"
+	assert.Equal(t, []string{"loose.pdf", zipName + "/old.pdf"}, keys)
+}
+
+func TestRestoreArchivedOriginals(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	archived := writeArchivedFile(t, "scan.pdf", 10, time.Hour)
+	writeArchivedFile(t, "old.pdf", 20, 20*24*time.Hour)
+	_ = os.WriteFile(filepath.Join(tempDir, "scan.pdf"), []byte("new scan"), 0644)
+
+	plan, _ := planArchivePrune(RetentionConfig{CompactAfterDays: 10}, time.Now())
+	_, err := applyPrunePlan(plan)
+	assert.NoError(t, err)
+
+	restored, err := restoreArchivedOriginals([]string{"scan.pdf", "old.pdf"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tempDir, "scan_1.pdf"), filepath.Join(tempDir, "old.pdf")}, restored)
+	assert.FileExists(t, archived, "restore copies, the archive keeps its file")
+
+	content, _ := os.ReadFile(restored[1])
+	assert.Len(t, content, 20)
+
+	_, err = restoreArchivedOriginals([]string{"missing.pdf"})
+	assert.Error(t, err)
+}
+
+func TestRestoreAmbiguousName(t *testing.T) {
+	useTestWorkspace(t)
+	compactDay := func(age time.Duration) string {
+		writeArchivedFile(t, "scan.pdf", 10, age)
+		plan, _ := planArchivePrune(RetentionConfig{CompactAfterDays: 10}, time.Now())
+		_, err := applyPrunePlan(plan)
+		assert.NoError(t, err)
+		return COMPACT_PREFIX + time.Now().Add(-age).Format("2006-01-02") + ".zip"
+	}
+	compactDay(40 * 24 * time.Hour)
+	newer := compactDay(30 * 24 * time.Hour)
+
+	_, err := restoreArchivedOriginals([]string{"scan.pdf"})
+	assert.ErrorContains(t, err, "2 times")
+
+	restored, err := restoreArchivedOriginals([]string{newer + "/scan.pdf"})
+	assert.NoError(t, err)
+	assert.Len(t, restored, 1)
+
+	// A loose file is matched by its exact name
+	writeArchivedFile(t, "scan.pdf", 10, time.Hour)
+	_, err = restoreArchivedOriginals([]string{"scan.pdf"})
+	assert.NoError(t, err)
+}
+
+func TestReprocessArchivedPair(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	front := filepath.Join(ARCHIVE, "front.pdf")
+	back := filepath.Join(ARCHIVE, "back.pdf")
+	_ = os.WriteFile(front, buildTextPDF("Page1", "Page3"), 0644)
+	// Back pages fed through in page order rather than reversed
+	_ = os.WriteFile(back, buildTextPDF("Page2", "Page4"), 0644)
+
+	originalOutput := filepath.Join(tempDir, "output", "front-back.pdf")
+	_ = os.MkdirAll(filepath.Dir(originalOutput), 0755)
+	_ = os.WriteFile(originalOutput, []byte("first merge"), 0644)
+
+	outputs, err := reprocessArchivedPair("front.pdf", "back.pdf", MergeOptions{BackOrder: BACK_ORDER_SCANNED, FlipEdge: FLIP_SHORT_EDGE})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tempDir, "output", "front-back-reprocessed.pdf")}, outputs)
+
+	text, err := extractPDFText(outputs[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "Page1\nPage2\nPage3\nPage4", text)
+
+	content, _ := os.ReadFile(originalOutput)
+	assert.Equal(t, "first merge", string(content), "the original output is untouched")
+	assert.FileExists(t, front)
+	assert.FileExists(t, back)
+
+	assert.Equal(t, "reprocess", HISTORY[len(HISTORY)-1].Operation.Type)
+	assert.NoError(t, undoLatestOperation())
+	assert.NoFileExists(t, outputs[0])
+	assert.FileExists(t, front)
+}
+
+func TestMergeWithOptionsReversesBack(t *testing.T) {
+	tempDir := t.TempDir()
+	front := filepath.Join(tempDir, "front.pdf")
+	back := filepath.Join(tempDir, "back.pdf")
+	output := filepath.Join(tempDir, "merged.pdf")
+	_ = os.WriteFile(front, buildTextPDF("Page1", "Page3"), 0644)
+	_ = os.WriteFile(back, buildTextPDF("Page4", "Page2"), 0644)
+
+	assert.NoError(t, mergeWithOptions(front, back, output, MergeOptions{FlipEdge: FLIP_SHORT_EDGE}))
+	text, _ := extractPDFText(output)
+	assert.Equal(t, "Page1\nPage2\nPage3\nPage4", text)
+
+	assert.Error(t, mergeWithOptions(front, back, output, MergeOptions{BackOrder: "sideways"}))
+}
+
+func TestSmartMergeInterleavesReversedBack(t *testing.T) {
+	tempDir := t.TempDir()
+	front := filepath.Join(tempDir, "front.pdf")
+	back := filepath.Join(tempDir, "back.pdf")
+	output := filepath.Join(tempDir, "merged.pdf")
+	_ = os.WriteFile(front, buildTextPDF("Page1", "Page3", "Page5"), 0644)
+	_ = os.WriteFile(back, buildTextPDF("Page6", "Page4", "Page2"), 0644)
+
+	assert.NoError(t, smartMerge(front, back, output, 3, 3))
+	text, _ := extractPDFText(output)
+	assert.Equal(t, "Page1\nPage2\nPage3\nPage4\nPage5\nPage6", text)
+}
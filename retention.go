@@ -0,0 +1,479 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Archive retention
+//
+// Retention rules bound the size of archive/. They are applied in order:
+//  1. keepDays  - delete archived files older than N days
+//  2. keepGB    - delete the oldest archived files until the archive fits
+//  3. compactAfterDays - zip the remaining files older than N days into
+//     archive-YYYY-MM-DD.zip (one per modification day) with a manifest
+//
+// Object store links are aged by when they were archived; deleting the last
+// link to an object deletes the object. Links are already deduplicated, so
+// they are never compacted, and each object counts once towards keepGB.
+//
+// Files referenced by the persisted undo history are never touched.
+
+// Prune actions
+const (
+	PRUNE_DELETE  = "delete"
+	PRUNE_COMPACT = "compact"
+
+	COMPACT_PREFIX   = "archive-"
+	COMPACT_MANIFEST = "manifest.json"
+
+	bytesPerGB = 1 << 30
+)
+
+// RetentionConfig holds the archive retention rules (zero disables a rule)
+type RetentionConfig struct {
+	KeepDays         int     `json:"keepDays,omitempty"`
+	KeepGB           float64 `json:"keepGB,omitempty"`
+	CompactAfterDays int     `json:"compactAfterDays,omitempty"`
+}
+
+// Check whether any retention rule is enabled
+func (r RetentionConfig) enabled() bool {
+	return r.KeepDays > 0 || r.KeepGB > 0 || r.CompactAfterDays > 0
+}
+
+// archiveItem is a file at the top level of the archive folder or an object store link
+type archiveItem struct {
+	path    string
+	size    int64
+	modTime time.Time
+	linked  bool
+}
+
+// pruneAction is one step of a prune plan
+type pruneAction struct {
+	action string
+	item   archiveItem
+	target string // zip file for compaction
+	reason string
+}
+
+// prunePlan lists what pruning will do
+type prunePlan struct {
+	actions   []pruneAction
+	protected []string
+	freed     int64
+}
+
+// CompactManifest describes the files stored in a compacted archive zip
+type CompactManifest struct {
+	Created time.Time             `json:"created"`
+	Files   []CompactManifestFile `json:"files"`
+}
+
+// CompactManifestFile is one entry of a compaction manifest
+type CompactManifestFile struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// List the files at the top level of the archive folder and the object store links, oldest first
+func listArchiveItems() ([]archiveItem, error) {
+	items, err := listArchiveFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := loadArchiveIndex()
+	if err != nil {
+		return nil, err
+	}
+	counted := map[string]bool{}
+	for _, entry := range index.Entries {
+		item := archiveItem{
+			path:    filepath.Join(ARCHIVE, entry.Name),
+			modTime: entry.Archived,
+			linked:  true,
+		}
+		if !counted[entry.Hash] {
+			item.size = entry.Size
+			counted[entry.Hash] = true
+		}
+		items = append(items, item)
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].modTime.Equal(items[j].modTime) {
+			return items[i].path < items[j].path
+		}
+		return items[i].modTime.Before(items[j].modTime)
+	})
+	return items, nil
+}
+
+// List the plain files at the top level of the archive folder
+func listArchiveFiles() ([]archiveItem, error) {
+	entries, err := STORAGE.list(ARCHIVE)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var items []archiveItem
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isTempFileName(entry.Name()) || entry.Name() == ARCHIVE_INDEX_FILE {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		items = append(items, archiveItem{
+			path:    filepath.Join(ARCHIVE, entry.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+	return items, nil
+}
+
+// Work out what the retention rules would do to the archive
+func planArchivePrune(rules RetentionConfig, now time.Time) (*prunePlan, error) {
+	items, err := listArchiveItems()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &prunePlan{}
+	referenced := historyReferencedFiles()
+	var total int64
+	var candidates []archiveItem
+	for _, item := range items {
+		total += item.size
+		abs, _ := filepath.Abs(item.path)
+		if referenced[abs] {
+			plan.protected = append(plan.protected, item.path)
+			continue
+		}
+		candidates = append(candidates, item)
+	}
+
+	var remaining []archiveItem
+	for _, item := range candidates {
+		if rules.KeepDays > 0 && now.Sub(item.modTime) > days(rules.KeepDays) {
+			plan.delete(item, fmt.Sprintf("older than %d days", rules.KeepDays))
+			total -= item.size
+			continue
+		}
+		remaining = append(remaining, item)
+	}
+
+	if rules.KeepGB > 0 {
+		limit := int64(rules.KeepGB * bytesPerGB)
+		kept := remaining[:0:0]
+		for _, item := range remaining {
+			if total > limit {
+				plan.delete(item, fmt.Sprintf("archive over %s", formatFileSize(limit)))
+				total -= item.size
+				continue
+			}
+			kept = append(kept, item)
+		}
+		remaining = kept
+	}
+
+	if rules.CompactAfterDays > 0 {
+		for _, item := range remaining {
+			if !item.linked && strings.HasSuffix(strings.ToLower(item.path), ".pdf") && now.Sub(item.modTime) > days(rules.CompactAfterDays) {
+				plan.actions = append(plan.actions, pruneAction{
+					action: PRUNE_COMPACT,
+					item:   item,
+					target: filepath.Join(ARCHIVE, COMPACT_PREFIX+item.modTime.Format("2006-01-02")+".zip"),
+					reason: fmt.Sprintf("older than %d days", rules.CompactAfterDays),
+				})
+			}
+		}
+	}
+
+	return plan, nil
+}
+
+// Add a deletion to a plan
+func (p *prunePlan) delete(item archiveItem, reason string) {
+	p.actions = append(p.actions, pruneAction{action: PRUNE_DELETE, item: item, reason: reason})
+	p.freed += item.size
+}
+
+// Convert a number of days to a duration
+func days(n int) time.Duration {
+	return time.Duration(n) * 24 * time.Hour
+}
+
+// Show a prune plan
+func displayPrunePlan(plan *prunePlan, dryRun bool) {
+	verb := map[string]string{PRUNE_DELETE: "Delete", PRUNE_COMPACT: "Compact"}
+	if dryRun {
+		verb = map[string]string{PRUNE_DELETE: "Would delete", PRUNE_COMPACT: "Would compact"}
+	}
+
+	if len(plan.actions) == 0 {
+		printInfo("Nothing to prune")
+	}
+	for _, action := range plan.actions {
+		line := fmt.Sprintf("%s %s (%s, %s)", verb[action.action], filepath.Base(action.item.path),
+			formatFileSize(action.item.size), action.reason)
+		if action.action == PRUNE_COMPACT {
+			line += " -> " + filepath.Base(action.target)
+		}
+		fmt.Println(line)
+	}
+	if len(plan.protected) > 0 {
+		fmt.Printf("Kept %d file(s) referenced by undo history\n", len(plan.protected))
+	}
+	if plan.freed > 0 {
+		fmt.Printf("Space freed by deletion: %s\n", formatFileSize(plan.freed))
+	}
+}
+
+// Carry out a prune plan, returns the number of files pruned
+func applyPrunePlan(plan *prunePlan) (int, error) {
+	pruned := 0
+	var failures []string
+	groups := map[string][]archiveItem{}
+	var targets []string
+
+	for _, action := range plan.actions {
+		switch action.action {
+		case PRUNE_DELETE:
+			remove := STORAGE.remove
+			if action.item.linked {
+				remove = unlinkArchiveEntry
+			}
+			if err := remove(action.item.path); err != nil && !os.IsNotExist(err) {
+				failures = append(failures, fmt.Sprintf("%s: %v", filepath.Base(action.item.path), err))
+				continue
+			}
+			logOperation("ARCHIVE_PRUNE", filepath.Base(action.item.path), "", "DELETED")
+			pruned++
+		case PRUNE_COMPACT:
+			if _, ok := groups[action.target]; !ok {
+				targets = append(targets, action.target)
+			}
+			groups[action.target] = append(groups[action.target], action.item)
+		}
+	}
+
+	for _, target := range targets {
+		count, err := compactArchiveFiles(target, groups[target])
+		pruned += count
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", filepath.Base(target), err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return pruned, fmt.Errorf("pruning failed for %s", strings.Join(failures, "; "))
+	}
+	return pruned, nil
+}
+
+// Zip archived files with a manifest, then remove the originals
+// An existing zip for the same day is kept; the new one gets a suffix
+func compactArchiveFiles(target string, items []archiveItem) (int, error) {
+	target, err := resolveDestinationConflicts(target)
+	if err != nil {
+		return 0, err
+	}
+
+	manifest := CompactManifest{Created: time.Now()}
+	newest := time.Time{}
+	for _, item := range items {
+		digest, err := calculateFileHash(item.path)
+		if err != nil {
+			return 0, err
+		}
+		manifest.Files = append(manifest.Files, CompactManifestFile{
+			Name:    filepath.Base(item.path),
+			Size:    item.size,
+			SHA256:  digest,
+			ModTime: item.modTime,
+		})
+		if item.modTime.After(newest) {
+			newest = item.modTime
+		}
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeCompactZip(writer, items, manifest))
+	}()
+	_, err = atomicWrite(target, reader, func(tempPath string, size int64) error {
+		return verifyCompactZip(tempPath, manifest)
+	})
+	reader.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// Date the zip by its newest file so later retention rules age it naturally
+	if err := os.Chtimes(target, newest, newest); err != nil && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to set time on %s: %v", filepath.Base(target), err))
+	}
+
+	removed := 0
+	for _, item := range items {
+		if err := STORAGE.remove(item.path); err != nil {
+			printWarning(fmt.Sprintf("Compacted file not removed: %v", err))
+			continue
+		}
+		removed++
+	}
+	logOperation("ARCHIVE_COMPACT", filepath.Base(target), fmt.Sprintf("%d files", removed), "SUCCESS")
+	return removed, nil
+}
+
+// Write archived files and their manifest into a zip stream
+func writeCompactZip(w io.Writer, items []archiveItem, manifest CompactManifest) error {
+	zw := zip.NewWriter(w)
+
+	for _, item := range items {
+		header := &zip.FileHeader{
+			Name:     filepath.Base(item.path),
+			Method:   zip.Deflate,
+			Modified: item.modTime,
+		}
+		entry, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		file, err := STORAGE.open(item.path)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(entry, file)
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	entry, err := zw.Create(COMPACT_MANIFEST)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(manifest); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// Check a written zip holds every manifest file with the right digest
+func verifyCompactZip(path string, manifest CompactManifest) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	entries := map[string]*zip.File{}
+	for _, file := range zr.File {
+		entries[file.Name] = file
+	}
+
+	for _, expected := range manifest.Files {
+		entry, ok := entries[expected.Name]
+		if !ok {
+			return fmt.Errorf("%s missing from zip", expected.Name)
+		}
+		reader, err := entry.Open()
+		if err != nil {
+			return err
+		}
+		digest, err := hashReader(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		if digest != expected.SHA256 {
+			return fmt.Errorf("%s corrupted in zip", expected.Name)
+		}
+	}
+	return nil
+}
+
+// Prune the archive using the configured rules
+func pruneArchive(dryRun bool) error {
+	rules := RetentionConfig{}
+	if CONFIG != nil {
+		rules = CONFIG.Retention
+	}
+	if !rules.enabled() {
+		printInfo("No retention rules configured (see \"retention\" in blendpdf.json)")
+		return nil
+	}
+
+	plan, err := planArchivePrune(rules, time.Now())
+	if err != nil {
+		return err
+	}
+	displayPrunePlan(plan, dryRun)
+	if dryRun || len(plan.actions) == 0 {
+		return nil
+	}
+
+	pruned, err := applyPrunePlan(plan)
+	printSuccess(fmt.Sprintf("Pruned %d archived file(s)", pruned))
+	return err
+}
+
+// Apply retention rules at startup, quietly unless something changes
+func applyRetentionAtStartup() {
+	if CONFIG == nil || !CONFIG.Retention.enabled() {
+		return
+	}
+
+	plan, err := planArchivePrune(CONFIG.Retention, time.Now())
+	if err != nil {
+		printWarning(fmt.Sprintf("Archive retention skipped: %v", err))
+		return
+	}
+	if len(plan.actions) == 0 {
+		return
+	}
+
+	pruned, err := applyPrunePlan(plan)
+	if err != nil {
+		printWarning(err.Error())
+	}
+	if pruned > 0 {
+		printInfo(fmt.Sprintf("Archive retention pruned %d file(s)", pruned))
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeArchivedFile creates an archived file with a given age
+func writeArchivedFile(t *testing.T, name string, size int, age time.Duration) string {
+	path := filepath.Join(ARCHIVE, name)
+	assert.NoError(t, os.WriteFile(path, make([]byte, size), 0644))
+	modTime := time.Now().Add(-age)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	return path
+}
+
+func planActions(plan *prunePlan) map[string]string {
+	actions := map[string]string{}
+	for _, action := range plan.actions {
+		actions[filepath.Base(action.item.path)] = action.action
+	}
+	return actions
+}
+
+func TestPruneKeepDays(t *testing.T) {
+	useTestWorkspace(t)
+	old := writeArchivedFile(t, "old.pdf", 10, 40*24*time.Hour)
+	recent := writeArchivedFile(t, "recent.pdf", 10, 2*24*time.Hour)
+
+	plan, err := planArchivePrune(RetentionConfig{KeepDays: 30}, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"old.pdf": PRUNE_DELETE}, planActions(plan))
+
+	pruned, err := applyPrunePlan(plan)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pruned)
+	assert.NoFileExists(t, old)
+	assert.FileExists(t, recent)
+}
+
+func TestPruneKeepGBDeletesOldestFirst(t *testing.T) {
+	useTestWorkspace(t)
+	writeArchivedFile(t, "oldest.pdf", 600, 3*time.Hour)
+	writeArchivedFile(t, "middle.pdf", 600, 2*time.Hour)
+	writeArchivedFile(t, "newest.pdf", 600, time.Hour)
+
+	// Limit of about 1300 bytes keeps the two newest files
+	plan, err := planArchivePrune(RetentionConfig{KeepGB: 1300.0 / bytesPerGB}, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"oldest.pdf": PRUNE_DELETE}, planActions(plan))
+	assert.Equal(t, int64(600), plan.freed)
+}
+
+func TestPruneNeverTouchesHistoryFiles(t *testing.T) {
+	useTestWorkspace(t)
+	referenced := writeArchivedFile(t, "referenced.pdf", 10, 90*24*time.Hour)
+	writeArchivedFile(t, "free.pdf", 10, 90*24*time.Hour)
+
+	HISTORY = []*HistoryEntry{{
+		ID:        "test",
+		State:     HISTORY_DONE,
+		Operation: &LastOperation{Type: "merge", ArchiveFiles: []string{referenced}},
+	}}
+
+	plan, err := planArchivePrune(RetentionConfig{KeepDays: 1, CompactAfterDays: 1}, time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"free.pdf": PRUNE_DELETE}, planActions(plan))
+	assert.Equal(t, []string{referenced}, plan.protected)
+
+	_, err = applyPrunePlan(plan)
+	assert.NoError(t, err)
+	assert.FileExists(t, referenced)
+}
+
+func TestPruneCompactsIntoDatedZip(t *testing.T) {
+	useTestWorkspace(t)
+	age := 20 * 24 * time.Hour
+	first := writeArchivedFile(t, "first.pdf", 100, age)
+	second := writeArchivedFile(t, "second.pdf", 200, age)
+	recent := writeArchivedFile(t, "recent.pdf", 100, time.Hour)
+
+	plan, err := planArchivePrune(RetentionConfig{CompactAfterDays: 10}, time.Now())
+	assert.NoError(t, err)
+	assert.Len(t, plan.actions, 2)
+
+	pruned, err := applyPrunePlan(plan)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pruned)
+	assert.NoFileExists(t, first)
+	assert.NoFileExists(t, second)
+	assert.FileExists(t, recent)
+
+	zipPath := filepath.Join(ARCHIVE, COMPACT_PREFIX+time.Now().Add(-age).Format("2006-01-02")+".zip")
+	zr, err := zip.OpenReader(zipPath)
+	assert.NoError(t, err)
+	defer zr.Close()
+
+	names := map[string]*zip.File{}
+	for _, file := range zr.File {
+		names[file.Name] = file
+	}
+	assert.Contains(t, names, "first.pdf")
+	assert.Contains(t, names, "second.pdf")
+	assert.Contains(t, names, COMPACT_MANIFEST)
+
+	reader, err := names[COMPACT_MANIFEST].Open()
+	assert.NoError(t, err)
+	var manifest CompactManifest
+	assert.NoError(t, json.NewDecoder(reader).Decode(&manifest))
+	reader.Close()
+	assert.Len(t, manifest.Files, 2)
+	assert.NotEmpty(t, manifest.Files[0].SHA256)
+}
+
+func TestPruneDryRunChangesNothing(t *testing.T) {
+	useTestWorkspace(t)
+	old := writeArchivedFile(t, "old.pdf", 10, 40*24*time.Hour)
+
+	CONFIG.Retention = RetentionConfig{KeepDays: 30, CompactAfterDays: 10}
+
+	assert.NoError(t, pruneArchive(true))
+	assert.FileExists(t, old)
+}
+
+func TestRetentionConfigValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.Retention.KeepDays = -1
+	assert.Error(t, validateConfig(config))
+}
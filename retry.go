@@ -0,0 +1,419 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Output copy retries
+//
+// A copy to an output folder that fails for a transient reason (a network
+// share dropping out, a timeout) is queued instead of going to the error
+// folder. The result is kept in the state folder and the copy is retried
+// with exponential backoff and jitter until it succeeds or the attempts run
+// out, when the result goes to the error folder as before. The queue is
+// saved after every change so pending copies survive a restart.
+
+const (
+	DEFAULT_RETRY_ATTEMPTS          = 8
+	DEFAULT_RETRY_DELAY_SECONDS     = 30
+	DEFAULT_RETRY_MAX_DELAY_SECONDS = 3600
+
+	OUTCOME_QUEUED = "queued" // Copy failed and is waiting for a retry
+)
+
+// RetryConfig sets the retry budget for failed output copies
+type RetryConfig struct {
+	MaxAttempts         int `json:"maxAttempts"`         // Attempts including the first, 0 for the default
+	InitialDelaySeconds int `json:"initialDelaySeconds"` // Wait before the first retry, doubled each time
+	MaxDelaySeconds     int `json:"maxDelaySeconds"`     // Longest wait between attempts
+}
+
+// PendingCopy is an output copy waiting to be retried
+type PendingCopy struct {
+	ID          string    `json:"id"`
+	Operation   string    `json:"operation,omitempty"` // History entry the copy belongs to
+	Index       int       `json:"index"`               // Position of the copy in the operation's ActualFiles
+	Spool       string    `json:"spool"`               // Kept copy of the result
+	Target      string    `json:"target"`
+	Folder      string    `json:"folder"`
+	Filename    string    `json:"filename"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError"`
+}
+
+// Output copies waiting for a retry, oldest first
+var RETRY_QUEUE []*PendingCopy
+
+// Errors a retry can't fix
+var errDestinationExists = errors.New("destination already exists")
+
+// Local errors a later attempt may get past
+var transientErrnos = []syscall.Errno{syscall.EAGAIN, syscall.EIO, syscall.ENOSPC, syscall.ESTALE}
+
+// Check whether a failed copy is worth retrying
+// Only network trouble, timeouts, transient I/O or disk-full errors and remote server errors are;
+// permission, missing path, conflict and validation failures go straight to the error folder
+func isTransientCopyError(err error) bool {
+	if err == nil || errors.Is(err, errDestinationExists) || errors.Is(err, fs.ErrPermission) || errors.Is(err, fs.ErrNotExist) {
+		return false
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || isRemoteServerError(err) {
+		return true
+	}
+	for _, errno := range transientErrnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate retry settings
+func (r RetryConfig) validate() error {
+	if r.MaxAttempts < 0 || r.InitialDelaySeconds < 0 || r.MaxDelaySeconds < 0 {
+		return fmt.Errorf("retry settings must not be negative")
+	}
+	return nil
+}
+
+// Get the retry settings with defaults filled in
+func retrySettings() RetryConfig {
+	settings := RetryConfig{
+		MaxAttempts:         DEFAULT_RETRY_ATTEMPTS,
+		InitialDelaySeconds: DEFAULT_RETRY_DELAY_SECONDS,
+		MaxDelaySeconds:     DEFAULT_RETRY_MAX_DELAY_SECONDS,
+	}
+	if CONFIG == nil {
+		return settings
+	}
+	if CONFIG.Retry.MaxAttempts > 0 {
+		settings.MaxAttempts = CONFIG.Retry.MaxAttempts
+	}
+	if CONFIG.Retry.InitialDelaySeconds > 0 {
+		settings.InitialDelaySeconds = CONFIG.Retry.InitialDelaySeconds
+	}
+	if CONFIG.Retry.MaxDelaySeconds > 0 {
+		settings.MaxDelaySeconds = CONFIG.Retry.MaxDelaySeconds
+	}
+	return settings
+}
+
+// Get the wait after a given number of failed attempts
+// The delay doubles each time up to the maximum; half of it is random so
+// copies that failed together don't all retry at the same moment
+func retryDelay(attempts int, jitter float64) time.Duration {
+	settings := retrySettings()
+	delay := time.Duration(settings.InitialDelaySeconds) * time.Second
+	limit := time.Duration(settings.MaxDelaySeconds) * time.Second
+	for i := 1; i < attempts && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay/2 + time.Duration(jitter*float64(delay/2))
+}
+
+// Get the retry queue file path
+func getRetryQueuePath() string {
+	if STATE_DIR == "" {
+		return ""
+	}
+	return filepath.Join(STATE_DIR, "retries.json")
+}
+
+// Get the folder holding results kept for retries
+func getRetrySpoolDir() string {
+	return filepath.Join(STATE_DIR, "retries")
+}
+
+// Load the retry queue from disk, replacing any in-memory queue
+func loadRetryQueue() {
+	RETRY_QUEUE = nil
+
+	path := getRetryQueuePath()
+	if path == "" {
+		return
+	}
+
+	data, err := readStorageFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &RETRY_QUEUE)
+	}
+	if err != nil {
+		printWarning(fmt.Sprintf("Failed to load retry queue: %v", err))
+		RETRY_QUEUE = nil
+	}
+}
+
+// Save the retry queue to disk
+func saveRetryQueue() error {
+	path := getRetryQueuePath()
+	if path == "" {
+		return nil
+	}
+	if len(RETRY_QUEUE) == 0 {
+		if err := STORAGE.remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(RETRY_QUEUE, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = atomicWrite(path, bytes.NewReader(data), nil)
+	return err
+}
+
+// Save the retry queue, warning on failure
+func persistRetryQueue() {
+	if err := saveRetryQueue(); err != nil {
+		printWarning(fmt.Sprintf("Failed to save retry queue: %v", err))
+	}
+}
+
+// failedCopy is an output copy that failed during an operation
+type failedCopy struct {
+	index  int
+	target string
+	folder string
+	err    error
+}
+
+// Keep a result and queue its failed copies for retry
+func queueOutputRetries(srcFile, filename string, failed []failedCopy) ([]*PendingCopy, error) {
+	if getRetryQueuePath() == "" {
+		return nil, fmt.Errorf("no state folder for the retry queue")
+	}
+
+	now := time.Now()
+	id := now.Format("20060102-150405.000000000")
+	spool := filepath.Join(getRetrySpoolDir(), id+filepath.Ext(filename))
+	if err := performFileCopy(srcFile, spool); err != nil {
+		return nil, fmt.Errorf("failed to keep %s for retry: %v", filename, err)
+	}
+
+	var pending []*PendingCopy
+	for i, f := range failed {
+		p := &PendingCopy{
+			ID:          fmt.Sprintf("%s-%d", id, i),
+			Index:       f.index,
+			Spool:       spool,
+			Target:      f.target,
+			Folder:      f.folder,
+			Filename:    filename,
+			Attempts:    1,
+			NextAttempt: now.Add(retryDelay(1, rand.Float64())), // #nosec G404 - jitter only
+			LastError:   f.err.Error(),
+		}
+		pending = append(pending, p)
+	}
+	RETRY_QUEUE = append(RETRY_QUEUE, pending...)
+	if err := saveRetryQueue(); err != nil {
+		RETRY_QUEUE = RETRY_QUEUE[:len(RETRY_QUEUE)-len(pending)]
+		_ = STORAGE.remove(spool)
+		return nil, fmt.Errorf("failed to save retry queue: %v", err)
+	}
+	return pending, nil
+}
+
+// Tie queued copies to the history entry of their operation
+func linkOutputRetries(pending []*PendingCopy, entry *HistoryEntry) {
+	if len(pending) == 0 || entry == nil {
+		return
+	}
+	for _, p := range pending {
+		p.Operation = entry.ID
+	}
+	persistRetryQueue()
+}
+
+// Drop queued copies of an undone operation
+func cancelOutputRetries(operationID string) {
+	var kept, cancelled []*PendingCopy
+	for _, p := range RETRY_QUEUE {
+		if p.Operation == operationID {
+			cancelled = append(cancelled, p)
+		} else {
+			kept = append(kept, p)
+		}
+	}
+	if len(cancelled) == 0 {
+		return
+	}
+	RETRY_QUEUE = kept
+	persistRetryQueue()
+	for _, p := range cancelled {
+		releaseRetrySpool(p.Spool)
+	}
+}
+
+// Remove a kept result once no queued copy needs it
+func releaseRetrySpool(spool string) {
+	for _, p := range RETRY_QUEUE {
+		if p.Spool == spool {
+			return
+		}
+	}
+	if err := STORAGE.remove(spool); err != nil && !os.IsNotExist(err) && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to remove kept result %s: %v", filepath.Base(spool), err))
+	}
+}
+
+// Retry every queued copy that is due
+// Returns whether the queue changed
+func processDueRetries(now time.Time) bool {
+	changed := false
+	for _, p := range append([]*PendingCopy{}, RETRY_QUEUE...) {
+		if now.Before(p.NextAttempt) {
+			continue
+		}
+		changed = true
+
+		actual, outcome, err := copyFileWithPolicy(p.Spool, p.Target)
+		switch {
+		case err == nil:
+			finishRetry(p)
+			recordRetriedCopy(p, actual, outcome)
+			if VERBOSE {
+				printSuccess(fmt.Sprintf("Retried copy of %s to %s succeeded", p.Filename, filepath.Base(p.Folder)))
+			}
+		case !isTransientCopyError(err) || p.Attempts+1 >= retrySettings().MaxAttempts:
+			p.Attempts++
+			p.LastError = err.Error()
+			finishRetry(p)
+			giveUpRetry(p)
+		default:
+			p.Attempts++
+			p.LastError = err.Error()
+			p.NextAttempt = now.Add(retryDelay(p.Attempts, rand.Float64())) // #nosec G404 - jitter only
+		}
+	}
+	if changed {
+		persistRetryQueue()
+	}
+	return changed
+}
+
+// Remove a copy from the queue, keeping its result until nothing else needs it
+func finishRetry(p *PendingCopy) {
+	for i, existing := range RETRY_QUEUE {
+		if existing == p {
+			RETRY_QUEUE = append(RETRY_QUEUE[:i], RETRY_QUEUE[i+1:]...)
+			break
+		}
+	}
+	persistRetryQueue()
+}
+
+// Record a delivered copy in its operation so undo removes it
+func recordRetriedCopy(p *PendingCopy, actual, outcome string) {
+	defer releaseRetrySpool(p.Spool)
+
+	entry := findHistoryEntry(p.Operation)
+	if entry == nil || p.Index >= len(entry.Operation.ActualFiles) {
+		return
+	}
+	op := entry.Operation
+	op.ActualFiles[p.Index] = actual
+	if p.Index < len(op.ConflictOutcomes) {
+		op.ConflictOutcomes[p.Index] = outcome
+	}
+	recordDigest(entry, actual)
+	if err := saveHistory(); err != nil {
+		printWarning(fmt.Sprintf("Failed to save operation history: %v", err))
+	}
+	reindexOperation(entry)
+}
+
+// Send a result to the error folder once its retries run out
+func giveUpRetry(p *PendingCopy) {
+	defer releaseRetrySpool(p.Spool)
+
+	cause := withStage(STAGE_OUTPUT, fmt.Errorf("output destination %s failed after %d attempt(s): %s", p.Folder, p.Attempts, p.LastError))
+	printWarning(fmt.Sprintf("Gave up copying %s to %s: %s", p.Filename, filepath.Base(p.Folder), p.LastError))
+
+	actualError, err := copyFileWithConflictResolution(p.Spool, filepath.Join(ERROR_DIR, p.Filename))
+	if err != nil {
+		printWarning(fmt.Sprintf("Failed to copy to error folder: %v", err))
+		return
+	}
+	ERROR_COUNT++
+	report := newErrorReport(p.Spool, "", cause)
+	report.File = p.Filename
+	report.Destinations = []string{p.Target}
+	if err := writeErrorReport(actualError, report); err != nil && VERBOSE {
+		printWarning(fmt.Sprintf("Failed to write error report: %v", err))
+	}
+}
+
+// Summarise queued copies in one line, "" when none are waiting
+func describeRetryQueue() string {
+	if len(RETRY_QUEUE) == 0 {
+		return ""
+	}
+	next := RETRY_QUEUE[0]
+	for _, p := range RETRY_QUEUE[1:] {
+		if p.NextAttempt.Before(next.NextAttempt) {
+			next = p
+		}
+	}
+	return fmt.Sprintf("%d copy(ies) pending, next %s to %s at %s (attempt %d of %d)",
+		len(RETRY_QUEUE), next.Filename, filepath.Base(next.Folder),
+		next.NextAttempt.Format("15:04:05"), next.Attempts+1, retrySettings().MaxAttempts)
+}
+
+// Retry copies that came due while the program wasn't running
+func processRetriesAtStartup() {
+	// Copies never tied to an operation belong to one that was interrupted and rolled back
+	var orphans []*PendingCopy
+	for _, p := range RETRY_QUEUE {
+		if p.Operation == "" {
+			orphans = append(orphans, p)
+		}
+	}
+	for _, p := range orphans {
+		finishRetry(p)
+		releaseRetrySpool(p.Spool)
+	}
+	if len(RETRY_QUEUE) == 0 {
+		return
+	}
+
+	processDueRetries(time.Now())
+	if summary := describeRetryQueue(); summary != "" {
+		printInfo("Output retries: " + summary)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// flakyStorage fails writes under one folder with I/O errors, like a share that dropped out
+type flakyStorage struct {
+	storage
+	folder  string
+	blocked bool
+}
+
+func (f *flakyStorage) fail(op, path string) error {
+	if f.blocked && (path == f.folder || strings.HasPrefix(path, f.folder+string(filepath.Separator))) {
+		return &fs.PathError{Op: op, Path: path, Err: syscall.EIO}
+	}
+	return nil
+}
+
+func (f *flakyStorage) mkdirAll(dir string) error {
+	if err := f.fail("mkdir", dir); err != nil {
+		return err
+	}
+	return f.storage.mkdirAll(dir)
+}
+
+func (f *flakyStorage) createAtomic(path string, reader io.Reader, verify func(tempPath string, size int64) error) (int64, error) {
+	if err := f.fail("open", path); err != nil {
+		return 0, err
+	}
+	return f.storage.createAtomic(path, reader, verify)
+}
+
+// setupRetryTest adds an output folder that fails with I/O errors until unblocked
+// The folder doesn't exist yet, so pre-flight checks probe its parent and pass
+func setupRetryTest(t *testing.T) (string, string, func()) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.MinFreeMB = 1
+
+	share := &flakyStorage{storage: STORAGE, folder: filepath.Join(tempDir, "share"), blocked: true}
+	STORAGE = share
+
+	flaky := filepath.Join(share.folder, "out")
+	CONFIG.OutputFolders = append(CONFIG.OutputFolders, flaky)
+	return tempDir, flaky, func() { share.blocked = false }
+}
+
+func TestRetryDelayBackoff(t *testing.T) {
+	useTestWorkspace(t)
+	CONFIG.Retry = RetryConfig{InitialDelaySeconds: 10, MaxDelaySeconds: 60}
+
+	assert.Equal(t, 5*time.Second, retryDelay(1, 0))
+	assert.Equal(t, 10*time.Second, retryDelay(1, 1))
+	assert.Equal(t, 20*time.Second, retryDelay(2, 1))
+	assert.Equal(t, 40*time.Second, retryDelay(3, 1))
+	assert.Equal(t, 60*time.Second, retryDelay(4, 1))
+	assert.Equal(t, 45*time.Second, retryDelay(12, 0.5))
+}
+
+func TestTransientOutputFailureIsQueued(t *testing.T) {
+	tempDir, flaky, unblock := setupRetryTest(t)
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	processSingleFileOperation()
+	assert.NoFileExists(t, file)
+	assert.FileExists(t, filepath.Join(tempDir, "output", "scan.pdf"))
+	assert.NoFileExists(t, filepath.Join(tempDir, "error", "scan.pdf"), "transient failures don't go to the error folder")
+
+	entry := latestHistoryEntry(HISTORY_DONE)
+	assert.Equal(t, []string{OUTCOME_CREATED, OUTCOME_QUEUED}, entry.Operation.ConflictOutcomes)
+	assert.Len(t, RETRY_QUEUE, 1)
+	spool := RETRY_QUEUE[0].Spool
+	assert.FileExists(t, spool)
+	assert.Equal(t, entry.ID, RETRY_QUEUE[0].Operation)
+	assert.Contains(t, describeRetryQueue(), "1 copy(ies) pending, next scan.pdf to out at")
+
+	// The queue survives a restart
+	loadRetryQueue()
+	assert.Len(t, RETRY_QUEUE, 1)
+
+	// Nothing happens before the copy is due
+	assert.False(t, processDueRetries(time.Now()))
+
+	unblock()
+	assert.True(t, processDueRetries(time.Now().Add(time.Hour)))
+	assert.Empty(t, RETRY_QUEUE)
+	assert.NoFileExists(t, spool)
+	assert.NoFileExists(t, getRetryQueuePath())
+	assert.FileExists(t, filepath.Join(flaky, "scan.pdf"))
+
+	// The delivered copy is part of the operation, so undo removes it
+	assert.Equal(t, filepath.Join(flaky, "scan.pdf"), entry.Operation.ActualFiles[1])
+	assert.NoError(t, undoHistoryEntry(entry))
+	assert.NoFileExists(t, filepath.Join(flaky, "scan.pdf"))
+	assert.FileExists(t, file)
+}
+
+func TestRetryGivesUpToErrorFolder(t *testing.T) {
+	tempDir, flaky, unblock := setupRetryTest(t)
+	CONFIG.Retry.MaxAttempts = 3
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	processSingleFileOperation()
+	assert.Len(t, RETRY_QUEUE, 1)
+	spool := RETRY_QUEUE[0].Spool
+
+	assert.True(t, processDueRetries(time.Now().Add(time.Hour)))
+	assert.Len(t, RETRY_QUEUE, 1)
+	assert.Equal(t, 2, RETRY_QUEUE[0].Attempts)
+	assert.NoFileExists(t, filepath.Join(tempDir, "error", "scan.pdf"))
+
+	assert.True(t, processDueRetries(time.Now().Add(24*time.Hour)))
+	assert.Empty(t, RETRY_QUEUE)
+	assert.NoFileExists(t, spool)
+	assert.FileExists(t, filepath.Join(tempDir, "error", "scan.pdf"))
+	assert.NoFileExists(t, file)
+
+	// Retrying from the error folder copies the result to the failed destination, not the inbox
+	report, _ := loadErrorReport(filepath.Join(tempDir, "error", "scan.pdf"))
+	assert.Equal(t, []string{filepath.Join(flaky, "scan.pdf")}, report.Destinations)
+	unblock()
+	retried, err := retryErrorFiles([]string{"scan.pdf"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, retried)
+	assert.FileExists(t, filepath.Join(flaky, "scan.pdf"))
+	assert.NoFileExists(t, file)
+	assert.NoFileExists(t, filepath.Join(tempDir, "error", "scan.pdf"))
+}
+
+func TestUndoCancelsQueuedCopies(t *testing.T) {
+	tempDir, _, _ := setupRetryTest(t)
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	processSingleFileOperation()
+	assert.Len(t, RETRY_QUEUE, 1)
+	spool := RETRY_QUEUE[0].Spool
+
+	assert.NoError(t, undoHistoryEntry(latestHistoryEntry(HISTORY_DONE)))
+	assert.Empty(t, RETRY_QUEUE)
+	assert.NoFileExists(t, spool)
+	assert.FileExists(t, file)
+}
+
+func TestConflictFailureIsNotRetried(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.ConflictPolicy = CONFLICT_FAIL
+	CONFIG.OutputFolders = append(CONFIG.OutputFolders, filepath.Join(tempDir, "taken"))
+	assert.NoError(t, os.MkdirAll(filepath.Join(tempDir, "taken"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(tempDir, "taken", "scan.pdf"), []byte("old"), 0644))
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	var journal *operationJournal
+	choice, err := chooseRoute(file, "scan.pdf", time.Now())
+	assert.NoError(t, err)
+	copies, err := copyToOutputs(journal, choice, file, "scan.pdf")
+	assert.NoError(t, err)
+	assert.Empty(t, copies.retries)
+	assert.Equal(t, "failed", copies.outcomes[1])
+	assert.FileExists(t, filepath.Join(tempDir, "error", "scan.pdf"))
+}
+
+func TestAllDestinationsFailedLeavesResultOutOfErrorFolder(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.ConflictPolicy = CONFLICT_FAIL
+	CONFIG.OutputFolders = []string{filepath.Join(tempDir, "taken")}
+	assert.NoError(t, os.MkdirAll(filepath.Join(tempDir, "taken"), 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(tempDir, "taken", "scan.pdf"), []byte("old"), 0644))
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	// The originals go to the error folder on their own, so retrying them can't deliver the result twice
+	var journal *operationJournal
+	choice, err := chooseRoute(file, "scan.pdf", time.Now())
+	assert.NoError(t, err)
+	_, err = copyToOutputs(journal, choice, file, "scan.pdf")
+	assert.Error(t, err)
+	assert.NoFileExists(t, filepath.Join(tempDir, "error", "scan.pdf"))
+}
+
+func TestTransientCopyErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		err       error
+		transient bool
+	}{
+		{"connection refused", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{"timeout", fmt.Errorf("failed to upload a.pdf: %w", context.DeadlineExceeded), true},
+		{"try again", &fs.PathError{Op: "write", Path: "a.pdf", Err: syscall.EAGAIN}, true},
+		{"I/O error", fmt.Errorf("failed to create destination directory: %w", &fs.PathError{Op: "mkdir", Path: "out", Err: syscall.EIO}), true},
+		{"disk full", &fs.PathError{Op: "write", Path: "a.pdf", Err: syscall.ENOSPC}, true},
+		{"stale handle", &fs.PathError{Op: "open", Path: "a.pdf", Err: syscall.ESTALE}, true},
+		{"server error", fmt.Errorf("failed to upload a.pdf: %w", &remoteStatusError{request: "PUT /a.pdf", status: http.StatusBadGateway}), true},
+		{"client error", &remoteStatusError{request: "PUT /a.pdf", status: http.StatusForbidden}, false},
+		{"permission denied", &fs.PathError{Op: "open", Path: "a.pdf", Err: syscall.EACCES}, false},
+		{"missing path", &fs.PathError{Op: "open", Path: "a.pdf", Err: syscall.ENOENT}, false},
+		{"conflict", fmt.Errorf("%w: a.pdf", errDestinationExists), false},
+		{"validation", validateFilePaths("../a.pdf", "out/a.pdf"), false},
+		{"digest mismatch", errors.New("digest mismatch for a.pdf"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Error(t, tc.err)
+			assert.Equal(t, tc.transient, isTransientCopyError(tc.err))
+		})
+	}
+}
@@ -0,0 +1,412 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output routing
+//
+// Without "routing" in blendpdf.json every result is copied to every output
+// folder. With it, rules are checked in order against each result and the
+// first match decides which destinations get a copy and what it is called.
+// Results no rule matches take the default route, which falls back to the
+// output folders.
+//
+// A separator sheet is a page printed with "SEPARATOR: <payload>" placed on
+// top of a scan; its payload can be matched by the separator condition.
+
+const (
+	DEFAULT_ROUTE    = "default"
+	SEPARATOR_MARKER = "SEPARATOR:"
+)
+
+// RoutingConfig holds the ordered routing rules and the default route
+type RoutingConfig struct {
+	Rules   []RouteRule        `json:"rules,omitempty"`
+	Default []RouteDestination `json:"default,omitempty"` // Destinations for unmatched results (default: output folders)
+}
+
+// RouteRule sends results matching every set condition to its destinations
+type RouteRule struct {
+	Name         string             `json:"name"`
+	When         RouteCondition     `json:"when"`
+	Destinations []RouteDestination `json:"destinations"`
+}
+
+// RouteCondition lists the checks a result must pass; unset fields always match
+type RouteCondition struct {
+	Filename  string `json:"filename,omitempty"`  // Regular expression on the result file name
+	MinPages  int    `json:"minPages,omitempty"`  // Page count at least
+	MaxPages  int    `json:"maxPages,omitempty"`  // Page count at most
+	Text      string `json:"text,omitempty"`      // Keyword in the text layer (case-insensitive)
+	Separator string `json:"separator,omitempty"` // Regular expression on the separator sheet payload
+	TimeOfDay string `json:"timeOfDay,omitempty"` // HH:MM-HH:MM, may wrap past midnight
+}
+
+// RouteDestination is one copy of a routed result
+type RouteDestination struct {
+	Folder string `json:"folder"`
+	Name   string `json:"name,omitempty"` // Naming template (default "{name}")
+}
+
+// routeSubject is a result being routed; page count and text are read on first use
+type routeSubject struct {
+	file     string
+	filename string
+	now      time.Time
+
+	pages       int
+	text        string
+	payload     string
+	pagesRead   bool
+	textRead    bool
+	payloadRead bool
+}
+
+// routeChoice is the route picked for a result and where its copies go
+type routeChoice struct {
+	route   string
+	targets []string // Destination paths, one per copy
+	folders []string // Destination folders aligned with targets
+}
+
+// Check whether routing rules are configured
+func routingEnabled() bool {
+	return CONFIG != nil && (len(CONFIG.Routing.Rules) > 0 || len(CONFIG.Routing.Default) > 0)
+}
+
+// Destinations used when no rule matches
+func defaultRouteDestinations() []RouteDestination {
+	if CONFIG != nil && len(CONFIG.Routing.Default) > 0 {
+		return CONFIG.Routing.Default
+	}
+
+	folders := []string{"output"}
+	if CONFIG != nil && len(CONFIG.OutputFolders) > 0 {
+		folders = CONFIG.OutputFolders
+	}
+	destinations := make([]RouteDestination, len(folders))
+	for i, folder := range folders {
+		destinations[i] = RouteDestination{Folder: folder}
+	}
+	return destinations
+}
+
+// Every folder a route can write to, for creating folders and cleanup at startup
+func routeFolders() []string {
+	if CONFIG == nil {
+		return nil
+	}
+
+	var folders []string
+	seen := map[string]bool{}
+	add := func(destinations []RouteDestination) {
+		for _, dest := range destinations {
+			if !seen[dest.Folder] {
+				seen[dest.Folder] = true
+				folders = append(folders, dest.Folder)
+			}
+		}
+	}
+	for _, rule := range CONFIG.Routing.Rules {
+		add(rule.Destinations)
+	}
+	add(defaultRouteDestinations())
+	return folders
+}
+
+// Check a path lies inside one of the configured output destinations
+func isRouteDestination(path string) bool {
+	for _, folder := range routeFolders() {
+		if isRemotePath(folder) {
+			if strings.HasPrefix(path, strings.TrimSuffix(folder, "/")+"/") {
+				return true
+			}
+			continue
+		}
+		rel, err := filepath.Rel(folder, path)
+		if err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick the route for a result and resolve its destination paths
+func chooseRoute(file, filename string, now time.Time) (*routeChoice, error) {
+	subject := &routeSubject{file: file, filename: filename, now: now}
+
+	route, destinations := DEFAULT_ROUTE, defaultRouteDestinations()
+	if CONFIG != nil {
+		for _, rule := range CONFIG.Routing.Rules {
+			if rule.When.matches(subject) {
+				route, destinations = rule.Name, rule.Destinations
+				break
+			}
+		}
+	}
+
+	choice := &routeChoice{route: route}
+	for _, dest := range destinations {
+		name, err := subject.expandName(dest.Name, route)
+		if err != nil {
+			return nil, err
+		}
+		choice.targets = append(choice.targets, joinDestination(dest.Folder, name))
+		choice.folders = append(choice.folders, dest.Folder)
+	}
+	return choice, nil
+}
+
+// Check a result against every set condition
+func (c RouteCondition) matches(s *routeSubject) bool {
+	if c.Filename != "" {
+		re, err := regexp.Compile(c.Filename)
+		if err != nil || !re.MatchString(s.filename) {
+			return false
+		}
+	}
+	if c.MinPages > 0 || c.MaxPages > 0 {
+		pages := s.pageCount()
+		if pages < c.MinPages || (c.MaxPages > 0 && pages > c.MaxPages) {
+			return false
+		}
+	}
+	if c.Text != "" && !strings.Contains(strings.ToLower(s.textLayer()), strings.ToLower(c.Text)) {
+		return false
+	}
+	if c.Separator != "" {
+		re, err := regexp.Compile(c.Separator)
+		if err != nil || s.separatorPayload() == "" || !re.MatchString(s.separatorPayload()) {
+			return false
+		}
+	}
+	if c.TimeOfDay != "" {
+		start, end, err := parseTimeOfDayRange(c.TimeOfDay)
+		if err != nil || !withinTimeOfDay(s.now, start, end) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check the condition's patterns and ranges
+func (c RouteCondition) validate() error {
+	for _, pattern := range []string{c.Filename, c.Separator} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if c.MinPages < 0 || c.MaxPages < 0 || (c.MaxPages > 0 && c.MinPages > c.MaxPages) {
+		return fmt.Errorf("invalid page range %d-%d", c.MinPages, c.MaxPages)
+	}
+	if c.TimeOfDay != "" {
+		if _, _, err := parseTimeOfDayRange(c.TimeOfDay); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check the routing rules and destinations
+func (r RoutingConfig) validate() error {
+	names := map[string]bool{DEFAULT_ROUTE: true}
+	for i, rule := range r.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("routing rule %d has no name", i+1)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate routing rule name: %s", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if err := rule.When.validate(); err != nil {
+			return fmt.Errorf("routing rule %s: %v", rule.Name, err)
+		}
+		if len(rule.Destinations) == 0 {
+			return fmt.Errorf("routing rule %s has no destinations", rule.Name)
+		}
+		if err := validateRouteDestinations(rule.Destinations); err != nil {
+			return fmt.Errorf("routing rule %s: %v", rule.Name, err)
+		}
+	}
+	if err := validateRouteDestinations(r.Default); err != nil {
+		return fmt.Errorf("default route: %v", err)
+	}
+	return nil
+}
+
+// Check each destination has a folder and a usable naming template
+func validateRouteDestinations(destinations []RouteDestination) error {
+	for _, dest := range destinations {
+		if dest.Folder == "" {
+			return fmt.Errorf("destination has no folder")
+		}
+		if err := validateDestinationFolder(dest.Folder); err != nil {
+			return err
+		}
+		if err := validateNameTemplate(dest.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Describe the route an operation took and where its copies went, "" without routing
+func describeRoute(op *LastOperation) string {
+	if op == nil || op.Route == "" {
+		return ""
+	}
+
+	var copies []string
+	for _, file := range op.ActualFiles {
+		if file != "" {
+			copies = append(copies, filepath.Join(filepath.Base(filepath.Dir(file)), filepath.Base(file)))
+		}
+	}
+	if len(copies) == 0 {
+		return "route " + op.Route
+	}
+	return fmt.Sprintf("route %s → %s", op.Route, strings.Join(copies, ", "))
+}
+
+// Result properties
+
+// Page count of the result, 0 when it can't be read
+func (s *routeSubject) pageCount() int {
+	if !s.pagesRead {
+		s.pages = indexedPageCount(s.file)
+		s.pagesRead = true
+	}
+	return s.pages
+}
+
+// Text layer of the result, "" for scans without one
+func (s *routeSubject) textLayer() string {
+	if !s.textRead {
+		s.text, _ = extractPDFText(s.file)
+		s.textRead = true
+	}
+	return s.text
+}
+
+// Payload of a separator sheet on the first page, "" when there is none
+func (s *routeSubject) separatorPayload() string {
+	if !s.payloadRead {
+		firstPage, _ := extractPDFTextPages(s.file, 1)
+		s.payload = findSeparatorPayload(firstPage)
+		s.payloadRead = true
+	}
+	return s.payload
+}
+
+// Find the text following the separator marker
+func findSeparatorPayload(text string) string {
+	index := strings.Index(text, SEPARATOR_MARKER)
+	if index < 0 {
+		return ""
+	}
+	payload := text[index+len(SEPARATOR_MARKER):]
+	if end := strings.IndexByte(payload, '\n'); end >= 0 {
+		payload = payload[:end]
+	}
+	return strings.TrimSpace(payload)
+}
+
+// Naming templates
+
+// Template placeholders and the values they stand for
+var nameTemplateFields = []string{"{name}", "{date}", "{time}", "{pages}", "{route}", "{separator}"}
+
+// Check a naming template only uses known placeholders
+func validateNameTemplate(template string) error {
+	rest := template
+	for _, field := range nameTemplateFields {
+		rest = strings.ReplaceAll(rest, field, "")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return fmt.Errorf("unknown placeholder in naming template %q (use %s)", template, strings.Join(nameTemplateFields, ", "))
+	}
+	return nil
+}
+
+// Expand a naming template into a file name for this result
+func (s *routeSubject) expandName(template, route string) (string, error) {
+	base := strings.TrimSuffix(s.filename, filepath.Ext(s.filename))
+	if template == "" {
+		return s.filename, nil
+	}
+	if err := validateNameTemplate(template); err != nil {
+		return "", err
+	}
+
+	name := template
+	name = strings.ReplaceAll(name, "{name}", base)
+	name = strings.ReplaceAll(name, "{date}", s.now.Format("2006-01-02"))
+	name = strings.ReplaceAll(name, "{time}", s.now.Format("150405"))
+	name = strings.ReplaceAll(name, "{route}", route)
+	if strings.Contains(name, "{pages}") {
+		name = strings.ReplaceAll(name, "{pages}", strconv.Itoa(s.pageCount()))
+	}
+	if strings.Contains(name, "{separator}") {
+		name = strings.ReplaceAll(name, "{separator}", s.separatorPayload())
+	}
+
+	// Names stay inside the destination folder
+	name = strings.NewReplacer("/", "-", "\\", "-").Replace(strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("naming template %q gives an empty name for %s", template, s.filename)
+	}
+	if !strings.EqualFold(filepath.Ext(name), ".pdf") {
+		name += ".pdf"
+	}
+	return name, nil
+}
+
+// Time of day
+
+// Parse "HH:MM-HH:MM" into minutes since midnight
+func parseTimeOfDayRange(value string) (int, int, error) {
+	parts := strings.Split(value, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid time of day %q (use HH:MM-HH:MM)", value)
+	}
+
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid time of day %q (use HH:MM-HH:MM)", value)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
+
+// Check whether now falls in [start, end), wrapping past midnight when end < start
+func withinTimeOfDay(now time.Time, start, end int) bool {
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
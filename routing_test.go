@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupRoutingTest configures routing rules writing under a temp folder
+func setupRoutingTest(t *testing.T, rules ...RouteRule) string {
+	tempDir := useTestWorkspace(t)
+	for i := range rules {
+		for j := range rules[i].Destinations {
+			rules[i].Destinations[j].Folder = filepath.Join(tempDir, rules[i].Destinations[j].Folder)
+		}
+	}
+	CONFIG.Routing = RoutingConfig{Rules: rules}
+	assert.NoError(t, CONFIG.Routing.validate())
+	return tempDir
+}
+
+// writeRoutedPDF writes a text PDF to route
+func writeRoutedPDF(t *testing.T, dir, name string, pages ...string) string {
+	path := filepath.Join(dir, name)
+	assert.NoError(t, os.WriteFile(path, buildTextPDF(pages...), 0644))
+	return path
+}
+
+func TestChooseRouteConditions(t *testing.T) {
+	tempDir := setupRoutingTest(t,
+		RouteRule{Name: "invoices", When: RouteCondition{Filename: `^inv-`}, Destinations: []RouteDestination{{Folder: "invoices"}}},
+		RouteRule{Name: "long", When: RouteCondition{MinPages: 3}, Destinations: []RouteDestination{{Folder: "long"}}},
+		RouteRule{Name: "bank", When: RouteCondition{Text: "statement"}, Destinations: []RouteDestination{{Folder: "bank"}}},
+		RouteRule{Name: "sorted", When: RouteCondition{Separator: `^acme`}, Destinations: []RouteDestination{{Folder: "acme"}}},
+		RouteRule{Name: "night", When: RouteCondition{TimeOfDay: "22:00-06:00"}, Destinations: []RouteDestination{{Folder: "night"}}},
+	)
+	noon := time.Date(2025, 3, 14, 12, 0, 0, 0, time.Local)
+	late := time.Date(2025, 3, 14, 23, 30, 0, 0, time.Local)
+
+	tests := []struct {
+		name  string
+		pages []string
+		now   time.Time
+		route string
+	}{
+		{"inv-001.pdf", []string{"Total"}, noon, "invoices"},
+		{"scan.pdf", []string{"One", "Two", "Three"}, noon, "long"},
+		{"scan.pdf", []string{"Bank Statement March"}, noon, "bank"},
+		{"scan.pdf", []string{"SEPARATOR: acme/2025", "Letter"}, noon, "sorted"},
+		{"scan.pdf", []string{"Letter"}, late, "night"},
+		{"scan.pdf", []string{"Letter"}, noon, DEFAULT_ROUTE},
+	}
+	for _, tt := range tests {
+		file := writeRoutedPDF(t, tempDir, "routed.pdf", tt.pages...)
+		choice, err := chooseRoute(file, tt.name, tt.now)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.route, choice.route, "%s %v", tt.name, tt.pages)
+	}
+}
+
+func TestDefaultRouteUsesOutputFolders(t *testing.T) {
+	tempDir := setupRoutingTest(t)
+	CONFIG.OutputFolders = []string{filepath.Join(tempDir, "a"), filepath.Join(tempDir, "b")}
+
+	choice, err := chooseRoute(writeRoutedPDF(t, tempDir, "x.pdf", "Text"), "x.pdf", time.Now())
+	assert.NoError(t, err)
+	assert.Equal(t, DEFAULT_ROUTE, choice.route)
+	assert.Equal(t, []string{filepath.Join(tempDir, "a", "x.pdf"), filepath.Join(tempDir, "b", "x.pdf")}, choice.targets)
+	assert.False(t, routingEnabled(), "no rules means plain output folders")
+}
+
+func TestRouteNamingTemplates(t *testing.T) {
+	tempDir := setupRoutingTest(t, RouteRule{
+		Name: "acme",
+		When: RouteCondition{Separator: "."},
+		Destinations: []RouteDestination{
+			{Folder: "accounts", Name: "{date}-{separator}-{name}"},
+			{Folder: "backup", Name: "{route}_{pages}p.pdf"},
+		},
+	})
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "SEPARATOR: acme/ltd", "Page")
+	now := time.Date(2025, 3, 14, 9, 30, 0, 0, time.Local)
+
+	choice, err := chooseRoute(file, "scan.pdf", now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(tempDir, "accounts", "2025-03-14-acme-ltd-scan.pdf"),
+		filepath.Join(tempDir, "backup", "acme_2p.pdf"),
+	}, choice.targets)
+
+	assert.Error(t, validateNameTemplate("{customer}"))
+}
+
+func TestCopyToOutputsRecordsRoute(t *testing.T) {
+	tempDir := setupRoutingTest(t, RouteRule{
+		Name:         "invoices",
+		When:         RouteCondition{Filename: `(?i)invoice`},
+		Destinations: []RouteDestination{{Folder: "accounts"}, {Folder: "backup", Name: "copy-{name}"}},
+	})
+	file := writeRoutedPDF(t, tempDir, "Invoice.pdf", "Total")
+
+	var journal *operationJournal
+	choice, err := chooseRoute(file, "Invoice.pdf", time.Now())
+	assert.NoError(t, err)
+	copies, err := copyToOutputs(journal, choice, file, "Invoice.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, "invoices", copies.route)
+	assert.FileExists(t, filepath.Join(tempDir, "accounts", "Invoice.pdf"))
+	assert.FileExists(t, filepath.Join(tempDir, "backup", "copy-Invoice.pdf"))
+	assert.Equal(t, []string{filepath.Join(tempDir, "accounts"), filepath.Join(tempDir, "backup")}, copies.folders)
+
+	op := &LastOperation{Type: "single", ActualFiles: copies.files, Route: copies.route}
+	assert.Equal(t, "route invoices → accounts/Invoice.pdf, backup/copy-Invoice.pdf", describeRoute(op))
+
+	// Unmatched results fall through to the output folders
+	other := writeRoutedPDF(t, tempDir, "letter.pdf", "Hello")
+	choice, err = chooseRoute(other, "letter.pdf", time.Now())
+	assert.NoError(t, err)
+	copies, err = copyToOutputs(journal, choice, other, "letter.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, DEFAULT_ROUTE, copies.route)
+	assert.FileExists(t, filepath.Join(tempDir, "output", "letter.pdf"))
+}
+
+func TestWithinTimeOfDay(t *testing.T) {
+	at := func(hour, minute int) time.Time { return time.Date(2025, 1, 1, hour, minute, 0, 0, time.Local) }
+	start, end, err := parseTimeOfDayRange("09:00-17:30")
+	assert.NoError(t, err)
+	assert.True(t, withinTimeOfDay(at(9, 0), start, end))
+	assert.False(t, withinTimeOfDay(at(17, 30), start, end))
+
+	start, end, _ = parseTimeOfDayRange("22:00-06:00")
+	assert.True(t, withinTimeOfDay(at(2, 0), start, end))
+	assert.False(t, withinTimeOfDay(at(12, 0), start, end))
+
+	_, _, err = parseTimeOfDayRange("9am-5pm")
+	assert.Error(t, err)
+}
+
+func TestRoutingConfigValidation(t *testing.T) {
+	valid := RouteRule{Name: "a", Destinations: []RouteDestination{{Folder: "out"}}}
+	config := getDefaultConfig()
+	config.Routing.Rules = []RouteRule{valid}
+	assert.NoError(t, validateConfig(config))
+
+	for _, rule := range []RouteRule{
+		{Destinations: valid.Destinations},
+		{Name: "b", When: RouteCondition{Filename: "("}, Destinations: valid.Destinations},
+		{Name: "b", When: RouteCondition{MinPages: 5, MaxPages: 2}, Destinations: valid.Destinations},
+		{Name: "b", When: RouteCondition{TimeOfDay: "noon"}, Destinations: valid.Destinations},
+		{Name: "b"},
+		{Name: "a", Destinations: valid.Destinations},
+	} {
+		config.Routing.Rules = []RouteRule{valid, rule}
+		assert.Error(t, validateConfig(config), "%+v", rule)
+	}
+}
@@ -0,0 +1,296 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5" // #nosec G501 - Content-MD5 is the integrity check S3 defines
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3-compatible object storage destinations (AWS S3, MinIO, ...)
+//
+// s3://bucket/prefix destinations use the endpoint, region and profile from
+// their destinations entry, falling back to the AWS environment variables.
+// Credentials come from the environment or the AWS or MinIO client files.
+// Every upload is multipart with a Content-MD5 and SHA-256 on each part, and
+// the SHA-256 of the whole file is stored as object metadata so conflicts,
+// recovery and undo can compare objects without downloading them.
+
+const (
+	S3_DEFAULT_ENDPOINT = "https://s3.amazonaws.com"
+	S3_DEFAULT_REGION   = "us-east-1"
+	S3_PART_SIZE        = 8 * 1024 * 1024 // Parts other than the last must be at least 5 MiB
+	S3_DIGEST_METADATA  = "Sha256"        // Stored as x-amz-meta-sha256
+	S3_TIMEOUT          = 5 * time.Minute
+)
+
+// s3Store uploads to one bucket
+type s3Store struct {
+	core   *minio.Core
+	bucket string
+}
+
+// Connect to the bucket of an s3:// URL
+func openS3Store(u *url.URL, dest DestinationConfig) (remoteStore, error) {
+	endpoint := firstNonEmpty(dest.Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL"), S3_DEFAULT_ENDPOINT)
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	endpointURL, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %v", endpoint, err)
+	}
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{Profile: dest.Profile},
+		&credentials.FileMinioClient{},
+	})
+	core, err := minio.NewCore(endpointURL.Host, &minio.Options{
+		Creds:  creds,
+		Secure: endpointURL.Scheme == "https",
+		Region: firstNonEmpty(dest.Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), S3_DEFAULT_REGION),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", endpointURL.Host, err)
+	}
+	return &s3Store{core: core, bucket: u.Host}, nil
+}
+
+// Get the first non-empty string
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func (s *s3Store) stat(key string) (remoteObject, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), S3_TIMEOUT)
+	defer cancel()
+
+	info, err := s.core.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if response := minio.ToErrorResponse(err); response.Code == "NoSuchKey" || response.StatusCode == http.StatusNotFound {
+			return remoteObject{}, errRemoteNotFound
+		}
+		return remoteObject{}, err
+	}
+	return remoteObject{size: info.Size, digest: info.UserMetadata[S3_DIGEST_METADATA]}, nil
+}
+
+func (s *s3Store) list(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), S3_TIMEOUT)
+	defer cancel()
+
+	var keys []string
+	for object := range s.core.Client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		keys = append(keys, object.Key)
+	}
+	return keys, nil
+}
+
+func (s *s3Store) upload(src, key, digest string) error {
+	info, err := STORAGE.stat(src)
+	if err != nil {
+		return err
+	}
+	file, err := STORAGE.open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), S3_TIMEOUT)
+	defer cancel()
+
+	uploadID, err := s.core.NewMultipartUpload(ctx, s.bucket, key, minio.PutObjectOptions{
+		ContentType:  "application/pdf",
+		UserMetadata: map[string]string{S3_DIGEST_METADATA: digest},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start upload of %s: %w", key, err)
+	}
+
+	parts, err := s.uploadParts(ctx, key, uploadID, file)
+	if err == nil {
+		_, err = s.core.CompleteMultipartUpload(ctx, s.bucket, key, uploadID, parts, minio.PutObjectOptions{})
+	}
+	if err != nil {
+		// Don't leave unfinished parts billed in the bucket
+		_ = s.core.AbortMultipartUpload(context.Background(), s.bucket, key, uploadID)
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+
+	// Confirm the bucket holds what was sent
+	object, err := s.stat(key)
+	if err != nil {
+		return fmt.Errorf("failed to verify upload of %s: %w", key, err)
+	}
+	if object.size != info.Size() || object.digest != digest {
+		return fmt.Errorf("upload of %s does not match the source", key)
+	}
+	return nil
+}
+
+// Upload a file in parts, each checked by Content-MD5 and SHA-256
+func (s *s3Store) uploadParts(ctx context.Context, key, uploadID string, reader io.Reader) ([]minio.CompletePart, error) {
+	var parts []minio.CompletePart
+	buffer := make([]byte, S3_PART_SIZE)
+
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return nil, err
+		}
+		if n == 0 && number > 1 {
+			return parts, nil
+		}
+
+		chunk := buffer[:n]
+		md5Sum := md5.Sum(chunk) // #nosec G401 - Content-MD5 is the integrity check S3 defines
+		shaSum := sha256.Sum256(chunk)
+		part, err := s.core.PutObjectPart(ctx, s.bucket, key, uploadID, number, bytes.NewReader(chunk), int64(n), minio.PutObjectPartOptions{
+			Md5Base64:            base64.StdEncoding.EncodeToString(md5Sum[:]),
+			Sha256Hex:            hex.EncodeToString(shaSum[:]),
+			DisableContentSha256: true, // Send the computed hash instead of a streaming signature
+		})
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %v", number, err)
+		}
+		parts = append(parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+
+		if n < len(buffer) {
+			return parts, nil
+		}
+	}
+}
+
+func (s *s3Store) open(key string) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), S3_TIMEOUT)
+	body, _, _, err := s.core.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return readCloser{Reader: body, Closer: cancelCloser{body, cancel}}, nil
+}
+
+// Releases the request context once the body is closed
+type cancelCloser struct {
+	io.Closer
+	cancel context.CancelFunc
+}
+
+func (c cancelCloser) Close() error {
+	defer c.cancel()
+	return c.Closer.Close()
+}
+
+func (s *s3Store) remove(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), S3_TIMEOUT)
+	defer cancel()
+	return s.core.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// The bucket is checked; prefixes need no creating
+func (s *s3Store) check(folder string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	exists, err := s.core.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %s does not exist", s.bucket)
+	}
+	return nil
+}
+
+// Claims write dst with If-None-Match so only one instance succeeds. The
+// object is read into memory, which suits scans; S3 has no conditional copy.
+func (s *s3Store) claim(src, dst string) error {
+	object, err := s.stat(src)
+	if err == errRemoteNotFound {
+		return errRemoteClaimed
+	}
+	if err != nil {
+		return err
+	}
+	body, err := s.open(src)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return err
+	}
+
+	md5Sum := md5.Sum(data) // #nosec G401 - Content-MD5 is the integrity check S3 defines
+	shaSum := sha256.Sum256(data)
+	opts := minio.PutObjectOptions{
+		ContentType:          "application/pdf",
+		UserMetadata:         map[string]string{S3_DIGEST_METADATA: hex.EncodeToString(shaSum[:])},
+		DisableContentSha256: true, // Send the computed hash instead of a streaming signature
+	}
+	opts.SetMatchETagExcept("*")
+
+	ctx, cancel := context.WithTimeout(context.Background(), S3_TIMEOUT)
+	defer cancel()
+	_, err = s.core.PutObject(ctx, s.bucket, dst, bytes.NewReader(data), object.size,
+		base64.StdEncoding.EncodeToString(md5Sum[:]), hex.EncodeToString(shaSum[:]), opts)
+	if response := minio.ToErrorResponse(err); response.StatusCode == http.StatusPreconditionFailed {
+		return errRemoteClaimed
+	}
+	if err != nil {
+		return err
+	}
+
+	// Another instance may have claimed, fetched and released src since it was read
+	if _, err := s.stat(src); err == errRemoteNotFound {
+		_ = s.remove(dst)
+		return errRemoteClaimed
+	}
+	return s.remove(src)
+}
+
+// Check whether an S3 request failed with a server error
+func isS3ServerError(err error) bool {
+	var response minio.ErrorResponse
+	return errors.As(err, &response) && response.StatusCode >= 500
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeS3 is an in-memory S3 server covering the calls the S3 destination makes
+type fakeS3 struct {
+	mu       sync.Mutex
+	bucket   string
+	objects  map[string]*fakeObject
+	uploads  map[string]*fakeUpload
+	started  int  // Multipart uploads started
+	parts    int  // Parts received
+	corrupt  bool // Damage part bodies in transit
+	uploadID int
+}
+
+type fakeObject struct {
+	data []byte
+	meta http.Header
+}
+
+type fakeUpload struct {
+	key   string
+	meta  http.Header
+	parts map[int][]byte
+}
+
+// setupS3Test starts a fake S3 server for bucket "docs" and points the destination at it
+func setupS3Test(t *testing.T) (string, *fakeS3) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.MinFreeMB = 1
+
+	fake := &fakeS3{bucket: "docs", objects: map[string]*fakeObject{}, uploads: map[string]*fakeUpload{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test-secret")
+	CONFIG.Destinations = map[string]DestinationConfig{"s3://docs": {Endpoint: server.URL}}
+	return tempDir, fake
+}
+
+func (f *fakeS3) object(key string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.objects[key]
+}
+
+func (f *fakeS3) put(key string, data []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.objects[key] = &fakeObject{data: data, meta: http.Header{}}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet:
+		f.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.uploadID++
+		id := strconv.Itoa(f.uploadID)
+		f.uploads[id] = &fakeUpload{key: key, meta: metaHeaders(r.Header), parts: map[int][]byte{}}
+		f.started++
+		writeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: bucket, Key: key, UploadId: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		f.putPart(w, r, query)
+	case r.Method == http.MethodPut:
+		if r.Header.Get("If-None-Match") == "*" && f.objects[key] != nil {
+			s3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		f.objects[key] = &fakeObject{data: body, meta: metaHeaders(r.Header)}
+		w.Header().Set("ETag", `"etag"`)
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		upload := f.uploads[query.Get("uploadId")]
+		if upload == nil {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload")
+			return
+		}
+		var numbers []int
+		for number := range upload.parts {
+			numbers = append(numbers, number)
+		}
+		sort.Ints(numbers)
+		var data []byte
+		for _, number := range numbers {
+			data = append(data, upload.parts[number]...)
+		}
+		f.objects[key] = &fakeObject{data: data, meta: upload.meta}
+		delete(f.uploads, query.Get("uploadId"))
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: bucket, Key: key, ETag: `"done"`})
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		object := f.objects[key]
+		if object == nil {
+			s3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		for name, values := range object.meta {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(object.data)
+		}
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// Store a part after checking its Content-MD5 and SHA-256
+func (f *fakeS3) putPart(w http.ResponseWriter, r *http.Request, query map[string][]string) {
+	upload := f.uploads[query["uploadId"][0]]
+	if upload == nil {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if f.corrupt && len(body) > 0 {
+		body[0] ^= 0xff
+	}
+
+	md5Sum := md5.Sum(body)
+	shaSum := sha256.Sum256(body)
+	if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(md5Sum[:]) {
+		s3Error(w, http.StatusBadRequest, "BadDigest")
+		return
+	}
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(shaSum[:]) {
+		s3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch")
+		return
+	}
+
+	number, _ := strconv.Atoi(query["partNumber"][0])
+	upload.parts[number] = body
+	f.parts++
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5Sum))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix string) {
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+		ETag         string
+	}
+	result := struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Name     string
+		Prefix   string
+		KeyCount int
+		Contents []content
+	}{Name: f.bucket, Prefix: prefix}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result.Contents = append(result.Contents, content{Key: key, Size: len(f.objects[key].data), LastModified: time.Now().UTC().Format(time.RFC3339), ETag: `"etag"`})
+	}
+	result.KeyCount = len(keys)
+	writeXML(w, result)
+}
+
+func metaHeaders(header http.Header) http.Header {
+	meta := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			meta[name] = values
+		}
+	}
+	return meta
+}
+
+func writeXML(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(value)
+}
+
+func s3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func TestS3DestinationUploadAndUndo(t *testing.T) {
+	tempDir, fake := setupS3Test(t)
+	CONFIG.OutputFolders = append(CONFIG.OutputFolders, "s3://docs/scans")
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+	content, _ := os.ReadFile(file)
+
+	processSingleFileOperation()
+	object := fake.object("scans/scan.pdf")
+	if assert.NotNil(t, object, "uploaded") {
+		assert.Equal(t, content, object.data)
+		digest, _ := calculateFileHash(filepath.Join(tempDir, "output", "scan.pdf"))
+		assert.Equal(t, digest, object.meta.Get("X-Amz-Meta-Sha256"))
+	}
+	assert.Equal(t, 1, fake.started, "uploads are multipart")
+	assert.False(t, destinationExists(filepath.Join(tempDir, "s3:")), "no local folder for the URL")
+
+	entry := latestHistoryEntry(HISTORY_DONE)
+	assert.Equal(t, "s3://docs/scans/scan.pdf", entry.Operation.ActualFiles[1])
+	assert.NotEmpty(t, entry.Digests["s3://docs/scans/scan.pdf"])
+
+	// Undo deletes the object, redo puts it back
+	assert.NoError(t, undoHistoryEntry(entry))
+	assert.Nil(t, fake.object("scans/scan.pdf"))
+	assert.FileExists(t, file)
+
+	assert.NoError(t, redoHistoryEntry(entry))
+	assert.NotNil(t, fake.object("scans/scan.pdf"))
+}
+
+func TestS3ConflictPolicies(t *testing.T) {
+	tempDir, fake := setupS3Test(t)
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+	fake.put("scans/scan.pdf", []byte("other"))
+
+	actual, outcome, err := copyFileWithPolicy(file, "s3://docs/scans/scan.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://docs/scans/scan_1.pdf", actual)
+	assert.Equal(t, OUTCOME_SUFFIXED, outcome)
+
+	CONFIG.ConflictPolicy = CONFLICT_SKIP_IDENTICAL
+	actual, outcome, err = copyFileWithPolicy(file, "s3://docs/scans/scan.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, "s3://docs/scans/scan_1.pdf", actual)
+	assert.Equal(t, OUTCOME_SKIPPED, outcome)
+
+	CONFIG.ConflictPolicy = CONFLICT_FAIL
+	_, _, err = copyFileWithPolicy(file, "s3://docs/scans/scan.pdf")
+	assert.ErrorIs(t, err, errDestinationExists)
+
+	CONFIG.ConflictPolicy = CONFLICT_OVERWRITE
+	_, outcome, err = copyFileWithPolicy(file, "s3://docs/scans/scan.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, OUTCOME_OVERWRITTEN, outcome)
+	content, _ := os.ReadFile(file)
+	assert.Equal(t, content, fake.object("scans/scan.pdf").data)
+}
+
+func TestS3LargeUploadUsesParts(t *testing.T) {
+	tempDir, fake := setupS3Test(t)
+	large := filepath.Join(tempDir, "large.pdf")
+	data := bytes.Repeat([]byte("0123456789abcdef"), (S3_PART_SIZE+S3_PART_SIZE/2)/16)
+	assert.NoError(t, os.WriteFile(large, data, 0644))
+
+	assert.NoError(t, performFileCopy(large, "s3://docs/large.pdf"))
+	assert.Equal(t, 2, fake.parts)
+	assert.Equal(t, data, fake.object("large.pdf").data)
+
+	// Downloads are checked against the recorded digest
+	back := filepath.Join(tempDir, "back.pdf")
+	assert.NoError(t, downloadRemote("s3://docs/large.pdf", back))
+	downloaded, _ := os.ReadFile(back)
+	assert.Equal(t, data, downloaded)
+}
+
+func TestS3CorruptPartIsRejected(t *testing.T) {
+	tempDir, fake := setupS3Test(t)
+	fake.corrupt = true
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+
+	err := performFileCopy(file, "s3://docs/scan.pdf")
+	assert.ErrorContains(t, err, "BadDigest")
+	assert.Nil(t, fake.object("scan.pdf"))
+	assert.Empty(t, fake.uploads, "failed uploads are aborted")
+}
+
+func TestRemoteDestinationValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.OutputFolders = []string{"output", "s3://docs/scans"}
+	assert.NoError(t, validateConfig(config))
+
+	for _, folder := range []string{"ftp://host/scans", "s3:///scans"} {
+		config.OutputFolders = []string{folder}
+		assert.Error(t, validateConfig(config), folder)
+	}
+
+	assert.Equal(t, "s3://docs/scans/a.pdf", joinDestination("s3://docs/scans/", "a.pdf"))
+	dir, name := splitDestination("s3://docs/scans/a.pdf")
+	assert.Equal(t, "s3://docs/scans", dir)
+	assert.Equal(t, "a.pdf", name)
+}
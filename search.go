@@ -0,0 +1,731 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+)
+
+// Searchable operation index
+//
+// Every completed operation is recorded in .blendpdf/search.json with its
+// source and output names, page count, digests and any text layer found in
+// the output. Unlike the undo history the index is never trimmed, so old
+// scans stay findable after their history entry has expired. Undone
+// operations stay in the index but are hidden from results until redone.
+
+// Index limits
+const (
+	SEARCH_INDEX_FILE = "search.json"
+	MAX_INDEXED_TEXT  = 64 * 1024 // Bytes of text kept per operation
+)
+
+// SearchSource describes an original file of an indexed operation
+type SearchSource struct {
+	Name    string `json:"name"`
+	Archive string `json:"archive,omitempty"` // Archived copy, if archive mode was on
+	SHA256  string `json:"sha256,omitempty"`
+	Pages   int    `json:"pages,omitempty"`
+}
+
+// SearchOutput describes an output copy of an indexed operation
+type SearchOutput struct {
+	Name   string `json:"name"`
+	Folder string `json:"folder"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// SearchRecord is one indexed operation
+type SearchRecord struct {
+	ID        string         `json:"id"` // History entry ID
+	Type      string         `json:"type"`
+	Timestamp time.Time      `json:"timestamp"`
+	Undone    bool           `json:"undone,omitempty"`
+	Pages     int            `json:"pages"`
+	Sources   []SearchSource `json:"sources"`
+	Outputs   []SearchOutput `json:"outputs"`
+	Text      string         `json:"text,omitempty"`
+}
+
+// SearchIndex holds every indexed operation, oldest first
+type SearchIndex struct {
+	Records []*SearchRecord `json:"records"`
+}
+
+// SearchQuery filters index records (zero values match everything)
+type SearchQuery struct {
+	From     time.Time
+	To       time.Time
+	Name     string // Glob matched against source and output names
+	Text     string // Case-insensitive text the output must contain
+	MinPages int
+	MaxPages int
+}
+
+// Get the search index path
+func getSearchIndexPath() string {
+	if STATE_DIR == "" {
+		return ""
+	}
+	return filepath.Join(STATE_DIR, SEARCH_INDEX_FILE)
+}
+
+// Load the search index (empty if there is none yet)
+func loadSearchIndex() (*SearchIndex, error) {
+	index := &SearchIndex{}
+
+	indexPath := getSearchIndexPath()
+	if indexPath == "" {
+		return index, nil
+	}
+	data, err := readStorageFile(indexPath)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("invalid search index: %v", err)
+	}
+	return index, nil
+}
+
+// Write the search index atomically
+func (idx *SearchIndex) save() error {
+	indexPath := getSearchIndexPath()
+	if indexPath == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = atomicWrite(indexPath, bytes.NewReader(data), nil)
+	return err
+}
+
+// Find a record by history ID
+func (idx *SearchIndex) find(id string) *SearchRecord {
+	for _, record := range idx.Records {
+		if record.ID == id {
+			return record
+		}
+	}
+	return nil
+}
+
+// Index maintenance
+
+// Add a history entry's operation to the search index
+func indexOperation(entry *HistoryEntry) {
+	if getSearchIndexPath() == "" {
+		return
+	}
+	index, err := loadSearchIndex()
+	if err == nil {
+		if index.find(entry.ID) == nil {
+			index.Records = append(index.Records, buildSearchRecord(entry))
+		}
+		err = index.save()
+	}
+	if err != nil {
+		printWarning(fmt.Sprintf("Failed to update search index: %v", err))
+	}
+}
+
+// Mark an indexed operation as undone or redone
+func markIndexedOperation(id string, undone bool) {
+	updateIndexedOperation(id, func(index *SearchIndex, record *SearchRecord) {
+		record.Undone = undone
+	})
+}
+
+// Refresh an indexed operation after its outputs changed
+func reindexOperation(entry *HistoryEntry) {
+	updateIndexedOperation(entry.ID, func(index *SearchIndex, record *SearchRecord) {
+		undone := record.Undone
+		*record = *buildSearchRecord(entry)
+		record.Undone = undone
+	})
+}
+
+// Drop an indexed operation that can no longer be redone
+func removeIndexedOperation(id string) {
+	updateIndexedOperation(id, func(index *SearchIndex, record *SearchRecord) {
+		for i, existing := range index.Records {
+			if existing == record {
+				index.Records = append(index.Records[:i], index.Records[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// Apply a change to one indexed operation and save the index
+func updateIndexedOperation(id string, change func(*SearchIndex, *SearchRecord)) {
+	index, err := loadSearchIndex()
+	if err != nil {
+		printWarning(fmt.Sprintf("Failed to update search index: %v", err))
+		return
+	}
+	record := index.find(id)
+	if record == nil {
+		return
+	}
+	change(index, record)
+	if err := index.save(); err != nil {
+		printWarning(fmt.Sprintf("Failed to update search index: %v", err))
+	}
+}
+
+// Index history entries recorded before the search index existed
+func backfillSearchIndex() error {
+	index, err := loadSearchIndex()
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for _, entry := range HISTORY {
+		if index.find(entry.ID) != nil {
+			continue
+		}
+		record := buildSearchRecord(entry)
+		record.Undone = entry.State == HISTORY_UNDONE
+		index.Records = append(index.Records, record)
+		added++
+	}
+	if added == 0 {
+		return nil
+	}
+
+	sort.SliceStable(index.Records, func(i, j int) bool {
+		return index.Records[i].Timestamp.Before(index.Records[j].Timestamp)
+	})
+	if VERBOSE {
+		printInfo(fmt.Sprintf("Indexed %d operation(s) from history", added))
+	}
+	return index.save()
+}
+
+// Describe an operation for the index from the files it left behind
+func buildSearchRecord(entry *HistoryEntry) *SearchRecord {
+	op := entry.Operation
+	record := &SearchRecord{
+		ID:        entry.ID,
+		Type:      op.Type,
+		Timestamp: op.Timestamp,
+	}
+
+	for i, original := range op.OriginalFiles {
+		source := SearchSource{Name: strings.TrimSuffix(filepath.Base(original), ENCRYPTED_SUFFIX)}
+		if archiveFile := operationArchiveFile(op, i); archiveFile != "" {
+			source.Archive = archiveFile
+			source.SHA256 = entry.Digests[archiveFile]
+			if readable, ok := resolveArchivedFile(archiveFile); ok {
+				source.Pages = indexedPageCount(readable)
+			}
+		}
+		record.Sources = append(record.Sources, source)
+	}
+
+	var readable string
+	for i, actual := range op.ActualFiles {
+		if actual == "" {
+			continue
+		}
+		folder := filepath.Base(filepath.Dir(actual))
+		if i < len(op.OutputFolders) {
+			folder = op.OutputFolders[i]
+		}
+		record.Outputs = append(record.Outputs, SearchOutput{
+			Name:   filepath.Base(actual),
+			Folder: folder,
+			Path:   actual,
+			SHA256: entry.Digests[actual],
+		})
+		if readable == "" && fileExists(actual) {
+			readable = actual
+		}
+	}
+
+	if readable != "" {
+		record.Pages = indexedPageCount(readable)
+		text, err := extractPDFText(readable)
+		if err != nil && VERBOSE {
+			printWarning(fmt.Sprintf("No text indexed for %s: %v", filepath.Base(readable), err))
+		}
+		record.Text = text
+	}
+
+	// A single file's output is the original
+	if op.Type == "single" && len(record.Sources) == 1 && record.Sources[0].Pages == 0 {
+		record.Sources[0].Pages = record.Pages
+	}
+	return record
+}
+
+// Get a page count for the index (0 when unknown)
+func indexedPageCount(file string) (pages int) {
+	defer func() {
+		if recover() != nil {
+			pages = 0
+		}
+	}()
+	if count, err := getPageCount(file); err == nil {
+		return count
+	}
+	return 0
+}
+
+// Get the archive copy of an operation's i-th original
+// Merges keep archive files aligned with originals; single files have at most one
+// and reprocessed pairs were read straight from the archive
+func operationArchiveFile(op *LastOperation, i int) string {
+	if op.Type == "reprocess" {
+		return op.OriginalFiles[i]
+	}
+	if i < len(op.ArchiveFiles) {
+		return op.ArchiveFiles[i]
+	}
+	return ""
+}
+
+// Text extraction
+
+// Extract the text layer of a PDF, or "" for scans without one
+func extractPDFText(file string) (string, error) {
+	return extractPDFTextPages(file, 0)
+}
+
+// Extract the text layer of the first lastPage pages (0 for every page)
+func extractPDFTextPages(file string, lastPage int) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("unreadable file structure: %v", r)
+		}
+	}()
+
+	data, err := readStorageFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, err := api.ReadAndValidate(bytes.NewReader(data), createValidationConfig())
+	if err != nil {
+		return "", err
+	}
+
+	if lastPage <= 0 || lastPage > ctx.PageCount {
+		lastPage = ctx.PageCount
+	}
+
+	var b strings.Builder
+	for page := 1; page <= lastPage && b.Len() < MAX_INDEXED_TEXT; page++ {
+		reader, err := pdfcpu.ExtractPageContent(ctx, page)
+		if err != nil {
+			continue
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			continue
+		}
+		if pageText := extractContentText(content); pageText != "" {
+			if b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString(pageText)
+		}
+	}
+
+	text = b.String()
+	if len(text) > MAX_INDEXED_TEXT {
+		text = text[:MAX_INDEXED_TEXT]
+	}
+	return text, nil
+}
+
+// Collect the strings shown by text operators (Tj, TJ, ' and ") in a content stream
+func extractContentText(content []byte) string {
+	var words []string
+	var pending []string
+
+	for i := 0; i < len(content); {
+		c := content[i]
+		switch {
+		case c == '(':
+			str, next := readLiteralString(content, i)
+			pending = append(pending, str)
+			i = next
+		case c == '<' && i+1 < len(content) && content[i+1] == '<':
+			i += 2 // Inline image or marked content dictionary
+		case c == '<':
+			str, next := readHexString(content, i)
+			pending = append(pending, str)
+			i = next
+		case c == '%':
+			for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+				i++
+			}
+		case isContentDelimiter(c):
+			i++
+		default:
+			start := i
+			for i < len(content) && !isContentDelimiter(content[i]) && content[i] != '(' && content[i] != '<' {
+				i++
+			}
+			switch string(content[start:i]) {
+			case "Tj", "TJ", "'", "\"":
+				if shown := strings.TrimSpace(strings.Join(pending, "")); shown != "" {
+					words = append(words, shown)
+				}
+				pending = nil
+			case "BT", "ET":
+				pending = nil
+			}
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// Check for content stream whitespace and array/dictionary delimiters
+func isContentDelimiter(c byte) bool {
+	switch c {
+	case ' ', '\t', '\r', '\n', '\f', 0, '[', ']', '>', '{', '}':
+		return true
+	}
+	return false
+}
+
+// Read a (literal) string starting at content[start], returns the text and the next offset
+func readLiteralString(content []byte, start int) (string, int) {
+	var b []byte
+	depth := 0
+	for i := start; i < len(content); i++ {
+		c := content[i]
+		switch {
+		case c == '\\' && i+1 < len(content):
+			i++
+			switch e := content[i]; e {
+			case 'n', 'r', 't':
+				b = append(b, ' ')
+			case 'b', 'f':
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if e >= '0' && e <= '7' {
+					end := i
+					for end < len(content) && end < i+3 && content[end] >= '0' && content[end] <= '7' {
+						end++
+					}
+					value, _ := strconv.ParseUint(string(content[i:end]), 8, 8)
+					b = append(b, byte(value))
+					i = end - 1
+				} else {
+					b = append(b, e)
+				}
+			}
+		case c == '(':
+			if depth > 0 {
+				b = append(b, c)
+			}
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return decodePDFString(b), i + 1
+			}
+			b = append(b, c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return decodePDFString(b), len(content)
+}
+
+// Read a <hex> string starting at content[start], returns the text and the next offset
+func readHexString(content []byte, start int) (string, int) {
+	end := bytes.IndexByte(content[start:], '>')
+	if end < 0 {
+		return "", len(content)
+	}
+
+	digits := make([]byte, 0, end)
+	for _, c := range content[start+1 : start+end] {
+		if unicode.Is(unicode.ASCII_Hex_Digit, rune(c)) {
+			digits = append(digits, c)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, '0')
+	}
+
+	b := make([]byte, len(digits)/2)
+	for i := range b {
+		value, _ := strconv.ParseUint(string(digits[2*i:2*i+2]), 16, 8)
+		b[i] = byte(value)
+	}
+	return decodePDFString(b), start + end + 1
+}
+
+// Decode string bytes as UTF-16 (with BOM) or single-byte text, dropping unprintable characters
+// Glyph IDs of subset fonts have no reliable mapping and come out as nothing
+func decodePDFString(b []byte) string {
+	var runes []rune
+	if len(b) >= 2 && b[0] == 0xFE && b[1] == 0xFF {
+		units := make([]uint16, 0, len(b)/2)
+		for i := 2; i+1 < len(b); i += 2 {
+			units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+		}
+		runes = utf16.Decode(units)
+	} else {
+		for _, c := range b {
+			runes = append(runes, rune(c))
+		}
+	}
+
+	var out strings.Builder
+	for _, r := range runes {
+		if unicode.IsPrint(r) {
+			out.WriteRune(r)
+		} else if unicode.IsSpace(r) {
+			out.WriteRune(' ')
+		}
+	}
+	return out.String()
+}
+
+// Searching
+
+// Find indexed operations matching a query, newest first
+func searchIndex(query SearchQuery) ([]*SearchRecord, error) {
+	index, err := loadSearchIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []*SearchRecord
+	for i := len(index.Records) - 1; i >= 0; i-- {
+		record := index.Records[i]
+		if !record.Undone && query.matches(record) {
+			results = append(results, record)
+		}
+	}
+	return results, nil
+}
+
+// Check whether a record satisfies every filter of the query
+func (q SearchQuery) matches(record *SearchRecord) bool {
+	if !q.From.IsZero() && record.Timestamp.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !record.Timestamp.Before(q.To) {
+		return false
+	}
+	if q.MinPages > 0 && record.Pages < q.MinPages {
+		return false
+	}
+	if q.MaxPages > 0 && record.Pages > q.MaxPages {
+		return false
+	}
+	if q.Text != "" && !strings.Contains(normalizeSearchText(record.Text), normalizeSearchText(q.Text)) {
+		return false
+	}
+	if q.Name != "" && !record.matchesName(q.Name) {
+		return false
+	}
+	return true
+}
+
+// Check a name glob against a record's source and output names (case-insensitive)
+func (r *SearchRecord) matchesName(pattern string) bool {
+	pattern = strings.ToLower(pattern)
+	var names []string
+	for _, source := range r.Sources {
+		names = append(names, source.Name)
+	}
+	for _, output := range r.Outputs {
+		names = append(names, output.Name)
+	}
+	for _, name := range names {
+		if ok, _ := path.Match(pattern, strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Lower-case text and collapse whitespace so line breaks do not split matches
+func normalizeSearchText(text string) string {
+	return strings.Join(strings.Fields(strings.ToLower(text)), " ")
+}
+
+// Parse a search date (YYYY-MM-DD) in local time
+func parseSearchDate(value string) (time.Time, error) {
+	t, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q (use YYYY-MM-DD)", value)
+	}
+	return t, nil
+}
+
+// Parse a page filter: "4" for exactly four pages, "2-10", "5-" or "-3" for a range
+func parsePageRange(value string) (int, int, error) {
+	invalid := fmt.Errorf("invalid page filter %q (use N, N-M, N- or -M)", value)
+
+	parse := func(s string) (int, error) {
+		if s == "" {
+			return 0, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, invalid
+		}
+		return n, nil
+	}
+
+	lower, upper, isRange := strings.Cut(value, "-")
+	min, err := parse(lower)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		if min == 0 {
+			return 0, 0, invalid
+		}
+		return min, min, nil
+	}
+	max, err := parse(upper)
+	if err != nil {
+		return 0, 0, err
+	}
+	if min == 0 && max == 0 || max > 0 && max < min {
+		return 0, 0, invalid
+	}
+	return min, max, nil
+}
+
+// Results
+
+// Print search results with where each output copy and archived original lives
+func displaySearchResults(results []*SearchRecord, query SearchQuery) {
+	if len(results) == 0 {
+		fmt.Println("No matching operations")
+		return
+	}
+
+	for _, record := range results {
+		fmt.Printf("%s%s%s  %s  %s, %d page(s)\n", BLUE, record.ID, NC,
+			record.Timestamp.Format("2006-01-02 15:04"), record.Type, record.Pages)
+
+		for _, source := range record.Sources {
+			location := "not archived"
+			if source.Archive != "" {
+				location = source.Archive
+				if !archivedFileExists(source.Archive) {
+					location += YELLOW + " (no longer in archive)" + NC
+				}
+			}
+			fmt.Printf("  source  %-32s %s\n", source.Name, location)
+		}
+		for _, output := range record.Outputs {
+			location := output.Path
+			if !fileExists(output.Path) {
+				location += YELLOW + " (missing)" + NC
+			}
+			fmt.Printf("  output  %-32s %s\n", output.Folder, location)
+		}
+		if snippet := searchSnippet(record.Text, query.Text); snippet != "" {
+			fmt.Printf("  text    %s\n", snippet)
+		}
+	}
+	fmt.Printf("\n%d matching operation(s)\n", len(results))
+}
+
+// Get a short excerpt of text around the first match (or its start)
+func searchSnippet(text, match string) string {
+	runes := []rune(strings.Join(strings.Fields(text), " "))
+	if len(runes) == 0 {
+		return ""
+	}
+
+	const width = 60
+	start := 0
+	if match != "" {
+		lower := []rune(strings.ToLower(string(runes)))
+		at := strings.Index(string(lower), normalizeSearchText(match))
+		if at > 0 && len(lower) == len(runes) {
+			if at = len([]rune(string(lower)[:at])); at > width/2 {
+				start = at - width/2
+			}
+		}
+	}
+
+	excerpt := string(runes[start:])
+	if len(runes)-start > width*2 {
+		excerpt = string(runes[start:start+width*2]) + "..."
+	}
+	if start > 0 {
+		excerpt = "..." + excerpt
+	}
+	return excerpt
+}
+
+// Copy the archived originals of a search result back to the watch folder
+// The archive copies stay in place so history undo/redo keeps working
+func restoreIndexedOriginals(record *SearchRecord) ([]string, error) {
+	var restored []string
+	for _, source := range record.Sources {
+		if source.Archive == "" {
+			return restored, fmt.Errorf("%s was not archived", source.Name)
+		}
+		if !archivedFileExists(source.Archive) {
+			return restored, fmt.Errorf("%s is no longer in the archive", source.Name)
+		}
+
+		dst := filepath.Join(FOLDER, source.Name)
+		if fileExists(dst) {
+			unique, err := generateUniqueFileName(dst)
+			if err != nil {
+				return restored, err
+			}
+			dst = unique
+		}
+		if err := copyPlaintext(source.Archive, dst); err != nil {
+			return restored, fmt.Errorf("failed to restore %s: %v", source.Name, err)
+		}
+		restored = append(restored, dst)
+		logOperation("RESTORE", source.Name, filepath.Base(dst), "SUCCESS")
+	}
+	return restored, nil
+}
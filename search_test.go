@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// buildTextPDF writes a PDF with one page per text line
+func buildTextPDF(lines ...string) []byte {
+	var b bytes.Buffer
+	b.WriteString("%PDF-1.4\n")
+
+	kids := ""
+	for i := range lines {
+		kids += fmt.Sprintf("%d 0 R ", 4+2*i)
+	}
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", kids, len(lines)),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+	for i, line := range lines {
+		content := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", line)
+		objects = append(objects,
+			fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Resources << /Font << /F1 3 0 R >> >> /Contents %d 0 R >>", 5+2*i),
+			fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content))
+	}
+
+	var offsets []int
+	for i, object := range objects {
+		offsets = append(offsets, b.Len())
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f\r\n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n\r\n", offset)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return b.Bytes()
+}
+
+// recordSearchTestOperation simulates a single file operation with an archived original
+func recordSearchTestOperation(t *testing.T, tempDir, name string, content []byte, at time.Time) string {
+	output := filepath.Join(tempDir, "output", name)
+	archived := filepath.Join(ARCHIVE, name)
+	for _, file := range []string{output, archived} {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.NoError(t, os.WriteFile(file, content, 0644))
+	}
+
+	recordOperation(&LastOperation{
+		Type:          "single",
+		OriginalFiles: []string{filepath.Join(tempDir, name)},
+		ActualFiles:   []string{output},
+		OutputFolders: []string{"output"},
+		ArchiveFiles:  []string{archived},
+		Timestamp:     at,
+	})
+	return archived
+}
+
+func TestExtractContentText(t *testing.T) {
+	content := []byte(`BT /F1 12 Tf (Bank \(March\)) Tj T* [(State) -250 (ment)] TJ <48692021> Tj ET
+% (comment) Tj
+BT (line\040two) ' ET`)
+	assert.Equal(t, "Bank (March) Statement Hi ! line two", extractContentText(content))
+}
+
+func TestExtractPDFText(t *testing.T) {
+	tempDir := t.TempDir()
+	textFile := filepath.Join(tempDir, "text.pdf")
+	blankFile := filepath.Join(tempDir, "blank.pdf")
+	_ = os.WriteFile(textFile, buildTextPDF("Bank statement", "March 2025"), 0644)
+	_ = os.WriteFile(blankFile, buildTestPDF(2, ""), 0644)
+
+	text, err := extractPDFText(textFile)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bank statement\nMarch 2025", text)
+
+	text, err = extractPDFText(blankFile)
+	assert.NoError(t, err)
+	assert.Empty(t, text)
+}
+
+func TestSearchFilters(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	march := time.Date(2025, 3, 14, 10, 0, 0, 0, time.Local)
+	april := time.Date(2025, 4, 2, 10, 0, 0, 0, time.Local)
+	recordSearchTestOperation(t, tempDir, "bank.pdf", buildTextPDF("Bank statement", "Balance"), march)
+	recordSearchTestOperation(t, tempDir, "invoice.pdf", buildTextPDF("Invoice for services"), april)
+
+	search := func(query SearchQuery) []string {
+		results, err := searchIndex(query)
+		assert.NoError(t, err)
+		var names []string
+		for _, record := range results {
+			names = append(names, record.Sources[0].Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"invoice.pdf", "bank.pdf"}, search(SearchQuery{}))
+	assert.Equal(t, []string{"bank.pdf"}, search(SearchQuery{Text: "BANK   statement"}))
+	assert.Equal(t, []string{"invoice.pdf"}, search(SearchQuery{Name: "INV*"}))
+	assert.Equal(t, []string{"bank.pdf"}, search(SearchQuery{MinPages: 2}))
+	assert.Equal(t, []string{"invoice.pdf"}, search(SearchQuery{MaxPages: 1}))
+
+	query, err := buildSearchQuery("2025-03-01", "2025-03-14", "", "", "", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bank.pdf"}, search(query))
+
+	results, _ := searchIndex(SearchQuery{Name: "bank.pdf"})
+	record := results[0]
+	assert.Equal(t, 2, record.Pages)
+	assert.Equal(t, 2, record.Sources[0].Pages)
+	assert.NotEmpty(t, record.Sources[0].SHA256)
+	assert.Equal(t, filepath.Join(ARCHIVE, "bank.pdf"), record.Sources[0].Archive)
+	assert.Equal(t, "output", record.Outputs[0].Folder)
+}
+
+func TestSearchHidesUndoneOperations(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	recordSearchTestOperation(t, tempDir, "bank.pdf", buildTextPDF("Bank statement"), time.Now())
+
+	assert.NoError(t, undoLatestOperation())
+	results, err := searchIndex(SearchQuery{Text: "bank"})
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	assert.NoError(t, redoLatestOperation())
+	results, _ = searchIndex(SearchQuery{Text: "bank"})
+	assert.Len(t, results, 1)
+}
+
+func TestSearchBackfillsHistory(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+	recordSearchTestOperation(t, tempDir, "bank.pdf", buildTextPDF("Bank statement"), time.Now())
+	assert.NoError(t, os.Remove(getSearchIndexPath()))
+
+	assert.NoError(t, backfillSearchIndex())
+	results, err := searchIndex(SearchQuery{Text: "statement"})
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+}
+
+func TestRestoreIndexedOriginals(t *testing.T) {
+	tempDir := useTestWorkspace(t)
+
+	archived := recordSearchTestOperation(t, tempDir, "bank.pdf", buildTextPDF("Bank statement"), time.Now())
+	_ = os.WriteFile(filepath.Join(tempDir, "bank.pdf"), []byte("new scan"), 0644)
+
+	results, _ := searchIndex(SearchQuery{Name: "bank.pdf"})
+	restored, err := restoreIndexedOriginals(results[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(tempDir, "bank_1.pdf")}, restored)
+	assert.FileExists(t, archived, "restoring leaves the archive copy in place")
+
+	content, _ := os.ReadFile(restored[0])
+	assert.Equal(t, buildTextPDF("Bank statement"), content)
+}
+
+func TestParsePageRange(t *testing.T) {
+	for value, want := range map[string][2]int{"4": {4, 4}, "2-10": {2, 10}, "5-": {5, 0}, "-3": {0, 3}} {
+		min, max, err := parsePageRange(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, [2]int{min, max}, value)
+	}
+	for _, value := range []string{"", "-", "x", "0", "5-2"} {
+		_, _, err := parsePageRange(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -16,7 +16,9 @@ package main
 
 import (
 	"crypto/md5"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -29,7 +31,11 @@ import (
 
 // Setup lock file to prevent multiple instances
 func setupLock() error {
-	watchDir := determineWatchDirectory()
+	return acquireLock(determineWatchDirectory())
+}
+
+// Acquire the lock for a specific watch directory
+func acquireLock(watchDir string) error {
 	LOCKFILE = generateLockFileName(watchDir)
 
 	if err := checkExistingLockFile(); err != nil {
@@ -380,7 +386,7 @@ func validatePDFFile(file string) error {
 
 // Check if file exists and is accessible
 func checkFileExists(file string) error {
-	info, err := os.Stat(file)
+	info, err := STORAGE.stat(file)
 	if os.IsNotExist(err) {
 		return fmt.Errorf("file does not exist")
 	}
@@ -426,55 +432,106 @@ func checkPDFStructure(file string) error {
 // Enhanced file operation with error recovery
 // Move file with error recovery and conflict resolution
 func moveFileWithRecovery(src, dst string) error {
+	_, err := moveFileResolved(src, dst)
+	return err
+}
+
+// Move file with conflict resolution, returns actual destination used
+func moveFileResolved(src, dst string) (string, error) {
 	if err := ensureDestinationDirectory(dst); err != nil {
-		return err
+		return "", err
 	}
 
-	dst = resolveDestinationConflicts(dst)
-	return performFileMove(src, dst)
+	dst, err := resolveDestinationConflicts(dst)
+	if err != nil {
+		return "", err
+	}
+	return dst, performFileMove(src, dst)
 }
 
 // Ensure destination directory exists
 func ensureDestinationDirectory(dst string) error {
 	dstDir := filepath.Dir(dst)
-	if err := os.MkdirAll(dstDir, 0750); err != nil {
-		return fmt.Errorf("failed to create destination directory: %v", err)
+	if err := STORAGE.mkdirAll(dstDir); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	if err := applyDirOwnership(dstDir); err != nil {
+		return fmt.Errorf("failed to set ownership of %s: %w", filepath.Base(dstDir), err)
 	}
 	return nil
 }
 
 // Resolve destination file conflicts by generating unique names
-func resolveDestinationConflicts(dst string) string {
-	if _, err := os.Stat(dst); os.IsNotExist(err) {
-		return dst // No conflict
+// Moves always keep both files, so they use suffixes regardless of policy
+func resolveDestinationConflicts(dst string) (string, error) {
+	if _, err := STORAGE.stat(dst); os.IsNotExist(err) {
+		return dst, nil // No conflict
 	}
 
 	return generateUniqueFileName(dst)
 }
 
 // Generate unique filename if destination exists
-func generateUniqueFileName(dst string) string {
-	dstDir := filepath.Dir(dst)
-	base := strings.TrimSuffix(filepath.Base(dst), filepath.Ext(dst))
-	ext := filepath.Ext(dst)
+func generateUniqueFileName(dst string) (string, error) {
+	dstDir, name := splitDestination(dst)
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	ext := filepath.Ext(name)
 
 	for counter := 1; counter <= 1000; counter++ {
-		newDst := filepath.Join(dstDir, fmt.Sprintf("%s_%d%s", base, counter, ext))
-		if _, err := os.Stat(newDst); os.IsNotExist(err) {
+		newDst := joinDestination(dstDir, fmt.Sprintf("%s_%d%s", base, counter, ext))
+		if !destinationExists(newDst) {
 			if VERBOSE {
 				printWarning(fmt.Sprintf("Destination exists, using: %s", filepath.Base(newDst)))
 			}
-			return newDst
+			return newDst, nil
 		}
 	}
 
-	// If we can't find a unique name after 1000 attempts, use original
-	return dst
+	// Never fall back to overwriting the original destination
+	return "", fmt.Errorf("no free filename for %s after 1000 attempts", filepath.Base(dst))
+}
+
+// Move a local file to dst without replacing anything, numbering the name
+// on conflict. Unlike resolveDestinationConflicts, the free name can't be
+// taken between the check and the move. Returns the path used.
+func placeWithoutReplacing(src, dst string) (string, error) {
+	dstDir, name := filepath.Dir(dst), filepath.Base(dst)
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	ext := filepath.Ext(name)
+
+	target := dst
+	for counter := 1; counter <= 1000; counter++ {
+		err := STORAGE.renameNoReplace(src, target)
+		if err == nil {
+			if target != dst && VERBOSE {
+				printWarning(fmt.Sprintf("Destination exists, using: %s", filepath.Base(target)))
+			}
+			return target, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		target = filepath.Join(dstDir, fmt.Sprintf("%s_%d%s", base, counter, ext))
+	}
+	return "", fmt.Errorf("no free filename for %s after 1000 attempts", name)
 }
 
 // Perform the actual file move operation
 func performFileMove(src, dst string) error {
-	err := os.Rename(src, dst)
+	switch {
+	case isRemotePath(src):
+		if err := downloadRemote(src, dst); err != nil {
+			return err
+		}
+		return removeDestination(src)
+	case isRemotePath(dst):
+		if err := uploadRemote(src, dst); err != nil {
+			return err
+		}
+		return STORAGE.remove(src)
+	}
+
+	err := STORAGE.rename(src, dst)
 	if err != nil {
 		return attemptCopyAndDelete(src, dst, err)
 	}
@@ -487,7 +544,7 @@ func attemptCopyAndDelete(src, dst string, originalErr error) error {
 		return fmt.Errorf("move failed: %v, copy fallback failed: %v", originalErr, copyErr)
 	}
 
-	if deleteErr := os.Remove(src); deleteErr != nil {
+	if deleteErr := STORAGE.remove(src); deleteErr != nil {
 		printWarning(fmt.Sprintf("Original file not deleted: %v", deleteErr))
 	}
 
@@ -496,19 +553,49 @@ func attemptCopyAndDelete(src, dst string, originalErr error) error {
 
 // Copy file with conflict resolution, returns actual destination used
 func copyFileWithConflictResolution(src, dst string) (string, error) {
+	actualDst, _, err := copyFileWithPolicy(src, dst)
+	return actualDst, err
+}
+
+// Copy file using the destination's conflict policy, returns actual destination and outcome
+func copyFileWithPolicy(src, dst string) (string, string, error) {
 	if err := validateFilePaths(src, dst); err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	actualDst := resolveDestinationConflicts(dst)
-	err := performFileCopy(src, actualDst)
-	return actualDst, err
+	policy := getConflictPolicy(destinationDir(dst))
+	resolution, err := resolveConflict(src, dst, policy)
+	if err != nil {
+		return "", "", err
+	}
+
+	if resolution.skip {
+		return resolution.path, resolution.outcome, nil
+	}
+
+	err = performFileCopy(src, resolution.path)
+	return resolution.path, resolution.outcome, err
+}
+
+// Copy file keeping both copies on conflict, mirroring moveFileWithRecovery
+func copyFileWithRecovery(src, dst string) error {
+	if err := ensureDestinationDirectory(dst); err != nil {
+		return err
+	}
+
+	dst, err := resolveDestinationConflicts(dst)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, dst)
 }
 
-// Copy file as fallback for move operations
+// Copy file as fallback for move operations (destination already resolved)
 func copyFile(src, dst string) error {
-	_, err := copyFileWithConflictResolution(src, dst)
-	return err
+	if err := validateFilePaths(src, dst); err != nil {
+		return err
+	}
+	return performFileCopy(src, dst)
 }
 
 // Validate file paths to prevent directory traversal
@@ -523,26 +610,13 @@ func validateFilePaths(src, dst string) error {
 	return nil
 }
 
-// Perform the actual file copy operation
+// Perform the actual file copy operation, applying the destination's ownership settings
 func performFileCopy(src, dst string) error {
-	sourceFile, err := os.Open(src) // #nosec G304 - path validated above
-	if err != nil {
-		return err
+	if isRemotePath(dst) {
+		return uploadRemote(src, dst)
 	}
-	defer sourceFile.Close()
-
-	// Create destination directory if it doesn't exist
-	destDir := filepath.Dir(dst)
-	if err := os.MkdirAll(destDir, 0750); err != nil {
-		return fmt.Errorf("failed to create destination directory %s: %v", destDir, err)
-	}
-
-	destFile, err := os.Create(dst) // #nosec G304 - path validated above
-	if err != nil {
+	if err := ensureDestinationDirectory(dst); err != nil {
 		return err
 	}
-	defer destFile.Close()
-
-	_, err = destFile.ReadFrom(sourceFile)
-	return err
+	return atomicCopyFile(src, dst)
 }
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -301,3 +302,41 @@ func TestEnableDebugMode(t *testing.T) {
 	assert.True(t, DEBUG, "Should enable debug mode")
 	assert.True(t, VERBOSE, "Should enable verbose mode when debug is enabled")
 }
+
+// useTestWorkspace points the working folders and state folder at a temp directory
+// with a default config, restoring every global the tests change when the test ends
+func useTestWorkspace(t *testing.T) string {
+	tempDir := t.TempDir()
+
+	folder, archive, errorDir, stateDir := FOLDER, ARCHIVE, ERROR_DIR, STATE_DIR
+	config, history, lastOperation := CONFIG, HISTORY, LAST_OPERATION
+	storage, counter, errorCount := STORAGE, COUNTER, ERROR_COUNT
+	retries, webhooks, inbox := RETRY_QUEUE, WEBHOOK_STATE, inboxState
+	t.Cleanup(func() {
+		FOLDER, ARCHIVE, ERROR_DIR, STATE_DIR = folder, archive, errorDir, stateDir
+		CONFIG, HISTORY, LAST_OPERATION = config, history, lastOperation
+		STORAGE, COUNTER, ERROR_COUNT = storage, counter, errorCount
+		RETRY_QUEUE, WEBHOOK_STATE, inboxState = retries, webhooks, inbox
+		for _, store := range remoteStores {
+			if store, ok := store.(*sftpStore); ok {
+				store.close()
+			}
+		}
+		remoteStores = map[string]remoteStore{}
+	})
+
+	FOLDER = tempDir
+	ARCHIVE = filepath.Join(tempDir, "archive")
+	ERROR_DIR = filepath.Join(tempDir, "error")
+	STATE_DIR = filepath.Join(tempDir, ".blendpdf")
+	CONFIG = getDefaultConfig()
+	CONFIG.OutputFolders = []string{filepath.Join(tempDir, "output")}
+	HISTORY, LAST_OPERATION, RETRY_QUEUE = nil, nil, nil
+	COUNTER, ERROR_COUNT = 0, 0
+	WEBHOOK_STATE = webhookState{}
+	inboxState.nextPoll, inboxState.lastPoll, inboxState.fetched, inboxState.lastError = time.Time{}, time.Time{}, 0, ""
+	remoteStores = map[string]remoteStore{}
+	_ = os.MkdirAll(ARCHIVE, 0755)
+	_ = os.MkdirAll(ERROR_DIR, 0755)
+	return tempDir
+}
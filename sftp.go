@@ -0,0 +1,406 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP destinations
+//
+// sftp://user@host[:port]/path destinations authenticate with a private key
+// (the destination's keyFile, the SSH agent, or the usual ~/.ssh keys) and
+// only connect to hosts listed in known_hosts. Paths are absolute unless
+// they start with ~/. Files are written under a temporary name and renamed
+// into place; a dropped connection is reopened on the next call, and failed
+// copies go through the retry queue like any other destination.
+
+const (
+	SFTP_DEFAULT_PORT = "22"
+	SFTP_TIMEOUT      = 30 * time.Second
+)
+
+// Keys tried when no keyFile is configured
+var sftpDefaultKeys = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+// sftpStore uploads to one SFTP server
+// Calls hold mu so a background health check can't close a session in use
+type sftpStore struct {
+	mu      sync.Mutex
+	address string
+	config  *ssh.ClientConfig
+	conn    *ssh.Client
+	client  *sftp.Client
+	agent   net.Conn // ssh-agent connection, open only while a handshake signs with it
+}
+
+// Prepare a connection to the server of an sftp:// URL
+func openSFTPStore(u *url.URL, dest DestinationConfig) (remoteStore, error) {
+	username := firstNonEmpty(u.User.Username(), dest.Username, os.Getenv("USER"), os.Getenv("USERNAME"))
+	if username == "" {
+		return nil, fmt.Errorf("no user name for %s", u.Host)
+	}
+
+	knownHostsFile := dest.KnownHosts
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts %s: %v", knownHostsFile, err)
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), SFTP_DEFAULT_PORT)
+	}
+	store := &sftpStore{address: address}
+	store.config = &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(sftpSigners(dest.KeyFile, &store.agent))},
+		HostKeyCallback: hostKeys,
+		Timeout:         SFTP_TIMEOUT,
+	}
+	return store, nil
+}
+
+// Get the signers for key-based auth, read when the connection opens
+// The ssh-agent connection is left in agentConn for the caller to close once the handshake is done
+func sftpSigners(keyFile string, agentConn *net.Conn) func() ([]ssh.Signer, error) {
+	var keyFiles []string
+	if keyFile != "" {
+		keyFiles = []string{keyFile}
+	} else if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range sftpDefaultKeys {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	return func() ([]ssh.Signer, error) {
+		var signers []ssh.Signer
+		for _, file := range keyFiles {
+			data, err := os.ReadFile(file) // #nosec G304 - key path from configuration
+			if os.IsNotExist(err) && keyFile == "" {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read key %s: %v", file, err)
+			}
+			signer, err := ssh.ParsePrivateKey(data)
+			if err != nil {
+				if _, protected := err.(*ssh.PassphraseMissingError); protected && keyFile == "" {
+					continue // Left to the agent
+				}
+				return nil, fmt.Errorf("failed to parse key %s: %v", file, err)
+			}
+			signers = append(signers, signer)
+		}
+
+		if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+			if conn, err := net.Dial("unix", socket); err == nil {
+				if *agentConn != nil {
+					(*agentConn).Close()
+				}
+				*agentConn = conn
+				if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+					signers = append(signers, agentSigners...)
+				}
+			}
+		}
+		if len(signers) == 0 {
+			return nil, fmt.Errorf("no SSH keys found; set keyFile for the destination or load a key into ssh-agent")
+		}
+		return signers, nil
+	}
+}
+
+// Get an open SFTP session, reconnecting if the last one dropped
+func (s *sftpStore) session() (*sftp.Client, error) {
+	if s.client != nil {
+		if _, err := s.client.Getwd(); err == nil {
+			return s.client, nil
+		}
+		s.close()
+	}
+
+	conn, err := ssh.Dial("tcp", s.address, s.config)
+	s.closeAgent() // Agent keys are only needed to sign the handshake
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.address, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start SFTP on %s: %w", s.address, err)
+	}
+	s.conn, s.client = conn, client
+	return client, nil
+}
+
+// Close the session after an error so the next call starts afresh
+func (s *sftpStore) close() {
+	if s.client != nil {
+		s.client.Close()
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn, s.client = nil, nil
+	s.closeAgent()
+}
+
+// Close the ssh-agent connection left by the last handshake
+func (s *sftpStore) closeAgent() {
+	if s.agent != nil {
+		s.agent.Close()
+		s.agent = nil
+	}
+}
+
+// Get the server path for a key
+func sftpPath(key string) string {
+	if home, ok := strings.CutPrefix(key, "~/"); ok {
+		return home
+	}
+	return "/" + key
+}
+
+func (s *sftpStore) stat(key string) (remoteObject, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, err := s.session()
+	if err != nil {
+		return remoteObject{}, err
+	}
+	info, err := client.Stat(sftpPath(key))
+	if os.IsNotExist(err) {
+		return remoteObject{}, errRemoteNotFound
+	}
+	if err != nil {
+		return remoteObject{}, err
+	}
+	return remoteObject{size: info.Size()}, nil
+}
+
+func (s *sftpStore) list(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, err := s.session()
+	if err != nil {
+		return nil, err
+	}
+	dir, _ := path.Split(prefix)
+	entries, err := client.ReadDir(sftpPath(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if key := dir + entry.Name(); !entry.IsDir() && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *sftpStore) upload(src, key, digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, err := s.session()
+	if err != nil {
+		return err
+	}
+	if err := s.uploadFile(client, src, key); err != nil {
+		s.close()
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	return nil
+}
+
+// Write src beside the target under a temporary name, then rename it into place
+func (s *sftpStore) uploadFile(client *sftp.Client, src, key string) error {
+	info, err := STORAGE.stat(src)
+	if err != nil {
+		return err
+	}
+	file, err := STORAGE.open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	target := sftpPath(key)
+	dir, name := path.Split(target)
+	if dir != "" {
+		if err := client.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+	tempPath := dir + TEMP_FILE_PREFIX + name + "." + strconv.FormatInt(time.Now().UnixNano(), 36) + TEMP_FILE_SUFFIX
+
+	remote, err := client.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(remote, file)
+	if closeErr := remote.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && written != info.Size() {
+		err = fmt.Errorf("wrote %d of %d bytes", written, info.Size())
+	}
+	if err == nil {
+		err = s.rename(client, tempPath, target)
+	}
+	if err != nil {
+		_ = client.Remove(tempPath)
+		return err
+	}
+
+	// Confirm the server holds what was sent
+	stored, err := client.Stat(target)
+	if err != nil {
+		return err
+	}
+	if stored.Size() != info.Size() {
+		return fmt.Errorf("upload of %s does not match the source", key)
+	}
+	return nil
+}
+
+// Rename over an existing file; the conflict policy has already decided on replacing
+func (s *sftpStore) rename(client *sftp.Client, src, dst string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(src, dst)
+	}
+	if err := client.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return client.Rename(src, dst)
+}
+
+// The session stays locked until the file is closed
+func (s *sftpStore) open(key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	client, err := s.session()
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	file, err := client.Open(sftpPath(key))
+	if err != nil {
+		s.mu.Unlock()
+		if os.IsNotExist(err) {
+			return nil, errRemoteNotFound
+		}
+		return nil, err
+	}
+	return readCloser{Reader: file, Closer: unlockCloser{Closer: file, mu: &s.mu}}, nil
+}
+
+// Releases a lock once the body is closed
+type unlockCloser struct {
+	io.Closer
+	mu *sync.Mutex
+}
+
+func (c unlockCloser) Close() error {
+	defer c.mu.Unlock()
+	return c.Closer.Close()
+}
+
+func (s *sftpStore) remove(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, err := s.session()
+	if err != nil {
+		return err
+	}
+	if err := client.Remove(sftpPath(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// The folder is created when missing, as local output folders are
+func (s *sftpStore) check(folder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, err := s.session()
+	if err != nil {
+		return err
+	}
+	return client.MkdirAll(sftpPath(strings.TrimSuffix(folder, "/")))
+}
+
+// A hard link fails when the target exists, so only one instance can make
+// it; servers without the extension fall back to the plain SFTP rename,
+// which OpenSSH also refuses over an existing file
+func (s *sftpStore) claim(src, dst string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	client, err := s.session()
+	if err != nil {
+		return err
+	}
+	target := sftpPath(dst)
+	if dir, _ := path.Split(target); dir != "" {
+		if err := client.MkdirAll(dir); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := client.HasExtension("hardlink@openssh.com"); ok {
+		err = client.Link(sftpPath(src), target)
+		if err == nil {
+			return client.Remove(sftpPath(src))
+		}
+	} else {
+		err = client.Rename(sftpPath(src), target)
+	}
+	if err == nil {
+		return nil
+	}
+	if os.IsNotExist(err) {
+		return errRemoteClaimed
+	}
+	if _, statErr := client.Stat(target); statErr == nil {
+		return errRemoteClaimed
+	}
+	return err
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSFTPServer runs an in-process SFTP server on the local filesystem that
+// accepts only clientKey, returning its address and host key
+func startSFTPServer(t *testing.T, clientKey ssh.PublicKey) (string, ssh.Signer) {
+	_, hostPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, err := ssh.NewSignerFromKey(hostPrivate)
+	assert.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "accounts" && string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, os.ErrPermission
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config)
+		}
+	}()
+	return listener.Addr().String(), hostKey
+}
+
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range channelRequests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err == nil {
+						_ = server.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+// setupSFTPTest starts an SFTP server and writes the key and known_hosts
+// files for it, returning the sftp:// URL of the test's remote folder
+func setupSFTPTest(t *testing.T) (string, string) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.MinFreeMB = 1
+
+	_, clientPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	clientKey, err := ssh.NewSignerFromKey(clientPrivate)
+	assert.NoError(t, err)
+	block, err := ssh.MarshalPrivateKey(clientPrivate, "")
+	assert.NoError(t, err)
+	keyFile := filepath.Join(tempDir, "id_ed25519")
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600))
+
+	address, hostKey := startSFTPServer(t, clientKey.PublicKey())
+	knownHostsFile := filepath.Join(tempDir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey.PublicKey())
+	assert.NoError(t, os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600))
+
+	CONFIG.Destinations = map[string]DestinationConfig{"sftp://" + address: {KeyFile: keyFile, KnownHosts: knownHostsFile}}
+
+	remoteDir := filepath.Join(tempDir, "server")
+	return tempDir, "sftp://accounts@" + address + filepath.ToSlash(remoteDir)
+}
+
+func TestSFTPDestinationUploadAndUndo(t *testing.T) {
+	tempDir, remote := setupSFTPTest(t)
+	CONFIG.OutputFolders = append(CONFIG.OutputFolders, remote+"/scans")
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+	content, _ := os.ReadFile(file)
+
+	processSingleFileOperation()
+	uploaded := filepath.Join(tempDir, "server", "scans", "scan.pdf")
+	stored, err := os.ReadFile(uploaded)
+	assert.NoError(t, err)
+	assert.Equal(t, content, stored)
+
+	// Only the renamed file is left behind
+	entries, _ := os.ReadDir(filepath.Dir(uploaded))
+	assert.Len(t, entries, 1)
+
+	entry := latestHistoryEntry(HISTORY_DONE)
+	target := remote + "/scans/scan.pdf"
+	assert.Equal(t, target, entry.Operation.ActualFiles[1])
+	digest, _ := calculateFileHash(uploaded)
+	assert.Equal(t, digest, entry.Digests[target])
+
+	// Undo deletes the remote file, redo puts it back
+	assert.NoError(t, undoHistoryEntry(entry))
+	assert.NoFileExists(t, uploaded)
+	assert.FileExists(t, file)
+
+	assert.NoError(t, redoHistoryEntry(entry))
+	assert.FileExists(t, uploaded)
+}
+
+func TestSFTPConflictsAndReconnect(t *testing.T) {
+	tempDir, remote := setupSFTPTest(t)
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+	assert.NoError(t, checkRemoteDestination(remote+"/scans"))
+	assert.DirExists(t, filepath.Join(tempDir, "server", "scans"))
+
+	_, outcome, err := copyFileWithPolicy(file, remote+"/scans/scan.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, OUTCOME_CREATED, outcome)
+
+	// A dropped connection is reopened
+	store, _, _ := openRemote(remote)
+	store.(*sftpStore).conn.Close()
+
+	actual, outcome, err := copyFileWithPolicy(file, remote+"/scans/scan.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, remote+"/scans/scan_1.pdf", actual)
+	assert.Equal(t, OUTCOME_SUFFIXED, outcome)
+
+	CONFIG.ConflictPolicy = CONFLICT_OVERWRITE
+	_, outcome, err = copyFileWithPolicy(file, remote+"/scans/scan.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, OUTCOME_OVERWRITTEN, outcome)
+}
+
+func TestSFTPClosesAgentConnection(t *testing.T) {
+	tempDir, remote := setupSFTPTest(t)
+	t.Setenv("HOME", t.TempDir()) // No default keys, so the agent's key is the only one
+
+	// Move the client key into an agent
+	keyring := agent.NewKeyring()
+	for id, dest := range CONFIG.Destinations {
+		data, _ := os.ReadFile(dest.KeyFile)
+		key, err := ssh.ParseRawPrivateKey(data)
+		assert.NoError(t, err)
+		assert.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: key}))
+		dest.KeyFile = ""
+		CONFIG.Destinations[id] = dest
+	}
+
+	socket := filepath.Join(tempDir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	var open atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			open.Add(1)
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				conn.Close()
+				open.Add(-1)
+			}()
+		}
+	}()
+
+	assert.NoError(t, checkRemoteDestination(remote+"/scans"))
+	assert.DirExists(t, filepath.Join(tempDir, "server", "scans"))
+	assert.Eventually(t, func() bool { return open.Load() == 0 }, 5*time.Second, 10*time.Millisecond,
+		"the agent connection is closed after the handshake")
+}
+
+func TestSFTPHealthCheckBesideUploads(t *testing.T) {
+	tempDir, remote := setupSFTPTest(t)
+	CONFIG.OutputFolders = []string{remote + "/out"}
+	src := writeRoutedPDF(t, tempDir, "a.pdf", "Page")
+
+	// The header's health check shares the store with the main loop
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 5; i++ {
+			checkDestinationFolders(healthFolders())
+		}
+	}()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, performFileCopy(src, fmt.Sprintf("%s/out/a%d.pdf", remote, i)))
+	}
+	<-done
+}
+
+func TestSFTPRejectsUnknownHost(t *testing.T) {
+	tempDir, remote := setupSFTPTest(t)
+	for id, dest := range CONFIG.Destinations {
+		dest.KnownHosts = filepath.Join(tempDir, "empty_known_hosts")
+		assert.NoError(t, os.WriteFile(dest.KnownHosts, nil, 0600))
+		CONFIG.Destinations[id] = dest
+	}
+
+	err := checkRemoteDestination(remote + "/scans")
+	assert.ErrorContains(t, err, "key is unknown")
+	assert.NoDirExists(t, filepath.Join(tempDir, "server", "scans"))
+}
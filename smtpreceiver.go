@@ -0,0 +1,596 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Built-in SMTP receiver
+//
+// Older scanners that can only "scan to email" can send to BlendPDF directly.
+// The receiver accepts mail for any recipient, takes the PDF and TIFF
+// attachments out of each message and drops them into the watch folder as
+// PDFs named from the sender and subject. Messages without a scan attached
+// are refused so the scanner reports the failure.
+
+const (
+	DEFAULT_SMTP_LISTEN          = "127.0.0.1:2525"
+	DEFAULT_SMTP_MAX_MESSAGE_MB  = 25
+	SMTP_IDLE_TIMEOUT            = 5 * time.Minute
+	SMTP_MAX_RECIPIENTS          = 100
+	SMTP_MAX_MIME_DEPTH          = 10
+	SMTP_MAX_NAME_LENGTH         = 100
+	SMTP_DEFAULT_ATTACHMENT_NAME = "scan"
+)
+
+// SMTP receiver settings
+type SMTPReceiverConfig struct {
+	Enabled        bool     `json:"enabled"`
+	Listen         string   `json:"listen"`   // Address to listen on (default "127.0.0.1:2525")
+	Username       string   `json:"username"` // Require AUTH with these credentials when set
+	Password       string   `json:"password"`
+	AllowedSenders []string `json:"allowedSenders"` // Sender addresses, or "@domain" for a whole domain; empty allows any
+	MaxMessageMB   int      `json:"maxMessageMB"`   // Largest message accepted (default 25)
+}
+
+// Validate SMTP receiver settings
+func (s SMTPReceiverConfig) validate() error {
+	if !s.Enabled {
+		return nil
+	}
+	if (s.Username == "") != (s.Password == "") {
+		return fmt.Errorf("smtp receiver needs both a username and password, or neither")
+	}
+	if s.MaxMessageMB < 0 {
+		return fmt.Errorf("smtp maxMessageMB must not be negative")
+	}
+	for _, sender := range s.AllowedSenders {
+		if !strings.Contains(sender, "@") {
+			return fmt.Errorf("invalid smtp allowed sender %q: use an address or @domain", sender)
+		}
+	}
+	return nil
+}
+
+// Get the largest message accepted in bytes
+func (s SMTPReceiverConfig) maxMessageBytes() int64 {
+	megabytes := s.MaxMessageMB
+	if megabytes == 0 {
+		megabytes = DEFAULT_SMTP_MAX_MESSAGE_MB
+	}
+	return int64(megabytes) * 1024 * 1024
+}
+
+// Check whether a sender is on the allow-list
+func (s SMTPReceiverConfig) senderAllowed(address string) bool {
+	if len(s.AllowedSenders) == 0 {
+		return true
+	}
+	address = strings.ToLower(address)
+	for _, allowed := range s.AllowedSenders {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if address == allowed || (strings.HasPrefix(allowed, "@") && strings.HasSuffix(address, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// smtpReceiver accepts scans by mail into a folder
+type smtpReceiver struct {
+	*tcpReceiver
+	config   SMTPReceiverConfig
+	folder   string
+	hostname string
+}
+
+// The running receiver, stopped by cleanup
+var SMTP_RECEIVER *smtpReceiver
+
+// Start listening for mail delivered into folder
+func startSMTPReceiver(config SMTPReceiverConfig, folder string) (*smtpReceiver, error) {
+	address := config.Listen
+	if address == "" {
+		address = DEFAULT_SMTP_LISTEN
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+
+	receiver := &smtpReceiver{config: config, folder: folder, hostname: hostname}
+	server, err := listenReceiver("SMTP", address, func(conn net.Conn) {
+		newSMTPSession(receiver, conn).run()
+	})
+	if err != nil {
+		return nil, err
+	}
+	receiver.tcpReceiver = server
+	return receiver, nil
+}
+
+// smtpSession is one client connection
+type smtpSession struct {
+	receiver   *smtpReceiver
+	conn       net.Conn
+	text       *textproto.Conn
+	greeted    bool
+	authed     bool
+	sender     string
+	recipients int
+}
+
+func newSMTPSession(receiver *smtpReceiver, conn net.Conn) *smtpSession {
+	return &smtpSession{receiver: receiver, conn: conn, text: textproto.NewConn(conn)}
+}
+
+func (s *smtpSession) reply(code int, message string) {
+	_ = s.text.PrintfLine("%d %s", code, message)
+}
+
+// Read and answer commands until QUIT or disconnect
+func (s *smtpSession) run() {
+	s.reply(220, s.receiver.hostname+" ESMTP BlendPDF ready")
+
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(SMTP_IDLE_TIMEOUT))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, argument, _ := strings.Cut(line, " ")
+		if !s.handle(strings.ToUpper(command), strings.TrimSpace(argument)) {
+			return
+		}
+	}
+}
+
+// Answer one command, returns false to close the session
+func (s *smtpSession) handle(command, argument string) bool {
+	switch command {
+	case "EHLO":
+		s.greeted = true
+		s.reset()
+		s.ehlo(argument)
+	case "HELO":
+		s.greeted = true
+		s.reset()
+		s.reply(250, s.receiver.hostname)
+	case "AUTH":
+		s.auth(argument)
+	case "MAIL":
+		s.mail(argument)
+	case "RCPT":
+		s.rcpt(argument)
+	case "DATA":
+		return s.data()
+	case "RSET":
+		s.reset()
+		s.reply(250, "2.0.0 OK")
+	case "NOOP":
+		s.reply(250, "2.0.0 OK")
+	case "VRFY":
+		s.reply(252, "2.5.0 Cannot verify, but will accept")
+	case "QUIT":
+		s.reply(221, "2.0.0 Bye")
+		return false
+	default:
+		s.reply(502, "5.5.1 Command not implemented")
+	}
+	return true
+}
+
+// Clear the current message
+func (s *smtpSession) reset() {
+	s.sender, s.recipients = "", 0
+}
+
+// Advertise the supported extensions
+func (s *smtpSession) ehlo(client string) {
+	lines := []string{s.receiver.hostname + " greets " + client, "8BITMIME", "ENHANCEDSTATUSCODES",
+		fmt.Sprintf("SIZE %d", s.receiver.config.maxMessageBytes())}
+	if s.receiver.config.Username != "" {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	for i, line := range lines {
+		separator := "-"
+		if i == len(lines)-1 {
+			separator = " "
+		}
+		_ = s.text.PrintfLine("250%s%s", separator, line)
+	}
+}
+
+// Authenticate with PLAIN or LOGIN
+func (s *smtpSession) auth(argument string) {
+	config := s.receiver.config
+	if config.Username == "" || s.authed || !s.greeted {
+		s.reply(503, "5.5.1 AUTH not available")
+		return
+	}
+
+	mechanism, initial, _ := strings.Cut(argument, " ")
+	var user, password string
+	var err error
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		if initial == "" {
+			initial, err = s.challenge("")
+		}
+		if err == nil {
+			user, password, err = decodeAuthPlain(initial)
+		}
+	case "LOGIN":
+		if initial == "" {
+			initial, err = s.challenge("Username:")
+		}
+		if err == nil {
+			user, err = decodeAuthLogin(initial)
+		}
+		if err == nil {
+			var response string
+			if response, err = s.challenge("Password:"); err == nil {
+				password, err = decodeAuthLogin(response)
+			}
+		}
+	default:
+		s.reply(504, "5.5.4 Unrecognised authentication type")
+		return
+	}
+	if err != nil {
+		s.reply(501, "5.5.2 Invalid authentication response")
+		return
+	}
+
+	if !credentialsMatch(user, password, config.Username, config.Password) {
+		time.Sleep(RECEIVER_LOGIN_FAIL_DELAY)
+		logOperation("SMTP", user, s.conn.RemoteAddr().String(), "login refused")
+		s.reply(535, "5.7.8 Authentication credentials invalid")
+		return
+	}
+	s.authed = true
+	s.reply(235, "2.7.0 Authentication successful")
+}
+
+// Send an AUTH challenge and read the base64 response
+func (s *smtpSession) challenge(prompt string) (string, error) {
+	s.reply(334, base64.StdEncoding.EncodeToString([]byte(prompt)))
+	line, err := s.text.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if line == "*" {
+		return "", errors.New("authentication cancelled")
+	}
+	return line, nil
+}
+
+// Decode an AUTH PLAIN response into user and password
+func decodeAuthPlain(response string) (string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return "", "", err
+	}
+	parts := strings.Split(string(decoded), "\x00")
+	if len(parts) != 3 {
+		return "", "", errors.New("malformed PLAIN response")
+	}
+	return parts[1], parts[2], nil
+}
+
+// Decode one AUTH LOGIN response
+func decodeAuthLogin(response string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	return string(decoded), err
+}
+
+// Start a message from the given sender
+func (s *smtpSession) mail(argument string) {
+	config := s.receiver.config
+	switch {
+	case !s.greeted:
+		s.reply(503, "5.5.1 Say EHLO first")
+		return
+	case config.Username != "" && !s.authed:
+		s.reply(530, "5.7.0 Authentication required")
+		return
+	case s.sender != "":
+		s.reply(503, "5.5.1 Sender already given")
+		return
+	}
+
+	address, parameters, ok := smtpPath(argument, "FROM:")
+	if !ok {
+		s.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, parameter := range strings.Fields(parameters) {
+		var size int64
+		if _, err := fmt.Sscanf(strings.ToUpper(parameter), "SIZE=%d", &size); err == nil && size > config.maxMessageBytes() {
+			s.reply(552, "5.3.4 Message too big")
+			return
+		}
+	}
+	if !config.senderAllowed(address) {
+		logOperation("SMTP", address, s.conn.RemoteAddr().String(), "sender not allowed")
+		s.reply(550, "5.7.1 Sender not allowed")
+		return
+	}
+
+	s.sender = address
+	if s.sender == "" {
+		s.sender = "<>"
+	}
+	s.reply(250, "2.1.0 OK")
+}
+
+// Add a recipient; every recipient ends up in the watch folder
+func (s *smtpSession) rcpt(argument string) {
+	if s.sender == "" {
+		s.reply(503, "5.5.1 Need MAIL first")
+		return
+	}
+	if _, _, ok := smtpPath(argument, "TO:"); !ok {
+		s.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if s.recipients >= SMTP_MAX_RECIPIENTS {
+		s.reply(452, "4.5.3 Too many recipients")
+		return
+	}
+	s.recipients++
+	s.reply(250, "2.1.5 OK")
+}
+
+// Parse "FROM:<address> parameters", returning the address and parameters
+func smtpPath(argument, prefix string) (string, string, bool) {
+	if len(argument) < len(prefix) || !strings.EqualFold(argument[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	rest := strings.TrimSpace(argument[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", "", false
+	}
+	end := strings.Index(rest, ">")
+	if end < 0 {
+		return "", "", false
+	}
+	return rest[1:end], strings.TrimSpace(rest[end+1:]), true
+}
+
+// Receive the message and deliver its scans, returns false to close the session
+func (s *smtpSession) data() bool {
+	if s.recipients == 0 {
+		s.reply(503, "5.5.1 Need RCPT first")
+		return true
+	}
+	s.reply(354, "End data with <CR><LF>.<CR><LF>")
+
+	limit := s.receiver.config.maxMessageBytes()
+	dot := s.text.DotReader()
+	message, err := io.ReadAll(io.LimitReader(dot, limit+1))
+	if err == nil && int64(len(message)) > limit {
+		_, err = io.Copy(io.Discard, dot)
+		if err == nil {
+			s.reset()
+			s.reply(552, "5.3.4 Message too big")
+			return true
+		}
+	}
+	if err != nil {
+		return false
+	}
+
+	code, reply := s.receiver.deliver(s.sender, message, s.conn.RemoteAddr().String())
+	s.reset()
+	s.reply(code, reply)
+	return true
+}
+
+// Deliver the scans in a message to the watch folder, returns the SMTP reply
+func (r *smtpReceiver) deliver(envelopeSender string, raw []byte, remote string) (int, string) {
+	message, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		logOperation("SMTP", envelopeSender, remote, fmt.Sprintf("malformed message: %v", err))
+		return 554, "5.6.0 Malformed message"
+	}
+
+	scans, err := extractScanAttachments(textproto.MIMEHeader(message.Header), message.Body, 0)
+	if err == nil && len(scans) == 0 {
+		err = errors.New("no PDF or TIFF attachments")
+	}
+	if err != nil {
+		logOperation("SMTP", envelopeSender, remote, fmt.Sprintf("rejected: %v", err))
+		return 554, "5.6.0 Rejected: " + err.Error()
+	}
+
+	// Convert everything before writing, so a bad attachment delivers nothing
+	documents := make([][]byte, len(scans))
+	for i, scan := range scans {
+		if documents[i], err = scan.document(); err != nil {
+			logOperation("SMTP", scan.filename, remote, fmt.Sprintf("rejected: %v", err))
+			return 554, fmt.Sprintf("5.6.0 Rejected: %s is not a readable scan", scan.filename)
+		}
+	}
+
+	sender := envelopeSender
+	if from, err := mail.ParseAddress(message.Header.Get("From")); err == nil {
+		sender = from.Address
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil {
+		subject = message.Header.Get("Subject")
+	}
+	name := smtpScanName(sender, subject)
+
+	for _, document := range documents {
+		dst, err := atomicWriteNew(filepath.Join(r.folder, name), bytes.NewReader(document), nil)
+		if err != nil {
+			logOperation("SMTP", name, remote, fmt.Sprintf("delivery failed: %v", err))
+			return 451, "4.3.0 Could not store the scan, try again later"
+		}
+		logOperation("SMTP", filepath.Base(dst), remote, "received from "+sender)
+	}
+	return 250, fmt.Sprintf("2.0.0 %d scan(s) received", len(documents))
+}
+
+// smtpScan is a PDF or TIFF attachment
+type smtpScan struct {
+	filename string
+	tiff     bool
+	data     []byte
+}
+
+// Get the attachment as a PDF
+func (s smtpScan) document() ([]byte, error) {
+	if s.tiff {
+		return convertImageToPDF(bytes.NewReader(s.data))
+	}
+	if !bytes.HasPrefix(bytes.TrimLeft(s.data, "\x00\t\r\n "), []byte("%PDF-")) {
+		return nil, errors.New("not a PDF")
+	}
+	return s.data, nil
+}
+
+// Walk a MIME part collecting PDF and TIFF attachments
+func extractScanAttachments(header textproto.MIMEHeader, body io.Reader, depth int) ([]smtpScan, error) {
+	if depth > SMTP_MAX_MIME_DEPTH {
+		return nil, errors.New("message nested too deeply")
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		var scans []smtpScan
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return scans, nil
+			}
+			if err != nil {
+				return nil, fmt.Errorf("malformed multipart body: %v", err)
+			}
+			found, err := extractScanAttachments(part.Header, part, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			scans = append(scans, found...)
+		}
+	}
+
+	filename := params["name"]
+	if _, dispositionParams, err := mime.ParseMediaType(header.Get("Content-Disposition")); err == nil && dispositionParams["filename"] != "" {
+		filename = dispositionParams["filename"]
+	}
+	extension := strings.ToLower(filepath.Ext(filename))
+	isPDF := mediaType == "application/pdf" || extension == ".pdf"
+	isTIFF := mediaType == "image/tiff" || extension == ".tif" || extension == ".tiff"
+	if !isPDF && !isTIFF {
+		return nil, nil
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("unreadable attachment %s: %v", filename, err)
+	}
+	if filename == "" {
+		filename = SMTP_DEFAULT_ATTACHMENT_NAME
+	}
+	return []smtpScan{{filename: filename, tiff: isTIFF && !isPDF, data: data}}, nil
+}
+
+// Name a scan from its sender and subject, e.g. "reception_Invoice_42.pdf"
+func smtpScanName(sender, subject string) string {
+	local, _, _ := strings.Cut(sender, "@")
+	var parts []string
+	for _, part := range []string{local, subject} {
+		if part = cleanNamePart(part); part != "" {
+			parts = append(parts, part)
+		}
+	}
+	name := strings.Join(parts, "_")
+	if runes := []rune(name); len(runes) > SMTP_MAX_NAME_LENGTH {
+		name = strings.TrimRight(string(runes[:SMTP_MAX_NAME_LENGTH]), "_-.")
+	}
+	if name == "" {
+		name = SMTP_DEFAULT_ATTACHMENT_NAME
+	}
+	return name + ".pdf"
+}
+
+// Reduce text to letters, digits, dots and dashes, with runs of anything else as one underscore
+func cleanNamePart(text string) string {
+	var builder strings.Builder
+	gap := false
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '-' || r == '.' {
+			if gap && builder.Len() > 0 {
+				builder.WriteByte('_')
+			}
+			builder.WriteRune(r)
+			gap = false
+			continue
+		}
+		gap = true
+	}
+	return strings.Trim(builder.String(), "_-.")
+}
+
+// Start the SMTP receiver if it is enabled
+func startSMTPReceiverAtStartup() error {
+	if CONFIG == nil || !CONFIG.SMTP.Enabled {
+		return nil
+	}
+	receiver, err := startSMTPReceiver(CONFIG.SMTP, FOLDER)
+	if err != nil {
+		return err
+	}
+	SMTP_RECEIVER = receiver
+	printInfo(fmt.Sprintf("SMTP receiver listening on %s", receiver.addr()))
+	return nil
+}
+
+// Stop the SMTP receiver if it is running
+func stopSMTPReceiver() {
+	if SMTP_RECEIVER != nil {
+		SMTP_RECEIVER.stop()
+		SMTP_RECEIVER = nil
+	}
+}
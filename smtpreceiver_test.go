@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"mime/multipart"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/image/tiff"
+)
+
+// setupSMTPTest starts a receiver on the test's watch folder
+func setupSMTPTest(t *testing.T, config SMTPReceiverConfig) (string, string) {
+	tempDir := useTestWorkspace(t)
+	config.Enabled = true
+	config.Listen = "127.0.0.1:0"
+	assert.NoError(t, config.validate())
+
+	receiver, err := startSMTPReceiver(config, tempDir)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(receiver.stop)
+	return tempDir, receiver.addr()
+}
+
+// smtpAttachment is a file to attach to a test message
+type smtpAttachment struct {
+	name, contentType string
+	data              []byte
+}
+
+// buildScanMail builds a message with a text part and the given attachments
+func buildScanMail(from, subject string, attachments ...smtpAttachment) []byte {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	text, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain"}})
+	fmt.Fprint(text, "Scanned on the second floor MFP")
+	for _, attachment := range attachments {
+		part, _ := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {attachment.contentType},
+			"Content-Disposition":       {fmt.Sprintf(`attachment; filename="%s"`, attachment.name)},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		part.Write([]byte(encodeBase64Lines(attachment.data)))
+	}
+	writer.Close()
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\nTo: scans@blendpdf.local\r\nSubject: %s\r\nMIME-Version: 1.0\r\n", from, subject)
+	fmt.Fprintf(&message, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", writer.Boundary())
+	message.Write(body.Bytes())
+	return message.Bytes()
+}
+
+// encodeBase64Lines wraps base64 at 76 columns as mail clients do
+func encodeBase64Lines(data []byte) string {
+	var encoded bytes.Buffer
+	encoder := base64.NewEncoder(base64.StdEncoding, &encoded)
+	encoder.Write(data)
+	encoder.Close()
+
+	var wrapped bytes.Buffer
+	for line := encoded.Bytes(); len(line) > 0; {
+		n := min(76, len(line))
+		wrapped.Write(line[:n])
+		wrapped.WriteString("\r\n")
+		line = line[n:]
+	}
+	return wrapped.String()
+}
+
+// buildTestTIFF encodes a small greyscale scan
+func buildTestTIFF(t *testing.T) []byte {
+	img := image.NewGray(image.Rect(0, 0, 40, 60))
+	for y := 0; y < 60; y++ {
+		for x := 0; x < 40; x++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x * y)})
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(t, tiff.Encode(&buf, img, nil))
+	return buf.Bytes()
+}
+
+func TestSMTPReceiverDeliversAttachments(t *testing.T) {
+	tempDir, address := setupSMTPTest(t, SMTPReceiverConfig{
+		Username: "scanner", Password: "secret", AllowedSenders: []string{"@office.example"},
+	})
+
+	message := buildScanMail(`"Reception MFP" <reception@office.example>`, "=?utf-8?q?Invoice_#42_=E2=80=93_March?=",
+		smtpAttachment{"scan0001.pdf", "application/pdf", buildTextPDF("page one", "page two")},
+		smtpAttachment{"scan0002.tif", "image/tiff", buildTestTIFF(t)},
+	)
+	auth := smtp.PlainAuth("", "scanner", "secret", "127.0.0.1")
+	assert.NoError(t, smtp.SendMail(address, auth, "reception@office.example", []string{"scans@blendpdf.local"}, message))
+
+	pdf := filepath.Join(tempDir, "reception_Invoice_42_March.pdf")
+	pages, err := getPageCount(pdf)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pages)
+
+	converted := filepath.Join(tempDir, "reception_Invoice_42_March_1.pdf")
+	pages, err = getPageCount(converted)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, pages)
+
+	files, _ := findPDFFiles()
+	assert.Len(t, files, 2)
+}
+
+func TestSMTPReceiverKeepsConcurrentDeliveries(t *testing.T) {
+	_, address := setupSMTPTest(t, SMTPReceiverConfig{Username: "scanner", Password: "secret"})
+	auth := smtp.PlainAuth("", "scanner", "secret", "127.0.0.1")
+
+	// Every message gets the same name, so each must be numbered rather than replace another
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			message := buildScanMail("mfp@office.example", "Scan",
+				smtpAttachment{"scan.pdf", "application/pdf", buildTextPDF(fmt.Sprintf("page %d", i))})
+			assert.NoError(t, smtp.SendMail(address, auth, "mfp@office.example", []string{"scans@blendpdf.local"}, message))
+		}()
+	}
+	wg.Wait()
+
+	files, _ := findPDFFiles()
+	assert.Len(t, files, 5)
+}
+
+func TestSMTPReceiverRefusesMessages(t *testing.T) {
+	tempDir, address := setupSMTPTest(t, SMTPReceiverConfig{
+		Username: "scanner", Password: "secret", AllowedSenders: []string{"reception@office.example"},
+	})
+	client, err := smtp.Dial(address)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.NoError(t, client.Hello("mfp"))
+
+	// Authentication is required before a sender is accepted
+	assert.ErrorContains(t, client.Mail("reception@office.example"), "530")
+	assert.ErrorContains(t, client.Auth(smtp.PlainAuth("", "scanner", "wrong", "127.0.0.1")), "535")
+	client.Close()
+
+	client, err = smtp.Dial(address)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer client.Close()
+	assert.NoError(t, client.Auth(smtp.PlainAuth("", "scanner", "secret", "127.0.0.1")))
+
+	// Senders off the allow-list are refused
+	assert.ErrorContains(t, client.Mail("someone@elsewhere.example"), "550")
+
+	// Mail without a scan is refused
+	assert.NoError(t, client.Mail("Reception@Office.example"))
+	assert.NoError(t, client.Rcpt("scans@blendpdf.local"))
+	writer, err := client.Data()
+	assert.NoError(t, err)
+	writer.Write(buildScanMail("reception@office.example", "Hello"))
+	assert.ErrorContains(t, writer.Close(), "554")
+
+	// So is an attachment that is not really a PDF, and nothing is written
+	assert.NoError(t, client.Mail("reception@office.example"))
+	assert.NoError(t, client.Rcpt("scans@blendpdf.local"))
+	writer, _ = client.Data()
+	writer.Write(buildScanMail("reception@office.example", "Broken",
+		smtpAttachment{"good.pdf", "application/pdf", buildTextPDF("fine")},
+		smtpAttachment{"bad.pdf", "application/pdf", []byte("not a pdf")},
+	))
+	assert.ErrorContains(t, writer.Close(), "554")
+
+	entries, _ := os.ReadDir(tempDir)
+	for _, entry := range entries {
+		assert.True(t, entry.IsDir(), "unexpected file %s", entry.Name())
+	}
+	assert.NoError(t, client.Quit())
+}
+
+func TestSMTPScanName(t *testing.T) {
+	assert.Equal(t, "reception_Invoice_42.pdf", smtpScanName("reception@office.example", "Invoice #42"))
+	assert.Equal(t, "mfp.floor2_Scan_from_MFP.pdf", smtpScanName("mfp.floor2@office.example", "  Scan from MFP!  "))
+	assert.Equal(t, "reception.pdf", smtpScanName("reception@office.example", ""))
+	assert.Equal(t, "scan.pdf", smtpScanName("", "../../"))
+	assert.Equal(t, "Müller_Rechnung.pdf", smtpScanName("Müller@example.de", "Rechnung"))
+}
+
+func TestSMTPReceiverValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.SMTP = SMTPReceiverConfig{Enabled: true, AllowedSenders: []string{"@office.example", "mfp@example.com"}}
+	assert.NoError(t, validateConfig(config))
+
+	for _, smtpConfig := range []SMTPReceiverConfig{
+		{Enabled: true, Username: "scanner"},
+		{Enabled: true, MaxMessageMB: -1},
+		{Enabled: true, AllowedSenders: []string{"office.example"}},
+	} {
+		config.SMTP = smtpConfig
+		assert.Error(t, validateConfig(config))
+	}
+
+	allowList := SMTPReceiverConfig{AllowedSenders: []string{"@office.example"}}
+	assert.True(t, allowList.senderAllowed("a@OFFICE.example"))
+	assert.False(t, allowList.senderAllowed("a@notoffice.example"))
+	assert.False(t, allowList.senderAllowed(""))
+}
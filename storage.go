@@ -0,0 +1,163 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage backend
+//
+// The working folders (watch folder, archive, outputs, error folder) and the
+// state folder are reached through STORAGE rather than the os package, so
+// processing, undo and recovery do not depend on where those folders live.
+// The local filesystem is the default; tests can swap in an in-memory
+// backend. Compacted archive zips are read in place, and file times,
+// ownership, configuration, the lock file and key files stay local.
+
+// storage is the filesystem holding the working folders
+type storage interface {
+	list(dir string) ([]fs.DirEntry, error) // Entries sorted by name, like os.ReadDir
+	stat(path string) (fs.FileInfo, error)
+	open(path string) (io.ReadCloser, error)
+	// Write reader to path via a temp file renamed into place; verify inspects the temp file first
+	createAtomic(path string, reader io.Reader, verify func(tempPath string, size int64) error) (int64, error)
+	rename(src, dst string) error
+	renameNoReplace(src, dst string) error // Fails with fs.ErrExist when dst is taken
+	remove(path string) error
+	mkdirAll(dir string) error
+	freeSpace(dir string) (uint64, error) // Bytes available to this user
+}
+
+// Active storage backend
+var STORAGE storage = localStorage{}
+
+// localStorage is the local filesystem
+type localStorage struct{}
+
+func (localStorage) list(dir string) ([]fs.DirEntry, error) {
+	return os.ReadDir(dir)
+}
+
+func (localStorage) stat(path string) (fs.FileInfo, error) {
+	return os.Stat(path)
+}
+
+func (localStorage) open(path string) (io.ReadCloser, error) {
+	return os.Open(path) // #nosec G304 - internal path
+}
+
+func (localStorage) createAtomic(path string, reader io.Reader, verify func(tempPath string, size int64) error) (int64, error) {
+	return writeFileAtomic(path, reader, verify)
+}
+
+func (localStorage) rename(src, dst string) error {
+	return os.Rename(src, dst)
+}
+
+// A hard link fails when dst exists, where a rename would replace it;
+// filesystems without hard links get dst reserved with O_EXCL first
+func (localStorage) renameNoReplace(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return os.Remove(src)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		return err
+	}
+
+	reserved, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, DEFAULT_FILE_MODE) // #nosec G304 - internal path
+	if err != nil {
+		return err
+	}
+	reserved.Close()
+	if err := os.Rename(src, dst); err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+func (localStorage) remove(path string) error {
+	return os.Remove(path)
+}
+
+func (localStorage) mkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0750)
+}
+
+func (localStorage) freeSpace(dir string) (uint64, error) {
+	return diskFreeBytes(dir)
+}
+
+// Read a whole file from STORAGE
+func readStorageFile(path string) ([]byte, error) {
+	file, err := STORAGE.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// List the files in dir whose names end in suffix, as full paths sorted by name
+func listStorageFiles(dir, suffix string) ([]string, error) {
+	entries, err := STORAGE.list(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), suffix) {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// Remove a folder and everything in it, like os.RemoveAll
+func removeStorageTree(path string) error {
+	entries, err := STORAGE.list(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		if entry.IsDir() {
+			err = removeStorageTree(child)
+		} else {
+			err = STORAGE.remove(child)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := STORAGE.remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryStorage keeps the working folders in memory
+type memoryStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	free  uint64
+}
+
+func newMemoryStorage() *memoryStorage {
+	return &memoryStorage{files: map[string][]byte{}, dirs: map[string]bool{}, free: 1 << 40}
+}
+
+// memoryInfo describes a file or folder in memoryStorage
+type memoryInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i memoryInfo) Name() string       { return i.name }
+func (i memoryInfo) Size() int64        { return i.size }
+func (i memoryInfo) ModTime() time.Time { return time.Time{} }
+func (i memoryInfo) IsDir() bool        { return i.dir }
+func (i memoryInfo) Sys() any           { return nil }
+func (i memoryInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0750
+	}
+	return DEFAULT_FILE_MODE
+}
+
+func notExist(op, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+}
+
+func (m *memoryStorage) list(dir string) ([]fs.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dir = filepath.Clean(dir)
+	if !m.dirs[dir] {
+		return nil, notExist("open", dir)
+	}
+
+	var entries []fs.DirEntry
+	for path, data := range m.files {
+		if filepath.Dir(path) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(memoryInfo{name: filepath.Base(path), size: int64(len(data))}))
+		}
+	}
+	for path := range m.dirs {
+		if path != dir && filepath.Dir(path) == dir {
+			entries = append(entries, fs.FileInfoToDirEntry(memoryInfo{name: filepath.Base(path), dir: true}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+func (m *memoryStorage) stat(path string) (fs.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	if data, ok := m.files[path]; ok {
+		return memoryInfo{name: filepath.Base(path), size: int64(len(data))}, nil
+	}
+	if m.dirs[path] {
+		return memoryInfo{name: filepath.Base(path), dir: true}, nil
+	}
+	return nil, notExist("stat", path)
+}
+
+func (m *memoryStorage) open(path string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[filepath.Clean(path)]
+	if !ok {
+		return nil, notExist("open", path)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memoryStorage) createAtomic(path string, reader io.Reader, verify func(tempPath string, size int64) error) (int64, error) {
+	path = filepath.Clean(path)
+	if err := m.mkdirAll(filepath.Dir(path)); err != nil {
+		return 0, err
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	tempPath := filepath.Join(filepath.Dir(path), TEMP_FILE_PREFIX+filepath.Base(path)+".mem"+TEMP_FILE_SUFFIX)
+	m.mu.Lock()
+	m.files[tempPath] = data
+	m.mu.Unlock()
+
+	if verify != nil {
+		if err := verify(tempPath, int64(len(data))); err != nil {
+			_ = m.remove(tempPath)
+			return 0, err
+		}
+	}
+	return int64(len(data)), m.rename(tempPath, path)
+}
+
+func (m *memoryStorage) rename(src, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	src, dst = filepath.Clean(src), filepath.Clean(dst)
+	data, ok := m.files[src]
+	if !ok {
+		return notExist("rename", src)
+	}
+	if !m.dirs[filepath.Dir(dst)] {
+		return notExist("rename", dst)
+	}
+	delete(m.files, src)
+	m.files[dst] = data
+	return nil
+}
+
+func (m *memoryStorage) renameNoReplace(src, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	src, dst = filepath.Clean(src), filepath.Clean(dst)
+	if _, ok := m.files[dst]; ok || m.dirs[dst] {
+		return &fs.PathError{Op: "link", Path: dst, Err: fs.ErrExist}
+	}
+	data, ok := m.files[src]
+	if !ok {
+		return notExist("link", src)
+	}
+	delete(m.files, src)
+	m.files[dst] = data
+	return nil
+}
+
+func (m *memoryStorage) remove(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	path = filepath.Clean(path)
+	if _, ok := m.files[path]; ok {
+		delete(m.files, path)
+		return nil
+	}
+	if m.dirs[path] {
+		delete(m.dirs, path)
+		return nil
+	}
+	return notExist("remove", path)
+}
+
+func (m *memoryStorage) mkdirAll(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for dir = filepath.Clean(dir); !m.dirs[dir]; dir = filepath.Dir(dir) {
+		m.dirs[dir] = true
+	}
+	return nil
+}
+
+func (m *memoryStorage) freeSpace(dir string) (uint64, error) {
+	return m.free, nil
+}
+
+// write puts a file straight into memory, creating its folder
+func (m *memoryStorage) write(path, content string) {
+	_ = m.mkdirAll(filepath.Dir(path))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[filepath.Clean(path)] = []byte(content)
+}
+
+// setupStorageTest points the working folders at an in-memory backend
+func setupStorageTest(t *testing.T) (string, *memoryStorage) {
+	tempDir := useTestWorkspace(t)
+	memory := newMemoryStorage()
+	STORAGE = memory
+
+	root := filepath.Join(tempDir, "memory")
+	FOLDER = root
+	ARCHIVE = filepath.Join(root, "archive")
+	ERROR_DIR = filepath.Join(root, "error")
+	CONFIG.OutputFolders = []string{filepath.Join(root, "output")}
+	CONFIG.MinFreeMB = 1
+	return root, memory
+}
+
+func TestMemoryStorageFileOperations(t *testing.T) {
+	root, memory := setupStorageTest(t)
+	assert.NoError(t, createRequiredDirectories())
+
+	memory.write(filepath.Join(root, "b.pdf"), "back")
+	memory.write(filepath.Join(root, "a.pdf"), "front")
+	memory.write(filepath.Join(root, "notes.txt"), "ignored")
+	memory.write(filepath.Join(root, TEMP_FILE_PREFIX+"c.pdf.123"+TEMP_FILE_SUFFIX), "partial")
+
+	assert.Equal(t, 1, cleanupPartialTempFiles(root))
+	files, err := findPDFFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(root, "a.pdf"), filepath.Join(root, "b.pdf")}, files)
+
+	// Moves keep both files on conflict
+	memory.write(filepath.Join(ARCHIVE, "a.pdf"), "earlier")
+	moveProcessedFiles(ARCHIVE, "Archived", filepath.Join(root, "a.pdf"))
+	assert.False(t, fileExists(filepath.Join(root, "a.pdf")))
+	assert.True(t, fileExists(filepath.Join(ARCHIVE, "a_1.pdf")))
+	assert.Equal(t, 2, countPDFFiles(ARCHIVE))
+
+	// Copies are verified and follow the conflict policy
+	output := filepath.Join(CONFIG.OutputFolders[0], "b.pdf")
+	_, outcome, err := copyFileWithPolicy(filepath.Join(root, "b.pdf"), output)
+	assert.NoError(t, err)
+	assert.Equal(t, OUTCOME_CREATED, outcome)
+	CONFIG.ConflictPolicy = CONFLICT_SKIP_IDENTICAL
+	actual, outcome, err := copyFileWithPolicy(filepath.Join(root, "b.pdf"), output)
+	assert.NoError(t, err)
+	assert.Equal(t, output, actual)
+	assert.Equal(t, OUTCOME_SKIPPED, outcome)
+
+	// Nothing reached the local disk
+	assert.NoDirExists(t, root)
+}
+
+func TestMemoryStoragePreflight(t *testing.T) {
+	root, memory := setupStorageTest(t)
+	assert.NoError(t, createRequiredDirectories())
+	output := CONFIG.OutputFolders[0]
+
+	health := checkDestination(output, 1024)
+	assert.Empty(t, health.Problem)
+	assert.Equal(t, memory.free, health.Free)
+
+	memory.free = 512 * 1024
+	health = checkDestination(output, 1024)
+	assert.Contains(t, health.Problem, "free")
+
+	files, _ := memory.list(output)
+	for _, file := range files {
+		assert.False(t, strings.HasPrefix(file.Name(), TEMP_FILE_PREFIX), "probe removed")
+	}
+	assert.NoDirExists(t, root)
+}
+
+func TestMemoryStorageSingleFileOperation(t *testing.T) {
+	root, memory := setupStorageTest(t)
+	assert.NoError(t, createRequiredDirectories())
+	CONFIG.ArchiveMode = true
+	original := string(buildTextPDF("Page one"))
+	memory.write(filepath.Join(root, "scan.pdf"), original)
+
+	processSingleFileWithValidation()
+	assert.Equal(t, 0, ERROR_COUNT)
+	assert.False(t, fileExists(filepath.Join(root, "scan.pdf")))
+	output := filepath.Join(CONFIG.OutputFolders[0], "scan.pdf")
+	assert.True(t, fileExists(output))
+	assert.True(t, fileExists(filepath.Join(ARCHIVE, "scan.pdf")))
+	assert.Equal(t, 0, countPDFFiles(ERROR_DIR))
+
+	// Undo puts the original back from the archive
+	assert.NoError(t, processUndoOperation())
+	assert.False(t, fileExists(output))
+	assert.Equal(t, []byte(original), memory.files[filepath.Join(root, "scan.pdf")])
+
+	// Nothing reached the local disk
+	assert.NoDirExists(t, root)
+}
+
+func TestMemoryStorageMergeOperation(t *testing.T) {
+	root, memory := setupStorageTest(t)
+	assert.NoError(t, createRequiredDirectories())
+	CONFIG.ArchiveMode = true
+	memory.write(filepath.Join(root, "a.pdf"), string(buildTextPDF("Front 1", "Front 2")))
+	memory.write(filepath.Join(root, "b.pdf"), string(buildTextPDF("Back 2", "Back 1")))
+
+	processMergeFilesWithValidation()
+	assert.Equal(t, 0, ERROR_COUNT)
+	assert.Equal(t, 0, countPDFFiles(root))
+	output := filepath.Join(CONFIG.OutputFolders[0], "a-b.pdf")
+	pages, err := getPageCount(output)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, pages)
+	assert.Equal(t, 2, countPDFFiles(ARCHIVE))
+
+	assert.NoError(t, processUndoOperation())
+	assert.False(t, fileExists(output))
+	assert.Equal(t, 2, countPDFFiles(root))
+	assert.NoDirExists(t, root)
+}
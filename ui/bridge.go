@@ -18,6 +18,8 @@ import (
 	"fmt"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 // FileOpsBridge bridges the UI with existing file operations
@@ -35,6 +37,47 @@ type FileOpsBridge struct {
 	processMergeFilesFunc func() error
 	processUndoFunc       func() error
 	toggleArchiveModeFunc func()
+	listHistoryFunc       func() ([]HistoryItem, error)
+	undoOperationFunc     func(id string) error
+	processRedoFunc       func() error
+	listErrorsFunc        func() ([]ErrorItem, error)
+	retryErrorsFunc       func(names []string) (int, error)
+	listArchiveFunc       func() ([]ArchiveItem, error)
+	restoreArchiveFunc    func(keys []string) (int, error)
+	reprocessArchiveFunc  func(front, back, backOrder, flipEdge string) (string, error)
+	latestRouteFunc       func() (string, string)
+	healthFunc            func() (string, bool)
+	retryDueFunc          func() bool
+	pollInboxFunc         func() bool
+	inboxStatusFunc       func() string
+	pendingRetriesFunc    func() string
+	scanFunc              func(flip func(prompt string) bool) (string, error)
+}
+
+// HistoryItem describes a recorded operation for the history screen
+type HistoryItem struct {
+	ID          string
+	Time        string
+	Type        string
+	Description string
+	Undone      bool
+}
+
+// ErrorItem describes a file in the error folder for the retry screen
+type ErrorItem struct {
+	Name    string
+	Time    string
+	Stage   string
+	Error   string
+	Partner string
+}
+
+// ArchiveItem describes an archived original for the browse screen
+type ArchiveItem struct {
+	Key  string // Unique name to restore by
+	Name string
+	Time string
+	Size string
 }
 
 // NewFileOpsBridge creates a new bridge with function pointers
@@ -72,6 +115,131 @@ func (b *FileOpsBridge) SetArchiveToggleFunction(toggleFunc func()) {
 	b.toggleArchiveModeFunc = toggleFunc
 }
 
+// SetHistoryFunctions sets the operation history functions
+func (b *FileOpsBridge) SetHistoryFunctions(list func() ([]HistoryItem, error), undo func(id string) error, redo func() error) {
+	b.listHistoryFunc = list
+	b.undoOperationFunc = undo
+	b.processRedoFunc = redo
+}
+
+// SetErrorFunctions sets the error folder listing and retry functions
+func (b *FileOpsBridge) SetErrorFunctions(list func() ([]ErrorItem, error), retry func(names []string) (int, error)) {
+	b.listErrorsFunc = list
+	b.retryErrorsFunc = retry
+}
+
+// SetArchiveFunctions sets the archive browsing, restore and reprocess functions
+func (b *FileOpsBridge) SetArchiveFunctions(
+	list func() ([]ArchiveItem, error),
+	restore func(keys []string) (int, error),
+	reprocess func(front, back, backOrder, flipEdge string) (string, error),
+) {
+	b.listArchiveFunc = list
+	b.restoreArchiveFunc = restore
+	b.reprocessArchiveFunc = reprocess
+}
+
+// SetRouteFunction sets the function reporting the latest operation ID and its route
+func (b *FileOpsBridge) SetRouteFunction(latest func() (string, string)) {
+	b.latestRouteFunc = latest
+}
+
+// SetHealthFunction sets the function summarising destination health
+func (b *FileOpsBridge) SetHealthFunction(health func() (string, bool)) {
+	b.healthFunc = health
+}
+
+// DestinationHealth implements FileOperations interface
+func (b *FileOpsBridge) DestinationHealth() (string, bool) {
+	if b.healthFunc == nil {
+		return "", true
+	}
+	return b.healthFunc()
+}
+
+// SetRetryFunctions sets the functions that run and summarise queued output copies
+func (b *FileOpsBridge) SetRetryFunctions(retryDue func() bool, pending func() string) {
+	b.retryDueFunc = retryDue
+	b.pendingRetriesFunc = pending
+}
+
+// RetryDueCopies implements FileOperations interface
+func (b *FileOpsBridge) RetryDueCopies() bool {
+	if b.retryDueFunc == nil {
+		return false
+	}
+	return b.retryDueFunc()
+}
+
+// PendingRetries implements FileOperations interface
+func (b *FileOpsBridge) PendingRetries() string {
+	if b.pendingRetriesFunc == nil {
+		return ""
+	}
+	return b.pendingRetriesFunc()
+}
+
+// SetInboxFunctions sets the functions that poll and summarise the remote inbox
+func (b *FileOpsBridge) SetInboxFunctions(poll func() bool, status func() string) {
+	b.pollInboxFunc = poll
+	b.inboxStatusFunc = status
+}
+
+// PollInbox implements FileOperations interface
+func (b *FileOpsBridge) PollInbox() bool {
+	if b.pollInboxFunc == nil {
+		return false
+	}
+	return b.pollInboxFunc()
+}
+
+// InboxStatus implements FileOperations interface
+func (b *FileOpsBridge) InboxStatus() string {
+	if b.inboxStatusFunc == nil {
+		return ""
+	}
+	return b.inboxStatusFunc()
+}
+
+// SetScanFunction sets the function that scans both sides and merges them
+func (b *FileOpsBridge) SetScanFunction(scan func(flip func(prompt string) bool) (string, error)) {
+	b.scanFunc = scan
+}
+
+// ScanDuplex implements FileOperations interface
+func (b *FileOpsBridge) ScanDuplex(flip func(prompt string) bool) (string, error) {
+	if b.scanFunc == nil {
+		return "", fmt.Errorf("scan function not set")
+	}
+	previousID := b.latestOperationID()
+	output, err := b.scanFunc(flip)
+	if err != nil {
+		return "", err
+	}
+	return b.withRoute("Scan → "+output, previousID), nil
+}
+
+// latestOperationID returns the ID of the latest recorded operation
+func (b *FileOpsBridge) latestOperationID() string {
+	if b.latestRouteFunc == nil {
+		return ""
+	}
+	id, _ := b.latestRouteFunc()
+	return id
+}
+
+// withRoute adds the route of a newly recorded operation to a description
+func (b *FileOpsBridge) withRoute(description, previousID string) string {
+	if b.latestRouteFunc == nil {
+		return description
+	}
+	id, route := b.latestRouteFunc()
+	if id == previousID || route == "" {
+		return description
+	}
+	return description + " (" + route + ")"
+}
+
 // FindPDFFiles implements FileOperations interface
 func (b *FileOpsBridge) FindPDFFiles(dir string) ([]string, error) {
 	if b.findPDFFilesFunc != nil {
@@ -120,12 +288,13 @@ func (b *FileOpsBridge) ProcessSingleFile() (string, error) {
 		}
 
 		filename := filepath.Base(files[0])
+		previousID := b.latestOperationID()
 		err = b.processSingleFileFunc()
 		if err != nil {
 			return "", err
 		}
 
-		return "Single file move - " + filename, nil
+		return b.withRoute("Single file move - "+filename, previousID), nil
 	}
 	return "", nil
 }
@@ -145,6 +314,7 @@ func (b *FileOpsBridge) ProcessMergeFiles() (string, error) {
 		file1 := filepath.Base(files[0])
 		file2 := filepath.Base(files[1])
 
+		previousID := b.latestOperationID()
 		err = b.processMergeFilesFunc()
 		if err != nil {
 			return "", err
@@ -152,7 +322,7 @@ func (b *FileOpsBridge) ProcessMergeFiles() (string, error) {
 
 		// Generate output filename using same logic as main program
 		outputName := file1[:len(file1)-4] + "-" + file2[:len(file2)-4] + ".pdf"
-		return "Merge - " + file1 + " + " + file2 + " → " + outputName, nil
+		return b.withRoute("Merge - "+file1+" + "+file2+" → "+outputName, previousID), nil
 	}
 	return "", nil
 }
@@ -171,3 +341,129 @@ func (b *FileOpsBridge) ToggleArchiveMode() {
 		b.toggleArchiveModeFunc()
 	}
 }
+
+// ListHistory returns recorded operations, newest first
+func (b *FileOpsBridge) ListHistory() ([]HistoryItem, error) {
+	if b.listHistoryFunc != nil {
+		return b.listHistoryFunc()
+	}
+	return nil, fmt.Errorf("history function not set")
+}
+
+// UndoOperation undoes a specific recorded operation
+func (b *FileOpsBridge) UndoOperation(id string) error {
+	if b.undoOperationFunc != nil {
+		return b.undoOperationFunc(id)
+	}
+	return fmt.Errorf("undo function not set")
+}
+
+// ProcessRedo redoes the most recently undone operation
+func (b *FileOpsBridge) ProcessRedo() error {
+	if b.processRedoFunc != nil {
+		return b.processRedoFunc()
+	}
+	return fmt.Errorf("redo function not set")
+}
+
+// ListErrorFiles returns files waiting in the error folder
+func (b *FileOpsBridge) ListErrorFiles() ([]ErrorItem, error) {
+	if b.listErrorsFunc != nil {
+		return b.listErrorsFunc()
+	}
+	return nil, fmt.Errorf("error listing function not set")
+}
+
+// RetryErrorFiles moves the named files from the error folder back to the watch folder
+func (b *FileOpsBridge) RetryErrorFiles(names []string) (int, error) {
+	if b.retryErrorsFunc != nil {
+		return b.retryErrorsFunc(names)
+	}
+	return 0, fmt.Errorf("retry function not set")
+}
+
+// ListArchive returns archived originals, newest first
+func (b *FileOpsBridge) ListArchive() ([]ArchiveItem, error) {
+	if b.listArchiveFunc != nil {
+		return b.listArchiveFunc()
+	}
+	return nil, fmt.Errorf("archive listing function not set")
+}
+
+// RestoreArchiveFiles copies the named archived originals back to the watch folder
+func (b *FileOpsBridge) RestoreArchiveFiles(keys []string) (int, error) {
+	if b.restoreArchiveFunc != nil {
+		return b.restoreArchiveFunc(keys)
+	}
+	return 0, fmt.Errorf("restore function not set")
+}
+
+// ReprocessArchivePair merges an archived pair again with different settings
+func (b *FileOpsBridge) ReprocessArchivePair(front, back, backOrder, flipEdge string) (string, error) {
+	if b.reprocessArchiveFunc != nil {
+		return b.reprocessArchiveFunc(front, back, backOrder, flipEdge)
+	}
+	return "", fmt.Errorf("reprocess function not set")
+}
+
+// parseSelection parses a list of 1-based item numbers ("1,3 4") or "a"/"all"
+func parseSelection(input string, count int) ([]int, error) {
+	input = strings.ToLower(strings.TrimSpace(input))
+	if input == "a" || input == "all" {
+		indexes := make([]int, count)
+		for i := range indexes {
+			indexes[i] = i
+		}
+		return indexes, nil
+	}
+
+	var indexes []int
+	for _, field := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == ' ' }) {
+		n, err := strconv.Atoi(field)
+		if err != nil || n < 1 || n > count {
+			return nil, fmt.Errorf("invalid selection: %s", field)
+		}
+		indexes = append(indexes, n-1)
+	}
+	return indexes, nil
+}
+
+// parseReprocessSelection parses "P front back" (e.g. "p 3,4"), returning 0-based indexes
+// ok is false when the input is not a reprocess request
+func parseReprocessSelection(input string, count int) (int, int, bool, error) {
+	input = strings.TrimSpace(input)
+	if len(input) == 0 || (input[0] != 'p' && input[0] != 'P') {
+		return 0, 0, false, nil
+	}
+
+	pair := strings.ToLower(strings.TrimSpace(input[1:]))
+	if pair == "a" || pair == "all" {
+		return 0, 0, true, fmt.Errorf("invalid pair: %s", input)
+	}
+	indexes, err := parseSelection(pair, count)
+	if err != nil {
+		return 0, 0, true, err
+	}
+	if len(indexes) != 2 || indexes[0] == indexes[1] {
+		return 0, 0, true, fmt.Errorf("choose a front and a back file, e.g. P 1,2")
+	}
+	return indexes[0], indexes[1], true, nil
+}
+
+// Reprocess settings offered on the browse screen (values match the main package's merge options)
+var (
+	backOrderChoices = map[string]string{"r": "reversed", "a": "as-scanned"}
+	flipEdgeChoices  = map[string]string{"l": "long", "s": "short"}
+)
+
+// parseMergeChoice maps a one-letter answer to a merge setting, defaulting on empty input
+func parseMergeChoice(input string, choices map[string]string, fallback string) (string, error) {
+	input = strings.ToLower(strings.TrimSpace(input))
+	if input == "" {
+		return fallback, nil
+	}
+	if value, ok := choices[input[:1]]; ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("invalid choice: %s", input)
+}
@@ -21,6 +21,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
@@ -144,7 +145,7 @@ func (e *EnhancedMenu) Run() error {
 		choice := e.getUserChoice()
 
 		// Handle invalid choices by continuing the loop
-		if choice != "S" && choice != "M" && choice != "H" && choice != "Q" {
+		if !e.isValidChoice(choice) {
 			// Clear and redraw to show only the current invalid choice
 			e.clearScreen()
 			e.showHeader()
@@ -170,6 +171,15 @@ func (e *EnhancedMenu) Run() error {
 	return nil
 }
 
+// isValidChoice reports whether a choice has a handler
+func (e *EnhancedMenu) isValidChoice(choice string) bool {
+	switch choice {
+	case "S", "M", "C", "U", "Y", "L", "E", "B", "A", "R", "V", "D", "H", "Q":
+		return true
+	}
+	return false
+}
+
 // cleanup closes the file watcher
 func (e *EnhancedMenu) cleanup() {
 	if e.watcher != nil {
@@ -218,8 +228,8 @@ func (e *EnhancedMenu) showHeader() {
 	if len(e.outputFolders) == 1 {
 		outputCount := e.fileOps.CountPDFFiles(e.outputFolders[0])
 		absPath, err := filepath.Abs(e.outputFolders[0])
-		if err != nil {
-			absPath = e.outputFolders[0] // Fallback to original path
+		if err != nil || strings.Contains(e.outputFolders[0], "://") {
+			absPath = e.outputFolders[0] // URLs and unresolvable paths are shown as configured
 		}
 		fmt.Printf("│ Output : %-59s %6d │\n", absPath, outputCount)
 	} else {
@@ -227,8 +237,8 @@ func (e *EnhancedMenu) showHeader() {
 		for _, folder := range e.outputFolders {
 			count := e.fileOps.CountPDFFiles(folder)
 			absPath, err := filepath.Abs(folder)
-			if err != nil {
-				absPath = folder // Fallback to original path
+			if err != nil || strings.Contains(folder, "://") {
+				absPath = folder // URLs and unresolvable paths are shown as configured
 			}
 			fmt.Printf("│ Output : %-59s %6d │\n", absPath, count)
 		}
@@ -236,10 +246,37 @@ func (e *EnhancedMenu) showHeader() {
 
 	fmt.Printf("│ Error  : %-59s %6d │\n", e.errorDir, errorCount)
 
+	// Destination space and permissions, checked on every redraw
+	if health, ok := e.fileOps.DestinationHealth(); health != "" {
+		if !ok {
+			health = "FAIL - " + health
+		}
+		fmt.Printf("│ Health : %-66s │\n", fitHeaderText(health, 66))
+	}
+
+	// Output copies waiting for a retry
+	if pending := e.fileOps.PendingRetries(); pending != "" {
+		fmt.Printf("│ Retry  : %-66s │\n", fitHeaderText(pending, 66))
+	}
+
+	// Remote folder scans are fetched from
+	if inbox := e.fileOps.InboxStatus(); inbox != "" {
+		fmt.Printf("│ Inbox  : %-66s │\n", fitHeaderText(inbox, 66))
+	}
+
 	fmt.Println("└─────────────────────────────────────────────────────────────────────────────┘")
 	fmt.Println()
 }
 
+// fitHeaderText shortens text to fit a header column
+func fitHeaderText(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) <= width {
+		return text
+	}
+	return string(runes[:width-3]) + "..."
+}
+
 func (e *EnhancedMenu) showStatus() {
 	// Show available files
 	var mainFiles []FileInfo
@@ -304,7 +341,12 @@ func (e *EnhancedMenu) showActionsBar() {
 	fmt.Println("├─────────────────────────────────────────────────────────────────────────────┤")
 	fmt.Println("│  [S] Single File  - Move a single PDF file to output directory              │")
 	fmt.Println("│  [M] Merge PDFs   - Merge two PDF files with interleaved pattern            │")
+	fmt.Println("│  [C] Scan         - Scan front and back on the network scanner and merge    │")
 	fmt.Println("│  [U] Undo         - Reverse last operation                                  │")
+	fmt.Println("│  [Y] Redo         - Reapply last undone operation                           │")
+	fmt.Println("│  [L] History      - Undo a specific past operation                          │")
+	fmt.Println("│  [E] Retry        - Move failed files back from the error folder            │")
+	fmt.Println("│  [B] Browse       - Restore or reprocess archived originals                 │")
 	fmt.Println("│  [H] Help         - Show help information                                   │")
 	fmt.Println("│  [Q] Quit         - Exit the program                                        │")
 	fmt.Println("└─────────────────────────────────────────────────────────────────────────────┘")
@@ -326,15 +368,23 @@ func (e *EnhancedMenu) getUserChoice() string {
 		}
 	}()
 
-	// Check for input or refresh needs every 100ms
+	// Check for input or refresh needs every 100ms, and for due retries and inbox polls every second
 	ticker := time.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
+	ticks := 0
 
 	for {
 		select {
 		case input := <-inputChan:
 			return input
 		case <-ticker.C:
+			ticks++
+			if ticks%10 == 0 && e.fileOps.RetryDueCopies() {
+				e.needsRefresh = true
+			}
+			if ticks%10 == 0 && e.fileOps.PollInbox() {
+				e.needsRefresh = true
+			}
 			if e.needsRefresh {
 				e.needsRefresh = false
 				e.clearScreen()
@@ -357,12 +407,22 @@ func (e *EnhancedMenu) processKeyboardShortcuts(input string) string {
 		return "R" // Refresh (new shortcut)
 	case "ctrl+z", "undo":
 		return "U" // Undo
+	case "ctrl+y", "redo":
+		return "Y" // Redo
+	case "history", "log":
+		return "L" // History
+	case "retry", "errors":
+		return "E" // Retry from error
+	case "browse", "restore":
+		return "B" // Browse archive
 	case "archive", "toggle":
 		return "A" // Archive toggle
 	case "single", "1":
 		return "S" // Single file
 	case "merge", "2":
 		return "M" // Merge
+	case "scan":
+		return "C" // Scan
 	case "verbose":
 		return "V" // Verbose
 	case "debug":
@@ -382,8 +442,18 @@ func (e *EnhancedMenu) handleChoice(choice string) bool {
 		return e.handleSingleFile()
 	case "M":
 		return e.handleMergeFiles()
+	case "C":
+		return e.handleScan()
 	case "U":
 		return e.handleUndo()
+	case "Y":
+		return e.handleRedo()
+	case "L":
+		return e.handleHistory()
+	case "E":
+		return e.handleRetry()
+	case "B":
+		return e.handleBrowse()
 	case "A":
 		return e.handleArchiveToggle()
 	case "R":
@@ -420,6 +490,252 @@ func (e *EnhancedMenu) handleUndo() bool {
 	return true
 }
 
+// handleRedo processes redo operation
+func (e *EnhancedMenu) handleRedo() bool {
+	e.setProcessing("Redo operation")
+
+	err := e.fileOps.ProcessRedo()
+	if err != nil {
+		e.addRecentOperation("Redo operation", "FAILED", err.Error())
+		fmt.Printf("❌ Error: %v\n", err)
+	} else {
+		e.addRecentOperation("Redo operation", "SUCCESS", "Operation reapplied")
+		fmt.Println("✅ Redo operation completed successfully.")
+	}
+
+	e.setIdle()
+	return true
+}
+
+// handleHistory shows the operation history and undoes a selected entry
+func (e *EnhancedMenu) handleHistory() bool {
+	items, err := e.fileOps.ListHistory()
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		return true
+	}
+
+	e.clearScreen()
+	fmt.Println("┌─────────────────────────────────────────────────────────────────────────────┐")
+	fmt.Println("│                            Operation History                                │")
+	fmt.Println("└─────────────────────────────────────────────────────────────────────────────┘")
+	if len(items) == 0 {
+		fmt.Println("  No operations recorded")
+		fmt.Print("Press Enter to return...")
+		e.scanner.Scan()
+		return true
+	}
+
+	for i, item := range items {
+		if i >= 20 {
+			fmt.Printf("  ... and %d older operation(s)\n", len(items)-20)
+			break
+		}
+		state := "  "
+		if item.Undone {
+			state = "↶ "
+		}
+		fmt.Printf("  %2d. %s[%s] %-6s %s\n", i+1, state, item.Time, item.Type, item.Description)
+	}
+	fmt.Println()
+	fmt.Print("Enter number to undo (Enter to return): ")
+
+	if !e.scanner.Scan() {
+		return true
+	}
+	input := strings.TrimSpace(e.scanner.Text())
+	if input == "" {
+		return true
+	}
+
+	index, err := strconv.Atoi(input)
+	if err != nil || index < 1 || index > len(items) || index > 20 {
+		fmt.Println("❌ Invalid selection.")
+		return true
+	}
+
+	item := items[index-1]
+	if err := e.fileOps.UndoOperation(item.ID); err != nil {
+		e.errorCount++
+		e.addRecentOperation("Undo operation", "FAILED", err.Error())
+		fmt.Printf("❌ Error: %v\n", err)
+	} else {
+		e.addRecentOperation("Undo operation", "SUCCESS", "Undid "+item.Description)
+		fmt.Println("✅ Undo operation completed successfully.")
+	}
+	return true
+}
+
+// handleRetry lists failed files with their reasons and moves selected ones back to the watch folder
+func (e *EnhancedMenu) handleRetry() bool {
+	items, err := e.fileOps.ListErrorFiles()
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		return true
+	}
+
+	e.clearScreen()
+	fmt.Println("┌─────────────────────────────────────────────────────────────────────────────┐")
+	fmt.Println("│                             Error Folder                                    │")
+	fmt.Println("└─────────────────────────────────────────────────────────────────────────────┘")
+	if len(items) == 0 {
+		fmt.Println("  Error folder is empty")
+		fmt.Print("Press Enter to return...")
+		e.scanner.Scan()
+		return true
+	}
+
+	for i, item := range items {
+		fmt.Printf("  %2d. %s\n", i+1, item.Name)
+		if item.Stage == "" {
+			fmt.Println("      no report")
+			continue
+		}
+		fmt.Printf("      [%s] %s: %s\n", item.Time, item.Stage, item.Error)
+		if item.Partner != "" {
+			fmt.Printf("      partner: %s\n", item.Partner)
+		}
+	}
+	fmt.Println()
+	fmt.Print("Enter numbers to retry, or A for all (Enter to return): ")
+
+	if !e.scanner.Scan() {
+		return true
+	}
+	input := strings.TrimSpace(e.scanner.Text())
+	if input == "" {
+		return true
+	}
+
+	indexes, err := parseSelection(input, len(items))
+	if err != nil {
+		fmt.Println("❌ Invalid selection.")
+		return true
+	}
+
+	var names []string
+	for _, index := range indexes {
+		names = append(names, items[index].Name)
+	}
+
+	retried, err := e.fileOps.RetryErrorFiles(names)
+	if err != nil {
+		e.errorCount++
+		e.addRecentOperation("Retry from error", "FAILED", err.Error())
+		fmt.Printf("❌ Error: %v\n", err)
+	}
+	if retried > 0 {
+		e.addRecentOperation("Retry from error", "SUCCESS", fmt.Sprintf("%d file(s) back in watch folder", retried))
+		fmt.Printf("✅ Moved %d file(s) back to the watch folder.\n", retried)
+	}
+	return true
+}
+
+// handleBrowse lists archived originals, copies selected ones back or reprocesses a pair
+func (e *EnhancedMenu) handleBrowse() bool {
+	items, err := e.fileOps.ListArchive()
+	if err != nil {
+		fmt.Printf("❌ Error: %v\n", err)
+		return true
+	}
+
+	e.clearScreen()
+	fmt.Println("┌─────────────────────────────────────────────────────────────────────────────┐")
+	fmt.Println("│                              Browse Archive                                 │")
+	fmt.Println("└─────────────────────────────────────────────────────────────────────────────┘")
+	if len(items) == 0 {
+		fmt.Println("  Archive is empty")
+		fmt.Print("Press Enter to return...")
+		e.scanner.Scan()
+		return true
+	}
+
+	for i, item := range items {
+		fmt.Printf("  %2d. [%s] %-50s %8s\n", i+1, item.Time, item.Key, item.Size)
+	}
+	fmt.Println()
+	fmt.Println("Enter numbers to copy back to the watch folder (e.g. 1,3),")
+	fmt.Print("or P and a front,back pair to merge again (e.g. P 1,2) (Enter to return): ")
+
+	if !e.scanner.Scan() {
+		return true
+	}
+	input := strings.TrimSpace(e.scanner.Text())
+	if input == "" {
+		return true
+	}
+
+	front, back, reprocess, err := parseReprocessSelection(input, len(items))
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return true
+	}
+	if reprocess {
+		return e.handleReprocess(items[front], items[back])
+	}
+
+	indexes, err := parseSelection(input, len(items))
+	if err != nil {
+		fmt.Println("❌ Invalid selection.")
+		return true
+	}
+
+	var keys []string
+	for _, index := range indexes {
+		keys = append(keys, items[index].Key)
+	}
+
+	restored, err := e.fileOps.RestoreArchiveFiles(keys)
+	if err != nil {
+		e.errorCount++
+		e.addRecentOperation("Restore from archive", "FAILED", err.Error())
+		fmt.Printf("❌ Error: %v\n", err)
+	}
+	if restored > 0 {
+		e.addRecentOperation("Restore from archive", "SUCCESS", fmt.Sprintf("%d file(s) copied to watch folder", restored))
+		fmt.Printf("✅ Copied %d file(s) back to the watch folder.\n", restored)
+	}
+	return true
+}
+
+// handleReprocess asks for merge settings and merges an archived pair into a new output
+func (e *EnhancedMenu) handleReprocess(front, back ArchiveItem) bool {
+	fmt.Print("Back pages [R]eversed or [A]s scanned (default R): ")
+	if !e.scanner.Scan() {
+		return true
+	}
+	backOrder, err := parseMergeChoice(e.scanner.Text(), backOrderChoices, "reversed")
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return true
+	}
+
+	fmt.Print("Flipped on the [L]ong or [S]hort edge (default L): ")
+	if !e.scanner.Scan() {
+		return true
+	}
+	flipEdge, err := parseMergeChoice(e.scanner.Text(), flipEdgeChoices, "long")
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		return true
+	}
+
+	e.setProcessing("Reprocess " + front.Name + " + " + back.Name)
+	output, err := e.fileOps.ReprocessArchivePair(front.Key, back.Key, backOrder, flipEdge)
+	e.setIdle()
+	if err != nil {
+		e.errorCount++
+		e.addRecentOperation("Reprocess", "FAILED", err.Error())
+		fmt.Printf("❌ Error: %v\n", err)
+		return true
+	}
+
+	e.successCount++
+	e.addRecentOperation("Reprocess", "SUCCESS", front.Name+" + "+back.Name+" → "+output)
+	fmt.Printf("✅ Merged again into %s.\n", output)
+	return true
+}
+
 // handleArchiveToggle toggles archive mode
 func (e *EnhancedMenu) handleArchiveToggle() bool {
 	e.fileOps.ToggleArchiveMode()
@@ -603,6 +919,30 @@ func (e *EnhancedMenu) handleMergeFiles() bool {
 	return true
 }
 
+// handleScan scans front and back on the network scanner, asking for the stack to be flipped between
+func (e *EnhancedMenu) handleScan() bool {
+	e.setProcessing("Scan")
+	description, err := e.fileOps.ScanDuplex(func(prompt string) bool {
+		fmt.Printf("%s (C to cancel): ", prompt)
+		if !e.scanner.Scan() {
+			return false
+		}
+		return !strings.EqualFold(strings.TrimSpace(e.scanner.Text()), "c")
+	})
+	e.setIdle()
+	if err != nil {
+		e.errorCount++
+		e.addRecentOperation("Scan", "FAILED", err.Error())
+		fmt.Printf("❌ Error: %v\n", err)
+		return true
+	}
+
+	e.successCount++
+	e.addRecentOperation("Scan", "SUCCESS", description)
+	fmt.Println("✅ Scanned and merged successfully")
+	return true
+}
+
 func (e *EnhancedMenu) showHelp() {
 	fmt.Printf("BlendPDFGo v%s - Help\n", e.version)
 	fmt.Println("===================")
@@ -617,7 +957,12 @@ func (e *EnhancedMenu) showHelp() {
 	fmt.Println("Keyboard Shortcuts:")
 	fmt.Println("  S, single, 1     - Single file operation")
 	fmt.Println("  M, merge, 2      - Merge operation")
+	fmt.Println("  C, scan          - Scan both sides on the network scanner and merge")
 	fmt.Println("  U, undo, Ctrl+Z  - Undo last operation")
+	fmt.Println("  Y, redo, Ctrl+Y  - Redo last undone operation")
+	fmt.Println("  L, history       - Undo a specific past operation")
+	fmt.Println("  E, retry         - Move failed files back from the error folder")
+	fmt.Println("  B, browse        - Restore or reprocess archived originals")
 	fmt.Println("  A, archive       - Toggle archive mode")
 	fmt.Println("  R, refresh, Space - Refresh display")
 	fmt.Println("  V, verbose       - Toggle verbose mode")
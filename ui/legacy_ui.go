@@ -18,6 +18,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -67,6 +68,10 @@ func (l *LegacyUI) Run() error {
 
 // showStatus displays current file counts
 func (l *LegacyUI) showStatus() {
+	// The legacy UI only retries queued copies and polls the inbox between choices
+	l.fileOps.RetryDueCopies()
+	l.fileOps.PollInbox()
+
 	mainCount := l.fileOps.CountPDFFiles(l.watchDir)
 	archiveCount := l.fileOps.CountPDFFiles(l.archiveDir)
 	outputCount := l.fileOps.CountPDFFiles(l.outputDir)
@@ -74,6 +79,13 @@ func (l *LegacyUI) showStatus() {
 
 	fmt.Printf("Files: Main(%d) Archive(%d) Output(%d) Error(%d)\n",
 		mainCount, archiveCount, outputCount, errorCount)
+
+	if pending := l.fileOps.PendingRetries(); pending != "" {
+		fmt.Printf("Retry: %s\n", pending)
+	}
+	if inbox := l.fileOps.InboxStatus(); inbox != "" {
+		fmt.Printf("Inbox: %s\n", inbox)
+	}
 	fmt.Println()
 }
 
@@ -82,7 +94,12 @@ func (l *LegacyUI) showMenu() {
 	fmt.Println("Available Options:")
 	fmt.Println("  [S] Single File  - Move a single PDF file to output")
 	fmt.Println("  [M] Merge PDFs   - Merge two PDF files with interleaved pattern")
+	fmt.Println("  [C] Scan         - Scan front and back on the network scanner and merge")
 	fmt.Println("  [U] Undo         - Reverse last operation")
+	fmt.Println("  [Y] Redo         - Reapply last undone operation")
+	fmt.Println("  [L] History      - Undo a specific past operation")
+	fmt.Println("  [E] Retry        - Move failed files back from the error folder")
+	fmt.Println("  [B] Browse       - Restore or reprocess archived originals")
 	fmt.Println("  [A] Archive      - Toggle archive mode")
 	fmt.Println("  [H] Help         - Show help information")
 	fmt.Println("  [Q] Quit         - Exit the program")
@@ -91,7 +108,7 @@ func (l *LegacyUI) showMenu() {
 
 // getUserChoice gets user input
 func (l *LegacyUI) getUserChoice() string {
-	fmt.Print("Enter choice (S/M/U/A/H/Q): ")
+	fmt.Print("Enter choice (S/M/C/U/Y/L/E/B/A/H/Q): ")
 	if l.scanner.Scan() {
 		input := strings.TrimSpace(l.scanner.Text())
 		// Handle keyboard shortcuts
@@ -110,12 +127,22 @@ func (l *LegacyUI) processKeyboardShortcuts(input string) string {
 		return "Q" // Quit
 	case "ctrl+z", "undo":
 		return "U" // Undo
+	case "ctrl+y", "redo":
+		return "Y" // Redo
+	case "history", "log":
+		return "L" // History
+	case "retry", "errors":
+		return "E" // Retry from error
+	case "browse", "restore":
+		return "B" // Browse archive
 	case "archive", "toggle":
 		return "A" // Archive toggle
 	case "single", "1":
 		return "S" // Single file
 	case "merge", "2":
 		return "M" // Merge
+	case "scan":
+		return "C" // Scan
 	default:
 		return input
 	}
@@ -128,8 +155,18 @@ func (l *LegacyUI) handleChoice(choice string) bool {
 		l.handleSingleFile()
 	case "M":
 		l.handleMerge()
+	case "C":
+		l.handleScan()
 	case "U":
 		l.handleUndo()
+	case "Y":
+		l.handleRedo()
+	case "L":
+		l.handleHistory()
+	case "E":
+		l.handleRetry()
+	case "B":
+		l.handleBrowse()
 	case "A":
 		l.handleArchiveToggle()
 	case "H":
@@ -178,6 +215,111 @@ func (l *LegacyUI) handleUndo() {
 	}
 }
 
+// handleRedo processes redo operation
+func (l *LegacyUI) handleRedo() {
+	fmt.Println("Processing redo...")
+	err := l.fileOps.ProcessRedo()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	} else {
+		fmt.Println("Redo operation completed successfully.")
+	}
+}
+
+// handleHistory lists past operations and undoes a selected one
+func (l *LegacyUI) handleHistory() {
+	items, err := l.fileOps.ListHistory()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(items) == 0 {
+		fmt.Println("No operations recorded.")
+		return
+	}
+
+	fmt.Println("Operation History:")
+	for i, item := range items {
+		if i >= 20 {
+			break
+		}
+		state := ""
+		if item.Undone {
+			state = " (undone)"
+		}
+		fmt.Printf("  %2d. [%s] %s %s%s\n", i+1, item.Time, item.Type, item.Description, state)
+	}
+
+	fmt.Print("Enter number to undo (Enter to return): ")
+	if !l.scanner.Scan() {
+		return
+	}
+	input := strings.TrimSpace(l.scanner.Text())
+	if input == "" {
+		return
+	}
+
+	index, err := strconv.Atoi(input)
+	if err != nil || index < 1 || index > len(items) || index > 20 {
+		fmt.Println("Invalid selection.")
+		return
+	}
+
+	if err := l.fileOps.UndoOperation(items[index-1].ID); err != nil {
+		fmt.Printf("Error: %v\n", err)
+	} else {
+		fmt.Println("Undo operation completed successfully.")
+	}
+}
+
+// handleRetry lists failed files and moves selected ones back to the watch folder
+func (l *LegacyUI) handleRetry() {
+	items, err := l.fileOps.ListErrorFiles()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(items) == 0 {
+		fmt.Println("Error folder is empty.")
+		return
+	}
+
+	fmt.Println("Error Folder:")
+	for i, item := range items {
+		reason := "no report"
+		if item.Stage != "" {
+			reason = item.Stage + ": " + item.Error
+		}
+		fmt.Printf("  %2d. %s - %s\n", i+1, item.Name, reason)
+	}
+
+	fmt.Print("Enter numbers to retry, or A for all (Enter to return): ")
+	if !l.scanner.Scan() {
+		return
+	}
+	input := strings.TrimSpace(l.scanner.Text())
+	if input == "" {
+		return
+	}
+
+	indexes, err := parseSelection(input, len(items))
+	if err != nil {
+		fmt.Println("Invalid selection.")
+		return
+	}
+
+	var names []string
+	for _, index := range indexes {
+		names = append(names, items[index].Name)
+	}
+
+	retried, err := l.fileOps.RetryErrorFiles(names)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	fmt.Printf("Moved %d file(s) back to the watch folder.\n", retried)
+}
+
 // handleArchiveToggle toggles archive mode
 func (l *LegacyUI) handleArchiveToggle() {
 	l.fileOps.ToggleArchiveMode()
@@ -197,7 +339,11 @@ func (l *LegacyUI) showHelp() {
 	fmt.Println("Keyboard Shortcuts:")
 	fmt.Println("  S, single, 1     - Single file operation")
 	fmt.Println("  M, merge, 2      - Merge operation")
+	fmt.Println("  C, scan          - Scan both sides on the network scanner and merge")
 	fmt.Println("  U, undo, Ctrl+Z  - Undo last operation")
+	fmt.Println("  Y, redo, Ctrl+Y  - Redo last undone operation")
+	fmt.Println("  L, history       - Undo a specific past operation")
+	fmt.Println("  B, browse        - Restore or reprocess archived originals")
 	fmt.Println("  A, archive       - Toggle archive mode")
 	fmt.Println("  H, help, F1, ?   - Show this help")
 	fmt.Println("  Q, quit, Ctrl+Q  - Exit program")
@@ -209,3 +355,104 @@ func (l *LegacyUI) showHelp() {
 	fmt.Println("Press Enter to continue...")
 	l.scanner.Scan()
 }
+
+// handleScan scans front and back on the network scanner, asking for the stack to be flipped between
+func (l *LegacyUI) handleScan() {
+	fmt.Println("Scanning front pages...")
+	_, err := l.fileOps.ScanDuplex(func(prompt string) bool {
+		fmt.Printf("%s (C to cancel): ", prompt)
+		if !l.scanner.Scan() {
+			return false
+		}
+		return !strings.EqualFold(strings.TrimSpace(l.scanner.Text()), "c")
+	})
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	} else {
+		fmt.Println("Scan and merge completed successfully.")
+	}
+}
+
+// handleBrowse lists archived originals, copies selected ones back or reprocesses a pair
+func (l *LegacyUI) handleBrowse() {
+	items, err := l.fileOps.ListArchive()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if len(items) == 0 {
+		fmt.Println("Archive is empty.")
+		return
+	}
+
+	fmt.Println("Archive:")
+	for i, item := range items {
+		fmt.Printf("  %2d. [%s] %s (%s)\n", i+1, item.Time, item.Key, item.Size)
+	}
+
+	fmt.Print("Enter numbers to copy back, or P front,back to merge again (Enter to return): ")
+	if !l.scanner.Scan() {
+		return
+	}
+	input := strings.TrimSpace(l.scanner.Text())
+	if input == "" {
+		return
+	}
+
+	front, back, reprocess, err := parseReprocessSelection(input, len(items))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	if reprocess {
+		l.handleReprocess(items[front], items[back])
+		return
+	}
+
+	indexes, err := parseSelection(input, len(items))
+	if err != nil {
+		fmt.Println("Invalid selection.")
+		return
+	}
+
+	var keys []string
+	for _, index := range indexes {
+		keys = append(keys, items[index].Key)
+	}
+
+	restored, err := l.fileOps.RestoreArchiveFiles(keys)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+	}
+	fmt.Printf("Copied %d file(s) back to the watch folder.\n", restored)
+}
+
+// handleReprocess asks for merge settings and merges an archived pair into a new output
+func (l *LegacyUI) handleReprocess(front, back ArchiveItem) {
+	fmt.Print("Back pages [R]eversed or [A]s scanned (default R): ")
+	if !l.scanner.Scan() {
+		return
+	}
+	backOrder, err := parseMergeChoice(l.scanner.Text(), backOrderChoices, "reversed")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	fmt.Print("Flipped on the [L]ong or [S]hort edge (default L): ")
+	if !l.scanner.Scan() {
+		return
+	}
+	flipEdge, err := parseMergeChoice(l.scanner.Text(), flipEdgeChoices, "long")
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	output, err := l.fileOps.ReprocessArchivePair(front.Key, back.Key, backOrder, flipEdge)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+	fmt.Printf("Merged again into %s.\n", output)
+}
@@ -28,10 +28,34 @@ type FileOperations interface {
 	FindPDFFiles(dir string) ([]string, error)
 	CountPDFFiles(dir string) int
 	GetHumanReadableSize(filename string) string
-	ProcessSingleFile() (string, error) // Returns operation description
-	ProcessMergeFiles() (string, error) // Returns operation description
-	ProcessUndo() error                 // Undo last operation
-	ToggleArchiveMode()                 // Toggle archive mode
+	ProcessSingleFile() (string, error)          // Returns operation description
+	ProcessMergeFiles() (string, error)          // Returns operation description
+	ProcessUndo() error                          // Undo last operation
+	ToggleArchiveMode()                          // Toggle archive mode
+	ListHistory() ([]HistoryItem, error)         // Recorded operations, newest first
+	UndoOperation(id string) error               // Undo a specific recorded operation
+	ProcessRedo() error                          // Redo most recently undone operation
+	ListErrorFiles() ([]ErrorItem, error)        // Files waiting in the error folder
+	RetryErrorFiles(names []string) (int, error) // Move error files back to the watch folder
+	ListArchive() ([]ArchiveItem, error)         // Archived originals, newest first
+
+	// Copy archived originals back to the watch folder, or merge an archived pair again
+	RestoreArchiveFiles(keys []string) (int, error)
+	ReprocessArchivePair(front, back, backOrder, flipEdge string) (string, error)
+
+	// One-line summary of destination space and permissions, and whether all are healthy
+	DestinationHealth() (string, bool)
+
+	// Retry queued output copies that are due, and summarise those still waiting
+	RetryDueCopies() bool   // Reports whether the queue changed
+	PendingRetries() string // "" when nothing is queued
+
+	// Fetch new scans from a remote inbox when one is configured
+	PollInbox() bool     // Reports whether files arrived
+	InboxStatus() string // "" when there is no remote inbox
+
+	// Scan front and back on the network scanner and merge them; flip shows a prompt and returns false to cancel
+	ScanDuplex(flip func(prompt string) bool) (string, error)
 }
 
 // TUI represents the terminal user interface
@@ -195,7 +219,7 @@ func (w *tuiWrapper) handleSingleFile() (tea.Model, tea.Cmd) {
 	w.ProgressMsg = "Processing single file..."
 
 	return w, func() tea.Msg {
-		_, err := w.fileOps.ProcessSingleFile()
+		description, err := w.fileOps.ProcessSingleFile()
 		if err != nil {
 			return operationCompleteMsg{
 				success: false,
@@ -204,7 +228,7 @@ func (w *tuiWrapper) handleSingleFile() (tea.Model, tea.Cmd) {
 		}
 		return operationCompleteMsg{
 			success: true,
-			message: "✅ Single file processed successfully",
+			message: "✅ " + description,
 		}
 	}
 }
@@ -220,7 +244,7 @@ func (w *tuiWrapper) handleMergeFiles() (tea.Model, tea.Cmd) {
 	w.ProgressMsg = fmt.Sprintf("Merging %s and %s...", selectedFiles[0].Name, selectedFiles[1].Name)
 
 	return w, func() tea.Msg {
-		_, err := w.fileOps.ProcessMergeFiles()
+		description, err := w.fileOps.ProcessMergeFiles()
 		if err != nil {
 			return operationCompleteMsg{
 				success: false,
@@ -229,7 +253,7 @@ func (w *tuiWrapper) handleMergeFiles() (tea.Model, tea.Cmd) {
 		}
 		return operationCompleteMsg{
 			success: true,
-			message: fmt.Sprintf("✅ Merged %s and %s", selectedFiles[0].Name, selectedFiles[1].Name),
+			message: "✅ " + description,
 		}
 	}
 }
@@ -0,0 +1,386 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebDAV destinations (Nextcloud, ownCloud, Apache mod_dav, ...)
+//
+// webdav://host/path and https://host/path destinations are reached over
+// HTTPS. Files are PUT under a temporary name and then MOVEd into place so
+// a half-written upload is never visible, and missing folders are created
+// with MKCOL. Authentication is basic (username and password) or bearer
+// (token), from the destinations entry or the WEBDAV_* environment variables.
+
+const (
+	WEBDAV_TIMEOUT      = 5 * time.Minute
+	WEBDAV_CHECKSUM     = "SHA256:" // OC-Checksum prefix understood by Nextcloud and ownCloud
+	WEBDAV_PROPFIND_XML = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop><d:getcontentlength/><d:resourcetype/><oc:checksums/></d:prop>
+</d:propfind>`
+)
+
+// webdavStore uploads to one WebDAV server
+type webdavStore struct {
+	base     string // scheme://host of the server
+	client   *http.Client
+	username string
+	password string
+	token    string
+}
+
+// Connect to the server of a webdav:// or https:// URL
+func openWebDAVStore(u *url.URL, dest DestinationConfig) (remoteStore, error) {
+	scheme := u.Scheme
+	if scheme == "webdav" {
+		scheme = "https"
+	}
+	return &webdavStore{
+		base:     scheme + "://" + u.Host,
+		client:   &http.Client{Timeout: WEBDAV_TIMEOUT},
+		username: firstNonEmpty(dest.Username, os.Getenv("WEBDAV_USERNAME")),
+		password: firstNonEmpty(dest.Password, os.Getenv("WEBDAV_PASSWORD")),
+		token:    firstNonEmpty(dest.Token, os.Getenv("WEBDAV_TOKEN")),
+	}, nil
+}
+
+// Multistatus reply to PROPFIND
+type davMultistatus struct {
+	Responses []davResponse `xml:"DAV: response"`
+}
+
+type davResponse struct {
+	Href      string        `xml:"DAV: href"`
+	Propstats []davPropstat `xml:"DAV: propstat"`
+}
+
+type davPropstat struct {
+	Status string `xml:"DAV: status"`
+	Prop   struct {
+		ContentLength string `xml:"DAV: getcontentlength"`
+		ResourceType  struct {
+			Collection *struct{} `xml:"DAV: collection"`
+		} `xml:"DAV: resourcetype"`
+		Checksums []string `xml:"http://owncloud.org/ns checksums>checksum"`
+	} `xml:"DAV: prop"`
+}
+
+// Build the URL of a key on the server
+func (s *webdavStore) url(key string) string {
+	return s.base + (&url.URL{Path: "/" + key}).EscapedPath()
+}
+
+// Send a request with the configured credentials
+func (s *webdavStore) do(method, key string, body io.Reader, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.url(key), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	s.authorize(req)
+	return s.client.Do(req)
+}
+
+// Add basic or bearer credentials to a request
+func (s *webdavStore) authorize(req *http.Request) {
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	} else if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+}
+
+// Describe a failed request
+func davError(method, key string, resp *http.Response) error {
+	return &remoteStatusError{request: method + " /" + key, status: resp.StatusCode}
+}
+
+// Read the properties of a key and, with depth 1, its children
+func (s *webdavStore) propfind(key, depth string) ([]davResponse, error) {
+	resp, err := s.do("PROPFIND", key, strings.NewReader(WEBDAV_PROPFIND_XML), map[string]string{
+		"Depth":        depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errRemoteNotFound
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, davError("PROPFIND", key, resp)
+	}
+	var status davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("PROPFIND /%s: invalid reply: %v", key, err)
+	}
+	return status.Responses, nil
+}
+
+// Get the key an href refers to
+func hrefKey(href string) string {
+	u, err := url.Parse(href)
+	if err != nil {
+		return ""
+	}
+	return strings.Trim(u.Path, "/")
+}
+
+// Describe a PROPFIND response as an object, noting whether it is a folder
+func (r davResponse) object() (remoteObject, bool) {
+	var object remoteObject
+	collection := false
+	for _, propstat := range r.Propstats {
+		if !strings.Contains(propstat.Status, " 200 ") {
+			continue
+		}
+		if propstat.Prop.ResourceType.Collection != nil {
+			collection = true
+		}
+		if size, err := strconv.ParseInt(propstat.Prop.ContentLength, 10, 64); err == nil {
+			object.size = size
+		}
+		for _, checksums := range propstat.Prop.Checksums {
+			for _, checksum := range strings.Fields(checksums) {
+				if digest, ok := strings.CutPrefix(strings.ToUpper(checksum), WEBDAV_CHECKSUM); ok {
+					object.digest = strings.ToLower(digest)
+				}
+			}
+		}
+	}
+	return object, collection
+}
+
+func (s *webdavStore) stat(key string) (remoteObject, error) {
+	responses, err := s.propfind(key, "0")
+	if err != nil {
+		return remoteObject{}, err
+	}
+	if len(responses) == 0 {
+		return remoteObject{}, errRemoteNotFound
+	}
+	object, _ := responses[0].object()
+	return object, nil
+}
+
+func (s *webdavStore) list(prefix string) ([]string, error) {
+	dir := path.Dir("/" + prefix)
+	responses, err := s.propfind(strings.TrimPrefix(dir, "/")+"/", "1")
+	if err == errRemoteNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, response := range responses {
+		key := hrefKey(response.Href)
+		if _, collection := response.object(); !collection && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *webdavStore) upload(src, key, digest string) error {
+	info, err := STORAGE.stat(src)
+	if err != nil {
+		return err
+	}
+
+	// Upload beside the target, then move it into place
+	dir, name := path.Split(key)
+	tempKey := dir + TEMP_FILE_PREFIX + name + "." + strconv.FormatInt(time.Now().UnixNano(), 36) + TEMP_FILE_SUFFIX
+
+	status, err := s.putFile(src, info.Size(), tempKey, digest)
+	if err == nil && (status == http.StatusNotFound || status == http.StatusConflict) {
+		// The folder is missing
+		if err = s.mkcolAll(strings.TrimSuffix(dir, "/")); err == nil {
+			status, err = s.putFile(src, info.Size(), tempKey, digest)
+		}
+	}
+	if err == nil && status/100 != 2 {
+		err = &remoteStatusError{request: "PUT /" + tempKey, status: status}
+	}
+	if err == nil {
+		err = s.move(tempKey, key)
+	}
+	if err != nil {
+		_ = s.remove(tempKey)
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+
+	// Confirm the server holds what was sent
+	object, err := s.stat(key)
+	if err != nil {
+		return fmt.Errorf("failed to verify upload of %s: %w", key, err)
+	}
+	if object.size != info.Size() || (object.digest != "" && object.digest != digest) {
+		return fmt.Errorf("upload of %s does not match the source", key)
+	}
+	return nil
+}
+
+// PUT a file from the working folders, returning the status code
+func (s *webdavStore) putFile(src string, size int64, key, digest string) (int, error) {
+	file, err := STORAGE.open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return s.put(file, size, key, digest)
+}
+
+// PUT a file, returning the status code
+func (s *webdavStore) put(file io.Reader, size int64, key, digest string) (int, error) {
+	req, err := http.NewRequest(http.MethodPut, s.url(key), io.NopCloser(file))
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/pdf")
+	req.Header.Set("OC-Checksum", WEBDAV_CHECKSUM+digest)
+	s.authorize(req)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// MOVE a key onto another, replacing it
+func (s *webdavStore) move(src, dst string) error {
+	resp, err := s.do("MOVE", src, nil, map[string]string{
+		"Destination": s.url(dst),
+		"Overwrite":   "T", // The conflict policy has already decided on replacing
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return davError("MOVE", src, resp)
+	}
+	return nil
+}
+
+// Create a folder and any missing parents
+func (s *webdavStore) mkcolAll(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		resp, err := s.do("MKCOL", dir+"/", nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode/100 == 2, resp.StatusCode == http.StatusMethodNotAllowed:
+			return nil // Created, or already there
+		case resp.StatusCode == http.StatusConflict && attempt == 0:
+			if err := s.mkcolAll(path.Dir("/" + dir)[1:]); err != nil {
+				return err
+			}
+		default:
+			return davError("MKCOL", dir, resp)
+		}
+	}
+}
+
+func (s *webdavStore) open(key string) (io.ReadCloser, error) {
+	resp, err := s.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errRemoteNotFound
+		}
+		return nil, davError("GET", key, resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *webdavStore) remove(key string) error {
+	resp, err := s.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return davError("DELETE", key, resp)
+	}
+	return nil
+}
+
+// The folder is created when missing, as local output folders are
+func (s *webdavStore) check(folder string) error {
+	folder = strings.Trim(folder, "/")
+	_, err := s.propfind(folder+"/", "0")
+	if err == errRemoteNotFound {
+		return s.mkcolAll(folder)
+	}
+	return err
+}
+
+// MOVE without overwrite: 412 when dst exists, 404 when src has gone
+func (s *webdavStore) claim(src, dst string) error {
+	for attempt := 0; ; attempt++ {
+		resp, err := s.do("MOVE", src, nil, map[string]string{
+			"Destination": s.url(dst),
+			"Overwrite":   "F",
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode/100 == 2:
+			return nil
+		case resp.StatusCode == http.StatusPreconditionFailed, resp.StatusCode == http.StatusNotFound:
+			return errRemoteClaimed
+		case (resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusForbidden) && attempt == 0:
+			// The processing folder is missing; some servers report that as forbidden
+			if err := s.mkcolAll(path.Dir("/" + dst)[1:]); err != nil {
+				return err
+			}
+		default:
+			return davError("MOVE", src, resp)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/webdav"
+)
+
+// fakeDAV is an in-memory WebDAV server that records the methods it receives
+type fakeDAV struct {
+	mu      sync.Mutex
+	handler *webdav.Handler
+	methods []string
+	auth    func(r *http.Request) bool
+}
+
+func (f *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.auth(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.mu.Lock()
+	f.methods = append(f.methods, r.Method+" "+r.URL.Path)
+	f.mu.Unlock()
+	f.handler.ServeHTTP(w, r)
+}
+
+// Get the content of a file on the server, or nil when missing
+func (f *fakeDAV) file(name string) []byte {
+	file, err := f.handler.FileSystem.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+	info, _ := file.Stat()
+	data := make([]byte, info.Size())
+	_, _ = file.Read(data)
+	return data
+}
+
+// setupWebDAVTest starts a fake WebDAV server requiring basic auth and
+// returns the webdav:// URL of its root
+func setupWebDAVTest(t *testing.T) (string, string, *fakeDAV) {
+	tempDir := useTestWorkspace(t)
+	CONFIG.MinFreeMB = 1
+
+	fake := &fakeDAV{handler: &webdav.Handler{FileSystem: webdav.NewMemFS(), LockSystem: webdav.NewMemLS()}}
+	fake.auth = func(r *http.Request) bool {
+		user, password, ok := r.BasicAuth()
+		return ok && user == "alice" && password == "app-password"
+	}
+	server := httptest.NewTLSServer(fake)
+	t.Cleanup(server.Close)
+
+	host := strings.TrimPrefix(server.URL, "https://")
+	CONFIG.Destinations = map[string]DestinationConfig{"webdav://" + host: {Username: "alice", Password: "app-password"}}
+
+	// Trust the test server's certificate
+	store, key, err := openRemote("webdav://" + host + "/files")
+	assert.NoError(t, err)
+	assert.Equal(t, "files", key)
+	store.(*webdavStore).client = server.Client()
+
+	return tempDir, "webdav://" + host, fake
+}
+
+func TestWebDAVDestinationUploadAndUndo(t *testing.T) {
+	tempDir, root, fake := setupWebDAVTest(t)
+	CONFIG.OutputFolders = append(CONFIG.OutputFolders, root+"/files/scans")
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+	content, _ := os.ReadFile(file)
+
+	processSingleFileOperation()
+	assert.Equal(t, content, fake.file("/files/scans/scan.pdf"), "uploaded")
+
+	// Missing folders are made, and the file appears by MOVE from a temporary name
+	assert.Contains(t, fake.methods, "MKCOL /files/")
+	assert.Contains(t, fake.methods, "MKCOL /files/scans/")
+	var put, move string
+	for _, method := range fake.methods {
+		if strings.HasPrefix(method, "PUT ") {
+			put = method
+		}
+		if strings.HasPrefix(method, "MOVE ") {
+			move = method
+		}
+	}
+	assert.Contains(t, put, "/files/scans/"+TEMP_FILE_PREFIX+"scan.pdf.")
+	assert.Equal(t, strings.Replace(put, "PUT", "MOVE", 1), move)
+
+	entry := latestHistoryEntry(HISTORY_DONE)
+	target := root + "/files/scans/scan.pdf"
+	assert.Equal(t, target, entry.Operation.ActualFiles[1])
+	digest, _ := calculateFileHash(filepath.Join(tempDir, "output", "scan.pdf"))
+	assert.Equal(t, digest, entry.Digests[target], "hashed by reading back")
+
+	// Undo deletes the remote file, redo puts it back
+	assert.NoError(t, undoHistoryEntry(entry))
+	assert.Nil(t, fake.file("/files/scans/scan.pdf"))
+	assert.FileExists(t, file)
+
+	assert.NoError(t, redoHistoryEntry(entry))
+	assert.Equal(t, content, fake.file("/files/scans/scan.pdf"))
+}
+
+func TestWebDAVConflictsAndChecks(t *testing.T) {
+	tempDir, root, fake := setupWebDAVTest(t)
+	file := writeRoutedPDF(t, tempDir, "scan.pdf", "Page")
+	assert.NoError(t, checkRemoteDestination(root+"/files/scans"), "missing folders are created")
+
+	actual, outcome, err := copyFileWithPolicy(file, root+"/files/scans/scan.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, OUTCOME_CREATED, outcome)
+
+	actual, outcome, err = copyFileWithPolicy(file, actual)
+	assert.NoError(t, err)
+	assert.Equal(t, root+"/files/scans/scan_1.pdf", actual)
+	assert.Equal(t, OUTCOME_SUFFIXED, outcome)
+
+	CONFIG.ConflictPolicy = CONFLICT_SKIP_IDENTICAL
+	actual, outcome, err = copyFileWithPolicy(file, root+"/files/scans/scan.pdf")
+	assert.NoError(t, err)
+	assert.Equal(t, OUTCOME_SKIPPED, outcome)
+	assert.Contains(t, []string{root + "/files/scans/scan.pdf", root + "/files/scans/scan_1.pdf"}, actual)
+
+	// Bearer tokens are sent instead of basic auth
+	fake.auth = func(r *http.Request) bool { return r.Header.Get("Authorization") == "Bearer secret" }
+	assert.Error(t, checkRemoteDestination(root+"/files/scans"))
+	store, _, _ := openRemote(root)
+	store.(*webdavStore).token = "secret"
+	assert.NoError(t, checkRemoteDestination(root+"/files/scans"))
+}
+
+func TestRemoteStoresFollowDestinationSettings(t *testing.T) {
+	useTestWorkspace(t)
+	CONFIG.Destinations = map[string]DestinationConfig{
+		"webdav://dav.example":               {Username: "alice"},
+		"webdav://dav.example/files/private": {Username: "bob"},
+		"webdav://carol@dav.example":         {Username: "carol"},
+	}
+
+	for path, want := range map[string]string{
+		"webdav://dav.example/files/a.pdf":           "alice",
+		"webdav://dav.example/files/private/a.pdf":   "bob",
+		"webdav://dav.example/files/privateer/a.pdf": "alice",
+		"webdav://carol@dav.example/files/a.pdf":     "carol",
+		"webdav://dave@dav.example/files/private/a":  "bob",
+	} {
+		store, _, err := openRemote(path)
+		assert.NoError(t, err)
+		assert.Equal(t, want, store.(*webdavStore).username, path)
+	}
+
+	shared, _, _ := openRemote("webdav://dav.example/other/b.pdf")
+	first, _, _ := openRemote("webdav://dav.example/files/a.pdf")
+	assert.Same(t, first, shared, "one store per destination")
+}
+
+func TestWebDAVChecksumProperty(t *testing.T) {
+	response := davResponse{Propstats: []davPropstat{{Status: "HTTP/1.1 200 OK"}}}
+	response.Propstats[0].Prop.ContentLength = "42"
+	response.Propstats[0].Prop.Checksums = []string{"SHA1:abc MD5:def SHA256:ABCDEF"}
+
+	object, collection := response.object()
+	assert.False(t, collection)
+	assert.Equal(t, int64(42), object.size)
+	assert.Equal(t, "abcdef", object.digest)
+}
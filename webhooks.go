@@ -0,0 +1,597 @@
+// Copyright 2025 Kristian Whittick
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Webhook notifications
+//
+// Operation events and a daily summary are POSTed to HTTP endpoints, either
+// as the event JSON or shaped for Slack or Teams incoming webhooks. Bodies
+// are signed with HMAC-SHA256 when the endpoint has a secret. Every delivery
+// goes through a queue saved in the state folder and is sent when pending
+// deliveries are processed, never from the operation itself: a failed one is
+// retried on the same backoff as output copies, so notifications survive an
+// outage or a restart.
+
+const (
+	EVENT_SUMMARY = "summary"
+
+	WEBHOOK_TEMPLATE_JSON  = "json"
+	WEBHOOK_TEMPLATE_SLACK = "slack"
+	WEBHOOK_TEMPLATE_TEAMS = "teams"
+
+	DEFAULT_WEBHOOK_TIMEOUT_SECONDS = 10
+	DEFAULT_WEBHOOK_SUMMARY_TIME    = "18:00"
+	WEBHOOK_SIGNATURE_HEADER        = "X-BlendPDF-Signature"
+)
+
+// Events an endpoint gets when it doesn't list any
+var defaultWebhookEvents = []string{EVENT_SUCCESS, EVENT_ERROR, EVENT_SUMMARY}
+
+// Webhook settings
+type WebhooksConfig struct {
+	Endpoints      []WebhookEndpoint `json:"endpoints"`
+	SummaryTime    string            `json:"summaryTime"`    // Local time the daily summary is sent, "HH:MM" (default 18:00)
+	TimeoutSeconds int               `json:"timeoutSeconds"` // Per delivery attempt (default 10)
+}
+
+// WebhookEndpoint is one URL notified of events
+type WebhookEndpoint struct {
+	URL      string   `json:"url"`
+	Events   []string `json:"events"`   // "success", "error", "undo", "summary" (default success, error and summary)
+	Template string   `json:"template"` // "json" (default), "slack" or "teams"
+	Secret   string   `json:"secret"`   // Signs bodies with HMAC-SHA256 when set
+}
+
+// Validate webhook settings
+func (w WebhooksConfig) validate() error {
+	if w.TimeoutSeconds < 0 {
+		return fmt.Errorf("webhooks timeoutSeconds must not be negative")
+	}
+	if w.SummaryTime != "" {
+		if _, err := time.Parse("15:04", w.SummaryTime); err != nil {
+			return fmt.Errorf("invalid webhooks summaryTime %q: use HH:MM", w.SummaryTime)
+		}
+	}
+	for _, endpoint := range w.Endpoints {
+		if err := endpoint.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate one webhook endpoint
+func (e WebhookEndpoint) validate() error {
+	target, err := url.Parse(e.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("invalid webhook url %q: use http:// or https://", e.URL)
+	}
+	for _, event := range e.Events {
+		if !slices.Contains([]string{EVENT_SUCCESS, EVENT_ERROR, EVENT_UNDO, EVENT_SUMMARY}, event) {
+			return fmt.Errorf("invalid webhook event %q (use success, error, undo or summary)", event)
+		}
+	}
+	switch e.Template {
+	case "", WEBHOOK_TEMPLATE_JSON, WEBHOOK_TEMPLATE_SLACK, WEBHOOK_TEMPLATE_TEAMS:
+		return nil
+	}
+	return fmt.Errorf("invalid webhook template %q (use json, slack or teams)", e.Template)
+}
+
+// Check whether an endpoint wants an event
+func (e WebhookEndpoint) wants(event string) bool {
+	if len(e.Events) == 0 {
+		return slices.Contains(defaultWebhookEvents, event)
+	}
+	return slices.Contains(e.Events, event)
+}
+
+// Get the endpoint host for messages; webhook URLs often carry a token in the path
+func (e WebhookEndpoint) host() string {
+	if target, err := url.Parse(e.URL); err == nil {
+		return target.Host
+	}
+	return e.URL
+}
+
+// Get how long a delivery attempt may take
+func (w WebhooksConfig) timeout() time.Duration {
+	if w.TimeoutSeconds > 0 {
+		return time.Duration(w.TimeoutSeconds) * time.Second
+	}
+	return DEFAULT_WEBHOOK_TIMEOUT_SECONDS * time.Second
+}
+
+// Get the first summary time after a moment
+func (w WebhooksConfig) nextSummary(after time.Time) time.Time {
+	at, err := time.Parse("15:04", w.SummaryTime)
+	if err != nil {
+		at, _ = time.Parse("15:04", DEFAULT_WEBHOOK_SUMMARY_TIME)
+	}
+	next := time.Date(after.Year(), after.Month(), after.Day(), at.Hour(), at.Minute(), 0, 0, after.Location())
+	if !next.After(after) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// Check whether any webhook needs an operation event
+// Events are also needed to count them for the summary
+func webhookWanted(event string) bool {
+	if CONFIG == nil {
+		return false
+	}
+	for _, endpoint := range CONFIG.Webhooks.Endpoints {
+		if endpoint.wants(event) || endpoint.wants(EVENT_SUMMARY) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether any webhook gets the daily summary
+func webhookSummaryWanted() bool {
+	if CONFIG == nil {
+		return false
+	}
+	for _, endpoint := range CONFIG.Webhooks.Endpoints {
+		if endpoint.wants(EVENT_SUMMARY) {
+			return true
+		}
+	}
+	return false
+}
+
+// DailySummary counts operations since the last summary
+type DailySummary struct {
+	Event     string    `json:"event"` // Always "summary"
+	Since     time.Time `json:"since"`
+	Until     time.Time `json:"until"`
+	Completed int       `json:"completed"`
+	Failed    int       `json:"failed"`
+	Undone    int       `json:"undone"`
+	Pages     int       `json:"pages"` // Pages produced by completed operations
+}
+
+// PendingWebhook is a delivery waiting to be sent
+type PendingWebhook struct {
+	ID          string    `json:"id"`
+	Endpoint    int       `json:"endpoint"` // Index in the configured endpoints; several may share a URL
+	URL         string    `json:"url"`
+	Event       string    `json:"event"`
+	Body        string    `json:"body"` // Kept as sent so every attempt has the same signature
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+// webhookState is the delivery queue and the running summary, saved together
+type webhookState struct {
+	Queue   []*PendingWebhook `json:"queue,omitempty"`
+	Summary DailySummary      `json:"summary"`
+}
+
+// Webhook deliveries and summary counts
+var WEBHOOK_STATE webhookState
+
+// webhookStatusError is a delivery the endpoint answered with an error status
+type webhookStatusError struct {
+	status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("endpoint answered %d %s", e.status, http.StatusText(e.status))
+}
+
+// Check whether a failed delivery is worth retrying
+// Client errors other than timeouts and rate limits won't fix themselves
+func isTransientWebhookError(err error) bool {
+	var se *webhookStatusError
+	if !errors.As(err, &se) {
+		return true
+	}
+	return se.status >= 500 || se.status == http.StatusRequestTimeout || se.status == http.StatusTooManyRequests
+}
+
+// Get the webhook state file path
+func getWebhookStatePath() string {
+	if STATE_DIR == "" {
+		return ""
+	}
+	return filepath.Join(STATE_DIR, "webhooks.json")
+}
+
+// Load webhook state from disk, replacing any in-memory state
+func loadWebhookState() {
+	WEBHOOK_STATE = webhookState{}
+
+	path := getWebhookStatePath()
+	if path == "" {
+		return
+	}
+
+	data, err := readStorageFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &WEBHOOK_STATE)
+	}
+	if err != nil {
+		printWarning(fmt.Sprintf("Failed to load webhook queue: %v", err))
+		WEBHOOK_STATE = webhookState{}
+	}
+}
+
+// Save webhook state, warning on failure
+func persistWebhookState() {
+	path := getWebhookStatePath()
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(WEBHOOK_STATE, "", "  ")
+	if err == nil {
+		_, err = atomicWrite(path, bytes.NewReader(data), nil)
+	}
+	if err != nil {
+		printWarning(fmt.Sprintf("Failed to save webhook queue: %v", err))
+	}
+}
+
+// Queue an operation event for its webhooks
+// Deliveries are left to processDueWebhooks so a slow endpoint never holds up an operation
+func sendWebhooks(event *OperationEvent) {
+	if !webhookWanted(event.Event) {
+		return
+	}
+	if webhookSummaryWanted() {
+		countForSummary(event)
+	}
+	queueWebhooks(event.Event, event, operationMessage(event))
+}
+
+// Add an operation to the running summary
+func countForSummary(event *OperationEvent) {
+	summary := &WEBHOOK_STATE.Summary
+	if summary.Since.IsZero() {
+		summary.Event, summary.Since = EVENT_SUMMARY, event.Timestamp
+	}
+	switch event.Event {
+	case EVENT_SUCCESS:
+		summary.Completed++
+		if len(event.Outputs) > 0 {
+			summary.Pages += event.Outputs[0].Pages
+		}
+	case EVENT_ERROR:
+		summary.Failed++
+	case EVENT_UNDO:
+		summary.Undone++
+	}
+	persistWebhookState()
+}
+
+// Queue a delivery of a payload to every endpoint that wants the event
+func queueWebhooks(event string, payload any, message webhookMessage) {
+	now := time.Now()
+	id := now.Format("20060102-150405.000000000")
+	for i, endpoint := range CONFIG.Webhooks.Endpoints {
+		if !endpoint.wants(event) {
+			continue
+		}
+		body, err := renderWebhook(endpoint.Template, payload, message)
+		if err != nil {
+			printWarning(fmt.Sprintf("Failed to build %s webhook for %s: %v", event, endpoint.host(), err))
+			continue
+		}
+		WEBHOOK_STATE.Queue = append(WEBHOOK_STATE.Queue, &PendingWebhook{
+			ID:          fmt.Sprintf("%s-%d", id, i),
+			Endpoint:    i,
+			URL:         endpoint.URL,
+			Event:       event,
+			Body:        string(body),
+			NextAttempt: now,
+		})
+	}
+	persistWebhookState()
+}
+
+// Queue the daily summary once its time has passed
+// Returns whether a summary was queued
+func queueDueSummary(now time.Time) bool {
+	if !webhookSummaryWanted() {
+		return false
+	}
+	summary := WEBHOOK_STATE.Summary
+	if summary.Since.IsZero() {
+		WEBHOOK_STATE.Summary = DailySummary{Event: EVENT_SUMMARY, Since: now}
+		persistWebhookState()
+		return false
+	}
+	if now.Before(CONFIG.Webhooks.nextSummary(summary.Since)) {
+		return false
+	}
+
+	summary.Event, summary.Until = EVENT_SUMMARY, now
+	WEBHOOK_STATE.Summary = DailySummary{Event: EVENT_SUMMARY, Since: now}
+	queueWebhooks(EVENT_SUMMARY, summary, summaryMessage(summary))
+	return true
+}
+
+// Send every queued delivery that is due
+// Returns whether the queue changed
+func processDueWebhooks(now time.Time) bool {
+	if CONFIG == nil {
+		return false
+	}
+	changed := queueDueSummary(now)
+	for _, p := range append([]*PendingWebhook{}, WEBHOOK_STATE.Queue...) {
+		if now.Before(p.NextAttempt) {
+			continue
+		}
+		changed = true
+
+		endpoint, ok := findWebhookEndpoint(p)
+		if !ok {
+			// The endpoint was removed from the config since
+			finishWebhook(p)
+			continue
+		}
+
+		p.Attempts++
+		err := deliverWebhook(endpoint, p)
+		switch {
+		case err == nil:
+			finishWebhook(p)
+			logOperation("WEBHOOK", p.Event, endpoint.host(), "DELIVERED")
+		case !isTransientWebhookError(err) || p.Attempts >= retrySettings().MaxAttempts:
+			finishWebhook(p)
+			printWarning(fmt.Sprintf("Gave up sending %s webhook to %s: %v", p.Event, endpoint.host(), err))
+			logOperation("WEBHOOK", p.Event, endpoint.host(), "FAILED: "+err.Error())
+		default:
+			p.LastError = err.Error()
+			p.NextAttempt = now.Add(retryDelay(p.Attempts, rand.Float64())) // #nosec G404 - jitter only
+			logOperation("WEBHOOK", p.Event, endpoint.host(), "RETRY: "+err.Error())
+		}
+	}
+	if changed {
+		persistWebhookState()
+	}
+	return changed
+}
+
+// Find the configured endpoint a delivery was queued for
+// When the config has changed since, a URL only one endpoint has still identifies it
+func findWebhookEndpoint(p *PendingWebhook) (WebhookEndpoint, bool) {
+	endpoints := CONFIG.Webhooks.Endpoints
+	if p.Endpoint >= 0 && p.Endpoint < len(endpoints) && endpoints[p.Endpoint].URL == p.URL {
+		return endpoints[p.Endpoint], true
+	}
+
+	var found []WebhookEndpoint
+	for _, endpoint := range endpoints {
+		if endpoint.URL == p.URL {
+			found = append(found, endpoint)
+		}
+	}
+	if len(found) != 1 {
+		return WebhookEndpoint{}, false
+	}
+	return found[0], true
+}
+
+// Remove a delivery from the queue
+func finishWebhook(p *PendingWebhook) {
+	for i, existing := range WEBHOOK_STATE.Queue {
+		if existing == p {
+			WEBHOOK_STATE.Queue = append(WEBHOOK_STATE.Queue[:i], WEBHOOK_STATE.Queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// POST a delivery to its endpoint
+func deliverWebhook(endpoint WebhookEndpoint, p *PendingWebhook) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, strings.NewReader(p.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "blendpdf/"+VERSION)
+	req.Header.Set("X-BlendPDF-Event", p.Event)
+	req.Header.Set("X-BlendPDF-Delivery", p.ID)
+	if endpoint.Secret != "" {
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, signWebhook(endpoint.Secret, []byte(p.Body)))
+	}
+
+	client := &http.Client{Timeout: CONFIG.Webhooks.timeout()}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &webhookStatusError{status: resp.StatusCode}
+	}
+	return nil
+}
+
+// Sign a body the way receivers check it: "sha256=" and the hex HMAC
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Summarise queued deliveries in one line, "" when none are waiting
+func describeWebhookQueue() string {
+	queue := WEBHOOK_STATE.Queue
+	if len(queue) == 0 {
+		return ""
+	}
+	next := queue[0]
+	for _, p := range queue[1:] {
+		if p.NextAttempt.Before(next.NextAttempt) {
+			next = p
+		}
+	}
+	host := next.URL
+	if endpoint, ok := findWebhookEndpoint(next); ok {
+		host = endpoint.host()
+	}
+	return fmt.Sprintf("%d webhook(s) pending, next %s to %s at %s (attempt %d of %d)",
+		len(queue), next.Event, host, next.NextAttempt.Format("15:04:05"), next.Attempts+1, retrySettings().MaxAttempts)
+}
+
+// Send deliveries and a summary that came due while the program wasn't running
+func processWebhooksAtStartup() {
+	if len(WEBHOOK_STATE.Queue) == 0 && !webhookSummaryWanted() {
+		return
+	}
+	processDueWebhooks(time.Now())
+	if pending := describeWebhookQueue(); pending != "" {
+		printInfo("Webhooks: " + pending)
+	}
+}
+
+// Templates
+
+// webhookMessage is an event laid out for chat templates
+type webhookMessage struct {
+	title  string
+	facts  [][2]string
+	failed bool
+}
+
+// Lay out an operation event for chat
+func operationMessage(event *OperationEvent) webhookMessage {
+	outcome := map[string]string{EVENT_SUCCESS: "completed", EVENT_ERROR: "failed", EVENT_UNDO: "undone"}[event.Event]
+	message := webhookMessage{
+		title:  fmt.Sprintf("BlendPDF: %s %s", event.Type, outcome),
+		failed: event.Event == EVENT_ERROR,
+	}
+	message.facts = append(message.facts, [2]string{"Inputs", describeEventFiles(event.Inputs)})
+	if len(event.Outputs) > 0 {
+		message.facts = append(message.facts, [2]string{"Output", describeEventFiles(event.Outputs)})
+	}
+	if event.Route != "" {
+		message.facts = append(message.facts, [2]string{"Route", event.Route})
+	}
+	message.facts = append(message.facts, [2]string{"Duration", (time.Duration(event.DurationMs) * time.Millisecond).String()})
+	if event.Error != "" {
+		message.facts = append(message.facts, [2]string{"Error", event.Error})
+	}
+	return message
+}
+
+// Lay out a daily summary for chat
+func summaryMessage(summary DailySummary) webhookMessage {
+	return webhookMessage{
+		title: "BlendPDF: daily summary",
+		facts: [][2]string{
+			{"Period", summary.Since.Format("2006-01-02 15:04") + " to " + summary.Until.Format("2006-01-02 15:04")},
+			{"Completed", fmt.Sprint(summary.Completed)},
+			{"Failed", fmt.Sprint(summary.Failed)},
+			{"Undone", fmt.Sprint(summary.Undone)},
+			{"Pages", fmt.Sprint(summary.Pages)},
+		},
+		failed: summary.Failed > 0,
+	}
+}
+
+// List event files by name with page counts, once per name
+func describeEventFiles(files []EventFile) string {
+	var names []string
+	for _, file := range files {
+		name := filepath.Base(file.Path)
+		if file.Pages > 0 {
+			name += fmt.Sprintf(" (%d pages)", file.Pages)
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// Build a delivery body for an endpoint's template
+func renderWebhook(template string, payload any, message webhookMessage) ([]byte, error) {
+	switch template {
+	case WEBHOOK_TEMPLATE_SLACK:
+		return json.Marshal(slackMessage(message))
+	case WEBHOOK_TEMPLATE_TEAMS:
+		return json.Marshal(teamsMessage(message))
+	}
+	return json.Marshal(payload)
+}
+
+// Build a Slack incoming webhook message
+func slackMessage(message webhookMessage) map[string]any {
+	var text strings.Builder
+	fmt.Fprintf(&text, "*%s*", message.title)
+	for _, fact := range message.facts {
+		fmt.Fprintf(&text, "\n*%s:* %s", fact[0], fact[1])
+	}
+	return map[string]any{"text": text.String()}
+}
+
+// Build a Teams incoming webhook message holding an Adaptive Card
+func teamsMessage(message webhookMessage) map[string]any {
+	color := "Good"
+	if message.failed {
+		color = "Attention"
+	}
+	var facts []map[string]string
+	for _, fact := range message.facts {
+		facts = append(facts, map[string]string{"title": fact[0], "value": fact[1]})
+	}
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []any{
+			map[string]any{"type": "TextBlock", "text": message.title, "weight": "Bolder", "size": "Medium", "color": color, "wrap": true},
+			map[string]any{"type": "FactSet", "facts": facts},
+		},
+	}
+	return map[string]any{
+		"type": "message",
+		"attachments": []any{
+			map[string]any{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receivedWebhook is one request the test endpoint got
+type receivedWebhook struct {
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver records deliveries and answers with queued status codes
+type webhookReceiver struct {
+	mu       sync.Mutex
+	received []receivedWebhook
+	statuses []int // Answered in turn before falling back to 200
+}
+
+func (w *webhookReceiver) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.received = append(w.received, receivedWebhook{r.URL.Path, r.Header.Clone(), body})
+	if len(w.statuses) > 0 {
+		status := w.statuses[0]
+		w.statuses = w.statuses[1:]
+		rw.WriteHeader(status)
+	}
+}
+
+func (w *webhookReceiver) deliveries() []receivedWebhook {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]receivedWebhook{}, w.received...)
+}
+
+// setupWebhookTest starts an endpoint and prepares a front and back scan
+func setupWebhookTest(t *testing.T) (*webhookReceiver, string, string, string) {
+	tempDir := useTestWorkspace(t)
+
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	front := filepath.Join(tempDir, "front.pdf")
+	back := filepath.Join(tempDir, "back.pdf")
+	assert.NoError(t, os.WriteFile(front, buildTextPDF("page 1", "page 3"), 0644))
+	assert.NoError(t, os.WriteFile(back, buildTextPDF("page 4", "page 2"), 0644))
+	return receiver, server.URL, front, back
+}
+
+func TestWebhookDeliversSignedEvent(t *testing.T) {
+	receiver, url, front, back := setupWebhookTest(t)
+	CONFIG.Webhooks = WebhooksConfig{Endpoints: []WebhookEndpoint{
+		{URL: url + "/hook", Secret: "s3cret"},
+		{URL: url + "/hook", Secret: "other", Events: []string{EVENT_SUCCESS}},
+	}}
+
+	// The operation only queues its deliveries
+	assert.NoError(t, validateAndProcessMerge(front, back, time.Now()))
+	assert.Empty(t, receiver.deliveries())
+	assert.Len(t, WEBHOOK_STATE.Queue, 2)
+	assert.True(t, processDueWebhooks(time.Now()))
+
+	deliveries := receiver.deliveries()
+	if !assert.Len(t, deliveries, 2) {
+		t.FailNow()
+	}
+	delivery := deliveries[0]
+	assert.Equal(t, "success", delivery.header.Get("X-BlendPDF-Event"))
+	assert.Equal(t, "application/json", delivery.header.Get("Content-Type"))
+
+	// Each endpoint signs with its own secret, even when they share a URL
+	for i, secret := range []string{"s3cret", "other"} {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(deliveries[i].body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), deliveries[i].header.Get(WEBHOOK_SIGNATURE_HEADER))
+	}
+
+	var event OperationEvent
+	assert.NoError(t, json.Unmarshal(delivery.body, &event))
+	assert.Equal(t, latestHistoryEntry(HISTORY_DONE).ID, event.ID)
+	assert.Equal(t, "merge", event.Type)
+	assert.Equal(t, []EventFile{{Path: front, Pages: 2}, {Path: back, Pages: 2}}, event.Inputs)
+	if assert.Len(t, event.Outputs, 1) {
+		assert.Equal(t, 4, event.Outputs[0].Pages)
+	}
+	assert.Empty(t, WEBHOOK_STATE.Queue)
+}
+
+func TestWebhookChatTemplates(t *testing.T) {
+	receiver, url, front, back := setupWebhookTest(t)
+	CONFIG.Webhooks = WebhooksConfig{Endpoints: []WebhookEndpoint{
+		{URL: url + "/slack", Template: WEBHOOK_TEMPLATE_SLACK},
+		{URL: url + "/teams", Template: WEBHOOK_TEMPLATE_TEAMS},
+		{URL: url + "/success-only", Events: []string{EVENT_SUCCESS}},
+	}}
+	assert.NoError(t, os.WriteFile(back, []byte("not a pdf"), 0644))
+
+	start := time.Now()
+	err := validateAndProcessMerge(front, back, start)
+	handleMergeError(front, back, err, start)
+	processDueWebhooks(time.Now())
+
+	deliveries := receiver.deliveries()
+	if !assert.Len(t, deliveries, 2) {
+		t.FailNow()
+	}
+	assert.Empty(t, deliveries[0].header.Get(WEBHOOK_SIGNATURE_HEADER))
+
+	var slack struct{ Text string }
+	assert.Equal(t, "/slack", deliveries[0].path)
+	assert.NoError(t, json.Unmarshal(deliveries[0].body, &slack))
+	assert.Contains(t, slack.Text, "*BlendPDF: merge failed*\n*Inputs:* front.pdf (2 pages), back.pdf\n")
+	assert.Contains(t, slack.Text, "*Error:* second PDF 'back.pdf' is invalid")
+
+	var teams struct {
+		Type        string
+		Attachments []struct {
+			ContentType string
+			Content     struct {
+				Type string
+				Body []struct {
+					Type  string
+					Text  string
+					Color string
+					Facts []struct{ Title, Value string }
+				}
+			}
+		}
+	}
+	assert.Equal(t, "/teams", deliveries[1].path)
+	assert.NoError(t, json.Unmarshal(deliveries[1].body, &teams))
+	assert.Equal(t, "message", teams.Type)
+	if assert.Len(t, teams.Attachments, 1) {
+		card := teams.Attachments[0]
+		assert.Equal(t, "application/vnd.microsoft.card.adaptive", card.ContentType)
+		assert.Equal(t, "AdaptiveCard", card.Content.Type)
+		assert.Equal(t, "BlendPDF: merge failed", card.Content.Body[0].Text)
+		assert.Equal(t, "Attention", card.Content.Body[0].Color)
+		assert.Equal(t, "Inputs", card.Content.Body[1].Facts[0].Title)
+	}
+}
+
+func TestWebhookRetriesUntilDelivered(t *testing.T) {
+	receiver, url, front, back := setupWebhookTest(t)
+	CONFIG.Webhooks = WebhooksConfig{Endpoints: []WebhookEndpoint{{URL: url + "/hook", Events: []string{EVENT_SUCCESS, EVENT_ERROR}}}}
+	receiver.statuses = []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable}
+
+	assert.NoError(t, validateAndProcessMerge(front, back, time.Now()))
+	assert.True(t, processDueWebhooks(time.Now()))
+	if !assert.Len(t, WEBHOOK_STATE.Queue, 1) {
+		t.FailNow()
+	}
+	assert.Equal(t, 1, WEBHOOK_STATE.Queue[0].Attempts)
+	assert.Contains(t, WEBHOOK_STATE.Queue[0].LastError, "503")
+	assert.Contains(t, describeWebhookQueue(), "1 webhook(s) pending, next success to 127.0.0.1:")
+	assert.Contains(t, describePendingDeliveries(), "webhook(s) pending")
+
+	// The queue survives a restart
+	loadWebhookState()
+	assert.Len(t, WEBHOOK_STATE.Queue, 1)
+
+	// Nothing is sent before the delivery is due
+	assert.False(t, processDueWebhooks(time.Now()))
+	assert.Len(t, receiver.deliveries(), 1)
+
+	assert.True(t, processDueWebhooks(time.Now().Add(time.Hour)))
+	assert.Equal(t, 2, WEBHOOK_STATE.Queue[0].Attempts)
+	assert.True(t, processDueWebhooks(time.Now().Add(24*time.Hour)))
+	assert.Empty(t, WEBHOOK_STATE.Queue)
+
+	// Every attempt sends the same delivery
+	deliveries := receiver.deliveries()
+	assert.Len(t, deliveries, 3)
+	assert.Equal(t, deliveries[0].body, deliveries[2].body)
+	assert.Equal(t, deliveries[0].header.Get("X-BlendPDF-Delivery"), deliveries[2].header.Get("X-BlendPDF-Delivery"))
+
+	// A request the endpoint rejects is not retried
+	receiver.statuses = []int{http.StatusBadRequest}
+	sendWebhooks(&OperationEvent{Event: EVENT_ERROR, Type: "single", Error: "broken", Timestamp: time.Now()})
+	assert.True(t, processDueWebhooks(time.Now()))
+	assert.Empty(t, WEBHOOK_STATE.Queue)
+	assert.Len(t, receiver.deliveries(), 4)
+}
+
+func TestWebhookDailySummary(t *testing.T) {
+	receiver, url, _, _ := setupWebhookTest(t)
+	since := time.Now().Add(-time.Minute)
+	CONFIG.Webhooks = WebhooksConfig{
+		Endpoints:   []WebhookEndpoint{{URL: url + "/summary", Events: []string{EVENT_SUMMARY}}},
+		SummaryTime: since.Add(2 * time.Hour).Format("15:04"),
+	}
+	WEBHOOK_STATE.Summary = DailySummary{Event: EVENT_SUMMARY, Since: since}
+
+	sendWebhooks(&OperationEvent{Event: EVENT_SUCCESS, Type: "merge", Outputs: []EventFile{{Path: "a.pdf", Pages: 4}, {Path: "b/a.pdf", Pages: 4}}, Timestamp: time.Now()})
+	sendWebhooks(&OperationEvent{Event: EVENT_SUCCESS, Type: "single", Outputs: []EventFile{{Path: "c.pdf", Pages: 1}}, Timestamp: time.Now()})
+	sendWebhooks(&OperationEvent{Event: EVENT_ERROR, Type: "merge", Error: "broken", Timestamp: time.Now()})
+	sendWebhooks(&OperationEvent{Event: EVENT_UNDO, Type: "single", Timestamp: time.Now()})
+	assert.Empty(t, receiver.deliveries(), "operations are only counted")
+
+	assert.False(t, processDueWebhooks(since.Add(time.Hour)))
+	due := since.Add(3 * time.Hour)
+	assert.True(t, processDueWebhooks(due))
+
+	deliveries := receiver.deliveries()
+	if !assert.Len(t, deliveries, 1) {
+		t.FailNow()
+	}
+	assert.Equal(t, "summary", deliveries[0].header.Get("X-BlendPDF-Event"))
+	var summary DailySummary
+	assert.NoError(t, json.Unmarshal(deliveries[0].body, &summary))
+	assert.Equal(t, 2, summary.Completed)
+	assert.Equal(t, 1, summary.Failed)
+	assert.Equal(t, 1, summary.Undone)
+	assert.Equal(t, 5, summary.Pages)
+	assert.True(t, summary.Until.Equal(due))
+
+	// Counting starts again for the next day
+	assert.Equal(t, DailySummary{Event: EVENT_SUMMARY, Since: due}, WEBHOOK_STATE.Summary)
+	assert.False(t, processDueWebhooks(due.Add(time.Hour)))
+}
+
+func TestWebhooksConfigValidation(t *testing.T) {
+	config := getDefaultConfig()
+	config.Webhooks = WebhooksConfig{
+		SummaryTime: "07:30",
+		Endpoints: []WebhookEndpoint{
+			{URL: "https://hooks.slack.com/services/T0/B0/x", Template: "slack"},
+			{URL: "http://dms.local/notify", Events: []string{"success", "undo"}, Secret: "s3cret"},
+		},
+	}
+	assert.NoError(t, validateConfig(config))
+
+	morning := time.Date(2026, 3, 2, 6, 0, 0, 0, time.Local)
+	assert.Equal(t, time.Date(2026, 3, 2, 7, 30, 0, 0, time.Local), config.Webhooks.nextSummary(morning))
+	assert.Equal(t, time.Date(2026, 3, 3, 7, 30, 0, 0, time.Local), config.Webhooks.nextSummary(morning.Add(2*time.Hour)))
+
+	for _, webhooks := range []WebhooksConfig{
+		{SummaryTime: "7pm"},
+		{TimeoutSeconds: -1},
+		{Endpoints: []WebhookEndpoint{{URL: "hooks.slack.com/services"}}},
+		{Endpoints: []WebhookEndpoint{{URL: "https://example.com", Events: []string{"daily"}}}},
+		{Endpoints: []WebhookEndpoint{{URL: "https://example.com", Template: "discord"}}},
+	} {
+		config.Webhooks = webhooks
+		assert.Error(t, validateConfig(config))
+	}
+
+	assert.True(t, isTransientWebhookError(errors.New("connection refused")))
+	assert.True(t, isTransientWebhookError(&webhookStatusError{status: http.StatusTooManyRequests}))
+	assert.False(t, isTransientWebhookError(&webhookStatusError{status: http.StatusNotFound}))
+}
@@ -194,6 +194,11 @@ func TestMoreProcessAndMerge(t *testing.T) {
 	file2 := filepath.Join(tempDir, "page2.pdf")
 	output := filepath.Join(tempDir, "merged.pdf")
 
+	// Failed merges move their inputs to the error folder
+	originalErrorDir := ERROR_DIR
+	defer func() { ERROR_DIR = originalErrorDir }()
+	ERROR_DIR = filepath.Join(tempDir, "error")
+
 	os.WriteFile(file1, []byte("page 1 content"), 0644)
 	os.WriteFile(file2, []byte("page 2 content"), 0644)
 